@@ -0,0 +1,235 @@
+package board
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+//bulletin board for the shuffled output of each round
+//every round's merged output is written to dir as <round>.db, with its parameters in <round>.json
+//only the most recent rounds are kept on disk
+
+var (
+    //round IDs have to keep increasing
+    ErrStaleRound = errors.New("board: round ID is not newer than the latest round")
+    //the round was never published or has been pruned
+    ErrUnknownRound = errors.New("board: unknown round")
+    //a row range outside the round
+    ErrBadRange = errors.New("board: bad row range")
+)
+
+//parameters of a published round
+type RoundInfo struct {
+    Round uint64 `json:"round"`
+    NumServers int `json:"numServers"`
+    //blocks per message, not counting the encryption key block
+    MsgBlocks int `json:"msgBlocks"`
+    BatchSize int `json:"batchSize"`
+    MessagingMode bool `json:"messagingMode"`
+    //bytes per row of the output
+    RowLength int `json:"rowLength"`
+}
+
+type Board struct {
+    dir string
+    retain int
+
+    mu sync.Mutex
+    //published rounds still on disk, oldest first
+    rounds []uint64
+}
+
+//open (or create) a board stored in dir that keeps the last retain rounds
+func Open(dir string, retain int) (*Board, error) {
+    if retain < 1 {
+        return nil, fmt.Errorf("board: must retain at least one round, got %d", retain)
+    }
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        return nil, err
+    }
+
+    b := &Board{dir: dir, retain: retain}
+
+    //pick up rounds from earlier runs
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    for _, f := range files {
+        if !strings.HasSuffix(f.Name(), ".json") {
+            continue
+        }
+        round, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".json"), 10, 64)
+        if err != nil {
+            continue
+        }
+        b.rounds = append(b.rounds, round)
+    }
+    sort.Slice(b.rounds, func(i, j int) bool { return b.rounds[i] < b.rounds[j] })
+
+    b.prune()
+    return b, nil
+}
+
+//the latest published round, 0 if there is none
+func (b *Board) Latest() uint64 {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if len(b.rounds) == 0 {
+        return 0
+    }
+    return b.rounds[len(b.rounds)-1]
+}
+
+//rounds currently available, oldest first
+func (b *Board) Rounds() []uint64 {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return append([]uint64(nil), b.rounds...)
+}
+
+//store a round's merged output
+func (b *Board) Publish(info RoundInfo, output []byte) error {
+    if info.RowLength <= 0 || len(output) != info.RowLength*info.BatchSize {
+        return fmt.Errorf("board: output length %d doesn't match %d rows of %d bytes", len(output), info.BatchSize, info.RowLength)
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if len(b.rounds) > 0 && info.Round <= b.rounds[len(b.rounds)-1] {
+        return fmt.Errorf("%w: %d after %d", ErrStaleRound, info.Round, b.rounds[len(b.rounds)-1])
+    }
+
+    meta, err := json.Marshal(info)
+    if err != nil {
+        return err
+    }
+
+    //write the data first, the json file is what marks a round as present
+    err = writeFileAtomic(b.dbPath(info.Round), output)
+    if err != nil {
+        return err
+    }
+    err = writeFileAtomic(b.infoPath(info.Round), meta)
+    if err != nil {
+        return err
+    }
+
+    b.rounds = append(b.rounds, info.Round)
+    b.prune()
+    return nil
+}
+
+func (b *Board) Info(round uint64) (*RoundInfo, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.info(round)
+}
+
+//the whole output of a round
+func (b *Board) Output(round uint64) (*RoundInfo, []byte, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    info, err := b.info(round)
+    if err != nil {
+        return nil, nil, err
+    }
+    data, err := ioutil.ReadFile(b.dbPath(round))
+    if err != nil {
+        return nil, nil, err
+    }
+    return info, data, nil
+}
+
+//rows [start, end) of a round's output
+func (b *Board) Rows(round uint64, start, end int) (*RoundInfo, []byte, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    info, err := b.info(round)
+    if err != nil {
+        return nil, nil, err
+    }
+    if start < 0 || end > info.BatchSize || start >= end {
+        return nil, nil, fmt.Errorf("%w: [%d, %d) of %d rows", ErrBadRange, start, end, info.BatchSize)
+    }
+
+    f, err := os.Open(b.dbPath(round))
+    if err != nil {
+        return nil, nil, err
+    }
+    defer f.Close()
+
+    rows := make([]byte, (end-start)*info.RowLength)
+    _, err = f.ReadAt(rows, int64(start)*int64(info.RowLength))
+    if err != nil && err != io.EOF {
+        return nil, nil, err
+    }
+    return info, rows, nil
+}
+
+//caller holds b.mu
+func (b *Board) info(round uint64) (*RoundInfo, error) {
+    if !b.has(round) {
+        return nil, fmt.Errorf("%w: %d", ErrUnknownRound, round)
+    }
+    meta, err := ioutil.ReadFile(b.infoPath(round))
+    if err != nil {
+        return nil, err
+    }
+    info := &RoundInfo{}
+    err = json.Unmarshal(meta, info)
+    if err != nil {
+        return nil, fmt.Errorf("board: corrupt metadata for round %d: %v", round, err)
+    }
+    return info, nil
+}
+
+func (b *Board) has(round uint64) bool {
+    for _, r := range b.rounds {
+        if r == round {
+            return true
+        }
+    }
+    return false
+}
+
+//drop rounds beyond the retention limit. caller holds b.mu
+func (b *Board) prune() {
+    for len(b.rounds) > b.retain {
+        round := b.rounds[0]
+        //remove the json first so a half-deleted round doesn't look present
+        os.Remove(b.infoPath(round))
+        os.Remove(b.dbPath(round))
+        b.rounds = b.rounds[1:]
+    }
+}
+
+func (b *Board) infoPath(round uint64) string {
+    return filepath.Join(b.dir, fmt.Sprintf("%d.json", round))
+}
+
+func (b *Board) dbPath(round uint64) string {
+    return filepath.Join(b.dir, fmt.Sprintf("%d.db", round))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+    tmp := path + ".tmp"
+    err := ioutil.WriteFile(tmp, data, 0644)
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
@@ -0,0 +1,137 @@
+package board
+
+import (
+    "bytes"
+    "errors"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+const testRowLength = 4
+
+//a round of batchSize rows, row i filled with byte i
+func testRound(round uint64, batchSize int) (RoundInfo, []byte) {
+    info := RoundInfo{Round: round, NumServers: 2, MsgBlocks: 1, BatchSize: batchSize, RowLength: testRowLength}
+    output := make([]byte, batchSize*testRowLength)
+    for i := range output {
+        output[i] = byte(i / testRowLength)
+    }
+    return info, output
+}
+
+func publish(t *testing.T, b *Board, round uint64) []byte {
+    t.Helper()
+    info, output := testRound(round, 8)
+    err := b.Publish(info, output)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return output
+}
+
+func TestRetention(t *testing.T) {
+    dir := t.TempDir()
+    b, err := Open(dir, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, round := range []uint64{1, 2, 5} {
+        publish(t, b, round)
+    }
+    if rounds := b.Rounds(); len(rounds) != 2 || rounds[0] != 2 || rounds[1] != 5 || b.Latest() != 5 {
+        t.Fatalf("have rounds %v, latest %d, want [2 5] and 5", rounds, b.Latest())
+    }
+    _, err = b.Info(1)
+    if !errors.Is(err, ErrUnknownRound) {
+        t.Errorf("got %v for a pruned round, want an unknown round", err)
+    }
+
+    //round IDs only go up
+    info, output := testRound(4, 8)
+    err = b.Publish(info, output)
+    if !errors.Is(err, ErrStaleRound) {
+        t.Errorf("got %v publishing an older round, want a stale round", err)
+    }
+    //and the output has to be the round's size
+    info, output = testRound(6, 8)
+    err = b.Publish(info, output[1:])
+    if err == nil {
+        t.Error("published an output that's shorter than the round")
+    }
+
+    //a board opened on the same directory picks up where this one stopped, and keeps less if it's told to
+    b, err = Open(dir, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rounds := b.Rounds(); len(rounds) != 1 || rounds[0] != 5 {
+        t.Fatalf("reopened with rounds %v, want [5]", rounds)
+    }
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(files) != 2 {
+        t.Errorf("%d files left for one round, want its output and its info", len(files))
+    }
+}
+
+func TestRows(t *testing.T) {
+    b, err := Open(t.TempDir(), 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    output := publish(t, b, 3)
+    _, rows, err := b.Rows(3, 2, 5)
+    if err != nil || !bytes.Equal(rows, output[2*testRowLength:5*testRowLength]) {
+        t.Fatalf("got rows %v, %v", rows, err)
+    }
+    for _, r := range [][2]int{{-1, 2}, {2, 9}, {4, 4}, {5, 2}} {
+        _, _, err := b.Rows(3, r[0], r[1])
+        if !errors.Is(err, ErrBadRange) {
+            t.Errorf("rows [%d, %d): got %v, want a bad range", r[0], r[1], err)
+        }
+    }
+}
+
+func TestHandler(t *testing.T) {
+    b, err := Open(t.TempDir(), 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    publish(t, b, 1)
+    output := publish(t, b, 2)
+    server := httptest.NewServer(b.Handler())
+    defer server.Close()
+
+    requests := []struct {
+        path string
+        status int
+        body []byte
+    }{
+        {"/rounds", http.StatusOK, []byte("{\"latest\":2,\"rounds\":[1,2]}\n")},
+        {"/rounds/latest", http.StatusOK, output},
+        {"/rounds/2/rows?start=1&end=3", http.StatusOK, output[testRowLength:3*testRowLength]},
+        {"/rounds/2/rows?start=1&end=30", http.StatusBadRequest, nil},
+        {"/rounds/2/rows?start=a&end=3", http.StatusBadRequest, nil},
+        {"/rounds/7/info", http.StatusNotFound, nil},
+        {"/rounds/x", http.StatusBadRequest, nil},
+        {"/rounds/2/other", http.StatusNotFound, nil},
+    }
+    for _, r := range requests {
+        resp, err := http.Get(server.URL + r.path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        body, err := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if resp.StatusCode != r.status || (r.body != nil && !bytes.Equal(body, r.body)) {
+            t.Errorf("%s: got %d %q, want %d %q", r.path, resp.StatusCode, body, r.status, r.body)
+        }
+    }
+}
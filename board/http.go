@@ -0,0 +1,119 @@
+package board
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+//HTTP interface of the board
+//  GET /rounds                            list of available rounds and the latest one
+//  GET /rounds/{id}/info                  parameters of a round
+//  GET /rounds/{id}                       the whole merged output of a round
+//  GET /rounds/{id}/rows?start=a&end=b    rows [a, b) of a round
+//{id} can also be "latest"
+//outputs are served as raw bytes, rows are RowLength bytes each
+
+func (b *Board) Handler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/rounds", b.serveRoundList)
+    mux.HandleFunc("/rounds/", b.serveRound)
+    return mux
+}
+
+func (b *Board) serveRoundList(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    list := struct {
+        Latest uint64 `json:"latest"`
+        Rounds []uint64 `json:"rounds"`
+    }{b.Latest(), b.Rounds()}
+    writeJSON(w, list)
+}
+
+func (b *Board) serveRound(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/rounds/"), "/")
+    if len(parts) > 2 {
+        http.NotFound(w, r)
+        return
+    }
+
+    var round uint64
+    var err error
+    if parts[0] == "latest" {
+        round = b.Latest()
+    } else {
+        round, err = strconv.ParseUint(parts[0], 10, 64)
+        if err != nil {
+            http.Error(w, "bad round ID", http.StatusBadRequest)
+            return
+        }
+    }
+
+    if len(parts) == 1 {
+        info, data, err := b.Output(round)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        writeData(w, info, data)
+        return
+    }
+
+    switch parts[1] {
+    case "info":
+        info, err := b.Info(round)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        writeJSON(w, info)
+    case "rows":
+        start, err1 := strconv.Atoi(r.URL.Query().Get("start"))
+        end, err2 := strconv.Atoi(r.URL.Query().Get("end"))
+        if err1 != nil || err2 != nil {
+            http.Error(w, "start and end must be integers", http.StatusBadRequest)
+            return
+        }
+        info, data, err := b.Rows(round, start, end)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        writeData(w, info, data)
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+func writeData(w http.ResponseWriter, info *RoundInfo, data []byte) {
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("X-Clarion-Round", strconv.FormatUint(info.Round, 10))
+    w.Header().Set("X-Clarion-Row-Length", strconv.Itoa(info.RowLength))
+    w.Write(data)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, ErrUnknownRound):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, ErrBadRange):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    default:
+        http.Error(w, "internal error", http.StatusInternalServerError)
+    }
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "golang.org/x/crypto/nacl/box"
+
+    "shufflemessage/mycrypto"
+    "shufflemessage/keys"
+)
+
+//library for building Clarion submissions and sending them to the leader
+
+//wire format of a submission, shared with the leader's listener:
+//  [4 bytes request type][4 bytes msgBlocks][4 bytes payload length][payload]
+//all integers are little endian. the leader answers with a 4 byte status
+const (
+    RequestSubmit = 1
+)
+
+const (
+    StatusAccepted = 1
+    StatusRejected = 2
+)
+
+//length of the submission header in bytes
+const HeaderLength = 12
+
+var (
+    //the config is missing something or is inconsistent
+    ErrBadConfig = errors.New("client: invalid config")
+    //the plaintext doesn't fit in a message of the configured size
+    ErrMessageTooLong = errors.New("client: message too long")
+    //a server could not be reached or the connection broke
+    ErrConnection = errors.New("client: connection to server failed")
+    //the leader refused the submission, e.g. because the size doesn't match the current round
+    ErrRejected = errors.New("client: submission rejected by leader")
+)
+
+type Config struct {
+    //address of the leader's client listener (addr:port)
+    LeaderAddr string
+    //addresses of every server's client listener, in server order. only needed for Fetch
+    ServerAddrs []string
+    //box public keys of the shuffle servers, in server order. see LoadPubKeys
+    PubKeys []*[32]byte
+    //number of 16-byte blocks in each message
+    MsgBlocks int
+    //in messaging mode only the first block is MACed
+    MessagingMode bool
+    //used to dial the leader. nil means the default config
+    TLSConfig *tls.Config
+}
+
+//the servers' box public keys from a key directory written by server keygen, for Config.PubKeys
+func LoadPubKeys(directoryPath string) ([]*[32]byte, error) {
+    directory, err := keys.ReadDirectory(directoryPath)
+    if err != nil {
+        return nil, err
+    }
+    return directory.BoxKeys(), nil
+}
+
+type Client struct {
+    config Config
+}
+
+func NewClient(config Config) (*Client, error) {
+    if len(config.PubKeys) < 2 {
+        return nil, fmt.Errorf("%w: need public keys for at least 2 servers", ErrBadConfig)
+    }
+    for i, key := range config.PubKeys {
+        if key == nil {
+            return nil, fmt.Errorf("%w: missing public key for server %d", ErrBadConfig, i)
+        }
+    }
+    if config.MsgBlocks <= 0 {
+        return nil, fmt.Errorf("%w: MsgBlocks must be positive", ErrBadConfig)
+    }
+    return &Client{config: config}, nil
+}
+
+//the longest plaintext that fits in one message
+func (c *Client) MaxPlaintextLength() int {
+    return MaxPlaintextLength(c.config.MsgBlocks)
+}
+
+//encrypt, MAC, share and box a plaintext. the result is the payload of a submission
+func (c *Client) Seal(plaintext []byte) ([]byte, error) {
+    padded, err := Pad(plaintext, c.config.MsgBlocks)
+    if err != nil {
+        return nil, err
+    }
+    ct, err := mycrypto.EncryptCT(padded)
+    if err != nil {
+        return nil, err
+    }
+    return SealCiphertext(ct, c.config.PubKeys, c.config.MessagingMode)
+}
+
+//seal the plaintext and send it to the leader
+//returns once the leader has accepted the message into a batch
+func (c *Client) Submit(ctx context.Context, plaintext []byte) error {
+    payload, err := c.Seal(plaintext)
+    if err != nil {
+        return err
+    }
+
+    dialer := &tls.Dialer{Config: c.config.TLSConfig}
+    conn, err := dialer.DialContext(ctx, "tcp", c.config.LeaderAddr)
+    if err != nil {
+        return fmt.Errorf("%w: %v", ErrConnection, err)
+    }
+    defer conn.Close()
+
+    //make the context's cancellation apply to the exchange too
+    stop := closeOnDone(ctx, conn)
+    defer stop()
+
+    status, err := sendSubmission(conn, c.config.MsgBlocks, payload)
+    if err != nil {
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        return fmt.Errorf("%w: %v", ErrConnection, err)
+    }
+    if status != StatusAccepted {
+        return ErrRejected
+    }
+    return nil
+}
+
+//the MACed ciphertext, with the leader's share in the clear and a box for each other server
+//ct is the output of mycrypto.EncryptCT, i.e. key followed by the encrypted message
+func SealCiphertext(ct []byte, pubKeys []*[32]byte, messagingMode bool) ([]byte, error) {
+    numServers := len(pubKeys)
+    if len(ct) % 16 != 0 {
+        return nil, fmt.Errorf("%w: ciphertext length not a multiple of 16", ErrBadConfig)
+    }
+
+    //generate the MAC and all the keys; secret share
+    //look in mycrypto/crypto.go for details
+    mac, keySeeds, err := mycrypto.WeirdMac(numServers, ct, messagingMode)
+    if err != nil {
+        return nil, err
+    }
+    bodyShares, err := mycrypto.Share(numServers, append(ct, mac...))
+    if err != nil {
+        return nil, err
+    }
+
+    //box shares with the appropriate key share seeds prepended
+    //"box" sent to leader is actually just sent to the leader without a box
+    msgToSend := append(bodyShares[0], keySeeds[0]...)
+
+    for i:= 1; i < numServers; i++ {
+        //SealAnonymous appends its output to msgToSend
+        boxedMessage, err := box.SealAnonymous(nil, append(bodyShares[i], keySeeds[i]...), pubKeys[i], rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+        msgToSend = append(msgToSend, boxedMessage...)
+    }
+
+    return msgToSend, nil
+}
+
+//length of a full submission payload for messages of msgBlocks blocks
+func SubmissionLength(numServers, msgBlocks int) int {
+    //the encryption key takes an extra block
+    //32 is for the mac and the key share seed
+    shareLength := 32 + 16*(msgBlocks+1)
+    boxedShareLength := shareLength + box.AnonymousOverhead
+    return shareLength + (numServers-1)*boxedShareLength
+}
+
+func sendSubmission(conn net.Conn, msgBlocks int, payload []byte) (int, error) {
+    header := make([]byte, 0, HeaderLength)
+    header = append(header, intToByte(RequestSubmit)...)
+    header = append(header, intToByte(msgBlocks)...)
+    header = append(header, intToByte(len(payload))...)
+
+    _, err := conn.Write(append(header, payload...))
+    if err != nil {
+        return 0, err
+    }
+
+    status := make([]byte, 4)
+    _, err = io.ReadFull(conn, status)
+    if err != nil {
+        return 0, err
+    }
+    return byteToInt(status), nil
+}
+
+//close conn if ctx is cancelled before stop is called
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+    done := make(chan int)
+    go func() {
+        select {
+        case <- ctx.Done():
+            conn.Close()
+        case <- done:
+        }
+    }()
+    return func() {
+        close(done)
+    }
+}
+
+func intToByte(myInt int) (retBytes []byte){
+    retBytes = make([]byte, 4)
+    retBytes[3] = byte((myInt >> 24) & 0xff)
+    retBytes[2] = byte((myInt >> 16) & 0xff)
+    retBytes[1] = byte((myInt >> 8) & 0xff)
+    retBytes[0] = byte(myInt & 0xff)
+    return
+}
+
+func byteToInt(myBytes []byte) (x int) {
+    x = int(myBytes[3]) << 24 + int(myBytes[2]) << 16 + int(myBytes[1]) << 8 + int(myBytes[0])
+    return
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+    "bytes"
+    "crypto/rand"
+    "errors"
+    "testing"
+
+    "golang.org/x/crypto/nacl/box"
+)
+
+func TestPadding(t *testing.T) {
+    const msgBlocks = 2
+    for _, length := range []int{0, 1, 15, 16, MaxPlaintextLength(msgBlocks)} {
+        plaintext := bytes.Repeat([]byte{0x80}, length)
+        padded, err := Pad(plaintext, msgBlocks)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(padded) != 16*msgBlocks {
+            t.Errorf("%d bytes padded to %d, want %d", length, len(padded), 16*msgBlocks)
+        }
+        unpadded, err := Unpad(padded)
+        if err != nil || !bytes.Equal(unpadded, plaintext) {
+            t.Errorf("%d bytes came back as %d, %v", length, len(unpadded), err)
+        }
+    }
+
+    _, err := Pad(make([]byte, MaxPlaintextLength(msgBlocks)+1), msgBlocks)
+    if !errors.Is(err, ErrMessageTooLong) {
+        t.Errorf("got %v padding a message that doesn't fit, want it too long", err)
+    }
+    //dummy rows are all zeros, and garbage doesn't end in the marker either
+    for _, row := range [][]byte{make([]byte, 32), append(make([]byte, 31), 1)} {
+        _, err = Unpad(row)
+        if !errors.Is(err, ErrBadPadding) {
+            t.Errorf("unpadding %v: got %v, want bad padding", row, err)
+        }
+    }
+}
+
+func testPubKeys(t *testing.T, numServers int) ([]*[32]byte, []*[32]byte) {
+    pubKeys := make([]*[32]byte, numServers)
+    secKeys := make([]*[32]byte, numServers)
+    for i := range pubKeys {
+        var err error
+        pubKeys[i], secKeys[i], err = box.GenerateKey(rand.Reader)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    return pubKeys, secKeys
+}
+
+func TestSeal(t *testing.T) {
+    for _, numServers := range []int{2, 3} {
+        for _, messagingMode := range []bool{false, true} {
+            const msgBlocks = 3
+            pubKeys, secKeys := testPubKeys(t, numServers)
+            c, err := NewClient(Config{PubKeys: pubKeys, MsgBlocks: msgBlocks, MessagingMode: messagingMode})
+            if err != nil {
+                t.Fatal(err)
+            }
+            payload, err := c.Seal([]byte("hello"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(payload) != SubmissionLength(numServers, msgBlocks) {
+                t.Fatalf("sealed %d bytes, want %d", len(payload), SubmissionLength(numServers, msgBlocks))
+            }
+
+            //every server but the leader opens its own box, and nobody else's
+            shareLength := 32 + 16*(msgBlocks+1)
+            boxLength := shareLength + box.AnonymousOverhead
+            for i := 1; i < numServers; i++ {
+                sealed := payload[shareLength+(i-1)*boxLength:shareLength+i*boxLength]
+                _, ok := box.OpenAnonymous(nil, sealed, pubKeys[i], secKeys[i])
+                if !ok {
+                    t.Errorf("%d servers: server %d can't open its share", numServers, i)
+                }
+                other := i%(numServers-1) + 1
+                if other != i {
+                    _, ok = box.OpenAnonymous(nil, sealed, pubKeys[other], secKeys[other])
+                    if ok {
+                        t.Errorf("%d servers: server %d opened server %d's share", numServers, other, i)
+                    }
+                }
+            }
+
+            _, err = c.Seal(make([]byte, c.MaxPlaintextLength()+1))
+            if !errors.Is(err, ErrMessageTooLong) {
+                t.Errorf("got %v sealing a message that doesn't fit, want it too long", err)
+            }
+        }
+    }
+}
+
+func TestNewClientChecksTheConfig(t *testing.T) {
+    pubKeys, _ := testPubKeys(t, 2)
+    configs := map[string]Config{
+        "one server": {PubKeys: pubKeys[:1], MsgBlocks: 1},
+        "missing key": {PubKeys: []*[32]byte{pubKeys[0], nil}, MsgBlocks: 1},
+        "no blocks": {PubKeys: pubKeys, MsgBlocks: 0},
+    }
+    for name, config := range configs {
+        _, err := NewClient(config)
+        if !errors.Is(err, ErrBadConfig) {
+            t.Errorf("%s: got %v, want a bad config", name, err)
+        }
+    }
+}
@@ -0,0 +1,312 @@
+package client
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+
+    "shufflemessage/mycrypto"
+)
+
+//retrieving the output of a round
+//every server serves its own revealed share of the shuffled batch together with
+//the hash commitments it received from all servers during the reveal.
+//a fetch request is a submission header with request type RequestFetch, msgBlocks 0
+//and an 8 byte round ID as payload (0 asks for the latest round)
+//the server answers with a 4 byte status, and if it has the round:
+//  [8 round][4 numServers][4 serverNum][4 msgBlocks][4 batchSize][4 messagingMode]
+//  [4 commitments length][4 share length][commitments][share]
+const (
+    RequestFetch = 2
+)
+
+//the server doesn't (or no longer) have the requested round
+const StatusUnknownRound = 3
+
+const fetchResponseHeaderLength = 36
+
+//upper bound on a share we're willing to download
+const maxShareLength = 1 << 31
+
+var (
+    //a server's opened share doesn't match the commitment it made
+    ErrCommitmentMismatch = errors.New("client: share does not match commitment")
+    //servers disagree about the round's commitments or parameters
+    ErrInconsistentOutput = errors.New("client: servers returned inconsistent output")
+    //a server doesn't have the requested round
+    ErrUnknownRound = errors.New("client: round not available")
+)
+
+type Output struct {
+    Round uint64
+    //plaintexts of all rows whose MAC verified and that held a message
+    Messages [][]byte
+    //rows whose MAC did not verify
+    InvalidRows []int
+}
+
+//one server's answer to a fetch request
+type serverShare struct {
+    round uint64
+    numServers int
+    serverNum int
+    msgBlocks int
+    batchSize int
+    messagingMode bool
+    commitments []byte
+    share []byte
+}
+
+//download every server's share of a round's output, check them against the commitments,
+//merge them, and return the messages whose MACs verify
+//round 0 fetches the latest round the first server has
+func (c *Client) Fetch(ctx context.Context, round uint64) (*Output, error) {
+    if len(c.config.ServerAddrs) != len(c.config.PubKeys) {
+        return nil, fmt.Errorf("%w: need a client address for each of the %d servers", ErrBadConfig, len(c.config.PubKeys))
+    }
+
+    numServers := len(c.config.ServerAddrs)
+    shares := make([]*serverShare, numServers)
+
+    //pin the round to whatever the first server calls latest
+    var err error
+    shares[0], err = c.fetchShare(ctx, c.config.ServerAddrs[0], round, numServers, nil)
+    if err != nil {
+        return nil, fmt.Errorf("server 0: %w", err)
+    }
+    round = shares[0].round
+
+    errs := make(chan error, numServers)
+    for i := 1; i < numServers; i++ {
+        go func(index int) {
+            var err error
+            shares[index], err = c.fetchShare(ctx, c.config.ServerAddrs[index], round, numServers, shares[0])
+            if err != nil {
+                err = fmt.Errorf("server %d: %w", index, err)
+            }
+            errs <- err
+        }(i)
+    }
+    for i := 1; i < numServers; i++ {
+        if err := <- errs; err != nil {
+            return nil, err
+        }
+    }
+
+    first := shares[0]
+    dbSize := len(first.share)
+    flatDBs := make([][]byte, numServers)
+    for i, s := range shares {
+        if s.round != round || s.numServers != numServers || s.serverNum != i ||
+            s.msgBlocks != first.msgBlocks || s.batchSize != first.batchSize ||
+            s.messagingMode != first.messagingMode || len(s.share) != dbSize {
+            return nil, fmt.Errorf("%w: server %d disagrees on the round parameters", ErrInconsistentOutput, i)
+        }
+        if len(s.commitments) != 32*numServers || !bytes.Equal(s.commitments, first.commitments) {
+            return nil, fmt.Errorf("%w: server %d reports different commitments", ErrInconsistentOutput, i)
+        }
+        if !bytes.Equal(mycrypto.Hash(s.share), s.commitments[32*i:32*(i+1)]) {
+            return nil, fmt.Errorf("%w: server %d", ErrCommitmentMismatch, i)
+        }
+        flatDBs[i] = s.share
+    }
+
+    mergedDB, err := mycrypto.Merge(flatDBs)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrInconsistentOutput, err)
+    }
+    rows, invalidRows := CheckMacsAndDecrypt(mergedDB, first.msgBlocks, first.batchSize, first.messagingMode)
+
+    output := &Output{Round: round, InvalidRows: invalidRows}
+    invalid := make(map[int]bool)
+    for _, i := range invalidRows {
+        invalid[i] = true
+    }
+    for i, row := range rows {
+        if invalid[i] {
+            continue
+        }
+        msg, err := Unpad(row)
+        if err != nil {
+            //dummy row
+            continue
+        }
+        output.Messages = append(output.Messages, msg)
+    }
+
+    return output, nil
+}
+
+//length of a row of the revealed db
+func RowLength(msgBlocks int, messagingMode bool) int {
+    //the encryption key takes an extra block
+    msgBlocks++
+    if messagingMode {
+        return msgBlocks*16 + 32
+    }
+    return msgBlocks*32 + 16
+}
+
+//check all the macs in a merged db and decrypt the messages
+//msgBlocks doesn't count the encryption key block
+//returns every row's plaintext (still padded) and the indices of rows whose MAC didn't verify
+func CheckMacsAndDecrypt(mergedDB []byte, msgBlocks, batchSize int, messagingMode bool) ([][]byte, []int) {
+    outputDB := make([][]byte, batchSize)
+    rowLen := RowLength(msgBlocks, messagingMode)
+    msgBlocks++
+
+    numThreads, chunkSize := mycrypto.PickNumThreads(batchSize)
+    badRows := make([][]int, numThreads)
+    blocker := make(chan int)
+
+    for t:=0; t < numThreads; t++ {
+        startIndex := t*chunkSize
+        endIndex := (t+1)*chunkSize
+        go func(startI, endI, threadNum int) {
+            for i:=startI; i < endI; i++ {
+                row := mergedDB[rowLen*i:rowLen*(i+1)]
+                msg := row[:msgBlocks*16]
+                tag := row[msgBlocks*16:(msgBlocks+1)*16]
+                keys := row[(msgBlocks+1)*16:]
+
+                //decrypt
+                var err error
+                outputDB[i], err = mycrypto.DecryptCT(msg)
+                if err == nil {
+                    err = mycrypto.CheckMac(msg, tag, keys, messagingMode)
+                }
+                if err != nil {
+                    badRows[threadNum] = append(badRows[threadNum], i)
+                }
+            }
+            blocker <- 1
+        }(startIndex, endIndex, t)
+    }
+
+    for i:=0; i < numThreads; i++ {
+        <- blocker
+    }
+
+    invalidRows := make([]int, 0)
+    for _, rows := range badRows {
+        invalidRows = append(invalidRows, rows...)
+    }
+    return outputDB, invalidRows
+}
+
+//fetch one server's share of a round with numServers servers
+//first is the first server's share, whose round every other server has to agree on, nil for the first server
+func (c *Client) fetchShare(ctx context.Context, addr string, round uint64, numServers int, first *serverShare) (*serverShare, error) {
+    dialer := &tls.Dialer{Config: c.config.TLSConfig}
+    conn, err := dialer.DialContext(ctx, "tcp", addr)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrConnection, err)
+    }
+    defer conn.Close()
+
+    stop := closeOnDone(ctx, conn)
+    defer stop()
+
+    s, err := requestShare(conn, round, numServers, first)
+    if err != nil && ctx.Err() != nil {
+        return nil, ctx.Err()
+    }
+    return s, err
+}
+
+func requestShare(conn net.Conn, round uint64, numServers int, first *serverShare) (*serverShare, error) {
+    request := make([]byte, 0, HeaderLength+8)
+    request = append(request, intToByte(RequestFetch)...)
+    request = append(request, intToByte(0)...)
+    request = append(request, intToByte(8)...)
+    request = append(request, uint64ToByte(round)...)
+
+    _, err := conn.Write(request)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrConnection, err)
+    }
+
+    status := make([]byte, 4)
+    _, err = io.ReadFull(conn, status)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrConnection, err)
+    }
+    switch byteToInt(status) {
+    case StatusAccepted:
+    case StatusUnknownRound:
+        return nil, ErrUnknownRound
+    default:
+        return nil, ErrRejected
+    }
+
+    header := make([]byte, fetchResponseHeaderLength)
+    _, err = io.ReadFull(conn, header)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrConnection, err)
+    }
+
+    s := &serverShare{
+        round: binary.LittleEndian.Uint64(header[0:8]),
+        numServers: byteToInt(header[8:12]),
+        serverNum: byteToInt(header[12:16]),
+        msgBlocks: byteToInt(header[16:20]),
+        batchSize: byteToInt(header[20:24]),
+        messagingMode: byteToInt(header[24:28]) == 1,
+    }
+    commitmentsLength := byteToInt(header[28:32])
+    shareLength := byteToInt(header[32:36])
+    //the share is the round's revealed db, so its length follows from the round's parameters
+    rowLength := RowLength(s.msgBlocks, s.messagingMode)
+    if s.numServers != numServers || commitmentsLength != 32*numServers || s.batchSize < 1 ||
+        s.batchSize > maxShareLength/rowLength || shareLength != s.batchSize*rowLength {
+        return nil, fmt.Errorf("%w: malformed response", ErrInconsistentOutput)
+    }
+    if first != nil && (s.round != first.round || s.msgBlocks != first.msgBlocks ||
+        s.batchSize != first.batchSize || s.messagingMode != first.messagingMode) {
+        return nil, fmt.Errorf("%w: server disagrees on the round parameters", ErrInconsistentOutput)
+    }
+
+    //read into a buffer that grows as the data comes, so a server that claims a big round
+    //has to send it before we hold it
+    var body bytes.Buffer
+    _, err = io.CopyN(&body, conn, int64(commitmentsLength+shareLength))
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrConnection, err)
+    }
+    s.commitments = body.Bytes()[:commitmentsLength]
+    s.share = body.Bytes()[commitmentsLength:]
+
+    return s, nil
+}
+
+//encode a fetch response. used by the servers
+func EncodeFetchResponse(round uint64, numServers, serverNum, msgBlocks, batchSize int, messagingMode bool, commitments, share []byte) []byte {
+    mode := 0
+    if messagingMode {
+        mode = 1
+    }
+    response := make([]byte, 0, 4+fetchResponseHeaderLength+len(commitments)+len(share))
+    response = append(response, intToByte(StatusAccepted)...)
+    response = append(response, uint64ToByte(round)...)
+    response = append(response, intToByte(numServers)...)
+    response = append(response, intToByte(serverNum)...)
+    response = append(response, intToByte(msgBlocks)...)
+    response = append(response, intToByte(batchSize)...)
+    response = append(response, intToByte(mode)...)
+    response = append(response, intToByte(len(commitments))...)
+    response = append(response, intToByte(len(share))...)
+    response = append(response, commitments...)
+    response = append(response, share...)
+    return response
+}
+
+func uint64ToByte(x uint64) []byte {
+    b := make([]byte, 8)
+    binary.LittleEndian.PutUint64(b, x)
+    return b
+}
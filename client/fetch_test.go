@@ -0,0 +1,67 @@
+package client
+
+import (
+    "errors"
+    "io"
+    "net"
+    "testing"
+)
+
+//answer a fetch request with response, as a server would
+func serveFetch(t *testing.T, response []byte) net.Conn {
+    client, server := net.Pipe()
+    t.Cleanup(func() {
+        client.Close()
+    })
+    go func() {
+        defer server.Close()
+        request := make([]byte, HeaderLength+8)
+        _, err := io.ReadFull(server, request)
+        if err != nil {
+            return
+        }
+        server.Write(response)
+    }()
+    return client
+}
+
+func TestFetchResponseLengths(t *testing.T) {
+    const numServers = 2
+    msgBlocks, batchSize := 2, 16
+    commitments := make([]byte, 32*numServers)
+    share := make([]byte, batchSize*RowLength(msgBlocks, false))
+
+    first, err := requestShare(serveFetch(t, EncodeFetchResponse(5, numServers, 0, msgBlocks, batchSize, false, commitments, share)), 5, numServers, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(first.share) != len(share) || first.batchSize != batchSize {
+        t.Fatalf("got a %d byte share of a batch of %d", len(first.share), first.batchSize)
+    }
+
+    bad := []struct {
+        name string
+        response []byte
+    }{
+        {"share shorter than the round", EncodeFetchResponse(5, numServers, 1, msgBlocks, batchSize, false, commitments, share[1:])},
+        {"share longer than the round", EncodeFetchResponse(5, numServers, 1, msgBlocks, batchSize, false, commitments, append(share, 0))},
+        {"other number of servers", EncodeFetchResponse(5, numServers+1, 1, msgBlocks, batchSize, false, append(commitments, make([]byte, 32)...), share)},
+        {"other round", EncodeFetchResponse(6, numServers, 1, msgBlocks, batchSize, false, commitments, share)},
+        {"other mode", EncodeFetchResponse(5, numServers, 1, msgBlocks, batchSize, true, commitments, make([]byte, batchSize*RowLength(msgBlocks, true)))},
+    }
+    for _, c := range bad {
+        _, err := requestShare(serveFetch(t, c.response), 5, numServers, first)
+        if !errors.Is(err, ErrInconsistentOutput) {
+            t.Errorf("%s: got %v, want an inconsistent output", c.name, err)
+        }
+    }
+
+    //a round too big to download is refused from its header, before anything is read
+    huge := maxShareLength/RowLength(msgBlocks, false) + 1
+    header := EncodeFetchResponse(5, numServers, 0, msgBlocks, huge, false, commitments, nil)
+    copy(header[4+32:], intToByte(huge * RowLength(msgBlocks, false)))
+    _, err = requestShare(serveFetch(t, header), 5, numServers, nil)
+    if !errors.Is(err, ErrInconsistentOutput) {
+        t.Errorf("got %v, want a round too big to download refused", err)
+    }
+}
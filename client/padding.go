@@ -0,0 +1,41 @@
+package client
+
+import (
+    "errors"
+    "fmt"
+)
+
+//plaintexts are padded to the full message size by appending 0x80 and then zeros
+//so the receiver can tell where the message ends. Rows without the marker
+//(e.g. dummy messages, which encrypt all zeros) don't hold a message
+
+var ErrBadPadding = errors.New("client: bad padding")
+
+//the longest plaintext that fits in a message of msgBlocks blocks
+func MaxPlaintextLength(msgBlocks int) int {
+    return 16*msgBlocks - 1
+}
+
+func Pad(plaintext []byte, msgBlocks int) ([]byte, error) {
+    if len(plaintext) > MaxPlaintextLength(msgBlocks) {
+        return nil, fmt.Errorf("%w: %d bytes, at most %d fit", ErrMessageTooLong, len(plaintext), MaxPlaintextLength(msgBlocks))
+    }
+    padded := make([]byte, 16*msgBlocks)
+    copy(padded, plaintext)
+    padded[len(plaintext)] = 0x80
+    return padded, nil
+}
+
+func Unpad(padded []byte) ([]byte, error) {
+    for i := len(padded) - 1; i >= 0; i-- {
+        switch padded[i] {
+        case 0:
+            continue
+        case 0x80:
+            return padded[:i], nil
+        default:
+            return nil, ErrBadPadding
+        }
+    }
+    return nil, ErrBadPadding
+}
@@ -0,0 +1,342 @@
+package config
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "shufflemessage/keys"
+)
+
+//deployment config shared by all servers and the aux
+//it's a JSON file like
+//  {
+//    "servers": [{"addr": "10.0.0.1:4330", "clientAddr": "10.0.0.1:443"}, {"addr": "10.0.0.2:4331", "key": "/etc/clarion/server-1.key"}],
+//    "aux": {},
+//    "directory": "keys/directory.json",
+//    "params": [{"mode": "standard", "msgBlocks": 10, "batchSize": 1000}],
+//    "timeouts": {"default": "1m", "shuffle": "5m"},
+//    "stockpile": 20
+//  }
+//servers are listed in server order. Key paths default to the files keygen writes next to the directory.
+//relative paths are taken relative to the working directory, like the rest of the command line
+
+const (
+    ModeStandard = "standard"
+    //only the first block of each message is MACed
+    ModeMessaging = "messaging"
+)
+
+//who makes the preprocessing of the rounds
+const (
+    //the aux, the default
+    PreprocessingAux = "aux"
+    //the servers among themselves, without an aux. it's slower, and only secure if every server follows
+    //the protocol, see protocol.ServerConfig.DealerFree. The name says so, so nobody turns it on by accident
+    PreprocessingSemiHonestServers = "semi-honest-servers"
+)
+
+const DefaultDirectory = "keys/directory.json"
+
+//steps of a round that get their own timeout
+const (
+    //handshakes and parameter agreement when the servers connect
+    StepSetup = "setup"
+    //the leader passing on the client submissions
+    StepSubmissions = "submissions"
+    //getting the preprocessing from the aux
+    StepPreprocessing = "preprocessing"
+    //the first blind MAC verification
+    StepBlindMac = "blindMac"
+    StepShuffle = "shuffle"
+    //the second blind MAC verification
+    StepVerification = "verification"
+    StepReveal = "reveal"
+    //the timeout of every step that isn't given one
+    StepDefault = "default"
+)
+
+var steps = []string{StepSetup, StepSubmissions, StepPreprocessing, StepBlindMac, StepShuffle, StepVerification, StepReveal, StepDefault}
+
+//how long a step gets if the config doesn't say
+const DefaultTimeout = time.Minute
+
+//the config can't be used. the error message says what's wrong with it
+var ErrInvalid = errors.New("config: invalid")
+
+type Config struct {
+    Servers []Server `json:"servers"`
+    Aux Aux `json:"aux"`
+    //public key directory written by keygen
+    Directory string `json:"directory,omitempty"`
+    //parameter sets to run, in order
+    Params []Params `json:"params"`
+    //how long each step of a round may take before the round is aborted, as Go durations like "30s"
+    //keys are the Step constants
+    Timeouts map[string]string `json:"timeouts,omitempty"`
+    //bundles of preprocessing the aux makes ahead of the rounds for each server to keep on disk
+    //0 means the aux prepares each round's preprocessing when the round starts
+    Stockpile int `json:"stockpile,omitempty"`
+    //PreprocessingAux or PreprocessingSemiHonestServers, empty means the aux
+    Preprocessing string `json:"preprocessing,omitempty"`
+    //the most messages a round evicts after they fail the first blind MAC verification. A round with more
+    //is aborted. 0 means a tenth of the batch
+    MaxEvictions int `json:"maxEvictions,omitempty"`
+}
+
+type Server struct {
+    //host:port the server listens on for the other servers
+    Addr string `json:"addr"`
+    //host:port the server takes client connections on, if it does
+    ClientAddr string `json:"clientAddr,omitempty"`
+    //secret key file, if it's not where keygen put it
+    Key string `json:"key,omitempty"`
+}
+
+type Aux struct {
+    Key string `json:"key,omitempty"`
+    //the aux isn't online during rounds: it writes the preprocessing of a range of rounds to files
+    //ahead of time (server aux -files), and the servers take it from those instead of connecting to it
+    Offline bool `json:"offline,omitempty"`
+    //the servers check the aux's preprocessing before each round uses it, and abort the round blaming the
+    //aux if it's wrong. The aux makes extra beaver triples for that, so it takes longer
+    Check bool `json:"check,omitempty"`
+}
+
+type Params struct {
+    //ModeStandard or ModeMessaging
+    Mode string `json:"mode"`
+    //16-byte blocks per message
+    MsgBlocks int `json:"msgBlocks"`
+    //messages per batch
+    BatchSize int `json:"batchSize"`
+}
+
+func (p Params) MessagingMode() bool {
+    return p.Mode == ModeMessaging
+}
+
+//read and validate a config
+//files ending in .txt are read as old style param files, see ParseLegacy
+func Load(path string) (*Config, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var c *Config
+    if strings.HasSuffix(path, ".txt") {
+        c, err = ParseLegacy(f)
+    } else {
+        c, err = Parse(f)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return c, nil
+}
+
+//read and validate a JSON config. unknown fields are an error, so typos don't go unnoticed
+func Parse(r io.Reader) (*Config, error) {
+    data, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil, err
+    }
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    c := &Config{}
+    err = dec.Decode(c)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+    }
+    if dec.More() {
+        return nil, fmt.Errorf("%w: trailing data after the config", ErrInvalid)
+    }
+    err = c.Validate()
+    if err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+func (c *Config) Validate() error {
+    if len(c.Servers) < 2 {
+        return fmt.Errorf("%w: need at least 2 servers, have %d", ErrInvalid, len(c.Servers))
+    }
+    seen := make(map[string]int)
+    for i, s := range c.Servers {
+        err := checkAddr(s.Addr)
+        if err != nil {
+            return fmt.Errorf("%w: server %d: %v", ErrInvalid, i, err)
+        }
+        if j, ok := seen[s.Addr]; ok {
+            return fmt.Errorf("%w: servers %d and %d both have address %s", ErrInvalid, j, i, s.Addr)
+        }
+        seen[s.Addr] = i
+        if s.ClientAddr != "" {
+            err = checkAddr(s.ClientAddr)
+            if err != nil {
+                return fmt.Errorf("%w: server %d client address: %v", ErrInvalid, i, err)
+            }
+        }
+    }
+    if len(c.Params) == 0 {
+        return fmt.Errorf("%w: no parameter sets", ErrInvalid)
+    }
+    for i, p := range c.Params {
+        if p.Mode != ModeStandard && p.Mode != ModeMessaging {
+            return fmt.Errorf("%w: parameter set %d: mode must be %q or %q, not %q", ErrInvalid, i, ModeStandard, ModeMessaging, p.Mode)
+        }
+        if p.MsgBlocks <= 0 {
+            return fmt.Errorf("%w: parameter set %d: msgBlocks must be positive, not %d", ErrInvalid, i, p.MsgBlocks)
+        }
+        if p.BatchSize <= 0 {
+            return fmt.Errorf("%w: parameter set %d: batchSize must be positive, not %d", ErrInvalid, i, p.BatchSize)
+        }
+    }
+    if c.Stockpile < 0 {
+        return fmt.Errorf("%w: stockpile can't be negative, got %d", ErrInvalid, c.Stockpile)
+    }
+    if c.MaxEvictions < 0 {
+        return fmt.Errorf("%w: maxEvictions can't be negative, got %d", ErrInvalid, c.MaxEvictions)
+    }
+    if c.Aux.Offline && c.Stockpile > 0 {
+        return fmt.Errorf("%w: an offline aux can't fill stockpiles, its files have the bundles of all the rounds", ErrInvalid)
+    }
+    if c.Preprocessing == "servers" {
+        return fmt.Errorf("%w: preprocessing by the servers is only secure against semi-honest servers: nothing proves the plaintexts of their Paillier ciphertexts are in range, so a server that deviates can learn the others' permutations and shares. Use %q to run it anyway", ErrInvalid, PreprocessingSemiHonestServers)
+    }
+    if c.Preprocessing != "" && c.Preprocessing != PreprocessingAux && c.Preprocessing != PreprocessingSemiHonestServers {
+        return fmt.Errorf("%w: preprocessing must be %q or %q, not %q", ErrInvalid, PreprocessingAux, PreprocessingSemiHonestServers, c.Preprocessing)
+    }
+    if c.DealerFree() && (c.Stockpile > 0 || c.Aux.Offline) {
+        return fmt.Errorf("%w: without an aux there's nothing to stockpile and no aux to be offline", ErrInvalid)
+    }
+    if c.DealerFree() && c.Aux.Check {
+        return fmt.Errorf("%w: without an aux there's no aux to check", ErrInvalid)
+    }
+    for step, timeout := range c.Timeouts {
+        known := false
+        for _, s := range steps {
+            known = known || s == step
+        }
+        if !known {
+            return fmt.Errorf("%w: unknown timeout %q, the steps are %s", ErrInvalid, step, strings.Join(steps, ", "))
+        }
+        d, err := time.ParseDuration(timeout)
+        if err != nil || d <= 0 {
+            return fmt.Errorf("%w: timeout %q must be a positive duration like \"30s\", not %q", ErrInvalid, step, timeout)
+        }
+    }
+    return nil
+}
+
+//whether the servers make the preprocessing themselves, without an aux
+func (c *Config) DealerFree() bool {
+    return c.Preprocessing == PreprocessingSemiHonestServers
+}
+
+//how long step may take: its own timeout, the default one, or DefaultTimeout
+func (c *Config) Timeout(step string) time.Duration {
+    for _, s := range []string{step, StepDefault} {
+        if timeout, ok := c.Timeouts[s]; ok {
+            d, err := time.ParseDuration(timeout)
+            if err == nil {
+                return d
+            }
+        }
+    }
+    return DefaultTimeout
+}
+
+func checkAddr(addr string) error {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return err
+    }
+    if host == "" {
+        return fmt.Errorf("address %q has no host", addr)
+    }
+    portNum, err := strconv.Atoi(port)
+    if err != nil || portNum <= 0 || portNum > 65535 {
+        return fmt.Errorf("address %q has a bad port", addr)
+    }
+    return nil
+}
+
+//the address server i listens on: its port on all interfaces
+func (c *Config) ListenAddr(i int) string {
+    _, port, _ := net.SplitHostPort(c.Servers[i].Addr)
+    return net.JoinHostPort("", port)
+}
+
+//the address server i takes client connections on: the port of its client address on all interfaces
+//empty if it doesn't take clients
+func (c *Config) ClientListenAddr(i int) string {
+    if c.Servers[i].ClientAddr == "" {
+        return ""
+    }
+    _, port, _ := net.SplitHostPort(c.Servers[i].ClientAddr)
+    return net.JoinHostPort("", port)
+}
+
+func (c *Config) Addrs() []string {
+    addrs := make([]string, len(c.Servers))
+    for i, s := range c.Servers {
+        addrs[i] = s.Addr
+    }
+    return addrs
+}
+
+//client addresses of all servers, or nil if some server doesn't take clients
+func (c *Config) ClientAddrs() []string {
+    addrs := make([]string, len(c.Servers))
+    for i, s := range c.Servers {
+        if s.ClientAddr == "" {
+            return nil
+        }
+        addrs[i] = s.ClientAddr
+    }
+    return addrs
+}
+
+func (c *Config) DirectoryFile() string {
+    if c.Directory == "" {
+        return DefaultDirectory
+    }
+    return c.Directory
+}
+
+//secret key file of server i, or of the aux for keys.Aux
+func (c *Config) KeyFile(i int) string {
+    path := ""
+    if i == keys.Aux {
+        path = c.Aux.Key
+    } else if i >= 0 && i < len(c.Servers) {
+        path = c.Servers[i].Key
+    }
+    if path == "" {
+        path = filepath.Join(filepath.Dir(c.DirectoryFile()), keys.SecretKeyFileName(i))
+    }
+    return path
+}
+
+//write a config as indented JSON
+func (c *Config) Write(w io.Writer) error {
+    data, err := json.MarshalIndent(c, "", "  ")
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(append(data, '\n'))
+    return err
+}
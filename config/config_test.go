@@ -0,0 +1,118 @@
+package config
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "time"
+)
+
+const testConfig = `{
+  "servers": [{"addr": "10.0.0.1:4330", "clientAddr": "10.0.0.1:443"}, {"addr": "10.0.0.2:4331"}],
+  "aux": {},
+  "params": [{"mode": "standard", "msgBlocks": 10, "batchSize": 1000}],
+  "timeouts": {"default": "30s", "shuffle": "5m"}
+}`
+
+//a valid config to break
+func testConfigValue(t *testing.T) *Config {
+    t.Helper()
+    c, err := Parse(strings.NewReader(testConfig))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return c
+}
+
+func TestParse(t *testing.T) {
+    c := testConfigValue(t)
+    if len(c.Servers) != 2 || c.Servers[0].ClientAddr != "10.0.0.1:443" || len(c.Params) != 1 || c.Params[0].BatchSize != 1000 {
+        t.Errorf("parsed %+v", c)
+    }
+    if c.DirectoryFile() != DefaultDirectory || c.ClientAddrs() != nil || c.ListenAddr(1) != ":4331" {
+        t.Errorf("got directory %q, client addresses %v, listen address %q", c.DirectoryFile(), c.ClientAddrs(), c.ListenAddr(1))
+    }
+
+    bad := map[string]string{
+        "unknown field": `{"servers": [], "stockpiles": 3}`,
+        "trailing data": testConfig + "{}",
+        "not json": "servers: []",
+    }
+    for name, data := range bad {
+        _, err := Parse(strings.NewReader(data))
+        if !errors.Is(err, ErrInvalid) {
+            t.Errorf("%s: got %v, want an invalid config", name, err)
+        }
+    }
+}
+
+func TestValidate(t *testing.T) {
+    bad := []struct {
+        name string
+        breaks func(c *Config)
+    }{
+        {"one server", func(c *Config) { c.Servers = c.Servers[:1] }},
+        {"address without a port", func(c *Config) { c.Servers[1].Addr = "10.0.0.2" }},
+        {"address without a host", func(c *Config) { c.Servers[1].Addr = ":4331" }},
+        {"port out of range", func(c *Config) { c.Servers[1].Addr = "10.0.0.2:70000" }},
+        {"two servers on one address", func(c *Config) { c.Servers[1].Addr = c.Servers[0].Addr }},
+        {"bad client address", func(c *Config) { c.Servers[1].ClientAddr = "10.0.0.2" }},
+        {"no parameter sets", func(c *Config) { c.Params = nil }},
+        {"unknown mode", func(c *Config) { c.Params[0].Mode = "fast" }},
+        {"no blocks", func(c *Config) { c.Params[0].MsgBlocks = 0 }},
+        {"no messages", func(c *Config) { c.Params[0].BatchSize = -1 }},
+        {"negative stockpile", func(c *Config) { c.Stockpile = -1 }},
+        {"negative maxEvictions", func(c *Config) { c.MaxEvictions = -1 }},
+        {"offline aux with a stockpile", func(c *Config) { c.Aux.Offline, c.Stockpile = true, 3 }},
+        {"servers preprocessing", func(c *Config) { c.Preprocessing = "servers" }},
+        {"unknown preprocessing", func(c *Config) { c.Preprocessing = "dealer" }},
+        {"no aux but offline", func(c *Config) { c.Preprocessing, c.Aux.Offline = PreprocessingSemiHonestServers, true }},
+        {"no aux but checked", func(c *Config) { c.Preprocessing, c.Aux.Check = PreprocessingSemiHonestServers, true }},
+        {"unknown timeout", func(c *Config) { c.Timeouts["mac"] = "1m" }},
+        {"timeout without a unit", func(c *Config) { c.Timeouts[StepReveal] = "30" }},
+        {"zero timeout", func(c *Config) { c.Timeouts[StepReveal] = "0s" }},
+        {"negative timeout", func(c *Config) { c.Timeouts[StepDefault] = "-1m" }},
+    }
+    for _, b := range bad {
+        c := testConfigValue(t)
+        b.breaks(c)
+        err := c.Validate()
+        if !errors.Is(err, ErrInvalid) {
+            t.Errorf("%s: got %v, want an invalid config", b.name, err)
+        }
+    }
+
+    c := testConfigValue(t)
+    c.Preprocessing = PreprocessingSemiHonestServers
+    err := c.Validate()
+    if err != nil || !c.DealerFree() {
+        t.Errorf("got %v, want preprocessing without an aux", err)
+    }
+}
+
+func TestTimeout(t *testing.T) {
+    c := testConfigValue(t)
+    if c.Timeout(StepShuffle) != 5*time.Minute || c.Timeout(StepReveal) != 30*time.Second {
+        t.Errorf("got %v for the shuffle and %v for the reveal, want 5m and 30s", c.Timeout(StepShuffle), c.Timeout(StepReveal))
+    }
+    c.Timeouts = nil
+    if c.Timeout(StepShuffle) != DefaultTimeout {
+        t.Errorf("got %v without timeouts, want %v", c.Timeout(StepShuffle), DefaultTimeout)
+    }
+}
+
+func TestParseLegacy(t *testing.T) {
+    legacy := "2\n2\n10.0.0.1:4330\n10.0.0.2:4331\n10.0.0.3:4332\nPARAMS\nmessaging\n1\n64\nstandard\n4\n32\n"
+    c, err := ParseLegacy(strings.NewReader(legacy))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(c.Servers) != 2 || len(c.Params) != 2 || !c.Params[0].MessagingMode() || c.Params[1].MsgBlocks != 4 {
+        t.Errorf("parsed %+v", c)
+    }
+
+    _, err = ParseLegacy(strings.NewReader("3\n1\n10.0.0.1:4330\n10.0.0.2:4331\nPARAMS\nstandard\n1\n16\n"))
+    if !errors.Is(err, ErrInvalid) {
+        t.Errorf("got %v for 3 servers with 2 addresses, want an invalid config", err)
+    }
+}
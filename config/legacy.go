@@ -0,0 +1,95 @@
+package config
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+)
+
+//old style param files, one value per line:
+//  number of servers
+//  number of parameter sets
+//  server addresses (addr:port), at least one per server. extra ones are ignored
+//  PARAMS
+//  for each parameter set: messaging or standard, blocks per message, batch size
+//anything after the last parameter set is ignored, like the old parser did
+
+//read an old style param file into a config that uses the default key paths
+func ParseLegacy(r io.Reader) (*Config, error) {
+    p := &legacyParser{scanner: bufio.NewScanner(r)}
+
+    numServers := p.int("number of servers")
+    numParams := p.int("number of parameter sets")
+    if p.err != nil {
+        return nil, p.err
+    }
+
+    c := &Config{}
+    for {
+        line := p.next("server address or PARAMS")
+        if p.err != nil {
+            return nil, p.err
+        }
+        if line == "PARAMS" {
+            break
+        }
+        if len(c.Servers) < numServers {
+            c.Servers = append(c.Servers, Server{Addr: line})
+        }
+    }
+    if len(c.Servers) < numServers {
+        return nil, fmt.Errorf("%w: line %d: %d servers but only %d addresses", ErrInvalid, p.line, numServers, len(c.Servers))
+    }
+
+    for i := 0; i < numParams; i++ {
+        mode := p.next("messaging or standard")
+        msgBlocks := p.int("blocks per message")
+        batchSize := p.int("batch size")
+        if p.err != nil {
+            return nil, p.err
+        }
+        c.Params = append(c.Params, Params{Mode: mode, MsgBlocks: msgBlocks, BatchSize: batchSize})
+    }
+
+    err := c.Validate()
+    if err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+type legacyParser struct {
+    scanner *bufio.Scanner
+    line int
+    err error
+}
+
+//the next line, trimmed. what says what was expected there, for the error message
+func (p *legacyParser) next(what string) string {
+    if p.err != nil {
+        return ""
+    }
+    if !p.scanner.Scan() {
+        p.err = p.scanner.Err()
+        if p.err == nil {
+            p.err = fmt.Errorf("%w: line %d: file ends where %s should be", ErrInvalid, p.line+1, what)
+        }
+        return ""
+    }
+    p.line++
+    return strings.TrimSpace(p.scanner.Text())
+}
+
+func (p *legacyParser) int(what string) int {
+    line := p.next(what)
+    if p.err != nil {
+        return 0
+    }
+    n, err := strconv.Atoi(line)
+    if err != nil {
+        p.err = fmt.Errorf("%w: line %d: %s should be a number, not %q", ErrInvalid, p.line, what, line)
+    }
+    return n
+}
@@ -0,0 +1,340 @@
+package keys
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "math/big"
+    "os"
+    "path/filepath"
+    "time"
+
+    "golang.org/x/crypto/curve25519"
+    "golang.org/x/crypto/nacl/box"
+)
+
+//long term keys of the servers
+//every server (and the aux, index -1) has a NaCl box key pair that clients seal their shares to,
+//an ed25519 key pair it signs evidence with, and a self-signed TLS certificate it uses
+//on connections to the other servers. Peers pin each other's certificate by its fingerprint.
+//the public halves of everyone's keys go in one directory file that is handed to every server and client.
+//each secret key file only goes to the server it belongs to
+
+//index of the aux server
+const Aux = -1
+
+//file names keygen uses
+const DirectoryFileName = "directory.json"
+
+var (
+    //a key file is malformed or doesn't match the directory
+    ErrBadKey = errors.New("keys: bad key file")
+    //the directory doesn't have keys for the server asked for
+    ErrMissingKey = errors.New("keys: no keys for server")
+)
+
+//public keys of one server
+type PublicKeys struct {
+    Index int `json:"index"`
+    Box []byte `json:"box"`
+    Sign []byte `json:"sign"`
+    //sha256 of the server's TLS certificate
+    TLS []byte `json:"tls"`
+}
+
+//public keys of all servers and the aux
+type Directory struct {
+    //shuffle servers in server order
+    Servers []PublicKeys `json:"servers"`
+    Aux PublicKeys `json:"aux"`
+}
+
+//secret keys of one server
+type SecretKeys struct {
+    Index int `json:"index"`
+    Box []byte `json:"box"`
+    //ed25519 seed
+    Sign []byte `json:"sign"`
+    //the TLS certificate (DER) and the ed25519 seed of its key
+    TLSCert []byte `json:"tlsCert"`
+    TLSKey []byte `json:"tlsKey"`
+}
+
+//make fresh keys for numServers servers and the aux
+//the secret keys are returned in server order, followed by the aux's
+func Generate(numServers int) (*Directory, []*SecretKeys, error) {
+    if numServers < 2 {
+        return nil, nil, fmt.Errorf("keys: need at least 2 servers, got %d", numServers)
+    }
+    dir := &Directory{}
+    secrets := make([]*SecretKeys, 0, numServers+1)
+    for i := 0; i <= numServers; i++ {
+        index := i
+        if i == numServers {
+            index = Aux
+        }
+        boxPub, boxSec, err := box.GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, nil, err
+        }
+        signPub, signSec, err := ed25519.GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, nil, err
+        }
+        tlsCert, tlsSec, err := generateCertificate(index)
+        if err != nil {
+            return nil, nil, err
+        }
+        pub := PublicKeys{Index: index, Box: boxPub[:], Sign: signPub, TLS: Fingerprint(tlsCert)}
+        if index == Aux {
+            dir.Aux = pub
+        } else {
+            dir.Servers = append(dir.Servers, pub)
+        }
+        secrets = append(secrets, &SecretKeys{Index: index, Box: boxSec[:], Sign: signSec.Seed(), TLSCert: tlsCert, TLSKey: tlsSec.Seed()})
+    }
+    return dir, secrets, nil
+}
+
+//name of the secret key file keygen writes for a server
+func SecretKeyFileName(index int) string {
+    if index == Aux {
+        return "aux.key"
+    }
+    return fmt.Sprintf("server-%d.key", index)
+}
+
+//generate keys for numServers servers and write them to outDir
+//as a directory file and one secret key file per server
+func GenerateFiles(numServers int, outDir string) error {
+    dir, secrets, err := Generate(numServers)
+    if err != nil {
+        return err
+    }
+    err = os.MkdirAll(outDir, 0700)
+    if err != nil {
+        return err
+    }
+    for _, sec := range secrets {
+        err = WriteSecretKeys(filepath.Join(outDir, SecretKeyFileName(sec.Index)), sec)
+        if err != nil {
+            return err
+        }
+    }
+    return WriteDirectory(filepath.Join(outDir, DirectoryFileName), dir)
+}
+
+func WriteDirectory(path string, dir *Directory) error {
+    data, err := json.MarshalIndent(dir, "", "  ")
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, data, 0644)
+}
+
+func ReadDirectory(path string) (*Directory, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    dir := &Directory{}
+    err = json.Unmarshal(data, dir)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s: %v", ErrBadKey, path, err)
+    }
+    for i, pub := range dir.Servers {
+        if pub.Index != i {
+            return nil, fmt.Errorf("%w: %s: entry %d is for server %d", ErrBadKey, path, i, pub.Index)
+        }
+        err = pub.check()
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", path, err)
+        }
+    }
+    if dir.Aux.Index != Aux {
+        return nil, fmt.Errorf("%w: %s: aux entry has index %d", ErrBadKey, path, dir.Aux.Index)
+    }
+    err = dir.Aux.check()
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return dir, nil
+}
+
+func (p PublicKeys) check() error {
+    if len(p.Box) != 32 || len(p.Sign) != ed25519.PublicKeySize || len(p.TLS) != sha256.Size {
+        return fmt.Errorf("%w: wrong key length for server %d", ErrBadKey, p.Index)
+    }
+    return nil
+}
+
+//box public keys of the shuffle servers in server order, the way the client and servers use them
+func (d *Directory) BoxKeys() []*[32]byte {
+    keys := make([]*[32]byte, len(d.Servers))
+    for i, pub := range d.Servers {
+        keys[i] = new([32]byte)
+        copy(keys[i][:], pub.Box)
+    }
+    return keys
+}
+
+//box public key of the aux, which the servers derive the keys they share with it from
+func (d *Directory) AuxBoxKey() *[32]byte {
+    key := new([32]byte)
+    copy(key[:], d.Aux.Box)
+    return key
+}
+
+//public keys of server index (or Aux)
+func (d *Directory) Server(index int) (*PublicKeys, error) {
+    if index == Aux {
+        return &d.Aux, nil
+    }
+    if index < 0 || index >= len(d.Servers) {
+        return nil, fmt.Errorf("%w %d", ErrMissingKey, index)
+    }
+    return &d.Servers[index], nil
+}
+
+func WriteSecretKeys(path string, sec *SecretKeys) error {
+    data, err := json.MarshalIndent(sec, "", "  ")
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, data, 0600)
+}
+
+//read a server's secret keys and check that they belong to its entry in the directory
+func ReadSecretKeys(path string, dir *Directory) (*SecretKeys, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    sec := &SecretKeys{}
+    err = json.Unmarshal(data, sec)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s: %v", ErrBadKey, path, err)
+    }
+    if len(sec.Box) != 32 || len(sec.Sign) != ed25519.SeedSize || len(sec.TLSKey) != ed25519.SeedSize {
+        return nil, fmt.Errorf("%w: %s: wrong key length", ErrBadKey, path)
+    }
+
+    pub, err := dir.Server(sec.Index)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    boxPub, err := curve25519.X25519(sec.Box, curve25519.Basepoint)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s: %v", ErrBadKey, path, err)
+    }
+    signPub := sec.SignKey().Public().(ed25519.PublicKey)
+    if !bytes.Equal(boxPub, pub.Box) || !signPub.Equal(ed25519.PublicKey(pub.Sign)) ||
+        !bytes.Equal(Fingerprint(sec.TLSCert), pub.TLS) {
+        return nil, fmt.Errorf("%w: %s doesn't match the directory's keys for server %d", ErrBadKey, path, sec.Index)
+    }
+    _, err = sec.Certificate()
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s: %v", ErrBadKey, path, err)
+    }
+    return sec, nil
+}
+
+func (s *SecretKeys) BoxKey() *[32]byte {
+    key := new([32]byte)
+    copy(key[:], s.Box)
+    return key
+}
+
+func (s *SecretKeys) SignKey() ed25519.PrivateKey {
+    return ed25519.NewKeyFromSeed(s.Sign)
+}
+
+//the server's TLS certificate with its key
+func (s *SecretKeys) Certificate() (tls.Certificate, error) {
+    key := ed25519.NewKeyFromSeed(s.TLSKey)
+    leaf, err := x509.ParseCertificate(s.TLSCert)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    certKey, ok := leaf.PublicKey.(ed25519.PublicKey)
+    if !ok || !certKey.Equal(key.Public()) {
+        return tls.Certificate{}, errors.New("certificate doesn't match its key")
+    }
+    return tls.Certificate{Certificate: [][]byte{s.TLSCert}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+//fingerprint of a DER encoded certificate, as it appears in the directory
+func Fingerprint(cert []byte) []byte {
+    sum := sha256.Sum256(cert)
+    return sum[:]
+}
+
+//which server a certificate belongs to. ok is false if it's nobody's in the directory
+func (d *Directory) Identify(cert []byte) (index int, ok bool) {
+    fingerprint := Fingerprint(cert)
+    for i, pub := range d.Servers {
+        if bytes.Equal(pub.TLS, fingerprint) {
+            return i, true
+        }
+    }
+    if bytes.Equal(d.Aux.TLS, fingerprint) {
+        return Aux, true
+    }
+    return 0, false
+}
+
+//TLS config for clients connecting to the servers' client listeners
+//it accepts any shuffle server's certificate from the directory
+func (d *Directory) ClientTLSConfig() *tls.Config {
+    return &tls.Config{
+        //the certificates are self-signed, they're checked against the directory instead
+        InsecureSkipVerify: true,
+        VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+            if len(rawCerts) > 0 {
+                if index, ok := d.Identify(rawCerts[0]); ok && index != Aux {
+                    return nil
+                }
+            }
+            return errors.New("keys: server certificate is not in the directory")
+        },
+        MinVersion: tls.VersionTLS12,
+    }
+}
+
+//self-signed certificate for a server. it's trusted by its fingerprint, so the names
+//and validity period only matter to tools that display them
+func generateCertificate(index int) ([]byte, ed25519.PrivateKey, error) {
+    pub, sec, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, nil, err
+    }
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return nil, nil, err
+    }
+    name := fmt.Sprintf("clarion server %d", index)
+    if index == Aux {
+        name = "clarion aux server"
+    }
+    template := &x509.Certificate{
+        SerialNumber: serial,
+        Subject: pkix.Name{CommonName: name},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().AddDate(10, 0, 0),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    cert, err := x509.CreateCertificate(rand.Reader, template, template, pub, sec)
+    if err != nil {
+        return nil, nil, err
+    }
+    return cert, sec, nil
+}
@@ -0,0 +1,74 @@
+package keys
+
+import (
+    "errors"
+    "path/filepath"
+    "testing"
+)
+
+func TestKeyFiles(t *testing.T) {
+    const numServers = 3
+    dir := t.TempDir()
+    err := GenerateFiles(numServers, dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    directory, err := ReadDirectory(filepath.Join(dir, DirectoryFileName))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(directory.Servers) != numServers || len(directory.BoxKeys()) != numServers {
+        t.Fatalf("directory has %d servers, want %d", len(directory.Servers), numServers)
+    }
+
+    for _, index := range []int{0, 1, 2, Aux} {
+        sec, err := ReadSecretKeys(filepath.Join(dir, SecretKeyFileName(index)), directory)
+        if err != nil {
+            t.Fatalf("server %d: %v", index, err)
+        }
+        //the directory tells who a certificate belongs to
+        cert, err := sec.Certificate()
+        if err != nil {
+            t.Fatal(err)
+        }
+        who, ok := directory.Identify(cert.Certificate[0])
+        if !ok || who != index {
+            t.Errorf("server %d's certificate is identified as %d, %v", index, who, ok)
+        }
+    }
+    _, err = directory.Server(numServers)
+    if !errors.Is(err, ErrMissingKey) {
+        t.Errorf("got %v for a server that's not in the directory, want a missing key", err)
+    }
+}
+
+func TestKeysFromAnotherDirectory(t *testing.T) {
+    dir, other := t.TempDir(), t.TempDir()
+    for _, d := range []string{dir, other} {
+        err := GenerateFiles(2, d)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    directory, err := ReadDirectory(filepath.Join(dir, DirectoryFileName))
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = ReadSecretKeys(filepath.Join(other, SecretKeyFileName(0)), directory)
+    if !errors.Is(err, ErrBadKey) {
+        t.Errorf("got %v for another deployment's key file, want a bad key", err)
+    }
+
+    //and nobody else's certificate is anyone's
+    otherDirectory, err := ReadDirectory(filepath.Join(other, DirectoryFileName))
+    if err != nil {
+        t.Fatal(err)
+    }
+    sec, err := ReadSecretKeys(filepath.Join(other, SecretKeyFileName(1)), otherDirectory)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := directory.Identify(sec.TLSCert); ok {
+        t.Error("a certificate from another deployment was identified")
+    }
+}
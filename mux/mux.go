@@ -0,0 +1,439 @@
+package mux
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+//many logical streams over one connection
+//the servers keep one authenticated connection to each other server and run everything over
+//streams of it: the protocol messages of a round on one, the submissions of each worker thread on others.
+//every chunk of data on the connection is a frame
+//  [4 stream][1 kind][4 length][payload]
+//little endian like the wire package. Streams don't have to be opened: both ends know which stream
+//IDs they use, and a stream exists once either end uses it. It's forgotten once both ends closed it and
+//everything sent on it was read, and its ID can then be used again. A peer can have at most MaxStreams
+//streams at once, so with the windows below it can't make this end hold more than MaxStreams*Window
+//unread bytes.
+//each stream has a receive window. A sender can have at most Window unread bytes outstanding on a
+//stream and the receiver hands out more as it reads, so a stream nobody reads from can't fill up
+//the memory of the other end or block the other streams. Data is sent in chunks of at most MaxChunk
+//bytes, taking turns between the streams that have something to send, and window updates go
+//ahead of data, so a bulk transfer on one stream only delays a small message on another by a chunk
+
+const (
+    //most unread bytes a stream can have at the receiver
+    Window = 4 << 20
+    //most data in one frame
+    MaxChunk = 32 << 10
+    //most streams a session has at once. The peer using another one is a protocol violation
+    MaxStreams = 64
+)
+
+const headerLength = 9
+
+const (
+    kindData byte = 0
+    //the sender may send 4-byte-length more bytes on the stream
+    kindWindow byte = 1
+    //the sender won't send anything more on the stream
+    kindClose byte = 2
+)
+
+var (
+    //the session or stream was closed
+    ErrClosed = errors.New("mux: closed")
+    //the peer broke the framing or the flow control
+    ErrProtocol = errors.New("mux: protocol violation")
+)
+
+//a connection carrying streams
+type Session struct {
+    conn net.Conn
+
+    mu sync.Mutex
+    //signalled on every change of state, for both the writer and waiting streams
+    cond *sync.Cond
+    streams map[uint32]*Stream
+    //frames other than data, which are sent first
+    control [][]byte
+    //streams with a chunk waiting to be sent, in the order they get to send
+    ready []*Stream
+    //why the session stopped, nil while it's running
+    err error
+}
+
+//start a session over conn. Both ends have to do this
+func NewSession(conn net.Conn) *Session {
+    s := &Session{
+        conn: conn,
+        streams: make(map[uint32]*Stream),
+    }
+    s.cond = sync.NewCond(&s.mu)
+    go s.readLoop()
+    go s.writeLoop()
+    return s
+}
+
+//the stream with the given ID. Streams opened here don't count against MaxStreams
+func (s *Session) Stream(id uint32) *Stream {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.stream(id)
+}
+
+//the caller holds mu
+func (s *Session) stream(id uint32) *Stream {
+    st, ok := s.streams[id]
+    if !ok {
+        st = &Stream{
+            session: s,
+            id: id,
+            sendWindow: Window,
+        }
+        s.streams[id] = st
+    }
+    return st
+}
+
+//forget st if neither end will use it again. the caller holds mu
+func (s *Session) forget(st *Stream) {
+    if st.localClosed && st.remoteClosed && len(st.buf) == 0 && s.streams[st.id] == st {
+        delete(s.streams, st.id)
+    }
+}
+
+//close the session and all its streams
+func (s *Session) Close() error {
+    s.fail(ErrClosed)
+    return nil
+}
+
+//stop the session with err, if it isn't stopped yet. the caller doesn't hold mu
+func (s *Session) fail(err error) {
+    s.mu.Lock()
+    first := s.err == nil
+    if first {
+        s.err = err
+    }
+    s.cond.Broadcast()
+    s.mu.Unlock()
+    if first {
+        s.conn.Close()
+    }
+}
+
+func frameHeader(id uint32, kind byte, length int) []byte {
+    header := make([]byte, headerLength)
+    binary.LittleEndian.PutUint32(header[0:4], id)
+    header[4] = kind
+    binary.LittleEndian.PutUint32(header[5:9], uint32(length))
+    return header
+}
+
+//queue a frame that isn't data. the caller holds mu
+func (s *Session) queueControl(id uint32, kind byte, payload []byte) {
+    s.control = append(s.control, append(frameHeader(id, kind, len(payload)), payload...))
+    s.cond.Broadcast()
+}
+
+func (s *Session) writeLoop() {
+    for {
+        s.mu.Lock()
+        for s.err == nil && len(s.control) == 0 && len(s.ready) == 0 {
+            s.cond.Wait()
+        }
+        if s.err != nil {
+            //let streams waiting for their chunk to go out know
+            for _, st := range s.ready {
+                st.pending.done <- s.err
+            }
+            s.ready = nil
+            s.mu.Unlock()
+            return
+        }
+        var frame net.Buffers
+        var chunk *pendingChunk
+        if len(s.control) > 0 {
+            frame = net.Buffers{s.control[0]}
+            s.control = s.control[1:]
+        } else {
+            st := s.ready[0]
+            s.ready = s.ready[1:]
+            chunk = st.pending
+            st.pending = nil
+            frame = net.Buffers{frameHeader(st.id, kindData, len(chunk.data)), chunk.data}
+        }
+        s.mu.Unlock()
+
+        _, err := frame.WriteTo(s.conn)
+        if err != nil {
+            s.fail(err)
+        }
+        if chunk != nil {
+            chunk.done <- err
+        }
+    }
+}
+
+func (s *Session) readLoop() {
+    header := make([]byte, headerLength)
+    for {
+        _, err := io.ReadFull(s.conn, header)
+        if err != nil {
+            s.fail(err)
+            return
+        }
+        id := binary.LittleEndian.Uint32(header[0:4])
+        kind := header[4]
+        length := int(binary.LittleEndian.Uint32(header[5:9]))
+
+        switch kind {
+        case kindData:
+            if length > MaxChunk {
+                s.fail(fmt.Errorf("%w: %d byte chunk on stream %d", ErrProtocol, length, id))
+                return
+            }
+        case kindWindow:
+            if length != 4 {
+                s.fail(fmt.Errorf("%w: window update of length %d", ErrProtocol, length))
+                return
+            }
+        case kindClose:
+            if length != 0 {
+                s.fail(fmt.Errorf("%w: close of length %d", ErrProtocol, length))
+                return
+            }
+        default:
+            s.fail(fmt.Errorf("%w: unknown frame kind %d", ErrProtocol, kind))
+            return
+        }
+
+        payload := make([]byte, length)
+        _, err = io.ReadFull(s.conn, payload)
+        if err != nil {
+            s.fail(err)
+            return
+        }
+
+        s.mu.Lock()
+        st, ok := s.streams[id]
+        if !ok {
+            //a window update is for data sent on a stream, so one for a stream that's not there is
+            //for one that's been forgotten since
+            if kind == kindWindow {
+                s.mu.Unlock()
+                continue
+            }
+            if len(s.streams) >= MaxStreams {
+                s.mu.Unlock()
+                s.fail(fmt.Errorf("%w: more than %d streams", ErrProtocol, MaxStreams))
+                return
+            }
+            st = s.stream(id)
+        }
+        switch kind {
+        case kindData:
+            if st.remoteClosed || len(st.buf) + length > Window {
+                s.mu.Unlock()
+                s.fail(fmt.Errorf("%w: data past the window or the end of stream %d", ErrProtocol, id))
+                return
+            }
+            st.buf = append(st.buf, payload...)
+        case kindWindow:
+            st.sendWindow += int(binary.LittleEndian.Uint32(payload))
+        case kindClose:
+            st.remoteClosed = true
+            s.forget(st)
+        }
+        s.cond.Broadcast()
+        s.mu.Unlock()
+    }
+}
+
+type pendingChunk struct {
+    data []byte
+    done chan error
+}
+
+//one stream of a session. It's a net.Conn, so the wire package can run over it
+//like a net.Conn, one Read and one Write may run at the same time
+type Stream struct {
+    session *Session
+    id uint32
+
+    //one Write at a time, so a stream has at most one chunk waiting to go out
+    writeMu sync.Mutex
+
+    //everything below is guarded by session.mu
+    //bytes the peer has room for
+    sendWindow int
+    pending *pendingChunk
+    //received and not read yet
+    buf []byte
+    //read since the last window update
+    consumed int
+    localClosed bool
+    remoteClosed bool
+    readDeadline time.Time
+    writeDeadline time.Time
+}
+
+func (st *Stream) ID() uint32 {
+    return st.id
+}
+
+//why the stream can't go on, if it can't. the caller holds session.mu
+func (st *Stream) stopped(deadline time.Time) error {
+    if st.session.err != nil {
+        return st.session.err
+    }
+    if !deadline.IsZero() && !time.Now().Before(deadline) {
+        return os.ErrDeadlineExceeded
+    }
+    return nil
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+    s := st.session
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for len(st.buf) == 0 {
+        if st.remoteClosed {
+            return 0, io.EOF
+        }
+        err := st.stopped(st.readDeadline)
+        if err != nil {
+            return 0, err
+        }
+        s.cond.Wait()
+    }
+    n := copy(p, st.buf)
+    st.buf = st.buf[n:]
+    if len(st.buf) == 0 {
+        //let the memory go
+        st.buf = nil
+        s.forget(st)
+    }
+    st.consumed += n
+    //give the window back in big enough steps that the updates don't cost much
+    if st.consumed >= Window/4 && !st.remoteClosed {
+        update := make([]byte, 4)
+        binary.LittleEndian.PutUint32(update, uint32(st.consumed))
+        s.queueControl(st.id, kindWindow, update)
+        st.consumed = 0
+    }
+    return n, nil
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+    st.writeMu.Lock()
+    defer st.writeMu.Unlock()
+    s := st.session
+
+    written := 0
+    for written < len(p) {
+        s.mu.Lock()
+        for {
+            err := st.stopped(st.writeDeadline)
+            if err == nil && st.localClosed {
+                err = ErrClosed
+            }
+            if err != nil {
+                s.mu.Unlock()
+                return written, err
+            }
+            if st.sendWindow > 0 {
+                break
+            }
+            s.cond.Wait()
+        }
+        n := len(p) - written
+        if n > st.sendWindow {
+            n = st.sendWindow
+        }
+        if n > MaxChunk {
+            n = MaxChunk
+        }
+        st.sendWindow -= n
+        chunk := &pendingChunk{data: p[written:written+n], done: make(chan error, 1)}
+        st.pending = chunk
+        s.ready = append(s.ready, st)
+        s.cond.Broadcast()
+        s.mu.Unlock()
+
+        //p can't be handed back before the chunk is written
+        err := <- chunk.done
+        if err != nil {
+            return written, err
+        }
+        written += n
+    }
+    return written, nil
+}
+
+//close the stream. The peer reads the rest of what was sent and then io.EOF
+func (st *Stream) Close() error {
+    s := st.session
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if st.localClosed {
+        return nil
+    }
+    st.localClosed = true
+    if s.err == nil {
+        s.queueControl(st.id, kindClose, nil)
+    }
+    s.forget(st)
+    return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+    return st.session.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+    return st.session.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+    st.SetReadDeadline(t)
+    return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+    st.session.mu.Lock()
+    st.readDeadline = t
+    st.session.mu.Unlock()
+    st.session.wakeAt(t)
+    return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+    st.session.mu.Lock()
+    st.writeDeadline = t
+    st.session.mu.Unlock()
+    st.session.wakeAt(t)
+    return nil
+}
+
+//wake the waiting streams at t, so they notice their deadline passed
+func (s *Session) wakeAt(t time.Time) {
+    if t.IsZero() {
+        return
+    }
+    s.mu.Lock()
+    s.cond.Broadcast()
+    s.mu.Unlock()
+    time.AfterFunc(time.Until(t), func() {
+        s.mu.Lock()
+        s.cond.Broadcast()
+        s.mu.Unlock()
+    })
+}
@@ -0,0 +1,210 @@
+package mux
+
+import (
+    "errors"
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "testing"
+    "time"
+)
+
+//two sessions over an in-memory connection
+func sessionPair(t *testing.T) (*Session, *Session) {
+    a, b := net.Pipe()
+    sa, sb := NewSession(a), NewSession(b)
+    t.Cleanup(func() {
+        sa.Close()
+        sb.Close()
+    })
+    return sa, sb
+}
+
+//a session and the raw connection on the other end of it, for sending it frames by hand
+func rawPair(t *testing.T) (*Session, net.Conn) {
+    a, b := net.Pipe()
+    s := NewSession(a)
+    t.Cleanup(func() {
+        s.Close()
+        b.Close()
+    })
+    //take whatever the session sends, so it never blocks on the pipe
+    go io.Copy(ioutil.Discard, b)
+    return s, b
+}
+
+//the error the session stopped with, once it has
+func waitStopped(t *testing.T, s *Session) error {
+    t.Helper()
+    s.Stream(0).SetReadDeadline(time.Now().Add(5 * time.Second))
+    _, err := s.Stream(0).Read(make([]byte, 1))
+    return err
+}
+
+func numStreams(s *Session) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.streams)
+}
+
+func TestStreamsPastTheLimitAreRefused(t *testing.T) {
+    s, raw := rawPair(t)
+    for id := uint32(1); id <= MaxStreams; id++ {
+        _, err := raw.Write(append(frameHeader(id, kindData, 1), 'x'))
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    //the peer is at the limit, and those streams work
+    last := s.Stream(MaxStreams)
+    last.SetReadDeadline(time.Now().Add(5 * time.Second))
+    _, err := io.ReadFull(last, make([]byte, 1))
+    if err != nil {
+        t.Fatal(err)
+    }
+    raw.Write(append(frameHeader(MaxStreams+1, kindData, 1), 'x'))
+    err = waitStopped(t, s)
+    if !errors.Is(err, ErrProtocol) {
+        t.Fatalf("got %v, want a protocol violation", err)
+    }
+}
+
+func TestClosedStreamsAreForgotten(t *testing.T) {
+    sa, sb := sessionPair(t)
+    //many more streams than the limit, one after the other
+    for id := uint32(1); id <= 2*MaxStreams; id++ {
+        w := sa.Stream(id)
+        go func() {
+            w.Write([]byte("hello"))
+            w.Close()
+        }()
+        r := sb.Stream(id)
+        r.SetReadDeadline(time.Now().Add(5 * time.Second))
+        data, err := ioutil.ReadAll(r)
+        if err != nil || string(data) != "hello" {
+            t.Fatalf("stream %d: got %q, %v", id, data, err)
+        }
+        r.Close()
+    }
+    if n := numStreams(sb); n != 0 {
+        t.Errorf("the reading end still has %d streams", n)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for numStreams(sa) != 0 {
+        if time.Now().After(deadline) {
+            t.Fatalf("the writing end still has %d streams", numStreams(sa))
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestUnreadStreamDoesntBlockOthers(t *testing.T) {
+    sa, sb := sessionPair(t)
+    //fill stream 1's window, which nobody reads
+    go sa.Stream(1).Write(make([]byte, Window+MaxChunk))
+
+    go sa.Stream(2).Write([]byte("hello"))
+    r := sb.Stream(2)
+    r.SetReadDeadline(time.Now().Add(5 * time.Second))
+    got := make([]byte, 5)
+    _, err := io.ReadFull(r, got)
+    if err != nil || string(got) != "hello" {
+        t.Fatalf("got %q, %v", got, err)
+    }
+}
+
+func TestWindow(t *testing.T) {
+    sa, sb := sessionPair(t)
+    w, r := sa.Stream(1), sb.Stream(1)
+    written := make(chan int, 1)
+    go func() {
+        n, _ := w.Write(make([]byte, 2*Window))
+        written <- n
+    }()
+
+    //the writer stops once the window is full
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        sb.mu.Lock()
+        buffered := len(r.buf)
+        sb.mu.Unlock()
+        if buffered == Window {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("%d bytes arrived, want a full window of %d", buffered, Window)
+        }
+        time.Sleep(time.Millisecond)
+    }
+    select {
+    case n := <- written:
+        t.Fatalf("the writer got %d bytes out past the window", n)
+    case <- time.After(50 * time.Millisecond):
+    }
+
+    //and goes on as the reader frees the window up
+    r.SetReadDeadline(time.Now().Add(5 * time.Second))
+    _, err := io.ReadFull(r, make([]byte, 2*Window))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n := <- written; n != 2*Window {
+        t.Errorf("wrote %d bytes, want %d", n, 2*Window)
+    }
+}
+
+func TestDataPastTheWindowIsRefused(t *testing.T) {
+    s, raw := rawPair(t)
+    chunk := append(frameHeader(1, kindData, MaxChunk), make([]byte, MaxChunk)...)
+    for sent := 0; sent <= Window; sent += MaxChunk {
+        _, err := raw.Write(chunk)
+        if err != nil {
+            break
+        }
+    }
+    err := waitStopped(t, s)
+    if !errors.Is(err, ErrProtocol) {
+        t.Fatalf("got %v, want a protocol violation", err)
+    }
+}
+
+func TestDeadlines(t *testing.T) {
+    sa, _ := sessionPair(t)
+    r := sa.Stream(1)
+    //a deadline set while the read waits wakes it up
+    time.AfterFunc(10*time.Millisecond, func() {
+        r.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+    })
+    _, err := r.Read(make([]byte, 1))
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Errorf("got %v, want the deadline exceeded", err)
+    }
+
+    //a write that can't get past a full window gives up too
+    w := sa.Stream(2)
+    w.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+    n, err := w.Write(make([]byte, Window+1))
+    if !errors.Is(err, os.ErrDeadlineExceeded) || n > Window {
+        t.Errorf("wrote %d bytes with %v, want at most %d and the deadline exceeded", n, err, Window)
+    }
+}
+
+func TestCloseEndsTheStream(t *testing.T) {
+    sa, sb := sessionPair(t)
+    w := sa.Stream(1)
+    go func() {
+        w.Write([]byte("last words"))
+        w.Close()
+    }()
+    r := sb.Stream(1)
+    r.SetReadDeadline(time.Now().Add(5 * time.Second))
+    data, err := ioutil.ReadAll(r)
+    if err != nil || string(data) != "last words" {
+        t.Fatalf("got %q, %v", data, err)
+    }
+    _, err = w.Write([]byte("more"))
+    if !errors.Is(err, ErrClosed) {
+        t.Errorf("got %v writing to a closed stream, want ErrClosed", err)
+    }
+}
@@ -1,6 +1,8 @@
 package mycrypto
 
 import (
+    "errors"
+    "fmt"
     "log"
     "crypto/rand"
     "crypto/aes"
@@ -13,6 +15,15 @@ import (
     "shufflemessage/modp"
 )
 
+var (
+    //inputs whose lengths don't fit together, e.g. shares of different lengths or a seed that isn't an AES key
+    ErrLength = errors.New("mycrypto: length mismatch")
+    //the system's source of randomness failed
+    ErrRandomness = errors.New("mycrypto: couldn't read randomness")
+    //a MAC or a check that shares sum to zero didn't come out right
+    ErrVerification = errors.New("mycrypto: verification failed")
+)
+
 
 //return a message
 func MakeMsg(numBlocks, msgType int) []byte {
@@ -29,16 +40,16 @@ func MakeMsg(numBlocks, msgType int) []byte {
 }
 
 //Generates a ciphertext under a random key and returns the ct with key prepended
-func MakeCT(numBlocks, msgType int) []byte {
+//the message is MakeMsg(numBlocks, msgType)
+func MakeCT(numBlocks, msgType int) ([]byte, error) {
+    return EncryptCT(MakeMsg(numBlocks, msgType))
+}
+
+//encrypt m under a fresh random key with a zero IV. returns the ct with the key prepended
+//DecryptCT undoes this
+func EncryptCT(m []byte) ([]byte, error) {
     
     blockSize := 16
-    dataLen := numBlocks * blockSize
-    
-    //make up a message to encrypt, set empty iv
-    m := make([]byte, dataLen)
-    for i := 0; i < dataLen; i++ {
-        m[i] = byte(97 + msgType) //ascii 'a' is 97
-    }
     zeroIV := make([]byte, blockSize)
     
     //generate a random encryption key
@@ -46,30 +57,31 @@ func MakeCT(numBlocks, msgType int) []byte {
     key := make([]byte, 16)
     _,err := rand.Read(key)
     if err != nil {
-        log.Println("couldn't generate key")
-        panic(err)
+        return nil, fmt.Errorf("%w: %v", ErrRandomness, err)
     }
     //log.Println(key)
     
     //use the key to encrypt the message
     c, err := aes.NewCipher(key)
     if err != nil {
-        log.Println("Couldn't inititate new cipher")
-        panic(err)
+        return nil, err
     }
     ctr := cipher.NewCTR(c, zeroIV)
-    ct := make([]byte, dataLen)
+    ct := make([]byte, len(m))
     ctr.XORKeyStream(ct, m)
     //ct now holds the encrypted message
     
     ct = append(key, ct...)
     
-    return ct
+    return ct, nil
 }
 
 //decrypt ct where first 16 bytes are the AES key. use zero IV
-func DecryptCT(ct []byte) []byte{
+func DecryptCT(ct []byte) ([]byte, error) {
     
+    if len(ct) < 16 {
+        return nil, fmt.Errorf("%w: %d byte ciphertext is shorter than its key", ErrLength, len(ct))
+    }
     plaintext := make([]byte, len(ct) - 16)
     zeroIV := make([]byte, 16)
     
@@ -77,17 +89,16 @@ func DecryptCT(ct []byte) []byte{
     
     c, err := aes.NewCipher(ct[:16])
     if err != nil {
-        log.Println("Couldn't initiate new cipher")
-        panic(err)
+        return nil, err
     }
     ctr := cipher.NewCTR(c, zeroIV)
     ctr.XORKeyStream(plaintext, ct[16:])
     
-    return plaintext
+    return plaintext, nil
 }
 
 //outputs a mac on the msg and a key share seed for each server
-func WeirdMac(numServers int, msg []byte, messagingMode bool) ([]byte, [][]byte) {
+func WeirdMac(numServers int, msg []byte, messagingMode bool) ([]byte, [][]byte, error) {
         
     //generate key shares
     keyShareSeeds := make([][]byte, numServers)
@@ -95,8 +106,7 @@ func WeirdMac(numServers int, msg []byte, messagingMode bool) ([]byte, [][]byte)
         keyShareSeeds[i] = make([]byte, 16)
         _,err := rand.Read(keyShareSeeds[i])
         if err != nil {
-            log.Println("wasn't able to generate a MAC key share seeds")
-            panic(err)
+            return nil, nil, fmt.Errorf("%w: %v", ErrRandomness, err)
         }
     }
     
@@ -111,7 +121,11 @@ func WeirdMac(numServers int, msg []byte, messagingMode bool) ([]byte, [][]byte)
         keyLen = 16
     } else {
         for i:= 0; i < numServers; i++ {
-            keyShares[i] = AesPRG(msgLen, keyShareSeeds[i])
+            var err error
+            keyShares[i], err = AesPRG(msgLen, keyShareSeeds[i])
+            if err != nil {
+                return nil, nil, err
+            }
         }
     }
     
@@ -127,24 +141,31 @@ func WeirdMac(numServers int, msg []byte, messagingMode bool) ([]byte, [][]byte)
         copy(keys[i*16:(i+1)*16], keyPiece.Bytes())
     }
     
-    return ComputeMac(msg, keys, messagingMode), keyShareSeeds
+    mac, err := ComputeMac(msg, keys, messagingMode)
+    if err != nil {
+        return nil, nil, err
+    }
+    return mac, keyShareSeeds, nil
 }
 
 //compute MAC in the clear
-func ComputeMac(msg []byte, keys []byte, messagingMode bool) []byte {
+func ComputeMac(msg []byte, keys []byte, messagingMode bool) ([]byte, error) {
     
     msgLen := len(msg)
     
     if messagingMode {
+        if msgLen < 16 {
+            return nil, fmt.Errorf("%w: %d byte message has no block to MAC", ErrLength, msgLen)
+        }
         msgLen = 16
     }
     
     msgBlocks := msgLen / 16
     if msgLen % 16 != 0 {
-        panic("msgLen isn't a multiple of block size. Something has gone wrong :(")
+        return nil, fmt.Errorf("%w: %d byte message isn't a whole number of blocks", ErrLength, msgLen)
     }
     if msgLen != len(keys)  {
-        panic("incorrect key vector length. Something has gone wrong :(")
+        return nil, fmt.Errorf("%w: %d bytes of keys for %d bytes of message", ErrLength, len(keys), msgLen)
     }
     
     var mac, key, msgPiece, product modp.Element
@@ -156,24 +177,35 @@ func ComputeMac(msg []byte, keys []byte, messagingMode bool) []byte {
         mac.Add(&mac, &product)
     }
     
-    return mac.Bytes()
+    return mac.Bytes(), nil
 }
 
 //check mac in the clear
-func CheckMac(msg, tag []byte, keys []byte, messagingMode bool) bool {
+//ErrVerification if the tag is wrong
+func CheckMac(msg, tag []byte, keys []byte, messagingMode bool) error {
  
-    return bytes.Equal(ComputeMac(msg, keys, messagingMode), tag)
+    mac, err := ComputeMac(msg, keys, messagingMode)
+    if err != nil {
+        return err
+    }
+    if !bytes.Equal(mac, tag) {
+        return ErrVerification
+    }
+    return nil
 }
 
 //expand a seed using aes in CTR mode
-func AesPRG(msgLen int, seed []byte) []byte {
+//the seed has to be an AES key, i.e. 16, 24 or 32 bytes
+func AesPRG(msgLen int, seed []byte) ([]byte, error) {
     
-    ct := make([]byte, msgLen)
+    if msgLen < 0 {
+        return nil, fmt.Errorf("%w: can't expand to %d bytes", ErrLength, msgLen)
+    }
     c, err := aes.NewCipher(seed)
     if err != nil {
-        log.Println("Couldn't inititate new cipher")
-        panic(err)
+        return nil, fmt.Errorf("%w: %d byte seed", ErrLength, len(seed))
     }
+    ct := make([]byte, msgLen)
     
     //our biggest DBs will fortunately have lengths that still fit in ints
     numThreads, chunkSize := PickNumThreads(msgLen)
@@ -200,7 +232,7 @@ func AesPRG(msgLen int, seed []byte) []byte {
         <- blocker
     }
     
-    return ct
+    return ct, nil
 }
 
 //expand a key seed share to a vector of zeros with the seed in the correct place
@@ -211,14 +243,17 @@ func ExpandKeyShares(myServerNum, numServers int, keySeedShare []byte) []byte {
 }
 
 //splits a message into additive shares mod a prime
-func Share(numShares int, msg []byte) [][]byte {
+func Share(numShares int, msg []byte) ([][]byte, error) {
+    if numShares < 1 {
+        return nil, fmt.Errorf("%w: can't split into %d shares", ErrLength, numShares)
+    }
+    if len(msg) % 16 != 0 {
+        return nil, fmt.Errorf("%w: %d byte message being shared isn't a multiple of 16", ErrLength, len(msg))
+    }
     shares := make([][]byte, numShares)
     shares[0] = make([]byte, len(msg))
     
     numBlocks := len(msg)/16
-    if len(msg) % 16 != 0 {
-        panic("message being shared has length not a multiple of 16")
-    }
         
     var lastShare []*modp.Element
 
@@ -235,8 +270,7 @@ func Share(numShares int, msg []byte) [][]byte {
         shares[i] = make([]byte, len(msg))
         _,err := rand.Read(shares[i])
         if err != nil {
-            log.Println("couldn't generate randomness for sharing")
-            panic(err)
+            return nil, fmt.Errorf("%w: %v", ErrRandomness, err)
         }
         
         //change every 16-byte block into an Element
@@ -252,16 +286,24 @@ func Share(numShares int, msg []byte) [][]byte {
         copy(shares[0][16*i:16*(i+1)], lastShare[i].Bytes())
     }
     
-    return shares
+    return shares, nil
 }
 
 //combine additive shares to recover message
-func Merge(shares [][]byte) []byte{
+func Merge(shares [][]byte) ([]byte, error) {
 
     numShares := len(shares)
+    if numShares == 0 {
+        return nil, fmt.Errorf("%w: no shares to merge", ErrLength)
+    }
     numBlocks := len(shares[0])/16
     if len(shares[0]) % 16 != 0 {
-        panic("messages being merged have length not a multiple of 16")
+        return nil, fmt.Errorf("%w: %d byte shares being merged aren't a multiple of 16", ErrLength, len(shares[0]))
+    }
+    for i:=1; i < numShares; i++ {
+        if len(shares[i]) != len(shares[0]) {
+            return nil, fmt.Errorf("%w: share %d is %d bytes, share 0 is %d", ErrLength, i, len(shares[i]), len(shares[0]))
+        }
     }
     
     var elements []*modp.Element
@@ -277,10 +319,6 @@ func Merge(shares [][]byte) []byte{
     
     //add in the corresponding elements from subsequent shares
     for i:=1; i < numShares; i++ {
-        if len(shares[i]) != len(shares[0]) {
-            panic("messages being merged have different lengths")
-        }
-        
         for t := 0; t<numThreads; t++ {
             startIndex := t*chunkSize
             endIndex := (t+1)*chunkSize
@@ -305,7 +343,7 @@ func Merge(shares [][]byte) []byte{
         output = append(output, elements[j].Bytes()...)
     }
     
-    return output
+    return output, nil
 }
 
 func PickNumThreads(size int) (int,int) {
@@ -403,16 +441,19 @@ func DoubleAddOrSub(a, b, c []byte, add1, add2 bool) {
 }
 
 //generate a permutation of the numbers [0, n)
-func GenPerm(n int, seed []byte) []int {
+func GenPerm(n int, seed []byte) ([]int, error) {
     perm := make([]int, n)
-    randomness := AesPRG(4*n, seed)
+    randomness, err := AesPRG(4*n, seed)
+    if err != nil {
+        return nil, err
+    }
     
     for i:=1; i < n; i++ {
         j := byteToInt(randomness[4*i:4*(i+1)]) % (i+1)
         perm[i] = perm[j]
         perm[j] = i
     }
-    return perm
+    return perm, nil
 }
 
 func byteToInt(myBytes []byte) (x int) {
@@ -430,10 +471,14 @@ func intToByte(myInt int) (retBytes []byte){
 }
 
 //generate beaver triples
+//aSeeds and bSeeds are the seeds of each server's shares of the a and b parts
 //outputs are [][]byte slices for each server that contain [a]||[b]||[c] (in beaverDB)
-func GenBeavers(numBeavers, seedIndex int, seeds [][]byte) [][]byte {
+func GenBeavers(numBeavers int, aSeeds, bSeeds [][]byte) ([][]byte, error) {
     
-    numServers := len(seeds)
+    numServers := len(aSeeds)
+    if len(bSeeds) != numServers {
+        return nil, fmt.Errorf("%w: a seeds for %d servers, b seeds for %d", ErrLength, numServers, len(bSeeds))
+    }
     beaversC := make([]byte, numBeavers*16)
     beaversA := make([][]byte, numServers)
     beaversB := make([][]byte, numServers)
@@ -441,26 +486,42 @@ func GenBeavers(numBeavers, seedIndex int, seeds [][]byte) [][]byte {
     
     numThreads, chunkSize := PickNumThreads(numBeavers)
     blocker := make(chan int)
+    errs := make(chan error, 2*numServers)
     
     //expand a and b shares
     for i:=0; i < numServers; i++ {
         go func(index int) {
-            beaversA[index] = AesPRG(16*numBeavers, seeds[index][seedIndex:seedIndex+16])
-            blocker <- 1
+            var err error
+            beaversA[index], err = AesPRG(16*numBeavers, aSeeds[index])
+            errs <- err
         }(i)
         go func(index int) {
-            beaversB[index] = AesPRG(16*numBeavers, seeds[index][seedIndex+16:seedIndex+32])
-            blocker <- 1
+            var err error
+            beaversB[index], err = AesPRG(16*numBeavers, bSeeds[index])
+            errs <- err
         }(i)
     }
     
+    var err error
     for i:=0; i < 2*numServers; i++ {
-        <- blocker
+        e := <- errs
+        if e != nil {
+            err = e
+        }
+    }
+    if err != nil {
+        return nil, err
     }
     
     //merge a and b shares
-    beaversAMerged := Merge(beaversA)
-    beaversBMerged := Merge(beaversB)
+    beaversAMerged, err := Merge(beaversA)
+    if err != nil {
+        return nil, err
+    }
+    beaversBMerged, err := Merge(beaversB)
+    if err != nil {
+        return nil, err
+    }
     
     //compute c
     for j:=0;j<numThreads; j++ {
@@ -487,28 +548,53 @@ func GenBeavers(numBeavers, seedIndex int, seeds [][]byte) [][]byte {
     return Share(numServers, beaversC)
 }
 
-func TestGenBeavers() bool {
+func TestGenBeavers() (bool, error) {
     numBeavers := 3
     numServers := 2
     
-    seeds := make([][]byte, numServers)
+    aSeeds := make([][]byte, numServers)
+    bSeeds := make([][]byte, numServers)
     for i:=0; i < numServers; i++ {
-        seeds[i] = make([]byte, 96)
-        _,err := rand.Read(seeds[i])
+        aSeeds[i] = make([]byte, 16)
+        bSeeds[i] = make([]byte, 16)
+        _,err := rand.Read(aSeeds[i])
+        if err == nil {
+            _,err = rand.Read(bSeeds[i])
+        }
         if err != nil {
-            panic(err)
+            return false, fmt.Errorf("%w: %v", ErrRandomness, err)
         }
     }
     beaversAShares := make([][]byte, numServers)
     beaversBShares := make([][]byte, numServers)
     for i:=0; i < numServers; i++ {
-        beaversAShares[i] = AesPRG(48, seeds[i][48:64])
-        beaversBShares[i] = AesPRG(48, seeds[i][64:80])
+        var err error
+        beaversAShares[i], err = AesPRG(48, aSeeds[i])
+        if err != nil {
+            return false, err
+        }
+        beaversBShares[i], err = AesPRG(48, bSeeds[i])
+        if err != nil {
+            return false, err
+        }
     }
     
-    beaversA := Merge(beaversAShares)
-    beaversB := Merge(beaversBShares)
-    beaversC := Merge(GenBeavers(numBeavers, 48, seeds))
+    beaversA, err := Merge(beaversAShares)
+    if err != nil {
+        return false, err
+    }
+    beaversB, err := Merge(beaversBShares)
+    if err != nil {
+        return false, err
+    }
+    beaverShares, err := GenBeavers(numBeavers, aSeeds, bSeeds)
+    if err != nil {
+        return false, err
+    }
+    beaversC, err := Merge(beaverShares)
+    if err != nil {
+        return false, err
+    }
     
     var a, b, c, prod modp.Element
     for i:=0; i < numBeavers; i++ {
@@ -520,11 +606,11 @@ func TestGenBeavers() bool {
         prod.Sub(&prod,&c)
         if !prod.IsZero() {
             log.Println(i)
-            return false
+            return false, nil
         }
     }
     
-    return true
+    return true, nil
 }
 
 //generate permutations and share translations
@@ -535,7 +621,8 @@ func TestGenBeavers() bool {
 // masks a for each server after they permute
 // an output b for each server from the last permutation
 // a value s that preprocesses input shares for each server's permutation
-func GenShareTrans(batchSize, blocksPerRow int, seeds [][]byte) []byte {
+//all of them come from the servers' seeds, see DeriveSeeds
+func GenShareTrans(batchSize, blocksPerRow int, seeds []*Seeds) ([]byte, error) {
     
     numServers := len(seeds)
     perms := make([][]int, numServers)
@@ -546,37 +633,48 @@ func GenShareTrans(batchSize, blocksPerRow int, seeds [][]byte) []byte {
     //length of db
     dbSize := batchSize*blocksPerRow*16
     
-    blocker := make(chan int)
+    errs := make(chan error, 4*numServers)
     
     //expand all the seeds
     for serverNum := 0; serverNum < numServers; serverNum++ {
         go func(serverNum int) {
-            perms[serverNum] = GenPerm(batchSize, seeds[serverNum][80:96])
-            blocker <- 1
+            var err error
+            perms[serverNum], err = GenPerm(batchSize, seeds[serverNum].Perm)
+            errs <- err
         }(serverNum)
         go func(serverNum int) {
+            var err error
             if serverNum > 0 {
-                aInitial[serverNum] = AesPRG(dbSize, seeds[serverNum][0:16])
+                aInitial[serverNum], err = AesPRG(dbSize, seeds[serverNum].AInitial)
             }
-            blocker <- 1
+            errs <- err
         }(serverNum)
         go func(serverNum int) {
+            var err error
             if serverNum != numServers - 1 {
-                bFinal[serverNum] = AesPRG(dbSize, seeds[serverNum][16:32])
+                bFinal[serverNum], err = AesPRG(dbSize, seeds[serverNum].BFinal)
             }
-            blocker <- 1
+            errs <- err
         }(serverNum)
         go func(serverNum int) {
+            var err error
             if serverNum != numServers - 1 {
-                aAtPermTime[serverNum] = AesPRG(dbSize, seeds[serverNum][32:48])
+                aAtPermTime[serverNum], err = AesPRG(dbSize, seeds[serverNum].AAtPermTime)
             }
-            blocker <- 1
+            errs <- err
         }(serverNum)
     }
     
     //wait to finish expansion
+    var err error
     for i:=0; i < 4*numServers; i++ {
-        <- blocker
+        e := <- errs
+        if e != nil {
+            err = e
+        }
+    }
+    if err != nil {
+        return nil, err
     }
     
     aInitSum := make([]byte, dbSize)
@@ -607,7 +705,7 @@ func GenShareTrans(batchSize, blocksPerRow int, seeds [][]byte) []byte {
         }
     }
 
-    return delta
+    return delta, nil
 }
 
 
@@ -729,28 +827,40 @@ func HashOnlyBeginning(flatDB []byte, batchSize, msgBlocks, blocksPerRow int) []
 
 //check hashes of many flat DBs
 func CheckHashes(hashes, dbs []byte, dbLen, myNum int) bool {
+    return len(FindHashMismatches(hashes, dbs, dbLen, myNum)) == 0
+}
+
+//find the servers whose flat DB doesn't match the hash they committed to
+//returns server indices in increasing order, empty if everything matches
+func FindHashMismatches(hashes, dbs []byte, dbLen, myNum int) []int {
     
-    resChan := make(chan bool)
-    res := true
+    numServers := len(hashes)/32
+    matches := make([]bool, numServers)
+    blocker := make(chan int)
     
-    for i:=0; i < len(hashes)/32; i++ {
+    for i:=0; i < numServers; i++ {
         if i == myNum {
+            matches[i] = true
             continue
         }
         go func(index int) {
             hash := Hash(dbs[dbLen*index:dbLen*(index+1)])
-            if bytes.Equal(hashes[32*index:32*(index+1)], hash[:]) {
-                resChan <- true
-            } else {
-                resChan <- false
-            }
+            matches[index] = bytes.Equal(hashes[32*index:32*(index+1)], hash[:])
+            blocker <- 1
         }(i)
     }
     
-    for i:=1; i < len(hashes)/32; i++ {
-        res = res && <- resChan
+    for i:=1; i < numServers; i++ {
+        <- blocker
     }
-    return res
+    
+    mismatches := make([]int, 0)
+    for i:=0; i < numServers; i++ {
+        if !matches[i] {
+            mismatches = append(mismatches, i)
+        }
+    }
+    return mismatches
 }
 
 //check that shares sum to zero
@@ -788,20 +898,62 @@ func CheckSharesAreZero(batchSize, numServers int, shares []byte) bool {
     return res;
 }
 
-func TestCheckSharesAreZero() bool {
+//find the rows whose shares don't sum to zero
+//shares is laid out like for CheckSharesAreZero. returns row indices in increasing order
+func FindNonZeroShares(batchSize, numServers int, shares []byte) []int {
+    
+    numThreads, chunkSize := PickNumThreads(batchSize)
+    nonZero := make([][]int, numThreads)
+    blocker := make(chan int)
+    
+    for t:=0; t < numThreads; t++ {
+        startIndex := t*chunkSize
+        endIndex := (t+1)*chunkSize
+        go func(startI, endI, threadNum int) {
+            var hopefullyZero, anotherShare modp.Element
+            for i:=startI; i < endI; i++ {
+                hopefullyZero.SetBytes(shares[16*i:16*(i+1)])
+                for j:=1; j < numServers; j++ {
+                    index := j*16*batchSize + 16*i
+                    anotherShare.SetBytes(shares[index:index+16])
+                    hopefullyZero.Add(&anotherShare, &hopefullyZero)
+                }
+                if !hopefullyZero.IsZero() {
+                    nonZero[threadNum] = append(nonZero[threadNum], i)
+                }
+            }
+            blocker <- 1
+        }(startIndex, endIndex, t)
+    }
+    
+    for i:=0; i < numThreads; i++ {
+        <- blocker
+    }
+    
+    rows := make([]int, 0)
+    for t:=0; t < numThreads; t++ {
+        rows = append(rows, nonZero[t]...)
+    }
+    return rows
+}
+
+func TestCheckSharesAreZero() (bool, error) {
     batchSize := 5
     numServers := 2
     
     zeroVals := make([]byte, 16*batchSize)
     
-    shares := Share(numServers, zeroVals)
+    shares, err := Share(numServers, zeroVals)
+    if err != nil {
+        return false, err
+    }
 
     flatShares := make([]byte, 0)
     for i:=0; i < len(shares); i++ {
         flatShares = append(flatShares, shares[i]...)
     }
     
-    return CheckSharesAreZero(batchSize, numServers, flatShares)
+    return CheckSharesAreZero(batchSize, numServers, flatShares), nil
 }
 
 func BeaverProduct(msgBlocks, batchSize int, beaversC, mergedMaskedShares []byte,  db [][]byte, leader, messagingMode, aggregate, partTwo bool) []byte {
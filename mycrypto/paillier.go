@@ -0,0 +1,209 @@
+package mycrypto
+
+import (
+    "crypto/rand"
+    "errors"
+    "fmt"
+    "math/big"
+)
+
+//Paillier encryption, which is additively homomorphic: multiplying two ciphertexts adds their plaintexts,
+//and raising a ciphertext to k multiplies its plaintext by k. The shuffle servers use it to make their
+//preprocessing among themselves when there's no aux
+//g is N+1, so the encryption of m with randomness r is (1+mN)*r^N mod N^2
+
+var one = big.NewInt(1)
+
+type PaillierPublicKey struct {
+    N *big.Int
+    nSquared *big.Int
+    //bytes of N
+    size int
+}
+
+//a secret key also encrypts, faster than the public key does since it knows the factors of N
+type PaillierSecretKey struct {
+    PaillierPublicKey
+    p, q *big.Int
+    pSquared, qSquared *big.Int
+    //N mod phi(p^2) and phi(q^2), the exponents of r^N mod p^2 and mod q^2
+    nModPhiP, nModPhiQ *big.Int
+    //for decryption mod p and q, see Decrypt
+    hp, hq *big.Int
+    //p^2 inverted mod q^2, and p inverted mod q, for the CRT
+    pSquaredInv, pInv *big.Int
+}
+
+//a new key whose N has bits bits, bits has to be even
+func GeneratePaillierKey(bits int) (*PaillierSecretKey, error) {
+    if bits < 64 || bits % 2 != 0 {
+        return nil, fmt.Errorf("mycrypto: can't make a %d bit Paillier key", bits)
+    }
+    for {
+        p, err := rand.Prime(rand.Reader, bits/2)
+        if err != nil {
+            return nil, fmt.Errorf("%w: %v", ErrRandomness, err)
+        }
+        q, err := rand.Prime(rand.Reader, bits/2)
+        if err != nil {
+            return nil, fmt.Errorf("%w: %v", ErrRandomness, err)
+        }
+        //rand.Prime sets the top two bits, so N has all its bits
+        if p.Cmp(q) == 0 {
+            continue
+        }
+        return newPaillierSecretKey(p, q), nil
+    }
+}
+
+func newPaillierSecretKey(p, q *big.Int) *PaillierSecretKey {
+    n := new(big.Int).Mul(p, q)
+    sk := &PaillierSecretKey{
+        PaillierPublicKey: *newPaillierPublicKey(n),
+        p: p,
+        q: q,
+        pSquared: new(big.Int).Mul(p, p),
+        qSquared: new(big.Int).Mul(q, q),
+    }
+    pMinusOne := new(big.Int).Sub(p, one)
+    qMinusOne := new(big.Int).Sub(q, one)
+    sk.nModPhiP = new(big.Int).Mod(n, new(big.Int).Mul(p, pMinusOne))
+    sk.nModPhiQ = new(big.Int).Mod(n, new(big.Int).Mul(q, qMinusOne))
+    sk.hp = paillierH(n, p, sk.pSquared, pMinusOne)
+    sk.hq = paillierH(n, q, sk.qSquared, qMinusOne)
+    sk.pSquaredInv = new(big.Int).ModInverse(sk.pSquared, sk.qSquared)
+    sk.pInv = new(big.Int).ModInverse(p, q)
+    return sk
+}
+
+func newPaillierPublicKey(n *big.Int) *PaillierPublicKey {
+    return &PaillierPublicKey{N: n, nSquared: new(big.Int).Mul(n, n), size: (n.BitLen()+7)/8}
+}
+
+//L_p(g^(p-1) mod p^2)^-1 mod p, where L_p(x) = (x-1)/p
+func paillierH(n, p, pSquared, pMinusOne *big.Int) *big.Int {
+    g := new(big.Int).Add(n, one)
+    h := paillierL(g.Exp(g, pMinusOne, pSquared), p)
+    return h.ModInverse(h, p)
+}
+
+func paillierL(x, p *big.Int) *big.Int {
+    x.Sub(x, one)
+    return x.Div(x, p)
+}
+
+//N, big endian in Size bytes
+func (pk *PaillierPublicKey) Bytes() []byte {
+    return pk.N.FillBytes(make([]byte, pk.size))
+}
+
+//bytes of N
+func (pk *PaillierPublicKey) Size() int {
+    return pk.size
+}
+
+//read a public key written by Bytes
+func ParsePaillierPublicKey(data []byte) (*PaillierPublicKey, error) {
+    n := new(big.Int).SetBytes(data)
+    if len(data) < 8 || n.BitLen() != 8*len(data) || n.Bit(0) == 0 {
+        return nil, errors.New("mycrypto: not a Paillier public key")
+    }
+    return newPaillierPublicKey(n), nil
+}
+
+//bytes of a ciphertext, see EncodeCiphertext
+func (pk *PaillierPublicKey) CiphertextLength() int {
+    return 2*pk.size
+}
+
+//write c to out, which is CiphertextLength bytes
+func (pk *PaillierPublicKey) EncodeCiphertext(out []byte, c *big.Int) {
+    c.FillBytes(out)
+}
+
+//read a ciphertext written by EncodeCiphertext
+func (pk *PaillierPublicKey) DecodeCiphertext(data []byte) (*big.Int, error) {
+    if len(data) != pk.CiphertextLength() {
+        return nil, fmt.Errorf("%w: %d byte Paillier ciphertext, want %d", ErrLength, len(data), pk.CiphertextLength())
+    }
+    c := new(big.Int).SetBytes(data)
+    if c.Sign() == 0 || c.Cmp(pk.nSquared) >= 0 {
+        return nil, errors.New("mycrypto: not a Paillier ciphertext")
+    }
+    return c, nil
+}
+
+//a random r in [1, N)
+func (pk *PaillierPublicKey) randomness() (*big.Int, error) {
+    for {
+        r, err := rand.Int(rand.Reader, pk.N)
+        if err != nil {
+            return nil, fmt.Errorf("%w: %v", ErrRandomness, err)
+        }
+        if r.Sign() != 0 {
+            return r, nil
+        }
+    }
+}
+
+//(1+mN)*rN mod N^2
+func (pk *PaillierPublicKey) withMask(m, rN *big.Int) *big.Int {
+    c := new(big.Int).Mod(m, pk.N)
+    c.Mul(c, pk.N)
+    c.Add(c, one)
+    c.Mul(c, rN)
+    return c.Mod(c, pk.nSquared)
+}
+
+//encrypt m, which is taken mod N
+func (pk *PaillierPublicKey) Encrypt(m *big.Int) (*big.Int, error) {
+    r, err := pk.randomness()
+    if err != nil {
+        return nil, err
+    }
+    return pk.withMask(m, r.Exp(r, pk.N, pk.nSquared)), nil
+}
+
+//the encryption of the sum of the plaintexts of a and b
+func (pk *PaillierPublicKey) Add(a, b *big.Int) *big.Int {
+    c := new(big.Int).Mul(a, b)
+    return c.Mod(c, pk.nSquared)
+}
+
+//the encryption of k times the plaintext of c
+func (pk *PaillierPublicKey) MulPlaintext(c, k *big.Int) *big.Int {
+    return new(big.Int).Exp(c, k, pk.nSquared)
+}
+
+//encrypt m like the public key does, with r^N computed mod p^2 and q^2
+func (sk *PaillierSecretKey) Encrypt(m *big.Int) (*big.Int, error) {
+    r, err := sk.randomness()
+    if err != nil {
+        return nil, err
+    }
+    rp := new(big.Int).Exp(r, sk.nModPhiP, sk.pSquared)
+    rq := new(big.Int).Exp(r, sk.nModPhiQ, sk.qSquared)
+    return sk.withMask(m, crt(rp, rq, sk.pSquared, sk.qSquared, sk.pSquaredInv)), nil
+}
+
+//the plaintext of c, in [0, N)
+func (sk *PaillierSecretKey) Decrypt(c *big.Int) *big.Int {
+    mp := new(big.Int).Exp(c, new(big.Int).Sub(sk.p, one), sk.pSquared)
+    mp = paillierL(mp, sk.p)
+    mp.Mul(mp, sk.hp)
+    mp.Mod(mp, sk.p)
+    mq := new(big.Int).Exp(c, new(big.Int).Sub(sk.q, one), sk.qSquared)
+    mq = paillierL(mq, sk.q)
+    mq.Mul(mq, sk.hq)
+    mq.Mod(mq, sk.q)
+    return crt(mp, mq, sk.p, sk.q, sk.pInv)
+}
+
+//the x mod mp*mq that is xp mod mp and xq mod mq, where mpInv is mp inverted mod mq
+func crt(xp, xq, mp, mq, mpInv *big.Int) *big.Int {
+    x := new(big.Int).Sub(xq, xp)
+    x.Mul(x, mpInv)
+    x.Mod(x, mq)
+    x.Mul(x, mp)
+    return x.Add(x, xp)
+}
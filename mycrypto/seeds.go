@@ -0,0 +1,104 @@
+package mycrypto
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+)
+
+//the seeds of one server's part of a round's preprocessing
+//the server and the aux both derive them from the key they share, so they're never sent anywhere.
+//each one is 16 bytes, an AES key for AesPRG (or for GenPerm in the case of Perm)
+type Seeds struct {
+    //masks of the db share a server sends the leader at the start of the shuffle. the leader has none
+    AInitial []byte
+    //the server's final db share. the last server has none
+    BFinal []byte
+    //masks of the db after the server's permutation. the last server has none
+    AAtPermTime []byte
+    //the server's permutation
+    Perm []byte
+    //shares of the a and b parts of the beaver triples of the first blind mac verification
+    BeaversA []byte
+    BeaversB []byte
+    //and of the second one
+    BeaversATwo []byte
+    BeaversBTwo []byte
+    //shares of the a and b parts of the extra triples a checking aux sends, which the servers sacrifice
+    //to check the others. only used if the aux is checked
+    SacrificeA []byte
+    SacrificeB []byte
+    //masks of a second share translation a checking aux makes, with the same permutation. only used if
+    //the aux is checked
+    CheckAInitial []byte
+    CheckBFinal []byte
+    CheckAAtPermTime []byte
+}
+
+//domain separation labels of the seeds
+const (
+    labelAInitial = "aInitial"
+    labelBFinal = "bFinal"
+    labelAAtPermTime = "aAtPermTime"
+    labelPerm = "permutation"
+    labelBeaversA = "beavers a"
+    labelBeaversB = "beavers b"
+    labelBeaversATwo = "second beavers a"
+    labelBeaversBTwo = "second beavers b"
+    labelSacrificeA = "sacrificed beavers a"
+    labelSacrificeB = "sacrificed beavers b"
+    labelCheckAInitial = "check aInitial"
+    labelCheckBFinal = "check bFinal"
+    labelCheckAAtPermTime = "check aAtPermTime"
+)
+
+//derive a server's seeds for a round from the key it shares with the aux
+//session has to be new every time the servers and the aux start, so the seeds don't repeat if the round IDs do
+func DeriveSeeds(key *[32]byte, session []byte, round uint64) *Seeds {
+    var roundBytes [8]byte
+    binary.LittleEndian.PutUint64(roundBytes[:], round)
+    derive := func(label string) []byte {
+        mac := hmac.New(sha256.New, key[:])
+        mac.Write([]byte("clarion seed v1\n"))
+        mac.Write([]byte(label + "\n"))
+        mac.Write(roundBytes[:])
+        mac.Write(session)
+        return mac.Sum(nil)[:16]
+    }
+    return &Seeds{
+        AInitial: derive(labelAInitial),
+        BFinal: derive(labelBFinal),
+        AAtPermTime: derive(labelAAtPermTime),
+        Perm: derive(labelPerm),
+        BeaversA: derive(labelBeaversA),
+        BeaversB: derive(labelBeaversB),
+        BeaversATwo: derive(labelBeaversATwo),
+        BeaversBTwo: derive(labelBeaversBTwo),
+        SacrificeA: derive(labelSacrificeA),
+        SacrificeB: derive(labelSacrificeB),
+        CheckAInitial: derive(labelCheckAInitial),
+        CheckBFinal: derive(labelCheckBFinal),
+        CheckAAtPermTime: derive(labelCheckAAtPermTime),
+    }
+}
+
+//the seeds of the second share translation, for GenShareTrans: the check masks in place of the masks,
+//and the same permutation
+func (s *Seeds) CheckTranslation() *Seeds {
+    return &Seeds{
+        AInitial: s.CheckAInitial,
+        BFinal: s.CheckBFinal,
+        AAtPermTime: s.CheckAAtPermTime,
+        Perm: s.Perm,
+    }
+}
+
+//the key an aux's files for a server are sealed with, derived from the key they share with a label of
+//its own, so that key isn't used both to derive seeds and to encrypt
+func DeriveFileKey(key *[32]byte) *[32]byte {
+    mac := hmac.New(sha256.New, key[:])
+    mac.Write([]byte("clarion aux file key v1\n"))
+    fileKey := new([32]byte)
+    copy(fileKey[:], mac.Sum(nil))
+    return fileKey
+}
@@ -0,0 +1,295 @@
+package protocol
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "time"
+
+    "shufflemessage/config"
+    "shufflemessage/mycrypto"
+    "shufflemessage/wire"
+)
+
+//how the aux is connected to the shuffle servers
+type AuxConfig struct {
+    //the connections to every server in order
+    Servers []*wire.Conn
+    //the keys the aux shares with every server, in order, and the session from StartSession
+    //the seeds of the preprocessing are derived from them, see mycrypto.DeriveSeeds
+    Keys []*[32]byte
+    Session []byte
+    //also send extra beaver triples for the servers to sacrifice, so they can check the rest of the
+    //preprocessing, see ServerConfig.CheckAux
+    Check bool
+    //the timeout of each step of a round, see config.Config.Timeout. nil means config.DefaultTimeout for all of them
+    Timeout func(step string) time.Duration
+}
+
+//what the aux did in a round
+type AuxOutput struct {
+    Round uint64
+    //how long the first set of beaver triples took to make
+    Beavers time.Duration
+    //how long it took from the servers' requests to sending the last of the preprocessing
+    Total time.Duration
+}
+
+//the aux, which makes the beaver triples and the share translation for each round
+//the shuffle servers derive the seeds of their own shares just like the aux does, so it only sends
+//them what they can't compute themselves
+type AuxServer struct {
+    conns []*wire.Conn
+    keys []*[32]byte
+    session []byte
+    check bool
+    timeout func(step string) time.Duration
+
+    params Params
+    //the last round, the servers have to go on with a later one
+    round uint64
+
+    //how the aux cheats, see faults.go. only tests set it
+    fault fault
+}
+
+func NewAuxServer(conf AuxConfig) (*AuxServer, error) {
+    if len(conf.Servers) < 2 {
+        return nil, fmt.Errorf("protocol: need at least 2 servers, got %d", len(conf.Servers))
+    }
+    if len(conf.Keys) != len(conf.Servers) {
+        return nil, fmt.Errorf("protocol: keys for %d servers, connections to %d", len(conf.Keys), len(conf.Servers))
+    }
+    for i, conn := range conf.Servers {
+        if conn == nil || conf.Keys[i] == nil {
+            return nil, fmt.Errorf("protocol: missing the connection to server %d or its key", i)
+        }
+    }
+    if len(conf.Session) != SessionLength {
+        return nil, fmt.Errorf("protocol: session is %d bytes, not %d", len(conf.Session), SessionLength)
+    }
+    timeout := conf.Timeout
+    if timeout == nil {
+        timeout = func(string) time.Duration { return config.DefaultTimeout }
+    }
+    return &AuxServer{conns: conf.Servers, keys: conf.Keys, session: conf.Session, check: conf.Check, timeout: timeout}, nil
+}
+
+//use params for the following rounds
+func (a *AuxServer) SetParams(params Params) {
+    a.params = params
+}
+
+//wait for the servers to start a round and send them its preprocessing
+//a round starts when the servers ask for its preprocessing. The first request can take as long as
+//the servers need to fill a batch, the others have to follow within the preprocessing timeout.
+//an error leaves the connections in an unknown state, like for ShuffleServer.RunRound
+func (a *AuxServer) RunRound(ctx context.Context) (AuxOutput, error) {
+    numServers := len(a.conns)
+    conns := a.conns
+    batchSize := a.params.BatchSize
+    blocksPerRow := a.params.blocksPerRow()
+    numBeavers := a.params.numBeavers()
+
+    //fresh channels with room for every signal, so goroutines of an aborted round can't block
+    blocker := make(chan int, numServers)
+    deltaBlocker := make(chan int, 1)
+    beaverBlocker := make(chan int, 1)
+
+    rounds := make([]uint64, numServers)
+    err := receiveRequests(ctx, conns, rounds, a.timeout(config.StepPreprocessing))
+    if err != nil {
+        return AuxOutput{}, err
+    }
+
+    //everyone has to be working on the same round
+    for i:=0; i < numServers; i++ {
+        if rounds[i] != rounds[0] {
+            return AuxOutput{}, fmt.Errorf("%w: server 0 asked for round %d but server %d asked for round %d", ErrRoundMismatch, rounds[0], i, rounds[i])
+        }
+    }
+    if rounds[0] <= a.round {
+        return AuxOutput{}, fmt.Errorf("%w: servers asked for round %d after round %d", ErrRoundMismatch, rounds[0], a.round)
+    }
+    round := rounds[0]
+    a.round = round
+
+    startTime := time.Now()
+    rc := newRoundContext(ctx, a.timeout)
+    sendCtx := rc.step(config.StepPreprocessing)
+    abort := func(err error) (AuxOutput, error) {
+        err = rc.reason(err)
+        rc.end()
+        return AuxOutput{}, &AbortError{Round: round, Err: err}
+    }
+
+    //generate the preprocessed information for all the parties
+    //from the seeds the servers derive too
+    seeds := make([]*mycrypto.Seeds, numServers)
+    beaversASeeds := make([][]byte, numServers)
+    beaversBSeeds := make([][]byte, numServers)
+    beaversATwoSeeds := make([][]byte, numServers)
+    beaversBTwoSeeds := make([][]byte, numServers)
+    sacrificeASeeds := make([][]byte, numServers)
+    sacrificeBSeeds := make([][]byte, numServers)
+    for i:=0; i < numServers; i++ {
+        seeds[i] = mycrypto.DeriveSeeds(a.keys[i], a.session, round)
+        beaversASeeds[i], beaversBSeeds[i] = seeds[i].BeaversA, seeds[i].BeaversB
+        beaversATwoSeeds[i], beaversBTwoSeeds[i] = seeds[i].BeaversATwo, seeds[i].BeaversBTwo
+        sacrificeASeeds[i], sacrificeBSeeds[i] = seeds[i].SacrificeA, seeds[i].SacrificeB
+    }
+
+    beavers, err := mycrypto.GenBeavers(numBeavers, beaversASeeds, beaversBSeeds)
+    if err != nil {
+        return abort(err)
+    }
+    beavers[0] = a.tamper(faultAuxBeavers, beavers[0])
+
+    //send servers their beaver stuff
+    for i:=0; i < numServers; i++ {
+        go func(myBeavers []byte, serverNum int) {
+            err := conns[serverNum].Send(sendCtx, wire.PhaseBeavers, round, myBeavers)
+            if err != nil {
+                rc.fail(err)
+            }
+            if serverNum == numServers - 1 {
+                deltaBlocker <- 1
+            }
+            blocker <- 1
+        }(beavers[i], i)
+    }
+
+    beaverElapsedTime := time.Since(startTime)
+
+    //get the last delta
+    delta, err := mycrypto.GenShareTrans(batchSize, blocksPerRow, seeds)
+    if err != nil {
+        return abort(err)
+    }
+
+    //send the last server delta
+    go func(){
+        //consume the delta blocker
+        if rc.wait(deltaBlocker, 1) == nil {
+            err := conns[numServers - 1].Send(sendCtx, wire.PhaseDelta, round, a.tamperRows(a.tamper(faultAuxDelta, delta)))
+            if err != nil {
+                rc.fail(err)
+            }
+        }
+        beaverBlocker <- 1
+    }()
+
+    //second round of beaver triples
+    beaversTwo, err := mycrypto.GenBeavers(batchSize, beaversATwoSeeds, beaversBTwoSeeds)
+    if err != nil {
+        return abort(err)
+    }
+    beaversTwo[0] = a.tamper(faultAuxBeaversTwo, beaversTwo[0])
+
+    //one extra triple for each of the others, and a second share translation, if the servers check them
+    var sacrificed [][]byte
+    var checkDelta []byte
+    if a.check {
+        sacrificed, err = mycrypto.GenBeavers(numBeavers + batchSize, sacrificeASeeds, sacrificeBSeeds)
+        if err != nil {
+            return abort(err)
+        }
+        checkDelta, err = mycrypto.GenShareTrans(batchSize, blocksPerRow, checkTranslationSeeds(seeds))
+        if err != nil {
+            return abort(err)
+        }
+    }
+
+    //make sure the previous messages are all sent
+    err = rc.wait(blocker, numServers)
+    if err == nil {
+        err = rc.wait(beaverBlocker, 1)
+    }
+    if err != nil {
+        return abort(err)
+    }
+
+    //send beaver stuff
+    for i:=0; i < numServers; i++ {
+        go func(myBeavers []byte, serverNum int) {
+            err := conns[serverNum].Send(sendCtx, wire.PhaseBeaversTwo, round, myBeavers)
+            if err != nil {
+                rc.fail(err)
+            }
+            blocker <- 1
+        }(beaversTwo[i], i)
+    }
+    err = rc.wait(blocker, numServers)
+    if err != nil {
+        return abort(err)
+    }
+
+    if a.check {
+        err = RunAll(sendCtx, numServers, func(ctx context.Context, i int) error {
+            err := conns[i].Send(ctx, wire.PhaseSacrificedBeavers, round, sacrificed[i])
+            if err != nil || i != numServers - 1 {
+                return err
+            }
+            return conns[i].Send(ctx, wire.PhaseCheckDelta, round, checkDelta)
+        })
+        if err != nil {
+            return abort(err)
+        }
+    }
+    rc.end()
+
+    return AuxOutput{
+        Round: round,
+        Beavers: beaverElapsedTime,
+        Total: time.Since(startTime),
+    }, nil
+}
+
+//receive every server's request for the preprocessing of the next round, which is just its round number
+//waits as long as it takes for the first request, and timeout for the others after that
+func receiveRequests(ctx context.Context, conns []*wire.Conn, rounds []uint64, timeout time.Duration) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    type request struct {
+        index int
+        err error
+    }
+    requests := make(chan request, len(conns))
+    for i:=0; i < len(conns); i++ {
+        go func(index int) {
+            frame, err := conns[index].ReceiveAnyRound(ctx, wire.PhaseRequest, 0)
+            if err == nil {
+                rounds[index] = frame.Round
+            }
+            requests <- request{index, err}
+        }(i)
+    }
+
+    //nil until the first request is in, which blocks forever
+    var deadline <-chan time.Time
+    waiting := make(map[int]bool)
+    for i:=0; i < len(conns); i++ {
+        waiting[i] = true
+    }
+    for len(waiting) > 0 {
+        select {
+        case r := <- requests:
+            if r.err != nil {
+                return r.err
+            }
+            delete(waiting, r.index)
+            if deadline == nil {
+                deadline = time.After(timeout)
+            }
+        case <- deadline:
+            late := make([]int, 0, len(waiting))
+            for i := range waiting {
+                late = append(late, i)
+            }
+            sort.Ints(late)
+            return fmt.Errorf("servers %v didn't ask for preprocessing within %s of the first server: %w", late, timeout, context.DeadlineExceeded)
+        }
+    }
+    return nil
+}
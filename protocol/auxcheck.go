@@ -0,0 +1,295 @@
+package protocol
+
+import (
+    "context"
+    "crypto/rand"
+    "errors"
+    "fmt"
+
+    "shufflemessage/modp"
+    "shufflemessage/mycrypto"
+    "shufflemessage/wire"
+)
+
+//checking the aux (see ServerConfig.CheckAux): otherwise the servers use whatever beaver triples and share
+//translation the aux sends. Wrong triples throw off the blind mac verifications, and a wrong delta changes
+//the messages, which comes out at best as a failed verification nobody can be blamed for. When the aux is
+//checked, the servers check the preprocessing together once all of it is here, before the blind mac
+//verification, and abort the round with ErrAuxCheating if it's wrong.
+//
+//beaver triples: the aux sends an extra triple (x, y, z) for every triple (a, b, c) of both verifications,
+//x and y derived from seeds like a and b. The servers toss coins for a random r and weights t_k, open
+//rho = r*a - x and sigma = b - y, and check that
+//  sum_k t_k (r*c - z - sigma*x - rho*y - sigma*rho) = sum_k t_k (r(c - ab) - (z - xy))
+//is zero, which it's only about 1/p likely to be if any triple is wrong. The extra triples are used for
+//nothing else, so the openings say nothing about a and b.
+//
+//share translation: the aux also makes a second delta, checkDelta, for masks derived from check seeds and
+//the same permutations (see mycrypto.Seeds.CheckTranslation). Both translate linearly, so with a random r,
+//delta + r*checkDelta is the translation of masks + r*check masks. The servers shuffle zero with those,
+//like in the round: everyone but the leader sends it aInitial + r*its check mask, everyone permutes in turn
+//and adds aAtPermTime + r*its check mask, and the last server adds delta + r*checkDelta. Everyone's output
+//(bFinal + r*its check mask for the others) then adds up to zero at every position if both deltas are
+//right, and the servers check a sum of the outputs with a random weight for every position. A wrong
+//entry anywhere in delta makes the sum nonzero unless r happens to cancel it, which is about 1/p likely.
+//the check masks hide the real ones in everything that's sent, and are used for nothing else.
+//
+//what the servers open at the end has shares of zero added, so only the sums come out. A server that lies
+//in the check makes it fail just like a cheating aux does, so a failure only blames the aux if the servers
+//are honest
+
+//the aux's preprocessing is wrong: its beaver triples failed the sacrifice, or its share translation doesn't
+//match the seeds. Every server sees it at the same point of the round, so they can go on with the next one
+var ErrAuxCheating = errors.New("protocol: the aux's preprocessing is wrong")
+
+//a server's part of the preprocessing, as the check sees it
+type auxPreprocessing struct {
+    //both sets of beaver triples, the first one followed by the second
+    a, b, c []byte
+    //the c parts of the triples to sacrifice, one for each of the others
+    sacrificed []byte
+    //the share translation. the leader has no aInitial, the last server no aAtPermTime and bFinal, and only
+    //the last server has delta and checkDelta
+    pi []int
+    aInitial, aAtPermTime, bFinal, delta, checkDelta []byte
+}
+
+//check this server's part of the aux's preprocessing with the other servers
+//a *CommitmentError if a server's coin doesn't match its commitment, ErrAuxCheating if the check fails
+func (s *ShuffleServer) checkAuxPreprocessing(ctx context.Context, round uint64, seeds *mycrypto.Seeds, pre *auxPreprocessing) error {
+    numServers := len(s.peers)
+    leader := s.serverNum == 0
+    numTriples := len(pre.c)/16
+
+    //r for the triples, then their weights, then r for the share translation and the weights of its positions
+    coins, err := s.tossCoins(ctx, round, 16*(2 + numTriples) + s.params.dbSize())
+    if err != nil {
+        return err
+    }
+    r := element(coins, 0)
+    triplesWeights := coins[16:16*(1+numTriples)]
+    translationR := element(coins, 1+numTriples)
+    positionWeights := coins[16*(2+numTriples):]
+
+    x, err := mycrypto.AesPRG(16*numTriples, seeds.SacrificeA)
+    if err != nil {
+        return err
+    }
+    y, err := mycrypto.AesPRG(16*numTriples, seeds.SacrificeB)
+    if err != nil {
+        return err
+    }
+
+    //open rho and sigma of every triple
+    openings := make([]byte, 32*numTriples)
+    var rho, sigma modp.Element
+    for k:=0; k < numTriples; k++ {
+        rho.Mul(r, element(pre.a, k))
+        rho.Sub(&rho, element(x, k))
+        sigma.Sub(element(pre.b, k), element(y, k))
+        copy(openings[16*k:16*(k+1)], rho.Bytes())
+        copy(openings[16*(numTriples+k):16*(numTriples+k+1)], sigma.Bytes())
+    }
+    allOpenings, err := broadcastAndReceiveFromAll(ctx, wire.PhaseSacrificeOpenings, round, openings, s.peers, s.serverNum)
+    if err != nil {
+        return err
+    }
+    opened, err := mergeFlattenedDBs(allOpenings, numServers, len(openings))
+    if err != nil {
+        return err
+    }
+
+    //this server's share of the weighted sum of r*c - z - sigma*x - rho*y - sigma*rho
+    var sacrificeShare, term, product modp.Element
+    for k:=0; k < numTriples; k++ {
+        rho.SetBytes(opened[16*k:16*(k+1)])
+        sigma.SetBytes(opened[16*(numTriples+k):16*(numTriples+k+1)])
+        term.Mul(r, element(pre.c, k))
+        term.Sub(&term, element(pre.sacrificed, k))
+        product.Mul(&sigma, element(x, k))
+        term.Sub(&term, &product)
+        product.Mul(&rho, element(y, k))
+        term.Sub(&term, &product)
+        if leader {
+            product.Mul(&sigma, &rho)
+            term.Sub(&term, &product)
+        }
+        term.Mul(&term, element(triplesWeights, k))
+        sacrificeShare.Add(&sacrificeShare, &term)
+    }
+
+    //and of the weighted sum of shuffling zero with the share translations
+    out, err := s.shuffleZero(ctx, round, seeds, pre, translationR)
+    if err != nil {
+        return err
+    }
+    var deltaShare modp.Element
+    for k:=0; k < len(out)/16; k++ {
+        product.Mul(element(out, k), element(positionWeights, k))
+        deltaShare.Add(&deltaShare, &product)
+    }
+
+    masks, err := s.zeroShares(ctx, round, 2)
+    if err != nil {
+        return err
+    }
+    sacrificeShare.Add(&sacrificeShare, &masks[0])
+    deltaShare.Add(&deltaShare, &masks[1])
+    result := append(sacrificeShare.Bytes(), deltaShare.Bytes()...)
+    results, err := broadcastAndReceiveFromAll(ctx, wire.PhaseCheckResult, round, result, s.peers, s.serverNum)
+    if err != nil {
+        return err
+    }
+    sums, err := mergeFlattenedDBs(results, numServers, len(result))
+    if err != nil {
+        return err
+    }
+    if !element(sums, 0).IsZero() {
+        return fmt.Errorf("%w: beaver triples fail the sacrifice check", ErrAuxCheating)
+    }
+    if !element(sums, 1).IsZero() {
+        return fmt.Errorf("%w: share translation delta doesn't match the seeds", ErrAuxCheating)
+    }
+    return nil
+}
+
+//this server's output of shuffling zero with the share translations combined with r, see the top of the file
+func (s *ShuffleServer) shuffleZero(ctx context.Context, round uint64, seeds *mycrypto.Seeds, pre *auxPreprocessing, r *modp.Element) ([]byte, error) {
+    numServers := len(s.peers)
+    serverNum := s.serverNum
+    dbSize := s.params.dbSize()
+    check := seeds.CheckTranslation()
+    //mask + r*checkMask
+    combine := func(mask, checkMask []byte) []byte {
+        combined := make([]byte, len(mask))
+        var elt, product modp.Element
+        for k:=0; k < len(mask)/16; k++ {
+            product.Mul(r, element(checkMask, k))
+            elt.Add(element(mask, k), &product)
+            copy(combined[16*k:16*(k+1)], elt.Bytes())
+        }
+        return combined
+    }
+    //same, with the check mask expanded from seed
+    combineSeed := func(mask, seed []byte) ([]byte, error) {
+        checkMask, err := mycrypto.AesPRG(dbSize, seed)
+        if err != nil {
+            return nil, err
+        }
+        return combine(mask, checkMask), nil
+    }
+
+    current := make([]byte, dbSize)
+    if serverNum != 0 {
+        aInitial, err := combineSeed(pre.aInitial, check.AInitial)
+        if err != nil {
+            return nil, err
+        }
+        err = s.peers[0].Send(ctx, wire.PhaseCheckShuffleInput, round, aInitial)
+        if err != nil {
+            return nil, err
+        }
+        current, err = s.peers[serverNum-1].Receive(ctx, wire.PhaseCheckShuffle, round, dbSize)
+        if err != nil {
+            return nil, err
+        }
+    } else {
+        for i:=1; i < numServers; i++ {
+            masked, err := s.peers[i].Receive(ctx, wire.PhaseCheckShuffleInput, round, dbSize)
+            if err != nil {
+                return nil, err
+            }
+            mycrypto.AddOrSub(current, masked, true)
+        }
+    }
+    current = mycrypto.PermuteDB(current, pre.pi)
+    if serverNum == numServers - 1 {
+        mycrypto.AddOrSub(current, combine(pre.delta, pre.checkDelta), true)
+        return current, nil
+    }
+    aAtPermTime, err := combineSeed(pre.aAtPermTime, check.AAtPermTime)
+    if err != nil {
+        return nil, err
+    }
+    mycrypto.AddOrSub(current, aAtPermTime, true)
+    err = s.peers[serverNum+1].Send(ctx, wire.PhaseCheckShuffle, round, current)
+    if err != nil {
+        return nil, err
+    }
+    return combineSeed(pre.bFinal, check.BFinal)
+}
+
+//the seeds of every server's second share translation, see mycrypto.Seeds.CheckTranslation
+func checkTranslationSeeds(seeds []*mycrypto.Seeds) []*mycrypto.Seeds {
+    checkSeeds := make([]*mycrypto.Seeds, len(seeds))
+    for i := range seeds {
+        checkSeeds[i] = seeds[i].CheckTranslation()
+    }
+    return checkSeeds
+}
+
+//the kth element of data
+func element(data []byte, k int) *modp.Element {
+    return new(modp.Element).SetBytes(data[16*k:16*(k+1)])
+}
+
+//length bytes of coins tossed with the other servers: everyone commits to a random seed, then opens it, and
+//the coins are expanded from all of them, so nobody picks them as long as one server is honest
+func (s *ShuffleServer) tossCoins(ctx context.Context, round uint64, length int) ([]byte, error) {
+    seed := make([]byte, 16)
+    _, err := rand.Read(seed)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", mycrypto.ErrRandomness, err)
+    }
+    commitments, err := broadcastAndReceiveFromAll(ctx, wire.PhaseCheckCommitment, round, mycrypto.Hash(seed), s.peers, s.serverNum)
+    if err != nil {
+        return nil, err
+    }
+    allSeeds, err := broadcastAndReceiveFromAll(ctx, wire.PhaseCheckCoins, round, seed, s.peers, s.serverNum)
+    if err != nil {
+        return nil, err
+    }
+    evidence := gatherEvidence(round, "check coins", s.serverNum, commitments, allSeeds, len(seed), s.signKey)
+    ok, err := agreeToContinue(ctx, wire.PhaseCheckCoinStatus, round, len(evidence) == 0, s.peers, s.serverNum)
+    if err != nil {
+        return nil, err
+    }
+    if !ok {
+        return nil, &CommitmentError{Round: round, Phase: "check coins", Evidence: evidence}
+    }
+    return mycrypto.AesPRG(length, mycrypto.Hash(allSeeds)[:16])
+}
+
+//this server's shares of count zeros: it sends every other server random elements, and its share is what
+//it sent minus what it got
+func (s *ShuffleServer) zeroShares(ctx context.Context, round uint64, count int) ([]modp.Element, error) {
+    sent := make([][]byte, len(s.peers))
+    for i := range sent {
+        if i == s.serverNum {
+            continue
+        }
+        sent[i] = make([]byte, 16*count)
+        _, err := rand.Read(sent[i])
+        if err != nil {
+            return nil, fmt.Errorf("%w: %v", mycrypto.ErrRandomness, err)
+        }
+    }
+    received, err := exchangeWithEach(ctx, wire.PhaseCheckMasks, round, sent, s.peers, s.serverNum)
+    if err != nil {
+        return nil, err
+    }
+    shares := make([]modp.Element, count)
+    var elt modp.Element
+    for i := range sent {
+        if i == s.serverNum {
+            continue
+        }
+        for k := range shares {
+            elt.SetBytes(sent[i][16*k:16*(k+1)])
+            shares[k].Add(&shares[k], &elt)
+            elt.SetBytes(received[i][16*k:16*(k+1)])
+            shares[k].Sub(&shares[k], &elt)
+        }
+    }
+    return shares, nil
+}
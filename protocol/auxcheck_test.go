@@ -0,0 +1,92 @@
+package protocol
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+//servers that check the aux run the same rounds with its preprocessing, wherever it comes from, and all
+//of them blame the aux if it's wrong
+
+func TestCheckedAuxRounds(t *testing.T) {
+    for _, numServers := range []int{2, 3} {
+        for _, messagingMode := range []bool{false, true} {
+            params := Params{MsgBlocks: 2, BatchSize: 16, MessagingMode: messagingMode}
+            d := newDeployment(t, numServers, params, deploymentOpts{check: true})
+            for round := uint64(1); round <= 2; round++ {
+                runHonestRound(t, d, round)
+            }
+        }
+    }
+}
+
+func TestCheckedAuxBundles(t *testing.T) {
+    numServers := 3
+    params := Params{MsgBlocks: 1, BatchSize: 16}
+
+    //streamed into the stockpiles
+    d := newDeployment(t, numServers, params, deploymentOpts{stockpileDirs: stockpileDirs(t, numServers), check: true})
+    stop := d.fill(t, 2)
+    for round := uint64(1); round <= 3; round++ {
+        runHonestRound(t, d, round)
+    }
+    stop()
+
+    //from aux files
+    auxKeys := testAuxKeys(t, numServers)
+    dirs := stockpileDirs(t, numServers)
+    d = newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs, offline: true, check: true})
+    writeTestAuxFiles(t, auxKeys, dirs, 1, 2, params, true)
+    d.importAuxFiles(t, auxKeys, 2)
+    for round := uint64(1); round <= 2; round++ {
+        runHonestRound(t, d, round)
+    }
+
+    //files written for servers that don't check have nothing to sacrifice, so every server aborts
+    writeTestAuxFiles(t, auxKeys, dirs, 3, 3, params, false)
+    d.importAuxFiles(t, auxKeys, 1)
+    inputs, _ := d.batch(t, 3)
+    _, errs := d.run(t, inputs)
+    for i, err := range errs {
+        if !errors.Is(err, ErrStockpile) {
+            t.Errorf("server %d: got %v, want a bundle that doesn't fit", i, err)
+        }
+    }
+}
+
+func TestCheatingAuxIsCaught(t *testing.T) {
+    attacks := []struct {
+        name string
+        fault fault
+        //what the error says is wrong
+        reason string
+    }{
+        {"beaver triples", faultAuxBeavers, "sacrifice"},
+        {"second beaver triples", faultAuxBeaversTwo, "sacrifice"},
+        {"delta", faultAuxDelta, "delta"},
+        {"delta with rows swapped", faultAuxDeltaRows, "delta"},
+    }
+    for _, attack := range attacks {
+        for _, numServers := range []int{2, 3} {
+            attack := attack
+            name := fmt.Sprintf("%s/%d servers", attack.name, numServers)
+            t.Run(name, func(t *testing.T) {
+                params := Params{MsgBlocks: 2, BatchSize: 16}
+                d := newDeployment(t, numServers, params, deploymentOpts{check: true})
+                d.aux.fault = attack.fault
+                inputs, _ := d.batch(t, 1)
+                _, errs := d.run(t, inputs)
+                for i, err := range errs {
+                    if !errors.Is(err, ErrAuxCheating) || !strings.Contains(err.Error(), attack.reason) {
+                        t.Errorf("server %d: got %v, want the aux's %s caught", i, err, attack.reason)
+                    }
+                }
+                //everyone stopped at the same point, so the next round goes ahead
+                d.aux.fault = noFault
+                runHonestRound(t, d, 2)
+            })
+        }
+    }
+}
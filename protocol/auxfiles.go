@@ -0,0 +1,371 @@
+package protocol
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "golang.org/x/crypto/nacl/box"
+
+    "shufflemessage/mycrypto"
+)
+
+//an aux that can't stay online makes the bundles for a range of rounds ahead of time, as a batch job,
+//and writes them to one file per server. Each file is a sequence of records, every one of them
+//sealed with nacl/box to a key derived from the one the server shares with the aux (see
+//mycrypto.DeriveFileKey):
+//  [4 length][24 nonce][sealed record]
+//the first record is a header, the others are the bundles of the rounds in order, see bundle.encode.
+//a bundle's index is the round it's for, and its seeds are derived from a session picked for the file.
+//
+//the servers import the files into their stockpiles (ImportAuxFiles) and each round takes the bundle
+//made for it (see ServerConfig.OfflineAux), so the aux doesn't have to be connected at all. A file's
+//session is recorded once it's imported, so the same file can't be imported again after its bundles
+//are used. The bundles are read, checked and put into the stockpile one at a time, so a file doesn't
+//have to fit in memory
+
+//file names of aux files end in this
+const AuxFileSuffix = ".aux"
+
+//the stockpile keeps the sessions of the aux files it imported in this file, one hex session per line
+const importedFile = "imported"
+
+const auxFileMagic = "clarion aux file v1"
+
+//the header of an aux file: [magic][4 server][16 session][8 first round][8 last round]
+type auxFileHeader struct {
+    server int
+    session []byte
+    first uint64
+    last uint64
+}
+
+func (h *auxFileHeader) encode() []byte {
+    data := make([]byte, len(auxFileMagic) + 4 + SessionLength + 16)
+    n := copy(data, auxFileMagic)
+    binary.LittleEndian.PutUint32(data[n:], uint32(h.server))
+    copy(data[n+4:], h.session)
+    binary.LittleEndian.PutUint64(data[n+4+SessionLength:], h.first)
+    binary.LittleEndian.PutUint64(data[n+12+SessionLength:], h.last)
+    return data
+}
+
+func decodeAuxFileHeader(data []byte) (*auxFileHeader, error) {
+    n := len(auxFileMagic)
+    if len(data) != n + 4 + SessionLength + 16 || string(data[:n]) != auxFileMagic {
+        return nil, errors.New("not an aux file header")
+    }
+    return &auxFileHeader{
+        server: int(binary.LittleEndian.Uint32(data[n:])),
+        session: append([]byte(nil), data[n+4:n+4+SessionLength]...),
+        first: binary.LittleEndian.Uint64(data[n+4+SessionLength:]),
+        last: binary.LittleEndian.Uint64(data[n+12+SessionLength:]),
+    }, nil
+}
+
+//seal a record to key and write it
+func writeAuxRecord(w io.Writer, key *[32]byte, record []byte) error {
+    var nonce [24]byte
+    _, err := rand.Read(nonce[:])
+    if err != nil {
+        return fmt.Errorf("%w: %v", mycrypto.ErrRandomness, err)
+    }
+    sealed := box.SealAfterPrecomputation(nil, record, &nonce, key)
+    var length [4]byte
+    binary.LittleEndian.PutUint32(length[:], uint32(len(sealed)))
+    for _, part := range [][]byte{length[:], nonce[:], sealed} {
+        _, err = w.Write(part)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+//read the next record and open it with key. io.EOF if there's none left
+func readAuxRecord(r io.Reader, key *[32]byte) ([]byte, error) {
+    var length [4]byte
+    _, err := io.ReadFull(r, length[:])
+    if err != nil {
+        return nil, err
+    }
+    var nonce [24]byte
+    _, err = io.ReadFull(r, nonce[:])
+    if err != nil {
+        return nil, io.ErrUnexpectedEOF
+    }
+    sealed := make([]byte, binary.LittleEndian.Uint32(length[:]))
+    _, err = io.ReadFull(r, sealed)
+    if err != nil {
+        return nil, io.ErrUnexpectedEOF
+    }
+    record, ok := box.OpenAfterPrecomputation(nil, sealed, &nonce, key)
+    if !ok {
+        return nil, errors.New("a record doesn't open with the key derived from the one shared with the aux")
+    }
+    return record, nil
+}
+
+//the name of server's aux file for rounds first to last
+func AuxFileName(server int, first, last uint64) string {
+    return fmt.Sprintf("server-%d-rounds-%d-%d", server, first, last) + AuxFileSuffix
+}
+
+//make the bundles of rounds first to last, with the parameters params gives for each round, and write
+//them to one file per server in dir, sealed with the keys the aux shares with the servers. With check, the
+//bundles have triples for servers that check the aux to sacrifice, see ServerConfig.CheckAux
+//returns the files' paths, in server order
+func WriteAuxFiles(dir string, keys []*[32]byte, first, last uint64, check bool, params func(round uint64) (Params, error)) ([]string, error) {
+    if first == 0 || last < first {
+        return nil, fmt.Errorf("protocol: can't make aux files for rounds %d to %d", first, last)
+    }
+    session := make([]byte, SessionLength)
+    _, err := rand.Read(session)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", mycrypto.ErrRandomness, err)
+    }
+    err = os.MkdirAll(dir, 0700)
+    if err != nil {
+        return nil, err
+    }
+
+    fileKeys := make([]*[32]byte, len(keys))
+    for i, key := range keys {
+        fileKeys[i] = mycrypto.DeriveFileKey(key)
+    }
+    paths := make([]string, len(keys))
+    files := make([]*os.File, len(keys))
+    writers := make([]*bufio.Writer, len(keys))
+    //files that weren't finished are removed
+    done := false
+    defer func() {
+        for i, f := range files {
+            if f == nil {
+                continue
+            }
+            f.Close()
+            if !done {
+                os.Remove(paths[i] + ".tmp")
+            }
+        }
+    }()
+    for i := range keys {
+        paths[i] = filepath.Join(dir, AuxFileName(i, first, last))
+        files[i], err = os.OpenFile(paths[i] + ".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+        if err != nil {
+            return nil, err
+        }
+        writers[i] = bufio.NewWriter(files[i])
+        header := &auxFileHeader{server: i, session: session, first: first, last: last}
+        err = writeAuxRecord(writers[i], fileKeys[i], header.encode())
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    for round := first; round <= last; round++ {
+        p, err := params(round)
+        if err != nil {
+            return nil, err
+        }
+        bundles, err := makeBundles(keys, p, session, round, check)
+        if err != nil {
+            return nil, err
+        }
+        for i, b := range bundles {
+            err = writeAuxRecord(writers[i], fileKeys[i], b.encode())
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    for i := range files {
+        err = writers[i].Flush()
+        if err == nil {
+            err = files[i].Sync()
+        }
+        if err == nil {
+            err = os.Rename(paths[i] + ".tmp", paths[i])
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    done = true
+    return paths, syncDir(dir)
+}
+
+//import the aux files (see WriteAuxFiles) that were put in the stockpile's directory and remove them
+//key is the one the server shares with the aux. A file is only imported if all of it opens with the key,
+//is for this server and hasn't been imported before, otherwise none of its bundles stay in the
+//stockpile, the file is left where it is and the error says why. returns how many bundles were imported
+func (s *Stockpile) ImportAuxFiles(key *[32]byte, server int) (int, error) {
+    files, err := ioutil.ReadDir(s.dir)
+    if err != nil {
+        return 0, err
+    }
+    imported, err := s.importedSessions()
+    if err != nil {
+        return 0, err
+    }
+    fileKey := mycrypto.DeriveFileKey(key)
+    count := 0
+    for _, f := range files {
+        if !strings.HasSuffix(f.Name(), AuxFileSuffix) {
+            continue
+        }
+        n, err := s.importAuxFile(filepath.Join(s.dir, f.Name()), fileKey, server, imported)
+        count += n
+        if err != nil {
+            return count, fmt.Errorf("%s: %w", f.Name(), err)
+        }
+    }
+    return count, syncDir(s.dir)
+}
+
+//import one aux file, sealed with fileKey, checking that it's whole and for server, and remove it
+//each bundle is put as soon as it's read and checked, and all of them are taken out again if the
+//rest of the file doesn't check out. returns how many bundles were imported
+func (s *Stockpile) importAuxFile(path string, fileKey *[32]byte, server int, imported map[string]bool) (int, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+    r := bufio.NewReader(f)
+
+    record, err := readAuxRecord(r, fileKey)
+    if err != nil {
+        return 0, err
+    }
+    header, err := decodeAuxFileHeader(record)
+    if err != nil {
+        return 0, err
+    }
+    if header.server != server {
+        return 0, fmt.Errorf("the file is for server %d, not server %d", header.server, server)
+    }
+    session := hex.EncodeToString(header.session)
+    //imported before, but not removed: the bundles are already in
+    if imported[session] {
+        return 0, os.Remove(path)
+    }
+
+    var put [][]byte
+    //take the bundles put so far out again
+    fail := func(err error) (int, error) {
+        if dropErr := s.drop(put); dropErr != nil {
+            return 0, fmt.Errorf("%v, and its bundles can't be taken out: %v", err, dropErr)
+        }
+        return 0, err
+    }
+    for round := header.first; round <= header.last; round++ {
+        record, err := readAuxRecord(r, fileKey)
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        if err != nil {
+            return fail(fmt.Errorf("round %d: %w", round, err))
+        }
+        b, err := decodeBundle(record)
+        if err != nil {
+            return fail(fmt.Errorf("round %d: %w", round, err))
+        }
+        if b.index != round || !bytes.Equal(b.session, header.session) {
+            return fail(fmt.Errorf("the bundle for round %d is out of place", round))
+        }
+        //a file whose import was cut off is imported again, without the bundles that made it in
+        if s.has(b.id()) {
+            continue
+        }
+        err = s.put(b)
+        if err != nil {
+            return fail(err)
+        }
+        put = append(put, b.id())
+    }
+    _, err = readAuxRecord(r, fileKey)
+    if err != io.EOF {
+        return fail(fmt.Errorf("the file goes on after round %d", header.last))
+    }
+
+    //recorded before the file goes, so it can't come back once its bundles are used
+    err = s.recordImport(session)
+    if err != nil {
+        return fail(err)
+    }
+    imported[session] = true
+    return len(put), os.Remove(path)
+}
+
+//the sessions of the aux files imported so far
+func (s *Stockpile) importedSessions() (map[string]bool, error) {
+    sessions := make(map[string]bool)
+    data, err := ioutil.ReadFile(filepath.Join(s.dir, importedFile))
+    if os.IsNotExist(err) {
+        return sessions, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    for _, line := range strings.Fields(string(data)) {
+        sessions[line] = true
+    }
+    return sessions, nil
+}
+
+func (s *Stockpile) recordImport(session string) error {
+    f, err := os.OpenFile(filepath.Join(s.dir, importedFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        return err
+    }
+    _, err = f.WriteString(session + "\n")
+    if err == nil {
+        err = f.Sync()
+    }
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+//whether a bundle with id is in the stockpile
+func (s *Stockpile) has(id []byte) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, entry := range s.entries {
+        if bytes.Equal(entry.id, id) {
+            return true
+        }
+    }
+    return false
+}
+
+//take the bundles with the given ids out of the stockpile
+func (s *Stockpile) drop(ids [][]byte) error {
+    if len(ids) == 0 {
+        return nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    taken := make(map[int]bool)
+    for i, entry := range s.entries {
+        for _, id := range ids {
+            if bytes.Equal(entry.id, id) {
+                taken[i] = true
+            }
+        }
+    }
+    _, err := s.remove(taken, -1)
+    return err
+}
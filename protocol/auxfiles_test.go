@@ -0,0 +1,176 @@
+package protocol
+
+import (
+    "errors"
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+//with an offline aux, rounds run from the bundles of the files it wrote, one per round, and a file
+//only goes into a stockpile once
+
+//write aux files for rounds first to last and copy each server's into its stockpile directory
+//with check, they're for servers that check the aux
+func writeTestAuxFiles(t *testing.T, auxKeys []*[32]byte, dirs []string, first, last uint64, params Params, check bool) {
+    t.Helper()
+    paths, err := WriteAuxFiles(t.TempDir(), auxKeys, first, last, check, func(uint64) (Params, error) { return params, nil })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, path := range paths {
+        copyAuxFile(t, path, dirs[i])
+    }
+}
+
+func copyAuxFile(t *testing.T, path, dir string) {
+    t.Helper()
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = ioutil.WriteFile(filepath.Join(dir, filepath.Base(path)), data, 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+//import the aux files in every server's stockpile and check there were want bundles in them
+func (d *testDeployment) importAuxFiles(t *testing.T, auxKeys []*[32]byte, want int) {
+    t.Helper()
+    for i, stockpile := range d.stockpiles {
+        count, err := stockpile.ImportAuxFiles(auxKeys[i], i)
+        if err != nil {
+            t.Fatalf("server %d: %v", i, err)
+        }
+        if count != want {
+            t.Fatalf("server %d imported %d bundles, want %d", i, count, want)
+        }
+    }
+}
+
+func TestRoundsFromAuxFiles(t *testing.T) {
+    for _, numServers := range []int{2, 3} {
+        for _, messagingMode := range []bool{false, true} {
+            params := Params{MsgBlocks: 2, BatchSize: 16, MessagingMode: messagingMode}
+            auxKeys := testAuxKeys(t, numServers)
+            dirs := stockpileDirs(t, numServers)
+            d := newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs, offline: true})
+            writeTestAuxFiles(t, auxKeys, dirs, 1, 4, params, false)
+            d.importAuxFiles(t, auxKeys, 4)
+
+            //a round that's skipped just leaves its bundle behind
+            for _, round := range []uint64{1, 2, 4} {
+                runHonestRound(t, d, round)
+            }
+            for i, stockpile := range d.stockpiles {
+                if stockpile.Len() != 0 {
+                    t.Errorf("server %d has %d bundles left after the last round of the file", i, stockpile.Len())
+                }
+            }
+
+            //there's nothing for round 5, so everyone aborts it
+            inputs, _ := d.batch(t, 5)
+            _, errs := d.run(t, inputs)
+            for i, err := range errs {
+                if !errors.Is(err, ErrStockpile) {
+                    t.Errorf("%d servers: server %d: got %v, want no preprocessing for round 5", numServers, i, err)
+                }
+            }
+        }
+    }
+}
+
+func TestAuxFileImportedOnce(t *testing.T) {
+    const numServers = 2
+    params := Params{MsgBlocks: 1, BatchSize: 16}
+    auxKeys := testAuxKeys(t, numServers)
+    dirs := stockpileDirs(t, numServers)
+    d := newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs, offline: true})
+
+    paths, err := WriteAuxFiles(t.TempDir(), auxKeys, 1, 3, false, func(uint64) (Params, error) { return params, nil })
+    if err != nil {
+        t.Fatal(err)
+    }
+    //a file for another server, or one sealed with another key, is refused and left alone
+    copyAuxFile(t, paths[1], dirs[0])
+    _, err = d.stockpiles[0].ImportAuxFiles(auxKeys[0], 0)
+    if err == nil {
+        t.Fatal("server 0 imported server 1's file")
+    }
+    _, err = d.stockpiles[0].ImportAuxFiles(auxKeys[1], 0)
+    if err == nil {
+        t.Fatal("server 0 imported a file for server 1 with server 1's key")
+    }
+    if d.stockpiles[0].Len() != 0 {
+        t.Fatalf("server 0 has %d bundles from a file that isn't its own", d.stockpiles[0].Len())
+    }
+
+    dirs = stockpileDirs(t, numServers)
+    d = newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs, offline: true})
+    for i, path := range paths {
+        copyAuxFile(t, path, dirs[i])
+    }
+    d.importAuxFiles(t, auxKeys, 3)
+    runHonestRound(t, d, 1)
+
+    //the used bundle doesn't come back with the same file, after a restart either
+    for i, path := range paths {
+        copyAuxFile(t, path, dirs[i])
+    }
+    d = newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs, offline: true})
+    d.importAuxFiles(t, auxKeys, 0)
+    for i, dir := range dirs {
+        matches, err := filepath.Glob(filepath.Join(dir, "*"+AuxFileSuffix))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(matches) != 0 || d.stockpiles[i].Len() != 2 {
+            t.Errorf("server %d has %d aux files and %d bundles left, want none and 2", i, len(matches), d.stockpiles[i].Len())
+        }
+    }
+    inputs, _ := d.batch(t, 1)
+    _, errs := d.run(t, inputs)
+    for i, err := range errs {
+        if !errors.Is(err, ErrStockpile) {
+            t.Errorf("server %d: got %v, want round 1 to be used up", i, err)
+        }
+    }
+    runHonestRound(t, d, 2)
+}
+
+func TestCutOffAuxFileIsRefused(t *testing.T) {
+    const numServers = 2
+    params := Params{MsgBlocks: 1, BatchSize: 16}
+    auxKeys := testAuxKeys(t, numServers)
+    dirs := stockpileDirs(t, numServers)
+    d := newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs, offline: true})
+
+    paths, err := WriteAuxFiles(t.TempDir(), auxKeys, 1, 3, false, func(uint64) (Params, error) { return params, nil })
+    if err != nil {
+        t.Fatal(err)
+    }
+    //the first bundles are stored before the end of the file turns out to be missing
+    data, err := ioutil.ReadFile(paths[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(dirs[0], filepath.Base(paths[0]))
+    err = ioutil.WriteFile(path, data[:len(data)-1], 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = d.stockpiles[0].ImportAuxFiles(auxKeys[0], 0)
+    if err == nil {
+        t.Fatal("a cut-off file was imported")
+    }
+    if d.stockpiles[0].Len() != 0 {
+        t.Fatalf("%d bundles of a cut-off file were kept", d.stockpiles[0].Len())
+    }
+
+    //the whole file goes in afterwards
+    copyAuxFile(t, paths[0], dirs[0])
+    copyAuxFile(t, paths[1], dirs[1])
+    d.importAuxFiles(t, auxKeys, 3)
+    runHonestRound(t, d, 1)
+}
@@ -0,0 +1,552 @@
+package protocol
+
+import (
+    "context"
+    "crypto/rand"
+    "fmt"
+    "math/big"
+    "runtime"
+    "sync/atomic"
+
+    "shufflemessage/modp"
+    "shufflemessage/mycrypto"
+    "shufflemessage/wire"
+)
+
+//dealer-free preprocessing: there's no aux, the shuffle servers make each round's preprocessing among
+//themselves with Paillier encryption (see ServerConfig.DealerFree). What comes out is what the aux would
+//have sent, so the rest of the round doesn't change. Each server's seeds come from a key of its own.
+//
+//beaver triples: c = (sum_i a_i)(sum_j b_j), so besides its own a_i*b_i every server needs a share of
+//each cross term a_j*b_i. Server j sends Enc_j(a_j) to everyone, server i sends back
+//Enc_j(a_j*b_i + R) for a random R much longer than the product and keeps -R, and j decrypts its part.
+//both sets of the round's triples go at once.
+//
+//share translation: the last server needs the delta of mycrypto.GenShareTrans. The servers hold additive
+//shares of the vector being permuted, starting with their aInitial (nothing for the leader), and take
+//turns permuting it: everyone else sends the permuting server its share, packed into ciphertexts under
+//its own key, and gets the rows back permuted with random masks added, which it decrypts as its new
+//share. The permuting server keeps its own permuted share minus the masks, plus its aAtPermTime. In the
+//end everyone but the last server sends it -share-bFinal, and the sum of those and -its share is delta.
+//
+//every mask is 40 bits longer than what it hides, so what a server decrypts tells it nothing about the
+//others' shares. That only holds for servers that follow the protocol, nothing here proves that a
+//server's plaintexts are in range or that it permuted honestly. A server that encrypts a share shifted
+//up past the masks (a slot has room for 8 more bits) reads the permuting server's permutation off the
+//high bits of what it decrypts, and one that sends Enc(a_j) with a_j of 2^256 or more gets back
+//a_j*b_i with a mask too short to hide b_i. Until there are range proofs for the plaintexts and proofs
+//for the permutation steps, this is semi-honest only, which config.PreprocessingSemiHonestServers says
+
+//bits of the servers' Paillier keys unless ServerConfig.PaillierKeyBits says otherwise
+const defaultPaillierKeyBits = 2048
+
+const (
+    //statistical security of the masks
+    maskSlack = 40
+    //a beaver product of two elements is below 2^256 and its mask below 2^296
+    productMaskBits = 2*128 + maskSlack
+    //an element of a share is below 2^128 and its mask below 2^168. a slot of a packed ciphertext has
+    //room for the sum
+    slotMaskBits = 128 + maskSlack
+    slotBits = slotMaskBits + 8
+)
+
+//a server's part of the dealer-free preprocessing
+type dealerFree struct {
+    key *mycrypto.PaillierSecretKey
+    //the other servers' public keys in server order, nil for this server
+    //nil until the first round exchanges them
+    peerKeys []*mycrypto.PaillierPublicKey
+    //the seeds are derived from this instead of a key shared with the aux. it's new every time the
+    //server starts, so the seeds don't repeat if the round IDs do
+    seedKey *[32]byte
+}
+
+//keyBits has to leave room for a beaver product plus its mask
+func newDealerFree(keyBits int) (*dealerFree, error) {
+    if keyBits <= productMaskBits + 1 {
+        return nil, fmt.Errorf("protocol: %d bit Paillier keys are too short for the beaver products", keyBits)
+    }
+    key, err := mycrypto.GeneratePaillierKey(keyBits)
+    if err != nil {
+        return nil, err
+    }
+    seedKey := new([32]byte)
+    _, err = rand.Read(seedKey[:])
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", mycrypto.ErrRandomness, err)
+    }
+    return &dealerFree{key: key, seedKey: seedKey}, nil
+}
+
+//make this server's part of the round's preprocessing with the other servers: the c parts of both sets
+//of beaver triples, and delta if this is the last server
+func (s *ShuffleServer) dealerFreePreprocessing(ctx context.Context, round uint64, seeds *mycrypto.Seeds) (beaversC, delta, beaversCTwo []byte, err error) {
+    if s.dealerFree.peerKeys == nil {
+        err = s.exchangePaillierKeys(ctx, round)
+        if err != nil {
+            return nil, nil, nil, err
+        }
+    }
+    numServers := len(s.peers)
+    numBeavers := s.params.numBeavers()
+    batchSize := s.params.BatchSize
+    dbSize := s.params.dbSize()
+
+    //the round expands the same seeds again, which is nothing next to the Paillier operations
+    expand := func(length int, seed []byte) []byte {
+        if err != nil {
+            return nil
+        }
+        var out []byte
+        out, err = mycrypto.AesPRG(length, seed)
+        return out
+    }
+    a := append(expand(16*numBeavers, seeds.BeaversA), expand(16*batchSize, seeds.BeaversATwo)...)
+    b := append(expand(16*numBeavers, seeds.BeaversB), expand(16*batchSize, seeds.BeaversBTwo)...)
+    aInitial := make([]byte, dbSize)
+    if s.serverNum > 0 {
+        aInitial = expand(dbSize, seeds.AInitial)
+    }
+    var aAtPermTime, bFinal []byte
+    if s.serverNum != numServers - 1 {
+        aAtPermTime = expand(dbSize, seeds.AAtPermTime)
+        bFinal = expand(dbSize, seeds.BFinal)
+    }
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    pi, err := mycrypto.GenPerm(batchSize, seeds.Perm)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+
+    c, err := s.dealerFreeBeavers(ctx, round, a, b)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    delta, err = s.dealerFreeDelta(ctx, round, pi, aInitial, aAtPermTime, bFinal)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    return c[:16*numBeavers], delta, c[16*numBeavers:], nil
+}
+
+//everyone sends everyone their public key
+func (s *ShuffleServer) exchangePaillierKeys(ctx context.Context, round uint64) error {
+    d := s.dealerFree
+    size := d.key.Size()
+    keys, err := broadcastAndReceiveFromAll(ctx, wire.PhasePaillierKey, round, d.key.Bytes(), s.peers, s.serverNum)
+    if err != nil {
+        return err
+    }
+    peerKeys := make([]*mycrypto.PaillierPublicKey, len(s.peers))
+    for i := range s.peers {
+        if i == s.serverNum {
+            continue
+        }
+        peerKeys[i], err = mycrypto.ParsePaillierPublicKey(keys[i*size:(i+1)*size])
+        if err != nil {
+            return fmt.Errorf("protocol: server %d: %w", i, err)
+        }
+    }
+    d.peerKeys = peerKeys
+    return nil
+}
+
+//this server's shares of the c parts of the beaver triples whose a and b parts it has shares of
+func (s *ShuffleServer) dealerFreeBeavers(ctx context.Context, round uint64, a, b []byte) ([]byte, error) {
+    d := s.dealerFree
+    numBeavers := len(a)/16
+    ctLen := d.key.CiphertextLength()
+
+    encrypted, err := encryptElements(ctx, d.key, a)
+    if err != nil {
+        return nil, err
+    }
+    allEncrypted, err := broadcastAndReceiveFromAll(ctx, wire.PhaseBeaverShares, round, encrypted, s.peers, s.serverNum)
+    if err != nil {
+        return nil, err
+    }
+
+    //start with a_i*b_i, and take the mask off every product that goes out
+    c := make([]byte, len(a))
+    var eltA, eltB modp.Element
+    for k := 0; k < numBeavers; k++ {
+        eltA.SetBytes(a[16*k:16*(k+1)])
+        eltB.SetBytes(b[16*k:16*(k+1)])
+        eltA.Mul(&eltA, &eltB)
+        copy(c[16*k:16*(k+1)], eltA.Bytes())
+    }
+    products := make([][]byte, len(s.peers))
+    for j := range s.peers {
+        if j == s.serverNum {
+            continue
+        }
+        pk := d.peerKeys[j]
+        theirs := allEncrypted[j*len(encrypted):(j+1)*len(encrypted)]
+        products[j] = make([]byte, len(encrypted))
+        kept := make([]byte, len(a))
+        err = parallel(ctx, numBeavers, func(k int) error {
+            encA, err := pk.DecodeCiphertext(theirs[k*ctLen:(k+1)*ctLen])
+            if err != nil {
+                return fmt.Errorf("protocol: server %d: %w", j, err)
+            }
+            mask, err := randomBits(productMaskBits)
+            if err != nil {
+                return err
+            }
+            encMask, err := pk.Encrypt(mask)
+            if err != nil {
+                return err
+            }
+            product := pk.MulPlaintext(encA, new(big.Int).SetBytes(b[16*k:16*(k+1)]))
+            pk.EncodeCiphertext(products[j][k*ctLen:(k+1)*ctLen], pk.Add(product, encMask))
+            setNegated(kept[16*k:16*(k+1)], mask)
+            return nil
+        })
+        if err != nil {
+            return nil, err
+        }
+        mycrypto.AddOrSub(c, kept, true)
+    }
+
+    //and add our parts of the products the others made
+    theirProducts, err := exchangeWithEach(ctx, wire.PhaseBeaverProducts, round, products, s.peers, s.serverNum)
+    if err != nil {
+        return nil, err
+    }
+    for j, product := range theirProducts {
+        if j == s.serverNum {
+            continue
+        }
+        decrypted, err := decryptElements(ctx, d.key, product, len(a))
+        if err != nil {
+            return nil, fmt.Errorf("protocol: server %d: %w", j, err)
+        }
+        mycrypto.AddOrSub(c, decrypted, true)
+    }
+    return c, nil
+}
+
+//the share translation: delta if this is the last server, nil for the others
+//aInitial is all zeros for the leader, aAtPermTime and bFinal are nil for the last server
+func (s *ShuffleServer) dealerFreeDelta(ctx context.Context, round uint64, pi []int, aInitial, aAtPermTime, bFinal []byte) ([]byte, error) {
+    numServers := len(s.peers)
+    last := numServers - 1
+    share := aInitial
+    var err error
+    for permuter := 0; permuter < numServers; permuter++ {
+        if permuter == s.serverNum {
+            share, err = s.permuteTranslationShares(ctx, round, pi, share)
+            if err == nil && permuter != last {
+                mycrypto.AddOrSub(share, aAtPermTime, true)
+            }
+        } else {
+            share, err = s.translationSharePermuted(ctx, round, permuter, share)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    if s.serverNum != last {
+        result := make([]byte, len(share))
+        mycrypto.DoubleAddOrSub(result, share, bFinal, false, false)
+        return nil, s.peers[last].Send(ctx, wire.PhaseTranslationResult, round, result)
+    }
+    delta := make([]byte, len(share))
+    mycrypto.AddOrSub(delta, share, false)
+    for i := 0; i < last; i++ {
+        result, err := s.peers[i].Receive(ctx, wire.PhaseTranslationResult, round, len(share))
+        if err != nil {
+            return nil, err
+        }
+        mycrypto.AddOrSub(delta, result, true)
+    }
+    return delta, nil
+}
+
+//have permuter permute our share and mask it, see permuteTranslationShares
+func (s *ShuffleServer) translationSharePermuted(ctx context.Context, round uint64, permuter int, share []byte) ([]byte, error) {
+    key := s.dealerFree.key
+    blocksPerRow := s.params.blocksPerRow()
+    encrypted, err := encryptRows(ctx, key, share, blocksPerRow)
+    if err != nil {
+        return nil, err
+    }
+    conn := s.peers[permuter]
+    err = conn.Send(ctx, wire.PhaseTranslationShares, round, encrypted)
+    if err != nil {
+        return nil, err
+    }
+    permuted, err := conn.Receive(ctx, wire.PhaseTranslationPermuted, round, len(encrypted))
+    if err != nil {
+        return nil, err
+    }
+    newShare, err := decryptRows(ctx, key, permuted, len(share), blocksPerRow)
+    if err != nil {
+        return nil, fmt.Errorf("protocol: server %d: %w", permuter, err)
+    }
+    return newShare, nil
+}
+
+//permute everyone's shares with pi, like mycrypto.PermuteDB. The others' come encrypted under their keys
+//and go back with masks added, and our new share is our permuted share minus all the masks
+func (s *ShuffleServer) permuteTranslationShares(ctx context.Context, round uint64, pi []int, share []byte) ([]byte, error) {
+    d := s.dealerFree
+    blocksPerRow := s.params.blocksPerRow()
+    masks := make([][]byte, len(s.peers))
+    err := RunAll(ctx, len(s.peers), func(ctx context.Context, i int) error {
+        if i == s.serverNum {
+            return nil
+        }
+        pk := d.peerKeys[i]
+        length := len(pi)*ctsPerRow(pk, blocksPerRow)*pk.CiphertextLength()
+        encrypted, err := s.peers[i].Receive(ctx, wire.PhaseTranslationShares, round, length)
+        if err != nil {
+            return err
+        }
+        var permuted []byte
+        permuted, masks[i], err = permuteEncryptedRows(ctx, pk, encrypted, pi, blocksPerRow)
+        if err != nil {
+            return fmt.Errorf("protocol: server %d: %w", i, err)
+        }
+        return s.peers[i].Send(ctx, wire.PhaseTranslationPermuted, round, permuted)
+    })
+    if err != nil {
+        return nil, err
+    }
+    newShare := mycrypto.PermuteDB(share, pi)
+    for _, kept := range masks {
+        if kept != nil {
+            mycrypto.AddOrSub(newShare, kept, true)
+        }
+    }
+    return newShare, nil
+}
+
+//elements of a share packed into one ciphertext under pk
+func slotsPerCiphertext(pk *mycrypto.PaillierPublicKey) int {
+    return (pk.N.BitLen() - 1)/slotBits
+}
+
+//ciphertexts a row of blocksPerRow elements is packed into under pk
+func ctsPerRow(pk *mycrypto.PaillierPublicKey, blocksPerRow int) int {
+    slots := slotsPerCiphertext(pk)
+    return (blocksPerRow + slots - 1)/slots
+}
+
+//the elements of a row in its part'th ciphertext, as the index of the first one and how many there are
+func rowPart(part, slots, blocksPerRow int) (int, int) {
+    first := part*slots
+    count := blocksPerRow - first
+    if count > slots {
+        count = slots
+    }
+    return first, count
+}
+
+//encrypt each row of share under key, packed into ctsPerRow ciphertexts
+func encryptRows(ctx context.Context, key *mycrypto.PaillierSecretKey, share []byte, blocksPerRow int) ([]byte, error) {
+    slots := slotsPerCiphertext(&key.PaillierPublicKey)
+    perRow := ctsPerRow(&key.PaillierPublicKey, blocksPerRow)
+    numRows := len(share)/(16*blocksPerRow)
+    ctLen := key.CiphertextLength()
+    out := make([]byte, numRows*perRow*ctLen)
+    err := parallel(ctx, numRows*perRow, func(k int) error {
+        first, count := rowPart(k % perRow, slots, blocksPerRow)
+        start := 16*((k/perRow)*blocksPerRow + first)
+        c, err := key.Encrypt(packSlots(share[start:start+16*count]))
+        if err != nil {
+            return err
+        }
+        key.EncodeCiphertext(out[k*ctLen:(k+1)*ctLen], c)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return out, nil
+}
+
+//undo encryptRows on shareLen bytes of rows, with each element taken mod p
+func decryptRows(ctx context.Context, key *mycrypto.PaillierSecretKey, encrypted []byte, shareLen, blocksPerRow int) ([]byte, error) {
+    slots := slotsPerCiphertext(&key.PaillierPublicKey)
+    perRow := ctsPerRow(&key.PaillierPublicKey, blocksPerRow)
+    ctLen := key.CiphertextLength()
+    out := make([]byte, shareLen)
+    err := parallel(ctx, len(encrypted)/ctLen, func(k int) error {
+        c, err := key.DecodeCiphertext(encrypted[k*ctLen:(k+1)*ctLen])
+        if err != nil {
+            return err
+        }
+        first, count := rowPart(k % perRow, slots, blocksPerRow)
+        start := 16*((k/perRow)*blocksPerRow + first)
+        unpackSlots(out[start:start+16*count], key.Decrypt(c))
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return out, nil
+}
+
+//put the rows of encrypted, made by encryptRows under pk, in the order of pi and add a random mask to
+//every element. returns them and the negated masks, in the layout of a share
+func permuteEncryptedRows(ctx context.Context, pk *mycrypto.PaillierPublicKey, encrypted []byte, pi []int, blocksPerRow int) ([]byte, []byte, error) {
+    slots := slotsPerCiphertext(pk)
+    perRow := ctsPerRow(pk, blocksPerRow)
+    ctLen := pk.CiphertextLength()
+    rowLen := perRow*ctLen
+    permuted := make([]byte, len(encrypted))
+    kept := make([]byte, 16*len(pi)*blocksPerRow)
+    err := parallel(ctx, len(pi)*perRow, func(k int) error {
+        row, part := k/perRow, k % perRow
+        from := pi[row]*rowLen + part*ctLen
+        c, err := pk.DecodeCiphertext(encrypted[from:from+ctLen])
+        if err != nil {
+            return err
+        }
+        first, count := rowPart(part, slots, blocksPerRow)
+        //packed like packSlots, the first element in the lowest bits
+        packed := new(big.Int)
+        for slot := count-1; slot >= 0; slot-- {
+            mask, err := randomBits(slotMaskBits)
+            if err != nil {
+                return err
+            }
+            packed.Lsh(packed, slotBits)
+            packed.Add(packed, mask)
+            start := 16*(row*blocksPerRow + first + slot)
+            setNegated(kept[start:start+16], mask)
+        }
+        encMask, err := pk.Encrypt(packed)
+        if err != nil {
+            return err
+        }
+        pk.EncodeCiphertext(permuted[row*rowLen+part*ctLen:row*rowLen+(part+1)*ctLen], pk.Add(c, encMask))
+        return nil
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+    return permuted, kept, nil
+}
+
+//the elements, one per slot of slotBits bits, the first in the lowest bits
+func packSlots(elements []byte) *big.Int {
+    x := new(big.Int)
+    for k := len(elements)/16 - 1; k >= 0; k-- {
+        x.Lsh(x, slotBits)
+        x.Add(x, new(big.Int).SetBytes(elements[16*k:16*(k+1)]))
+    }
+    return x
+}
+
+//undo packSlots into out, taking each slot mod p
+func unpackSlots(out []byte, x *big.Int) {
+    slotMask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), slotBits), big.NewInt(1))
+    slot := new(big.Int)
+    var elt modp.Element
+    for k := 0; k < len(out)/16; k++ {
+        slot.And(x, slotMask)
+        elt.SetBigInt(slot)
+        copy(out[16*k:16*(k+1)], elt.Bytes())
+        x.Rsh(x, slotBits)
+    }
+}
+
+//encrypt every element of elements under key, one ciphertext each
+func encryptElements(ctx context.Context, key *mycrypto.PaillierSecretKey, elements []byte) ([]byte, error) {
+    ctLen := key.CiphertextLength()
+    out := make([]byte, len(elements)/16*ctLen)
+    err := parallel(ctx, len(elements)/16, func(k int) error {
+        c, err := key.Encrypt(new(big.Int).SetBytes(elements[16*k:16*(k+1)]))
+        if err != nil {
+            return err
+        }
+        key.EncodeCiphertext(out[k*ctLen:(k+1)*ctLen], c)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return out, nil
+}
+
+//decrypt ciphertexts made like encryptElements' into length bytes of elements, taken mod p
+func decryptElements(ctx context.Context, key *mycrypto.PaillierSecretKey, encrypted []byte, length int) ([]byte, error) {
+    ctLen := key.CiphertextLength()
+    out := make([]byte, length)
+    err := parallel(ctx, length/16, func(k int) error {
+        c, err := key.DecodeCiphertext(encrypted[k*ctLen:(k+1)*ctLen])
+        if err != nil {
+            return err
+        }
+        var elt modp.Element
+        elt.SetBigInt(key.Decrypt(c))
+        copy(out[16*k:16*(k+1)], elt.Bytes())
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return out, nil
+}
+
+//a random number below 2^bits
+func randomBits(bits uint) (*big.Int, error) {
+    x, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), bits))
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", mycrypto.ErrRandomness, err)
+    }
+    return x, nil
+}
+
+//write -x mod p to out
+func setNegated(out []byte, x *big.Int) {
+    var elt modp.Element
+    elt.SetBigInt(x)
+    elt.Neg(&elt)
+    copy(out, elt.Bytes())
+}
+
+//run f(k) for every k in [0, n) on all cores
+//stops at the first error, which it returns, or when ctx is done
+func parallel(ctx context.Context, n int, f func(k int) error) error {
+    workers := runtime.NumCPU()
+    if workers > n {
+        workers = n
+    }
+    var next int64 = -1
+    errs := make(chan error, workers)
+    for w := 0; w < workers; w++ {
+        go func() {
+            for {
+                k := int(atomic.AddInt64(&next, 1))
+                if k >= n {
+                    errs <- nil
+                    return
+                }
+                err := ctx.Err()
+                if err == nil {
+                    err = f(k)
+                }
+                if err != nil {
+                    //the others stop at their next element
+                    atomic.StoreInt64(&next, int64(n))
+                    errs <- err
+                    return
+                }
+            }
+        }()
+    }
+    var first error
+    for w := 0; w < workers; w++ {
+        if err := <- errs; err != nil && first == nil {
+            first = err
+        }
+    }
+    return first
+}
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "fmt"
+    "net"
+    "testing"
+
+    "shufflemessage/wire"
+)
+
+//without an aux, the servers' own preprocessing has to give the same rounds, and the blind mac
+//verifications have to catch cheating just the same
+
+func TestDealerFreeRounds(t *testing.T) {
+    for _, numServers := range []int{2, 3} {
+        for _, messagingMode := range []bool{false, true} {
+            params := Params{MsgBlocks: 2, BatchSize: 16, MessagingMode: messagingMode}
+            d := newDeployment(t, numServers, params, deploymentOpts{dealerFree: true})
+            //the first round also exchanges the Paillier keys
+            for round := uint64(1); round <= 2; round++ {
+                runHonestRound(t, d, round)
+            }
+        }
+    }
+}
+
+func TestDealerFreeCheatingServerIsCaught(t *testing.T) {
+    attacks := []struct {
+        name string
+        fault fault
+        lastOnly bool
+    }{
+        {"permutation", faultPermutation, false},
+        {"delta", faultDelta, true},
+    }
+    for _, attack := range attacks {
+        for _, numServers := range []int{2, 3} {
+            for cheater:=0; cheater < numServers; cheater++ {
+                if attack.lastOnly && cheater != numServers-1 {
+                    continue
+                }
+                attack := attack
+                name := fmt.Sprintf("%s/%d servers/server %d cheats", attack.name, numServers, cheater)
+                t.Run(name, func(t *testing.T) {
+                    params := Params{MsgBlocks: 1, BatchSize: 16}
+                    d := newDeployment(t, numServers, params, deploymentOpts{dealerFree: true})
+                    d.servers[cheater].fault = attack.fault
+                    inputs, plaintexts := d.batch(t, 1)
+                    outputs, errs := d.run(t, inputs)
+                    failsVerification(t, d, cheater, plaintexts, outputs, errs)
+                })
+            }
+        }
+    }
+}
+
+func TestShortPaillierKeysAreRefused(t *testing.T) {
+    a, b := net.Pipe()
+    defer a.Close()
+    defer b.Close()
+    _, signKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conf := ServerConfig{
+        Peers: []*wire.Conn{nil, wire.NewConnVersion(a, "server 1", wire.MaxVersion)},
+        DealerFree: true,
+        SignKey: signKey,
+    }
+    //a beaver product plus its mask has to fit
+    conf.PaillierKeyBits = productMaskBits + 1
+    _, err = NewShuffleServer(conf)
+    if err == nil {
+        t.Errorf("made a server with %d bit Paillier keys, too short for the beaver products", conf.PaillierKeyBits)
+    }
+    conf.PaillierKeyBits = testPaillierKeyBits
+    _, err = NewShuffleServer(conf)
+    if err != nil {
+        t.Errorf("%d bit Paillier keys: %v", conf.PaillierKeyBits, err)
+    }
+}
@@ -0,0 +1,267 @@
+package protocol
+
+import (
+    "context"
+    "crypto/ed25519"
+    "crypto/rand"
+    "fmt"
+    "net"
+    "testing"
+    "time"
+
+    "shufflemessage/mux"
+    "shufflemessage/mycrypto"
+    "shufflemessage/wire"
+)
+
+//the shuffle servers and the aux of a deployment in one test, connected by net.Pipe
+//the servers talk over mux sessions like the server command's do, and the aux over plain connections
+
+//how long a step of a test round may take
+const testStepTimeout = 10*time.Second
+
+type testDeployment struct {
+    params Params
+    servers []*ShuffleServer
+    aux *AuxServer
+    //the servers' stockpiles, if they take their preprocessing from them
+    stockpiles []*Stockpile
+    //the keys the servers were given to sign evidence with
+    signKeys []ed25519.PrivateKey
+}
+
+//how a test deployment's servers get their preprocessing. The zero value has the aux send it when each
+//round starts
+type deploymentOpts struct {
+    //the keys the servers share with the aux, random if nil. Bundles only work with the same keys, so a
+    //test restarting a deployment with stockpiles keeps them
+    auxKeys []*[32]byte
+    //a stockpile directory for each server, if they keep stockpiles
+    stockpileDirs []string
+    //the aux is offline: the servers aren't connected to it and take the bundles of its files from their
+    //stockpiles
+    offline bool
+    //the servers check the aux, which sends or writes the triples to sacrifice for that
+    check bool
+    //there's no aux, the servers make the preprocessing themselves
+    dealerFree bool
+}
+
+//Paillier keys of dealer-free test deployments. short keys keep the tests fast and still have room
+//for the beaver products
+const testPaillierKeyBits = 512
+
+//random keys for the servers to share with the aux
+func testAuxKeys(t *testing.T, numServers int) []*[32]byte {
+    t.Helper()
+    auxKeys := make([]*[32]byte, numServers)
+    for i := range auxKeys {
+        auxKeys[i] = new([32]byte)
+        _, err := rand.Read(auxKeys[i][:])
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    return auxKeys
+}
+
+func newDeployment(t *testing.T, numServers int, params Params, opts deploymentOpts) *testDeployment {
+    t.Helper()
+    auxKeys := opts.auxKeys
+    if auxKeys == nil {
+        auxKeys = testAuxKeys(t, numServers)
+    }
+    timeout := func(string) time.Duration { return testStepTimeout }
+    //peers[stream][i][j] is server i's connection to server j on a stream of their session: the control
+    //stream, then the ones for the shuffle, the verifications and the reveal
+    peers := make([][][]*wire.Conn, 4)
+    for stream := range peers {
+        peers[stream] = make([][]*wire.Conn, numServers)
+        for i := range peers[stream] {
+            peers[stream][i] = make([]*wire.Conn, numServers)
+        }
+    }
+    for i:=0; i < numServers; i++ {
+        for j:=i+1; j < numServers; j++ {
+            a, b := net.Pipe()
+            sessionA, sessionB := mux.NewSession(a), mux.NewSession(b)
+            t.Cleanup(func() {
+                sessionA.Close()
+                sessionB.Close()
+            })
+            for stream := range peers {
+                peers[stream][i][j] = wire.NewConnVersion(sessionA.Stream(uint32(stream)), fmt.Sprintf("server %d", j), wire.MaxVersion)
+                peers[stream][j][i] = wire.NewConnVersion(sessionB.Stream(uint32(stream)), fmt.Sprintf("server %d", i), wire.MaxVersion)
+            }
+        }
+    }
+
+    //the session the aux would pick
+    session := make([]byte, SessionLength)
+    _, err := rand.Read(session)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    d := &testDeployment{params: params}
+    auxConns := make([]*wire.Conn, numServers)
+    for i:=0; i < numServers; i++ {
+        a, b := net.Pipe()
+        t.Cleanup(func() {
+            a.Close()
+            b.Close()
+        })
+        auxConns[i] = wire.NewConnVersion(a, fmt.Sprintf("server %d", i), wire.MaxVersion)
+        _, signKey, err := ed25519.GenerateKey(rand.Reader)
+        if err != nil {
+            t.Fatal(err)
+        }
+        d.signKeys = append(d.signKeys, signKey)
+        var stockpile *Stockpile
+        if opts.stockpileDirs != nil {
+            stockpile, err = OpenStockpile(opts.stockpileDirs[i])
+            if err != nil {
+                t.Fatal(err)
+            }
+            d.stockpiles = append(d.stockpiles, stockpile)
+        }
+        conf := ServerConfig{
+            ServerNum: i,
+            Peers: peers[0][i],
+            ShufflePeers: peers[1][i],
+            VerificationPeers: peers[2][i],
+            RevealPeers: peers[3][i],
+            Aux: wire.NewConnVersion(b, "aux", wire.MaxVersion),
+            AuxKey: auxKeys[i],
+            Session: session,
+            Stockpile: stockpile,
+            CheckAux: opts.check,
+            SignKey: signKey,
+            Timeout: timeout,
+        }
+        if opts.offline {
+            conf.Aux, conf.Session, conf.OfflineAux = nil, nil, true
+        }
+        if opts.dealerFree {
+            //there are no keys shared with an aux either
+            conf.Aux, conf.AuxKey, conf.Session, conf.DealerFree = nil, nil, nil, true
+            conf.PaillierKeyBits = testPaillierKeyBits
+        }
+        server, err := NewShuffleServer(conf)
+        if err != nil {
+            t.Fatal(err)
+        }
+        server.SetParams(params)
+        d.servers = append(d.servers, server)
+    }
+    if opts.dealerFree {
+        return d
+    }
+    d.aux, err = NewAuxServer(AuxConfig{Servers: auxConns, Keys: auxKeys, Session: session, Check: opts.check, Timeout: timeout})
+    if err != nil {
+        t.Fatal(err)
+    }
+    d.aux.SetParams(params)
+    return d
+}
+
+//a batch of made up messages and every server's shares of them, the way a client makes them
+//inputs[i] are server i's shares, and plaintexts[j] is the message in row j of them
+func (d *testDeployment) batch(t *testing.T, round uint64) (inputs []Inputs, plaintexts [][]byte) {
+    t.Helper()
+    numServers := len(d.servers)
+    inputs = make([]Inputs, numServers)
+    for i := range inputs {
+        inputs[i] = Inputs{Round: round, Shares: make([][]byte, d.params.BatchSize)}
+    }
+    for row:=0; row < d.params.BatchSize; row++ {
+        plaintext := mycrypto.MakeMsg(d.params.MsgBlocks, row)
+        ct, err := mycrypto.EncryptCT(plaintext)
+        if err != nil {
+            t.Fatal(err)
+        }
+        mac, keySeeds, err := mycrypto.WeirdMac(numServers, ct, d.params.MessagingMode)
+        if err != nil {
+            t.Fatal(err)
+        }
+        bodyShares, err := mycrypto.Share(numServers, append(ct, mac...))
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i:=0; i < numServers; i++ {
+            inputs[i].Shares[row] = append(bodyShares[i], keySeeds[i]...)
+        }
+        plaintexts = append(plaintexts, plaintext)
+    }
+    return inputs, plaintexts
+}
+
+//run a round on every server and the aux at once, or just the servers if they have stockpiles or
+//there's no aux. the aux's part of a round is done before any server can cheat, so it has to succeed
+func (d *testDeployment) run(t *testing.T, inputs []Inputs) ([]Output, []error) {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), 4*testStepTimeout)
+    defer cancel()
+    auxErr := make(chan error, 1)
+    if d.stockpiles != nil || d.aux == nil {
+        auxErr <- nil
+    } else {
+        go func() {
+            _, err := d.aux.RunRound(ctx)
+            auxErr <- err
+        }()
+    }
+
+    outputs := make([]Output, len(d.servers))
+    errs := make([]error, len(d.servers))
+    done := make(chan int, len(d.servers))
+    for i, server := range d.servers {
+        go func(i int, server *ShuffleServer) {
+            outputs[i], errs[i] = server.RunRound(ctx, inputs[i])
+            done <- 1
+        }(i, server)
+    }
+    for range d.servers {
+        <- done
+    }
+    if err := <- auxErr; err != nil {
+        t.Fatalf("aux: %v", err)
+    }
+    return outputs, errs
+}
+
+//have the aux stream bundles into the servers' stockpiles, keeping each at size
+//the returned function stops it and says how many bundles the aux made
+func (d *testDeployment) fill(t *testing.T, size int) func() StockpileOutput {
+    t.Helper()
+    ctx, cancel := context.WithCancel(context.Background())
+    type result struct {
+        out StockpileOutput
+        err error
+    }
+    auxDone := make(chan result, 1)
+    go func() {
+        out, err := d.aux.RunStockpile(context.Background())
+        auxDone <- result{out, err}
+    }()
+    fillErrs := make(chan error, len(d.servers))
+    for _, server := range d.servers {
+        go func(server *ShuffleServer) {
+            fillErrs <- server.FillStockpile(ctx, size)
+        }(server)
+    }
+    return func() StockpileOutput {
+        t.Helper()
+        cancel()
+        for range d.servers {
+            if err := <- fillErrs; err != nil {
+                t.Fatalf("filling a stockpile: %v", err)
+            }
+        }
+        r := <- auxDone
+        if r.err != nil {
+            t.Fatalf("aux: %v", r.err)
+        }
+        return r.out
+    }
+}
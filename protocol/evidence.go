@@ -0,0 +1,81 @@
+package protocol
+
+import (
+    "crypto/ed25519"
+    "encoding/json"
+    "fmt"
+
+    "shufflemessage/mycrypto"
+)
+
+//evidence against a server whose opening didn't match its commitment
+//signed by the server that caught it, so an operator can show it to others
+type Evidence struct {
+    Round uint64 `json:"round"`
+    //which commitment was opened, e.g. "mac differences" or "db"
+    Phase string `json:"phase"`
+    //the server that caught the mismatch
+    Reporter int `json:"reporter"`
+    //the server whose opening didn't match
+    Accused int `json:"accused"`
+    //hash the accused server committed to
+    Commitment []byte `json:"commitment"`
+    //hash of the data it opened
+    OpenedHash []byte `json:"openedHash"`
+    //the reporter's public key and its ed25519 signature over all of the above
+    PublicKey []byte `json:"publicKey"`
+    Signature []byte `json:"signature"`
+}
+
+//the bytes that get signed: the record's json encoding without a signature
+func (e *Evidence) signedBytes() []byte {
+    unsigned := *e
+    unsigned.Signature = nil
+    data, err := json.Marshal(&unsigned)
+    if err != nil {
+        panic(err)
+    }
+    return append([]byte("clarion evidence v1\n"), data...)
+}
+
+func (e *Evidence) sign(key ed25519.PrivateKey) {
+    e.PublicKey = key.Public().(ed25519.PublicKey)
+    e.Signature = ed25519.Sign(key, e.signedBytes())
+}
+
+//build signed evidence against every server whose opening didn't match its commitment
+//commitments and openings are laid out like for mycrypto.CheckHashes
+func gatherEvidence(round uint64, phase string, serverNum int, commitments, openings []byte, openingLen int, key ed25519.PrivateKey) []*Evidence {
+    mismatches := mycrypto.FindHashMismatches(commitments, openings, openingLen, serverNum)
+    records := make([]*Evidence, 0, len(mismatches))
+    for _, accused := range mismatches {
+        e := &Evidence{
+            Round: round,
+            Phase: phase,
+            Reporter: serverNum,
+            Accused: accused,
+            Commitment: commitments[32*accused:32*(accused+1)],
+            OpenedHash: mycrypto.Hash(openings[openingLen*accused:openingLen*(accused+1)]),
+        }
+        e.sign(key)
+        records = append(records, e)
+    }
+    return records
+}
+
+//all servers aborted the round together because some server's opening didn't match its commitment
+//this server only has evidence if it caught the mismatch itself
+type CommitmentError struct {
+    Round uint64
+    //which commitment was opened, like Evidence.Phase
+    Phase string
+    Evidence []*Evidence
+}
+
+func (e *CommitmentError) Error() string {
+    return fmt.Sprintf("round %d aborted: a server's %s opening didn't match its commitment", e.Round, e.Phase)
+}
+
+func (e *CommitmentError) Unwrap() error {
+    return ErrCommitment
+}
@@ -0,0 +1,76 @@
+package protocol
+
+//ways for a shuffle server or the aux to cheat in a round, so tests can check that the servers catch it
+//a party only cheats if a test in this package sets its fault; nothing outside the package can,
+//and one with noFault runs rounds exactly as if this file didn't exist
+
+type fault int
+
+const (
+    noFault fault = iota
+    //change one of the masked shares it broadcasts in the first blind mac verification
+    faultMaskedShares
+    //same, in the second blind mac verification
+    faultMaskedSharesTwo
+    //shuffle with a different permutation than the one the aux derived for it
+    faultPermutation
+    //use a different share translation delta than the aux sent. only the last server gets one
+    faultDelta
+    //change a row of the db after permuting it
+    faultPermutedRow
+    //open a different db share in the reveal than the one it committed to
+    faultReveal
+
+    //the aux's faults, in the online rounds
+    //send server 0 a wrong c share of the first beaver triples
+    faultAuxBeavers
+    //same, for the second beaver triples
+    faultAuxBeaversTwo
+    //send the last server a wrong share translation delta
+    faultAuxDelta
+    //send the last server a share translation delta with its first two rows swapped, which keeps the sum
+    //of every column
+    faultAuxDeltaRows
+)
+
+//a changed copy of data if the server is set to cheat at point, otherwise data itself
+//the first block is changed, which is in the first row of whatever data holds
+func (s *ShuffleServer) tamper(point fault, data []byte) []byte {
+    return tamperIf(s.fault == point, data)
+}
+
+//like ShuffleServer.tamper, for the aux
+func (a *AuxServer) tamper(point fault, data []byte) []byte {
+    return tamperIf(a.fault == point, data)
+}
+
+func tamperIf(cheat bool, data []byte) []byte {
+    if !cheat || len(data) == 0 {
+        return data
+    }
+    tampered := append([]byte(nil), data...)
+    tampered[0] ^= 1
+    return tampered
+}
+
+//delta with its first two rows swapped if the aux is set to cheat that way
+func (a *AuxServer) tamperRows(delta []byte) []byte {
+    rowLen := a.params.blocksPerRow()*16
+    if a.fault != faultAuxDeltaRows || len(delta) < 2*rowLen {
+        return delta
+    }
+    tampered := append([]byte(nil), delta...)
+    copy(tampered[:rowLen], delta[rowLen:2*rowLen])
+    copy(tampered[rowLen:2*rowLen], delta[:rowLen])
+    return tampered
+}
+
+//a different permutation than pi if the server is set to cheat with its permutation
+func (s *ShuffleServer) tamperPerm(pi []int) []int {
+    if s.fault != faultPermutation || len(pi) < 2 {
+        return pi
+    }
+    tampered := append([]int(nil), pi...)
+    tampered[0], tampered[1] = tampered[1], tampered[0]
+    return tampered
+}
@@ -0,0 +1,230 @@
+package protocol
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "errors"
+    "fmt"
+    "testing"
+
+    "shufflemessage/client"
+    "shufflemessage/mycrypto"
+)
+
+//a server that cheats at any point of a round must be caught by the blind mac verifications or the
+//hash commitments, so nothing it tampered with comes out of the round. The one exception is tampering
+//with a masked share in the first verification, which isn't caught, see censorsFirstRow
+
+//the messages revealed by out, in output order
+//errors if a row doesn't verify, which can't happen for an output a round returned
+func revealedMessages(params Params, out Output) ([][]byte, error) {
+    rows, badRows := client.CheckMacsAndDecrypt(out.Merged, params.MsgBlocks, params.BatchSize, params.MessagingMode)
+    if len(badRows) > 0 {
+        return nil, fmt.Errorf("rows %v of the output don't verify", badRows)
+    }
+    return rows, nil
+}
+
+//whether messages holds every plaintext except the skipped ones, in any order
+func holdsPlaintexts(messages, plaintexts [][]byte, skip map[int]bool) bool {
+    found := make([]bool, len(messages))
+    for i, plaintext := range plaintexts {
+        if skip[i] {
+            continue
+        }
+        match := false
+        for j, msg := range messages {
+            if !found[j] && bytes.Equal(msg, plaintext) {
+                found[j], match = true, true
+                break
+            }
+        }
+        if !match {
+            return false
+        }
+    }
+    for i := range skip {
+        for _, msg := range messages {
+            if bytes.Equal(msg, plaintexts[i]) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func TestHonestRound(t *testing.T) {
+    for _, numServers := range []int{2, 3} {
+        for _, messagingMode := range []bool{false, true} {
+            params := Params{MsgBlocks: 2, BatchSize: 16, MessagingMode: messagingMode}
+            d := newDeployment(t, numServers, params, deploymentOpts{})
+            for round := uint64(1); round <= 2; round++ {
+                inputs, plaintexts := d.batch(t, round)
+                outputs, errs := d.run(t, inputs)
+                for i, err := range errs {
+                    if err != nil {
+                        t.Fatalf("%d servers, round %d: server %d: %v", numServers, round, i, err)
+                    }
+                }
+                messages, err := revealedMessages(params, outputs[0])
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if !holdsPlaintexts(messages, plaintexts, nil) {
+                    t.Errorf("%d servers, round %d: output isn't a permutation of the inputs", numServers, round)
+                }
+            }
+        }
+    }
+}
+
+//every server's round has to fail the way check says
+type faultCheck func(t *testing.T, d *testDeployment, cheater int, plaintexts [][]byte, outputs []Output, errs []error)
+
+//NOT caught: the tampered masked share makes the first row fail the first blind mac verification, so
+//every server evicts that honest message and nobody can tell whether its client or a server is to blame.
+//A server can censor messages this way. Until evictions can be blamed, it's only bounded by the cap on
+//evictions per round (see TestEvictionsAreCapped), and this checks that it stays at that: the row is
+//evicted everywhere, nothing else is touched, and no server aborts or accuses anyone
+func censorsFirstRow(t *testing.T, d *testDeployment, cheater int, plaintexts [][]byte, outputs []Output, errs []error) {
+    for i, err := range errs {
+        if err != nil {
+            t.Fatalf("server %d: %v", i, err)
+        }
+        if len(outputs[i].Evicted) != 1 || outputs[i].Evicted[0] != 0 {
+            t.Errorf("server %d evicted rows %v, want [0]", i, outputs[i].Evicted)
+        }
+    }
+    messages, err := revealedMessages(d.params, outputs[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !holdsPlaintexts(messages, plaintexts, map[int]bool{0: true}) {
+        t.Error("output isn't the inputs without the evicted row")
+    }
+}
+
+//the shuffled db doesn't hold valid macs any more, so every server fails the second verification
+func failsVerification(t *testing.T, d *testDeployment, cheater int, plaintexts [][]byte, outputs []Output, errs []error) {
+    for i, err := range errs {
+        if !errors.Is(err, mycrypto.ErrVerification) {
+            t.Errorf("server %d: got %v, want a failed verification", i, err)
+        }
+    }
+}
+
+//the cheater's opening doesn't match its commitment, so every server aborts and the honest ones
+//have signed evidence against it
+func failsCommitment(t *testing.T, d *testDeployment, cheater int, plaintexts [][]byte, outputs []Output, errs []error) {
+    for i, err := range errs {
+        var mismatch *CommitmentError
+        if !errors.As(err, &mismatch) {
+            t.Errorf("server %d: got %v, want a commitment mismatch", i, err)
+            continue
+        }
+        if i == cheater {
+            continue
+        }
+        if len(mismatch.Evidence) != 1 || mismatch.Evidence[0].Accused != cheater {
+            t.Errorf("server %d has evidence %+v, want evidence against server %d", i, mismatch.Evidence, cheater)
+            continue
+        }
+        e := mismatch.Evidence[0]
+        //signed with the key the server was given, which the record names
+        publicKey := d.signKeys[i].Public().(ed25519.PublicKey)
+        if e.Reporter != i || !bytes.Equal(e.PublicKey, publicKey) || !ed25519.Verify(publicKey, e.signedBytes(), e.Signature) {
+            t.Errorf("server %d's evidence isn't signed with its key", i)
+        }
+    }
+}
+
+func TestCheatingServerIsCaught(t *testing.T) {
+    attacks := []struct {
+        name string
+        fault fault
+        //only the last server can cheat with the delta
+        lastOnly bool
+        check faultCheck
+    }{
+        {"masked shares", faultMaskedShares, false, censorsFirstRow},
+        {"masked shares in second verification", faultMaskedSharesTwo, false, failsVerification},
+        {"permutation", faultPermutation, false, failsVerification},
+        {"delta", faultDelta, true, failsVerification},
+        {"permuted row", faultPermutedRow, false, failsVerification},
+        {"reveal", faultReveal, false, failsCommitment},
+    }
+    for _, attack := range attacks {
+        for _, numServers := range []int{2, 3} {
+            for _, messagingMode := range []bool{false, true} {
+                for cheater:=0; cheater < numServers; cheater++ {
+                    if attack.lastOnly && cheater != numServers-1 {
+                        continue
+                    }
+                    attack, messagingMode, cheater := attack, messagingMode, cheater
+                    name := fmt.Sprintf("%s/%d servers/messaging mode %v/server %d cheats", attack.name, numServers, messagingMode, cheater)
+                    t.Run(name, func(t *testing.T) {
+                        params := Params{MsgBlocks: 2, BatchSize: 16, MessagingMode: messagingMode}
+                        d := newDeployment(t, numServers, params, deploymentOpts{})
+                        d.servers[cheater].fault = attack.fault
+                        inputs, plaintexts := d.batch(t, 1)
+                        outputs, errs := d.run(t, inputs)
+                        attack.check(t, d, cheater, plaintexts, outputs, errs)
+                    })
+                }
+            }
+        }
+    }
+}
+
+//a round that fails the second verification leaves the servers ready for the next one
+func TestRoundAfterFailedVerification(t *testing.T) {
+    params := Params{MsgBlocks: 2, BatchSize: 16}
+    for _, numServers := range []int{2, 3} {
+        d := newDeployment(t, numServers, params, deploymentOpts{})
+        d.servers[0].fault = faultPermutation
+        inputs, plaintexts := d.batch(t, 1)
+        outputs, errs := d.run(t, inputs)
+        failsVerification(t, d, 0, plaintexts, outputs, errs)
+        d.servers[0].fault = noFault
+        runHonestRound(t, d, 2)
+    }
+}
+
+//a round evicts up to a tenth of its batch that fails the first verification, and aborts with more
+func TestEvictionsAreCapped(t *testing.T) {
+    params := Params{MsgBlocks: 2, BatchSize: 16}
+    for _, numBad := range []int{2, 3} {
+        d := newDeployment(t, 2, params, deploymentOpts{})
+        inputs, plaintexts := d.batch(t, 1)
+        skip := make(map[int]bool)
+        for row:=0; row < numBad; row++ {
+            inputs[0].Shares[row][0] ^= 1
+            skip[row] = true
+        }
+        outputs, errs := d.run(t, inputs)
+        for i, err := range errs {
+            if numBad > 2 {
+                if !errors.Is(err, mycrypto.ErrVerification) {
+                    t.Errorf("%d bad rows: server %d: got %v, want a failed verification", numBad, i, err)
+                }
+                continue
+            }
+            if err != nil {
+                t.Fatalf("%d bad rows: server %d: %v", numBad, i, err)
+            }
+            if len(outputs[i].Evicted) != numBad {
+                t.Errorf("%d bad rows: server %d evicted rows %v", numBad, i, outputs[i].Evicted)
+            }
+        }
+        if numBad > 2 {
+            continue
+        }
+        messages, err := revealedMessages(params, outputs[0])
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !holdsPlaintexts(messages, plaintexts, skip) {
+            t.Errorf("%d bad rows: output isn't the inputs without the evicted rows", numBad)
+        }
+    }
+}
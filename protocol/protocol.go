@@ -0,0 +1,342 @@
+package protocol
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "shufflemessage/mycrypto"
+    "shufflemessage/wire"
+)
+
+//the rounds of Clarion, for embedding a shuffle server or the aux in a Go program
+//a ShuffleServer runs one round at a time over connections it's given: it takes its shares of a
+//batch of client messages, gets preprocessing from the aux, checks the MACs blindly, shuffles,
+//checks the MACs again and reveals, and hands back the output. An AuxServer prepares the
+//preprocessing the shuffle servers ask it for. Setting up the connections, collecting submissions
+//and publishing outputs is up to the caller, see the server command for how it does it
+
+var (
+    //the inputs don't fit the parameters the round runs with
+    ErrBadInputs = errors.New("protocol: inputs don't match the parameters")
+    //the servers or the aux aren't working on the same round
+    ErrRoundMismatch = errors.New("protocol: parties disagree on the round")
+    //a server's opening didn't match its commitment, see CommitmentError
+    ErrCommitment = errors.New("protocol: opening doesn't match commitment")
+    //another server or the aux broke off, stopped answering or sent something out of step
+    ErrNetwork = errors.New("protocol: network failure")
+)
+
+//a round that was given up on, and why
+//errors.Is(err, ErrNetwork) tells if it was because of a connection, which may then be left in the
+//middle of a message. Errors from mycrypto keep their sentinels, e.g. mycrypto.ErrVerification if a blind
+//mac verification failed, which every server sees at the same point of the round
+type AbortError struct {
+    Round uint64
+    Err error
+}
+
+func (e *AbortError) Error() string {
+    return fmt.Sprintf("round %d aborted: %v", e.Round, e.Err)
+}
+
+func (e *AbortError) Unwrap() error {
+    return e.Err
+}
+
+func (e *AbortError) Is(target error) bool {
+    var connErr *wire.Error
+    return target == ErrNetwork && errors.As(e.Err, &connErr)
+}
+
+//the parameters of a round, the same for all servers and the aux
+type Params struct {
+    //16-byte blocks in each message, not counting the encryption key block
+    MsgBlocks int
+    //messages in a batch
+    BatchSize int
+    //in messaging mode only the first block of each message is MACed
+    MessagingMode bool
+}
+
+//bytes of a server's share of one client message: mac key share, mac and the blocks with the key block
+func (p Params) ShareLength() int {
+    return 32 + 16*(p.MsgBlocks+1)
+}
+
+//blocks in a row of the db once the seeds are expanded
+func (p Params) blocksPerRow() int {
+    if p.MessagingMode {
+        return p.MsgBlocks + 3
+    }
+    return 2*(p.MsgBlocks+1) + 1
+}
+
+func (p Params) numBeavers() int {
+    if p.MessagingMode {
+        return p.BatchSize
+    }
+    return p.BatchSize * (p.MsgBlocks+1)
+}
+
+func (p Params) dbSize() int {
+    return p.blocksPerRow()*p.BatchSize*16
+}
+
+//run f(ctx, i) for every i in [0, n) at once and wait for all of them
+//the first error cancels the ctx the others run under, so they stop too, and is the one returned
+func RunAll(ctx context.Context, n int, f func(ctx context.Context, i int) error) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    errs := make(chan error, n)
+    for i:=0; i < n; i++ {
+        go func(index int) {
+            err := f(ctx, index)
+            if err != nil {
+                cancel()
+            }
+            errs <- err
+        }(i)
+    }
+    var first error
+    for i:=0; i < n; i++ {
+        err := <- errs
+        if err != nil && first == nil {
+            first = err
+        }
+    }
+    return first
+}
+
+//the context of a round
+//any of the round's goroutines that fails cancels it, which stops the others, and every step of
+//the round runs under its own timeout within it
+type roundContext struct {
+    ctx context.Context
+    cancel context.CancelFunc
+    timeout func(step string) time.Duration
+
+    mu sync.Mutex
+    err error
+}
+
+func newRoundContext(parent context.Context, timeout func(step string) time.Duration) *roundContext {
+    ctx, cancel := context.WithCancel(parent)
+    return &roundContext{ctx: ctx, cancel: cancel, timeout: timeout}
+}
+
+//a context for one step, which times out after the step's timeout and ends with the round at the latest
+func (r *roundContext) step(name string) context.Context {
+    ctx, cancel := context.WithTimeout(r.ctx, r.timeout(name))
+    go func() {
+        <- ctx.Done()
+        cancel()
+    }()
+    return ctx
+}
+
+//give up on the round because of err. Only the first error is kept
+func (r *roundContext) fail(err error) {
+    r.mu.Lock()
+    if r.err == nil {
+        r.err = err
+    }
+    r.mu.Unlock()
+    r.cancel()
+}
+
+//why the round failed, nil if it didn't
+func (r *roundContext) failed() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.err != nil {
+        return r.err
+    }
+    return r.ctx.Err()
+}
+
+//wait for n signals on ch, or until the round fails
+//errors if the round failed, even if the signals came, since then some goroutine didn't finish its job
+func (r *roundContext) wait(ch chan int, n int) error {
+    for i:=0; i < n; i++ {
+        select {
+        case <- ch:
+        case <- r.ctx.Done():
+            return r.failed()
+        }
+    }
+    return r.failed()
+}
+
+//the reason to give for the round failing with err: if err is only the cancellation
+//caused by another goroutine's failure, that failure
+func (r *roundContext) reason(err error) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.err != nil && errors.Is(err, context.Canceled) {
+        return r.err
+    }
+    return err
+}
+
+//the round is over, stop whatever's still running
+func (r *roundContext) end() {
+    r.cancel()
+}
+
+//send msg to every other server and receive theirs, all as frames for phase in round
+//everyone's messages have to be the same length. returns all of them concatenated in server order
+//if anything fails, the exchanges with the other servers are cancelled too
+func broadcastAndReceiveFromAll(ctx context.Context, phase wire.Phase, round uint64, msg []byte, conns []*wire.Conn, myNum int) ([]byte, error) {
+    numServers := len(conns)
+    contentLenPerServer := len(msg)
+    content := make([]byte, contentLenPerServer*numServers)
+
+    err := RunAll(ctx, numServers, func(ctx context.Context, i int) error {
+        outputLocation := content[i*contentLenPerServer:(i+1)*contentLenPerServer]
+        if i == myNum {
+            //"receive" from self
+            copy(outputLocation, msg)
+            return nil
+        }
+        //for servers with lower number, read then write
+        //for servers with higher number, write then read
+        if i > myNum {
+            err := conns[i].Send(ctx, phase, round, msg)
+            if err != nil {
+                return err
+            }
+        }
+        data, err := conns[i].Receive(ctx, phase, round, contentLenPerServer)
+        if err != nil {
+            return err
+        }
+        copy(outputLocation, data)
+        if i < myNum {
+            return conns[i].Send(ctx, phase, round, msg)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return content, nil
+}
+
+//send msgs[i] to every other server i and receive a message of the same length back, all as frames
+//for phase in round. returns what each server sent, nil for this one
+func exchangeWithEach(ctx context.Context, phase wire.Phase, round uint64, msgs [][]byte, conns []*wire.Conn, myNum int) ([][]byte, error) {
+    received := make([][]byte, len(conns))
+    err := RunAll(ctx, len(conns), func(ctx context.Context, i int) error {
+        if i == myNum {
+            return nil
+        }
+        //the same order as broadcastAndReceiveFromAll
+        if i > myNum {
+            err := conns[i].Send(ctx, phase, round, msgs[i])
+            if err != nil {
+                return err
+            }
+        }
+        data, err := conns[i].Receive(ctx, phase, round, len(msgs[i]))
+        if err != nil {
+            return err
+        }
+        received[i] = data
+        if i < myNum {
+            return conns[i].Send(ctx, phase, round, msgs[i])
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return received, nil
+}
+
+//everyone says whether they're fine to go on with the round
+//returns false if anyone wants to abort, so all servers abort together
+func agreeToContinue(ctx context.Context, phase wire.Phase, round uint64, ok bool, conns []*wire.Conn, serverNum int) (bool, error) {
+    status := []byte{0}
+    if ok {
+        status[0] = 1
+    }
+    allStatuses, err := broadcastAndReceiveFromAll(ctx, phase, round, status, conns, serverNum)
+    if err != nil {
+        return false, err
+    }
+    for _, s := range allStatuses {
+        if s != 1 {
+            return false, nil
+        }
+    }
+    return true, nil
+}
+
+func expandDB(db [][]byte, msgBlocks int) error {
+    errs := make(chan error)
+    batchSize := len(db)
+    numThreads, chunkSize := mycrypto.PickNumThreads(batchSize)
+
+    for i:=0; i < numThreads; i++ {
+        startIndex := i*chunkSize;
+        endIndex := (i+1)*chunkSize
+        go func(startI, endI int) {
+            for j:=startI; j < endI; j++ {
+                keys, err := mycrypto.AesPRG(msgBlocks*16, db[j][(msgBlocks+1)*16:(msgBlocks+2)*16])
+                if err != nil {
+                    errs <- err
+                    return
+                }
+                copy(db[j][(msgBlocks+1)*16:], keys)
+            }
+            errs <- nil
+        }(startIndex, endIndex)
+    }
+
+    var err error
+    for i:=0; i < numThreads; i++ {
+        if e := <- errs; e != nil {
+            err = e
+        }
+    }
+    return err
+}
+
+//replace the given rows of the db with all zeros
+//a zero row has a valid MAC (zero tag on a zero message under a zero key), so it passes the
+//later checks and just decrypts to garbage that clients ignore
+func evictRows(db [][]byte, rows []int) {
+    for _, row := range rows {
+        for j := range db[row] {
+            db[row][j] = 0
+        }
+    }
+}
+
+//flatten the db
+func flatten(db [][]byte, flatDB []byte){
+    rowLen := len(db[0])
+    for i:= 0; i < len(db); i++ {
+        copy(flatDB[i*rowLen:(i+1)*rowLen], db[i])
+    }
+}
+
+//merge the concatenation of flattened DBs into one DB
+//by taking the elementwise sum of all the DBs
+func mergeFlattenedDBs(flatDBs []byte, numServers, dbSize int) ([]byte, error) {
+    if dbSize % 16 != 0 || len(flatDBs) != numServers*dbSize {
+        return nil, fmt.Errorf("%w: can't merge %d bytes into %d byte dbs from %d servers", mycrypto.ErrLength, len(flatDBs), dbSize, numServers)
+    }
+
+    dbs := make([][]byte, numServers)
+
+    for i := 0; i < numServers; i++ {
+        dbs[i] = flatDBs[i*dbSize:(i+1)*dbSize]
+    }
+
+    return mycrypto.Merge(dbs)
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+    "context"
+    "crypto/rand"
+    "fmt"
+
+    "shufflemessage/mycrypto"
+    "shufflemessage/wire"
+)
+
+//the servers and the aux derive every round's seeds from the keys they share, the round ID and a
+//session the aux picks when they connect, see mycrypto.DeriveSeeds. The session keeps the seeds from
+//repeating if the round IDs start over, e.g. when the leader restarts without a bulletin board
+
+//bytes of a session
+const SessionLength = 16
+
+//pick a new session and send it to every server. the aux does this once it's connected, before the first round
+func StartSession(ctx context.Context, servers []*wire.Conn) ([]byte, error) {
+    session := make([]byte, SessionLength)
+    _, err := rand.Read(session)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", mycrypto.ErrRandomness, err)
+    }
+    err = RunAll(ctx, len(servers), func(ctx context.Context, i int) error {
+        return servers[i].Send(ctx, wire.PhaseSession, 0, session)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return session, nil
+}
+
+//receive the session the aux picked. a server does this once it's connected to the aux
+func JoinSession(ctx context.Context, aux *wire.Conn) ([]byte, error) {
+    return aux.Receive(ctx, wire.PhaseSession, 0, SessionLength)
+}
@@ -0,0 +1,830 @@
+package protocol
+
+import (
+    "bytes"
+    "context"
+    "crypto/ed25519"
+    "errors"
+    "fmt"
+    "time"
+
+    "shufflemessage/config"
+    "shufflemessage/mycrypto"
+    "shufflemessage/wire"
+)
+
+//how a shuffle server is connected to the others
+type ServerConfig struct {
+    //this server's number. server 0 is the leader
+    ServerNum int
+    //the connections to every server in order, nil for this one. the leader announces rounds
+    //and passes on submissions over connections of its own, these only carry the rounds
+    Peers []*wire.Conn
+    //connections to the same servers for the bulk of a round: passing the DB on in the shuffle, the
+    //broadcasts of both blind mac verifications and the reveal. With separate streams (see the mux
+    //package) a DB on its way doesn't hold up the messages on Peers. nil means Peers carries them too
+    ShufflePeers []*wire.Conn
+    VerificationPeers []*wire.Conn
+    RevealPeers []*wire.Conn
+    //the connection to the aux
+    Aux *wire.Conn
+    //the key this server shares with the aux and the session the aux picked, see JoinSession
+    //the seeds of the preprocessing are derived from them, see mycrypto.DeriveSeeds
+    AuxKey *[32]byte
+    Session []byte
+    //where the rounds take their preprocessing from, see FillStockpile. nil means the aux prepares it
+    //when a round starts
+    Stockpile *Stockpile
+    //the aux isn't connected: the stockpile is filled from its files, see ImportAuxFiles, and each
+    //round takes the bundle made for it. Aux and Session aren't needed then
+    OfflineAux bool
+    //there's no aux at all: the servers make each round's preprocessing together, see dealerfree.go.
+    //it's a lot slower, so the preprocessing timeout may need raising. Aux, AuxKey, Session and
+    //Stockpile aren't used. Only secure against semi-honest servers: nothing proves that what a server
+    //encrypts is in range, and a server that encrypts something too big can learn the others'
+    //permutations and shares of b
+    DealerFree bool
+    //bits of this server's Paillier key for dealer-free preprocessing. 0 means 2048. Shorter keys are
+    //faster and only good for tests
+    PaillierKeyBits int
+    //the most messages the first blind mac verification evicts in a round. A round with more bad rows
+    //is aborted with mycrypto.ErrVerification instead. 0 means a tenth of the batch, rounded up. Every
+    //server needs the same cap
+    MaxEvictions int
+    //check the aux's preprocessing before using it, see auxcheck.go. The aux has to send the triples
+    //to sacrifice, see AuxConfig.Check, or put them in its bundles. Not for dealer-free preprocessing
+    CheckAux bool
+    //signs evidence against servers whose openings don't match their commitments
+    SignKey ed25519.PrivateKey
+    //the timeout of each step of a round, see config.Config.Timeout. nil means config.DefaultTimeout for all of them
+    Timeout func(step string) time.Duration
+}
+
+//this server's part of one round
+type Inputs struct {
+    //the round's number, which all servers and the aux have to agree on
+    Round uint64
+    //this server's share of every message of the batch, in the order of the leader's preliminary permutation.
+    //there are Params.BatchSize of them, each Params.ShareLength bytes long
+    Shares [][]byte
+}
+
+//what came out of a round
+type Output struct {
+    Round uint64
+    //this server's share of the shuffled batch, flattened
+    Share []byte
+    //every server's hash commitment to its share, in server order
+    Commitments []byte
+    //the sum of all servers' shares: the shuffled, still encrypted messages, in the format
+    //expected by client.CheckMacsAndDecrypt
+    Merged []byte
+    //rows of the inputs that failed the first blind mac verification and were zeroed out. Nobody is
+    //blamed for them: a server can make a client's row fail as well as the client can
+    Evicted []int
+    Timings Timings
+}
+
+//how long the parts of a round took. Total doesn't count waiting for the aux, checking its preprocessing,
+//or making the preprocessing without one, when there are more than 2 servers
+type Timings struct {
+    BlindMac time.Duration
+    Shuffle time.Duration
+    Reveal time.Duration
+    Total time.Duration
+}
+
+//a shuffle server, which runs the rounds with the other servers and the aux one at a time
+type ShuffleServer struct {
+    serverNum int
+    peers []*wire.Conn
+    shufflePeers []*wire.Conn
+    verificationPeers []*wire.Conn
+    revealPeers []*wire.Conn
+    aux *wire.Conn
+    auxKey *[32]byte
+    session []byte
+    stockpile *Stockpile
+    offlineAux bool
+    checkAux bool
+    //0 for the default, see evictionCap
+    maxEvictions int
+    //nil unless the preprocessing is dealer-free
+    dealerFree *dealerFree
+    signKey ed25519.PrivateKey
+    timeout func(step string) time.Duration
+
+    params Params
+    //buffers reused from round to round
+    db [][]byte
+    flatDB []byte
+
+    //how this server cheats, see faults.go. only tests set it
+    fault fault
+}
+
+func NewShuffleServer(conf ServerConfig) (*ShuffleServer, error) {
+    numServers := len(conf.Peers)
+    if numServers < 2 {
+        return nil, fmt.Errorf("protocol: need at least 2 servers, got %d", numServers)
+    }
+    if conf.ServerNum < 0 || conf.ServerNum >= numServers {
+        return nil, fmt.Errorf("protocol: server %d of %d", conf.ServerNum, numServers)
+    }
+    shufflePeers, verificationPeers, revealPeers := conf.ShufflePeers, conf.VerificationPeers, conf.RevealPeers
+    if shufflePeers == nil {
+        shufflePeers = conf.Peers
+    }
+    if verificationPeers == nil {
+        verificationPeers = conf.Peers
+    }
+    if revealPeers == nil {
+        revealPeers = conf.Peers
+    }
+    for _, peers := range [][]*wire.Conn{conf.Peers, shufflePeers, verificationPeers, revealPeers} {
+        if len(peers) != numServers {
+            return nil, fmt.Errorf("protocol: %d connections for %d servers", len(peers), numServers)
+        }
+        for i, peer := range peers {
+            if (peer == nil) != (i == conf.ServerNum) {
+                return nil, fmt.Errorf("protocol: need a connection to every other server and none to this one, server %d is wrong", i)
+            }
+        }
+    }
+    if conf.SignKey == nil {
+        return nil, errors.New("protocol: missing the signing key")
+    }
+    if conf.MaxEvictions < 0 {
+        return nil, fmt.Errorf("protocol: can't evict %d messages", conf.MaxEvictions)
+    }
+    var df *dealerFree
+    if conf.DealerFree {
+        if conf.Stockpile != nil || conf.OfflineAux {
+            return nil, errors.New("protocol: dealer-free preprocessing doesn't take bundles from an aux")
+        }
+        if conf.CheckAux {
+            return nil, errors.New("protocol: dealer-free preprocessing has no aux to check")
+        }
+        keyBits := conf.PaillierKeyBits
+        if keyBits == 0 {
+            keyBits = defaultPaillierKeyBits
+        }
+        var err error
+        df, err = newDealerFree(keyBits)
+        if err != nil {
+            return nil, err
+        }
+    } else if conf.AuxKey == nil {
+        return nil, errors.New("protocol: missing the aux key")
+    } else if conf.OfflineAux {
+        if conf.Stockpile == nil {
+            return nil, errors.New("protocol: an offline aux needs a stockpile to take its files")
+        }
+    } else {
+        if conf.Aux == nil {
+            return nil, errors.New("protocol: missing the aux connection")
+        }
+        if len(conf.Session) != SessionLength {
+            return nil, fmt.Errorf("protocol: session is %d bytes, not %d", len(conf.Session), SessionLength)
+        }
+    }
+    timeout := conf.Timeout
+    if timeout == nil {
+        timeout = func(string) time.Duration { return config.DefaultTimeout }
+    }
+    return &ShuffleServer{
+        serverNum: conf.ServerNum,
+        peers: conf.Peers,
+        shufflePeers: shufflePeers,
+        verificationPeers: verificationPeers,
+        revealPeers: revealPeers,
+        aux: conf.Aux,
+        auxKey: conf.AuxKey,
+        session: conf.Session,
+        stockpile: conf.Stockpile,
+        offlineAux: conf.OfflineAux,
+        checkAux: conf.CheckAux,
+        maxEvictions: conf.MaxEvictions,
+        dealerFree: df,
+        signKey: conf.SignKey,
+        timeout: timeout,
+    }, nil
+}
+
+//the most messages a round may evict, see ServerConfig.MaxEvictions
+func (s *ShuffleServer) evictionCap() int {
+    if s.maxEvictions > 0 {
+        return s.maxEvictions
+    }
+    return (s.params.BatchSize + 9)/10
+}
+
+//use params for the following rounds
+func (s *ShuffleServer) SetParams(params Params) {
+    s.params = params
+    //data structure for holding batch of messages
+    //each entry will be of length blocksPerRow*16
+    s.db = make([][]byte, params.BatchSize)
+    for i:= 0; i < params.BatchSize; i++ {
+        s.db[i] = make([]byte, params.blocksPerRow()*16)
+    }
+    s.flatDB = make([]byte, params.dbSize())
+}
+
+//run a round with the other servers and the aux
+//any failure aborts the round, with a *CommitmentError if a server's opening didn't match its commitment.
+//after that, all servers can go on with the next round. After any other error the connections may be
+//left in the middle of a message and shouldn't be used for further rounds
+func (s *ShuffleServer) RunRound(ctx context.Context, inputs Inputs) (Output, error) {
+    round := inputs.Round
+    rc := newRoundContext(ctx, s.timeout)
+    abort := func(err error) (Output, error) {
+        err = rc.reason(err)
+        rc.end()
+        return Output{}, &AbortError{Round: round, Err: err}
+    }
+
+    numServers := len(s.peers)
+    serverNum := s.serverNum
+    myNum := serverNum
+    leader := serverNum == 0
+    shuffleConns := s.shufflePeers
+    verificationConns := s.verificationPeers
+    revealConns := s.revealPeers
+    auxConn := s.aux
+    messagingMode := s.params.MessagingMode
+    msgBlocks := s.params.MsgBlocks
+    batchSize := s.params.BatchSize
+    blocksPerRow := s.params.blocksPerRow()
+    numBeavers := s.params.numBeavers()
+    dbSize := s.params.dbSize()
+    db := s.db
+    flatDB := s.flatDB
+
+    shareLength := s.params.ShareLength()
+    if len(inputs.Shares) != batchSize {
+        return abort(fmt.Errorf("%w: %d shares for a batch of %d", ErrBadInputs, len(inputs.Shares), batchSize))
+    }
+    for i, share := range inputs.Shares {
+        if len(share) != shareLength {
+            return abort(fmt.Errorf("%w: share %d is %d bytes, expected %d", ErrBadInputs, i, len(share), shareLength))
+        }
+        copy(db[i], share)
+    }
+
+    numThreads, chunkSize := mycrypto.PickNumThreads(batchSize)
+
+    //the channels are made fresh every round, with room for every signal,
+    //so goroutines of an aborted round can't block or leave signals behind
+    beaverBlocker := make(chan int, 2)
+    beaverBlockerTwo := make(chan int, 2)
+    beaverCBlocker := make(chan int, 1)
+    beaverCBlockerTwo := make(chan int, 1)
+    blocker := make(chan int, 5)
+    deltaBlocker := make(chan int, 1)
+    expansionBlocker := make(chan int, 1)
+    hashBlocker := make(chan int, 1)
+    unflattenBlocker := make(chan int, numThreads)
+
+    //processing phase
+    //NOTE: in reality, the blind verification and aux server stuff could be done as messages arrive
+    //this would speed up the processing time, esp. if the server were multithreaded
+    //but I'm handling everything for a batch at once so I can report performance for processing a batch
+
+    aInitial := make([]byte, 0) //not important for first server
+    bFinal := make([]byte, 0) //not important for last server
+    aAtPermTime := make([]byte, 0) //not important for last server
+    delta := make([]byte, 0) //only important for last server
+    pi := make([]int, 0)
+    beaversA := make([]byte, 0)
+    beaversB := make([]byte, 0)
+    beaversC := make([]byte, 0)
+    beaversATwo := make([]byte, 0)
+    beaversBTwo := make([]byte, 0)
+    beaversCTwo := make([]byte, 0)
+    sacrificed := make([]byte, 0) //only if the aux is checked
+    checkDelta := make([]byte, 0) //only if the aux is checked, for the last server
+
+    startTime := time.Now()
+
+    //seeds for aInitial, bFinal, aAtPermTime, pi, and beaver shares a, b (for both sets of verifications)
+    //the aux derives the same ones
+    var seeds *mycrypto.Seeds
+    //whether the aux sends the preprocessing during the round
+    fromAux := s.stockpile == nil && s.dealerFree == nil
+    if s.dealerFree != nil {
+        //no aux: make the preprocessing with the others before anything else
+        seeds = mycrypto.DeriveSeeds(s.dealerFree.seedKey, nil, round)
+        var err error
+        beaversC, delta, beaversCTwo, err = s.dealerFreePreprocessing(rc.step(config.StepPreprocessing), round, seeds)
+        if err != nil {
+            return abort(err)
+        }
+        blocker <- 1
+        beaverCBlocker <- 1
+        if serverNum == numServers - 1 {
+            deltaBlocker <- 1
+        }
+        beaverCBlockerTwo <- 1
+    } else if s.stockpile != nil {
+        //the aux's part is already here, in a bundle all servers have to pick
+        b, err := s.pickBundle(rc, round)
+        if err != nil {
+            return abort(err)
+        }
+        seeds = mycrypto.DeriveSeeds(s.auxKey, b.session, b.index)
+        beaversC, delta, beaversCTwo, sacrificed, checkDelta = b.beavers, b.delta, b.beaversTwo, b.sacrificed, b.checkDelta
+        blocker <- 1
+        beaverCBlocker <- 1
+        if serverNum == numServers - 1 {
+            deltaBlocker <- 1
+        }
+        beaverCBlockerTwo <- 1
+    } else {
+        seeds = mycrypto.DeriveSeeds(s.auxKey, s.session, round)
+    }
+
+    //everything with the aux runs under the preprocessing timeout
+    auxCtx := rc.step(config.StepPreprocessing)
+
+    //ask the aux for the round's preprocessing
+    if fromAux {
+        go func () {
+            err := auxConn.Send(auxCtx, wire.PhaseRequest, round, nil)
+            if err != nil {
+                rc.fail(err)
+            }
+            blocker <- 1
+        }()
+    }
+    //run f in the background and signal done, or fail the round if f fails
+    background := func(done chan int, f func() error) {
+        go func() {
+            err := f()
+            if err != nil {
+                rc.fail(err)
+            }
+            done <- 1
+        }()
+    }
+    //seed expansion
+    background(expansionBlocker, func() error {
+        if !messagingMode {
+            return expandDB(db, msgBlocks+1)
+        }
+        return nil
+    })
+    //generate the shares for which seeds were sent to the aux server
+    background(beaverBlocker, func() (err error) {
+            beaversA, err = mycrypto.AesPRG(16*numBeavers, seeds.BeaversA)
+            return
+    })
+    background(beaverBlocker, func() (err error) {
+            beaversB, err = mycrypto.AesPRG(16*numBeavers, seeds.BeaversB)
+            return
+    })
+    background(blocker, func() (err error) {
+        pi, err = mycrypto.GenPerm(batchSize, seeds.Perm)
+        return
+    })
+    background(blocker, func() (err error) {
+        if serverNum > 0 {
+            aInitial, err = mycrypto.AesPRG(dbSize, seeds.AInitial)
+        }
+        return
+    })
+    background(blocker, func() (err error) {
+        if serverNum != numServers - 1 {
+            bFinal, err = mycrypto.AesPRG(dbSize, seeds.BFinal)
+        }
+        return
+    })
+    background(blocker, func() (err error) {
+        if serverNum != numServers - 1 {
+            aAtPermTime, err = mycrypto.AesPRG(dbSize, seeds.AAtPermTime)
+        }
+        return
+    })
+    background(beaverBlockerTwo, func() (err error) {
+            beaversATwo, err = mycrypto.AesPRG(16*batchSize, seeds.BeaversATwo)
+            return
+    })
+    background(beaverBlockerTwo, func() (err error) {
+            beaversBTwo, err = mycrypto.AesPRG(16*batchSize, seeds.BeaversBTwo)
+            return
+    })
+
+    go func() {
+        if !fromAux {
+            return
+        }
+        //read beaver triples and share translation stuff
+        //if anything fails, the round is aborted and nobody waits for the rest
+        var err error
+        beaversC, err = auxConn.Receive(auxCtx, wire.PhaseBeavers, round, numBeavers*16)
+        if err != nil {
+            rc.fail(err)
+            return
+        }
+        beaverCBlocker <- 1
+        if serverNum == numServers - 1 {//read delta
+            delta, err = auxConn.Receive(auxCtx, wire.PhaseDelta, round, dbSize)
+            if err != nil {
+                rc.fail(err)
+                return
+            }
+            deltaBlocker <- 1
+        }
+
+        if messagingMode {
+            beaversCTwo, err = auxConn.Receive(auxCtx, wire.PhaseBeaversTwo, round, numBeavers*16)
+        } else { //fewer beaver triples second time
+            beaversCTwo, err = auxConn.Receive(auxCtx, wire.PhaseBeaversTwo, round, batchSize*16)
+        }
+        if err != nil {
+            rc.fail(err)
+            return
+        }
+        if s.checkAux {
+            sacrificed, err = auxConn.Receive(auxCtx, wire.PhaseSacrificedBeavers, round, 16*(numBeavers+batchSize))
+            if err == nil && serverNum == numServers - 1 {
+                checkDelta, err = auxConn.Receive(auxCtx, wire.PhaseCheckDelta, round, dbSize)
+            }
+            if err != nil {
+                rc.fail(err)
+                return
+            }
+        }
+
+        beaverCBlockerTwo <- 1
+    }()
+
+    //make sure all the beaver triple a/b parts are here before proceeding
+    //and that seed expansion is done
+    err := rc.wait(beaverBlocker, 2)
+    if err == nil {
+        err = rc.wait(expansionBlocker, 1)
+    }
+    if err != nil {
+        return abort(err)
+    }
+
+    //with 2 servers, each part of the preprocessing is only waited for when it's needed. Checking the aux
+    //needs all of it first
+    lazy := numServers == 2 && !s.checkAux
+
+    //if numServers > 2, timing starts here, wait to have all aux stuff. If numServers == 2, timing starts earlier with processing phase
+    if !lazy {
+        err = rc.wait(blocker, 5)
+        if err == nil {
+            err = rc.wait(beaverCBlocker, 1)
+        }
+        if err == nil && serverNum == numServers - 1 {
+            err = rc.wait(deltaBlocker, 1)
+        }
+        if err == nil {
+            err = rc.wait(beaverBlockerTwo, 2)
+        }
+        if err == nil {
+            err = rc.wait(beaverCBlockerTwo, 1)
+        }
+        if err != nil {
+            return abort(err)
+        }
+
+        if s.checkAux {
+            err = s.checkAuxPreprocessing(rc.step(config.StepPreprocessing), round, seeds, &auxPreprocessing{
+                a: append(append([]byte(nil), beaversA...), beaversATwo...),
+                b: append(append([]byte(nil), beaversB...), beaversBTwo...),
+                c: append(append([]byte(nil), beaversC...), beaversCTwo...),
+                sacrificed: sacrificed,
+                pi: pi,
+                aInitial: aInitial,
+                aAtPermTime: aAtPermTime,
+                bFinal: bFinal,
+                delta: delta,
+                checkDelta: checkDelta,
+            })
+            var mismatch *CommitmentError
+            if errors.As(err, &mismatch) {
+                rc.end()
+                return Output{}, mismatch
+            }
+            if err != nil {
+                return abort(err)
+            }
+        }
+
+        if numServers > 2 {
+            startTime = time.Now()
+        }
+    }
+
+    blindMacStartTime := time.Now()
+
+    //blind mac verification
+
+    //expand the key shares into the individual mac key shares, mask them and the msg shares with part of a beaver triple
+    maskedStuff := mycrypto.GetMaskedStuff(batchSize, msgBlocks+1, myNum, beaversA, beaversB, db, messagingMode, false)
+    maskedStuff = s.tamper(faultMaskedShares, maskedStuff)
+
+    blindMacCtx := rc.step(config.StepBlindMac)
+
+    //everyone distributes shares and then merges them
+    maskedShares, err := broadcastAndReceiveFromAll(blindMacCtx, wire.PhaseMaskedShares, round, maskedStuff, verificationConns, serverNum)
+    if err != nil {
+        return abort(err)
+    }
+
+    mergedMaskedShares, err := mergeFlattenedDBs(maskedShares, numServers, len(maskedStuff))
+    if err != nil {
+        return abort(err)
+    }
+
+    if lazy {
+        err = rc.wait(beaverCBlocker, 1)
+        if err != nil {
+            return abort(err)
+        }
+    }
+
+    //everyone computes (computed mac - provided tag) shares
+    macDiffShares := mycrypto.BeaverProduct(msgBlocks+1, batchSize, beaversC, mergedMaskedShares, db, leader, messagingMode, false, false)
+
+    //broadcast shares
+    finalMacDiffShares, err := broadcastAndReceiveFromAll(blindMacCtx, wire.PhaseMacDiffShares, round, macDiffShares, verificationConns, serverNum)
+    if err != nil {
+        return abort(err)
+    }
+
+    //verify the mac differences come out to 0
+    //a server can send different shares to different servers, so first make sure everyone opened the
+    //same mac differences. Then everyone finds the same bad rows, and the rows that remain are the ones
+    //every server checked to be zero. We don't reopen anything for them since masking new values with
+    //the same beaver triples would leak them
+    digests, err := broadcastAndReceiveFromAll(blindMacCtx, wire.PhaseMacDiffDigest, round, mycrypto.Hash(finalMacDiffShares), verificationConns, serverNum)
+    if err != nil {
+        return abort(err)
+    }
+    for i:=1; i < numServers; i++ {
+        if !bytes.Equal(digests[:32], digests[32*i:32*(i+1)]) {
+            return abort(fmt.Errorf("%w: servers %d and 0 opened different mac differences", mycrypto.ErrVerification, i))
+        }
+    }
+    //the messages of the bad rows are evicted: the rows are zeroed out everywhere, which gives them a
+    //valid mac, and the round goes on with the rest. Any server can make a row fail by adding to its
+    //masked share, so a bad row doesn't mean a bad client. The rows are evicted without blame, and the
+    //number evicted is capped to bound how much of a batch a server can censor
+    badRows := mycrypto.FindNonZeroShares(batchSize, numServers, finalMacDiffShares)
+    if len(badRows) > s.evictionCap() {
+        return abort(fmt.Errorf("%w: %d messages fail the mac check, more than the %d that may be evicted", mycrypto.ErrVerification, len(badRows), s.evictionCap()))
+    }
+    evictRows(db, badRows)
+
+
+    blindMacElapsedTime := time.Since(blindMacStartTime)
+
+    //make sure the self-computed share translation stuff is ready if numServers == 2
+    if lazy {
+        err = rc.wait(blocker, 5)
+        if err != nil {
+            return abort(err)
+        }
+    }
+
+    pi = s.tamperPerm(pi)
+
+    shuffleStartTime := time.Now()
+    shuffleCtx := rc.step(config.StepShuffle)
+
+    //shuffle
+    flatten(db, flatDB)
+    if serverNum != 0 { //everyone masks their DB share and sends it to server 0
+
+        mycrypto.AddOrSub(flatDB, aInitial, true)//false is for subtraction
+        err = shuffleConns[0].Send(shuffleCtx, wire.PhaseShuffleInput, round, flatDB)
+        if err != nil {
+            return abort(err)
+        }
+    } else { //server 0 does the shuffle
+
+        //receive all the values masked with aInitial
+        for i:=1; i < numServers; i++ {
+            maskedDB, err := shuffleConns[i].Receive(shuffleCtx, wire.PhaseShuffleInput, round, dbSize)
+            if err != nil {
+                return abort(err)
+            }
+            mycrypto.AddOrSub(flatDB, maskedDB, true)
+        }
+
+        //permute and apply delta, mask result and send to server 1
+        flatDB = s.tamper(faultPermutedRow, mycrypto.PermuteDB(flatDB, pi))
+        mycrypto.AddOrSub(flatDB, aAtPermTime, true)
+        err = shuffleConns[1].Send(shuffleCtx, wire.PhaseShuffle, round, flatDB)
+        if err != nil {
+            return abort(err)
+        }
+    }
+    //the middle servers take turns shuffling
+    if serverNum != 0 && serverNum != numServers - 1 {
+        //complete the vector to be permuted (read from prev server)
+        sAtPermTime, err := shuffleConns[serverNum-1].Receive(shuffleCtx, wire.PhaseShuffle, round, dbSize)
+        if err != nil {
+            return abort(err)
+        }
+
+        //permute and apply delta, mask and send to next server
+        flatDB = s.tamper(faultPermutedRow, mycrypto.PermuteDB(sAtPermTime, pi))
+        mycrypto.AddOrSub(flatDB, aAtPermTime, true)
+        err = shuffleConns[serverNum+1].Send(shuffleCtx, wire.PhaseShuffle, round, flatDB)
+        if err != nil {
+            return abort(err)
+        }
+    }
+    //the last server shuffles
+    if serverNum == numServers - 1 {
+        //complete the vector to be permuted (read from prev server)
+        sAtPermTime, err := shuffleConns[serverNum-1].Receive(shuffleCtx, wire.PhaseShuffle, round, dbSize)
+        if err != nil {
+            return abort(err)
+        }
+
+        //permute and apply delta
+        flatDB = s.tamper(faultPermutedRow, mycrypto.PermuteDB(sAtPermTime, pi))
+
+        if lazy {
+            err = rc.wait(deltaBlocker, 1)
+            if err != nil {
+                return abort(err)
+            }
+        }
+
+        mycrypto.AddOrSub(flatDB, s.tamper(faultDelta, delta), true)
+    }
+    //bFinal is actually the db here for everyone except the final server
+    if serverNum != numServers - 1 {
+        flatDB = bFinal
+    }
+    //the rows of db point into flatDB from here on, so keep it for the next round
+    s.flatDB = flatDB
+
+    shuffleElapsedTime := time.Since(shuffleStartTime)
+
+
+    //second blind mac verification
+
+    //unflatten DB
+    for i:=0; i < numThreads; i++ {
+        startI := i*chunkSize
+        endI := (i+1)*chunkSize
+        go func(startIndex, endIndex int) {
+            for j:=startIndex; j < endIndex; j++ {
+                db[j] = flatDB[j*blocksPerRow*16:(j+1)*blocksPerRow*16]
+            }
+            unflattenBlocker <- 1
+        }(startI, endI)
+    }
+
+
+    //start the hash of the final DB here in the background
+    hash := make([]byte, 0)
+    go func() {
+        //hash the whole db
+        hash = mycrypto.Hash(flatDB)
+        hashBlocker <- 1
+    }()
+
+
+
+    if lazy {
+        err = rc.wait(beaverBlockerTwo, 2)
+        if err != nil {
+            <- hashBlocker
+            return abort(err)
+        }
+    }
+
+    for i:=0; i < numThreads; i++ {
+        <-unflattenBlocker
+    }
+
+    verificationCtx := rc.step(config.StepVerification)
+    //the hash reads flatDB, which the next round reuses, so it has to be done before we return
+    abortVerification := func(err error) (Output, error) {
+        <- hashBlocker
+        return abort(err)
+    }
+
+    //expand the key shares into the individual mac key shares, mask them and the msg shares with part of a beaver triple
+    maskedStuff = mycrypto.GetMaskedStuff(batchSize, msgBlocks+1, myNum, beaversATwo, beaversBTwo, db, messagingMode, true)
+    maskedStuff = s.tamper(faultMaskedSharesTwo, maskedStuff)
+
+    //everyone distributes shares and then merges them
+    maskedShares, err = broadcastAndReceiveFromAll(verificationCtx, wire.PhaseMaskedSharesTwo, round, maskedStuff, verificationConns, serverNum)
+    if err != nil {
+        return abortVerification(err)
+    }
+
+    mergedMaskedShares, err = mergeFlattenedDBs(maskedShares, numServers, len(maskedStuff))
+    if err != nil {
+        return abortVerification(err)
+    }
+
+    if lazy {
+        err = rc.wait(beaverCBlockerTwo, 1)
+        if err != nil {
+            return abortVerification(err)
+        }
+    }
+
+    //everyone computes (computed mac - provided tag) shares
+    macDiffShares = mycrypto.BeaverProduct(msgBlocks+1, batchSize, beaversCTwo, mergedMaskedShares, db, leader, messagingMode, true, true)
+
+    //hash macDiffShares and distribute as a commitment.
+    hashedMacDiffShares := mycrypto.Hash(macDiffShares)
+    allHashedMacDiffShares, err := broadcastAndReceiveFromAll(verificationCtx, wire.PhaseMacDiffCommitment, round, hashedMacDiffShares, verificationConns, serverNum)
+    if err != nil {
+        return abortVerification(err)
+    }
+
+    //broadcast shares
+    finalMacDiffShares, err = broadcastAndReceiveFromAll(verificationCtx, wire.PhaseMacDiffSharesTwo, round, macDiffShares, verificationConns, serverNum)
+    if err != nil {
+        return abortVerification(err)
+    }
+
+    //check that the broadcasted shares match the commitment
+    //if someone's don't, abort the round everywhere and hand back the evidence
+    macEvidence := gatherEvidence(round, "mac differences", serverNum, allHashedMacDiffShares, finalMacDiffShares, len(macDiffShares), s.signKey)
+    ok, err := agreeToContinue(verificationCtx, wire.PhaseMacStatus, round, len(macEvidence) == 0, verificationConns, serverNum)
+    if err != nil {
+        return abortVerification(err)
+    }
+    if !ok {
+        rc.end()
+        <- hashBlocker
+        return Output{}, &CommitmentError{Round: round, Phase: "mac differences", Evidence: macEvidence}
+    }
+
+    //verify the macs come out to 0
+    //everyone got the same shares and agreed to go on, so everyone fails here together
+    success := mycrypto.CheckSharesAreZero(numThreads, numServers, finalMacDiffShares)
+    if !success {
+        return abortVerification(fmt.Errorf("%w: second blind mac verification", mycrypto.ErrVerification))
+    }
+
+    revealTimeStart := time.Now()
+
+
+    //commit, reveal, mac verify, decrypt
+
+    //make sure we're done hashing the DB
+    <- hashBlocker
+
+    revealCtx := rc.step(config.StepReveal)
+
+    //send out hash (commitments)
+    hashes, err := broadcastAndReceiveFromAll(revealCtx, wire.PhaseDBCommitment, round, hash, revealConns, serverNum)
+    if err != nil {
+        return abort(err)
+    }
+
+    //send out full DB after getting everyone's commitment
+    flatDBs, err := broadcastAndReceiveFromAll(revealCtx, wire.PhaseDB, round, s.tamper(faultReveal, flatDB), revealConns, serverNum)
+    if err != nil {
+        return abort(err)
+    }
+
+    //check that the received DBs match the received hashes
+    dbEvidence := gatherEvidence(round, "db", serverNum, hashes, flatDBs, dbSize, s.signKey)
+    ok, err = agreeToContinue(revealCtx, wire.PhaseRevealStatus, round, len(dbEvidence) == 0, revealConns, serverNum)
+    if err != nil {
+        return abort(err)
+    }
+    rc.end()
+    if !ok {
+        return Output{}, &CommitmentError{Round: round, Phase: "db", Evidence: dbEvidence}
+    }
+    //merge DBs
+    mergedDB, err := mergeFlattenedDBs(flatDBs, numServers, len(flatDB))
+    if err != nil {
+        return Output{}, &AbortError{Round: round, Err: err}
+    }
+
+    revealElapsedTime := time.Since(revealTimeStart)
+    elapsedTime := time.Since(startTime)
+
+    return Output{
+        Round: round,
+        Share: append([]byte(nil), flatDB...), //flatDB gets reused next round
+        Commitments: hashes,
+        Merged: mergedDB,
+        Evicted: badRows,
+        Timings: Timings{
+            BlindMac: blindMacElapsedTime,
+            Shuffle: shuffleElapsedTime,
+            Reveal: revealElapsedTime,
+            Total: elapsedTime,
+        },
+    }, nil
+}
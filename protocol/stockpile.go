@@ -0,0 +1,791 @@
+package protocol
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "shufflemessage/config"
+    "shufflemessage/mycrypto"
+    "shufflemessage/wire"
+)
+
+//offline preprocessing: instead of preparing each round's preprocessing when the servers start the
+//round, the aux makes bundles of it ahead of time and streams them to the servers, which keep them in
+//a Stockpile on disk. A bundle is one server's part of one round's preprocessing: its beaver triple
+//c shares for both verifications, for the last server the share translation delta, and if the servers
+//check the aux (see ServerConfig.CheckAux) the sacrificed triples and, for the last server, the second
+//delta. Its seeds are
+//derived like a round's (see mycrypto.DeriveSeeds), from a session the aux picks for the stream and the
+//bundle's index in it, so no two bundles share seeds, and none shares them with an online round.
+//
+//at the start of a round the leader takes its oldest bundle and tells the others which one it is. They
+//take the same one, dropping any older ones they still hold, or the round is aborted on all servers with
+//ErrStockpile. A bundle's file is deleted before the bundle is used, so it's never used twice, even if the
+//server restarts in the middle of a round
+
+//the stockpiles of the servers don't hold the same bundle for a round, or the aux sent a bundle that
+//doesn't fit the round's parameters. Every server aborts the round at the same point, so they can go on
+var ErrStockpile = errors.New("protocol: stockpiles out of step")
+
+//bytes of a bundle's ID: its index and the session it's from
+const bundleIDLength = 8 + SessionLength
+
+//one server's part of the preprocessing of one round
+type bundle struct {
+    session []byte
+    index uint64
+    params Params
+    beavers []byte
+    //only the last server has one
+    delta []byte
+    beaversTwo []byte
+    //nil unless the aux is checked. only the last server has a checkDelta then
+    sacrificed []byte
+    checkDelta []byte
+}
+
+func (b *bundle) id() []byte {
+    id := make([]byte, bundleIDLength)
+    binary.LittleEndian.PutUint64(id, b.index)
+    copy(id[8:], b.session)
+    return id
+}
+
+//whether the bundle can be used in a round with params, by the last server or another one, and by
+//servers that check the aux or don't
+func (b *bundle) fits(params Params, last, check bool) bool {
+    deltaLength := 0
+    if last {
+        deltaLength = params.dbSize()
+    }
+    sacrificedLength, checkDeltaLength := 0, 0
+    if check {
+        sacrificedLength, checkDeltaLength = 16*(params.numBeavers() + params.BatchSize), deltaLength
+    }
+    return b.params == params &&
+        len(b.beavers) == 16*params.numBeavers() &&
+        len(b.delta) == deltaLength &&
+        len(b.beaversTwo) == 16*params.BatchSize &&
+        len(b.sacrificed) == sacrificedLength &&
+        len(b.checkDelta) == checkDeltaLength
+}
+
+//a bundle on the wire and on disk:
+//  [8 index][16 session][4 msgBlocks][4 batchSize][1 messaging mode]
+//  [4 length][beavers][4 length][delta][4 length][second beavers]
+//followed by [4 length][sacrificed beavers][4 length][check delta] if it's for servers that check the aux.
+//Bundles from before the aux could be checked don't have those, and still decode
+func (b *bundle) encode() []byte {
+    var buf bytes.Buffer
+    buf.Write(b.id())
+    var header [9]byte
+    binary.LittleEndian.PutUint32(header[0:4], uint32(b.params.MsgBlocks))
+    binary.LittleEndian.PutUint32(header[4:8], uint32(b.params.BatchSize))
+    if b.params.MessagingMode {
+        header[8] = 1
+    }
+    buf.Write(header[:])
+    parts := [][]byte{b.beavers, b.delta, b.beaversTwo}
+    if b.sacrificed != nil {
+        parts = append(parts, b.sacrificed, b.checkDelta)
+    }
+    for _, part := range parts {
+        var length [4]byte
+        binary.LittleEndian.PutUint32(length[:], uint32(len(part)))
+        buf.Write(length[:])
+        buf.Write(part)
+    }
+    return buf.Bytes()
+}
+
+func decodeBundle(data []byte) (*bundle, error) {
+    if len(data) < bundleIDLength + 9 {
+        return nil, fmt.Errorf("%w: bundle of %d bytes", mycrypto.ErrLength, len(data))
+    }
+    b := &bundle{
+        index: binary.LittleEndian.Uint64(data[0:8]),
+        session: append([]byte(nil), data[8:bundleIDLength]...),
+    }
+    data = data[bundleIDLength:]
+    b.params = Params{
+        MsgBlocks: int(binary.LittleEndian.Uint32(data[0:4])),
+        BatchSize: int(binary.LittleEndian.Uint32(data[4:8])),
+        MessagingMode: data[8] == 1,
+    }
+    data = data[9:]
+    parts := make([][]byte, 5)
+    for i := range parts {
+        if i == 3 && len(data) == 0 {
+            break
+        }
+        if len(data) < 4 {
+            return nil, fmt.Errorf("%w: bundle ends early", mycrypto.ErrLength)
+        }
+        length := binary.LittleEndian.Uint32(data[0:4])
+        data = data[4:]
+        if uint64(len(data)) < uint64(length) {
+            return nil, fmt.Errorf("%w: bundle ends early", mycrypto.ErrLength)
+        }
+        parts[i] = data[:length]
+        data = data[length:]
+    }
+    if len(data) != 0 {
+        return nil, fmt.Errorf("%w: %d bytes after the bundle", mycrypto.ErrLength, len(data))
+    }
+    b.beavers, b.delta, b.beaversTwo, b.sacrificed, b.checkDelta = parts[0], parts[1], parts[2], parts[3], parts[4]
+    return b, nil
+}
+
+//a server's bundles, one file each in a directory, in the order they came in
+//files are named by a counter, so the oldest bundle has the lowest name
+type Stockpile struct {
+    dir string
+
+    mu sync.Mutex
+    //the bundles not used yet, oldest first
+    entries []stockpileEntry
+    next uint64
+    //closed and replaced whenever a bundle comes in or goes, see changed
+    change chan struct{}
+}
+
+type stockpileEntry struct {
+    file string
+    id []byte
+    params Params
+}
+
+const bundleSuffix = ".bundle"
+
+//open the stockpile kept in dir, which is made if it doesn't exist
+//the bundles already in it are used before any new ones. Only bundles made by the same aux, for a
+//server with the same keys, are any good; others make rounds fail their verifications
+func OpenStockpile(dir string) (*Stockpile, error) {
+    err := os.MkdirAll(dir, 0700)
+    if err != nil {
+        return nil, err
+    }
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    s := &Stockpile{dir: dir, change: make(chan struct{})}
+    names := make([]string, 0, len(files))
+    for _, f := range files {
+        //a bundle that was being written when the server stopped never made it in
+        if strings.HasSuffix(f.Name(), ".tmp") {
+            os.Remove(filepath.Join(dir, f.Name()))
+            continue
+        }
+        if strings.HasSuffix(f.Name(), bundleSuffix) {
+            names = append(names, f.Name())
+        }
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        var counter uint64
+        _, err := fmt.Sscanf(name, "%016x"+bundleSuffix, &counter)
+        if err != nil {
+            return nil, fmt.Errorf("stockpile: unexpected file %s in %s", name, dir)
+        }
+        data, err := ioutil.ReadFile(filepath.Join(dir, name))
+        if err != nil {
+            return nil, err
+        }
+        b, err := decodeBundle(data)
+        if err != nil {
+            return nil, fmt.Errorf("stockpile: %s: %w", name, err)
+        }
+        s.entries = append(s.entries, stockpileEntry{file: name, id: b.id(), params: b.params})
+        s.next = counter + 1
+    }
+    return s, nil
+}
+
+//how many bundles are left
+func (s *Stockpile) Len() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.entries)
+}
+
+//how many bundles are left for rounds with params
+func (s *Stockpile) count(params Params) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n := 0
+    for _, entry := range s.entries {
+        if entry.params == params {
+            n++
+        }
+    }
+    return n
+}
+
+//a channel that's closed the next time a bundle comes in or goes
+func (s *Stockpile) changed() <-chan struct{} {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.change
+}
+
+//call with s.mu held
+func (s *Stockpile) notify() {
+    close(s.change)
+    s.change = make(chan struct{})
+}
+
+//add a bundle. It's on disk by the time this returns
+func (s *Stockpile) put(b *bundle) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    name := fmt.Sprintf("%016x", s.next) + bundleSuffix
+    path := filepath.Join(s.dir, name)
+    err := writeFileSync(path + ".tmp", b.encode())
+    if err == nil {
+        err = os.Rename(path + ".tmp", path)
+    }
+    if err == nil {
+        err = syncDir(s.dir)
+    }
+    if err != nil {
+        os.Remove(path + ".tmp")
+        return err
+    }
+    s.next++
+    s.entries = append(s.entries, stockpileEntry{file: name, id: b.id(), params: b.params})
+    s.notify()
+    return nil
+}
+
+//take the entries at the given indices out of the stockpile and return the bundle of the one at use,
+//which has to be one of them, or nil if use is -1
+//the files are gone from the disk before the bundle is returned, so nothing can use it again
+//call with s.mu held
+func (s *Stockpile) remove(taken map[int]bool, use int) (*bundle, error) {
+    var data []byte
+    var readErr error
+    if use >= 0 {
+        data, readErr = ioutil.ReadFile(filepath.Join(s.dir, s.entries[use].file))
+    }
+    kept := make([]stockpileEntry, 0, len(s.entries))
+    dropped := make([]stockpileEntry, 0, len(taken))
+    for i, entry := range s.entries {
+        if taken[i] {
+            dropped = append(dropped, entry)
+        } else {
+            kept = append(kept, entry)
+        }
+    }
+    s.entries = kept
+    s.notify()
+    for _, entry := range dropped {
+        err := os.Remove(filepath.Join(s.dir, entry.file))
+        if err != nil && !os.IsNotExist(err) {
+            return nil, err
+        }
+    }
+    err := syncDir(s.dir)
+    if err != nil || use < 0 {
+        return nil, err
+    }
+    if readErr != nil {
+        return nil, readErr
+    }
+    return decodeBundle(data)
+}
+
+//the indices up to and including i
+func upTo(i int) map[int]bool {
+    indices := make(map[int]bool)
+    for j:=0; j <= i; j++ {
+        indices[j] = true
+    }
+    return indices
+}
+
+//take the oldest bundle that fits params, dropping the ones before it that don't, e.g. from a
+//parameter set that was run before. Waits for one to come in if there's none
+func (s *Stockpile) takeOldest(ctx context.Context, params Params, last, check bool) (*bundle, error) {
+    for {
+        s.mu.Lock()
+        for len(s.entries) > 0 {
+            b, err := s.remove(upTo(0), 0)
+            if err != nil {
+                s.mu.Unlock()
+                return nil, err
+            }
+            if b.fits(params, last, check) {
+                s.mu.Unlock()
+                return b, nil
+            }
+        }
+        change := s.change
+        s.mu.Unlock()
+        select {
+        case <- change:
+        case <- ctx.Done():
+            return nil, fmt.Errorf("no bundle in the stockpile: %w", ctx.Err())
+        }
+    }
+}
+
+//take the bundle with the given ID and drop all older ones
+//waits for it to come in if it's not there yet, unless a later bundle of its stream is there
+func (s *Stockpile) take(ctx context.Context, id []byte, params Params, last, check bool) (*bundle, error) {
+    index := binary.LittleEndian.Uint64(id[0:8])
+    session := id[8:]
+    for {
+        s.mu.Lock()
+        for i, entry := range s.entries {
+            if bytes.Equal(entry.id, id) {
+                b, err := s.remove(upTo(i), i)
+                s.mu.Unlock()
+                if err != nil {
+                    return nil, err
+                }
+                if !b.fits(params, last, check) {
+                    return nil, fmt.Errorf("%w: bundle %d doesn't fit the round's parameters", ErrStockpile, index)
+                }
+                return b, nil
+            }
+            if bytes.Equal(entry.id[8:], session) && binary.LittleEndian.Uint64(entry.id[0:8]) > index {
+                s.mu.Unlock()
+                return nil, fmt.Errorf("%w: bundle %d isn't in the stockpile", ErrStockpile, index)
+            }
+        }
+        change := s.change
+        s.mu.Unlock()
+        select {
+        case <- change:
+        case <- ctx.Done():
+            return nil, fmt.Errorf("%w: bundle %d didn't come in: %v", ErrStockpile, index, ctx.Err())
+        }
+    }
+}
+
+//take the bundle made for round, the one with the given ID if id isn't nil, and drop all bundles made
+//for earlier rounds. For bundles from aux files, see ImportAuxFiles, which are made for one round each
+func (s *Stockpile) takeRound(round uint64, id []byte, params Params, last, check bool) (*bundle, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    taken := make(map[int]bool)
+    use := -1
+    for i, entry := range s.entries {
+        index := binary.LittleEndian.Uint64(entry.id[0:8])
+        if index < round {
+            taken[i] = true
+        }
+        if use < 0 && index == round && entry.params == params && (id == nil || bytes.Equal(entry.id, id)) {
+            taken[i] = true
+            use = i
+        }
+    }
+    b, err := s.remove(taken, use)
+    if err != nil {
+        return nil, err
+    }
+    if b == nil {
+        return nil, fmt.Errorf("%w: no preprocessing for round %d", ErrStockpile, round)
+    }
+    if !b.fits(params, last, check) {
+        return nil, fmt.Errorf("%w: the preprocessing for round %d doesn't fit its parameters", ErrStockpile, round)
+    }
+    return b, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    _, err = f.Write(data)
+    if err == nil {
+        err = f.Sync()
+    }
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+//make renames and removals in dir stick
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    err = d.Sync()
+    if closeErr := d.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+//the leader picks the round's bundle and everyone takes the same one
+//if a server doesn't have it, all of them abort with ErrStockpile, and the bundle is gone on those that had it.
+//they abort the same way if the leader has none to pick
+func (s *ShuffleServer) pickBundle(rc *roundContext, round uint64) (*bundle, error) {
+    numServers := len(s.peers)
+    last := s.serverNum == numServers - 1
+    ctx := rc.step(config.StepPreprocessing)
+
+    var b *bundle
+    var takeErr error
+    if s.serverNum == 0 {
+        //with an offline aux the bundle is the one made for the round, if there is one. Without one,
+        //the others are sent an ID of zeros, which no bundle has, so everyone aborts together
+        id := make([]byte, bundleIDLength)
+        if s.offlineAux {
+            b, takeErr = s.stockpile.takeRound(round, nil, s.params, last, s.checkAux)
+        } else {
+            //like the others below, we wait at most half the step, so there's time left to tell them
+            takeCtx, cancel := context.WithTimeout(ctx, s.timeout(config.StepPreprocessing)/2)
+            b, takeErr = s.stockpile.takeOldest(takeCtx, s.params, last, s.checkAux)
+            cancel()
+            if takeErr != nil && !errors.Is(takeErr, ErrStockpile) {
+                takeErr = fmt.Errorf("%w: %v", ErrStockpile, takeErr)
+            }
+        }
+        if b != nil {
+            id = b.id()
+        }
+        err := RunAll(ctx, numServers-1, func(ctx context.Context, i int) error {
+            return s.peers[i+1].Send(ctx, wire.PhaseBundleChoice, round, id)
+        })
+        if err != nil {
+            return nil, err
+        }
+    } else {
+        id, err := s.peers[0].Receive(ctx, wire.PhaseBundleChoice, round, bundleIDLength)
+        if err != nil {
+            return nil, err
+        }
+        //not having the bundle is said below, so everyone aborts together
+        if s.offlineAux {
+            b, takeErr = s.stockpile.takeRound(round, id, s.params, last, s.checkAux)
+        } else if bytes.Equal(id, make([]byte, bundleIDLength)) {
+            takeErr = fmt.Errorf("%w: the leader has no bundle", ErrStockpile)
+        } else {
+            //we wait for it at most half the step, so the others are still waiting for us then
+            takeCtx, cancel := context.WithTimeout(ctx, s.timeout(config.StepPreprocessing)/2)
+            b, takeErr = s.stockpile.take(takeCtx, id, s.params, last, s.checkAux)
+            cancel()
+        }
+    }
+
+    ok, err := agreeToContinue(rc.step(config.StepPreprocessing), wire.PhaseBundleStatus, round, b != nil, s.peers, s.serverNum)
+    if err != nil {
+        return nil, err
+    }
+    if takeErr != nil {
+        return nil, takeErr
+    }
+    if !ok {
+        return nil, fmt.Errorf("%w: another server doesn't have bundle %d", ErrStockpile, b.index)
+    }
+    return b, nil
+}
+
+//keep the stockpile at size bundles for the parameters set with SetParams until ctx is done: ask the
+//aux for more whenever rounds use some, and store them as they come in. The aux has to run RunStockpile
+//meanwhile. this is the only thing that may use the aux connection while it runs, so rounds have to take their
+//preprocessing from the stockpile. Once ctx is done, the aux is told to stop and the bundles it
+//already sent are stored, then FillStockpile returns nil
+func (s *ShuffleServer) FillStockpile(ctx context.Context, size int) error {
+    if s.stockpile == nil {
+        return errors.New("protocol: the server has no stockpile")
+    }
+    if s.offlineAux {
+        return errors.New("protocol: the aux is offline, its bundles come from files")
+    }
+    if size <= 0 {
+        return fmt.Errorf("protocol: stockpile size must be positive, not %d", size)
+    }
+    params := s.params
+    last := s.serverNum == len(s.peers) - 1
+    check := s.checkAux
+    aux := s.aux
+    timeout := s.timeout(config.StepPreprocessing)
+
+    //bundles are received on their own, so we can ask for more while waiting for them
+    //a nil bundle is the end of the stream
+    type arrival struct {
+        b *bundle
+        err error
+    }
+    arrivals := make(chan arrival)
+    //not ctx, the bundles sent before the aux stops still have to be received after it's done
+    recvCtx, cancelRecv := context.WithCancel(context.Background())
+    defer cancelRecv()
+    go func() {
+        for {
+            var a arrival
+            frame, err := aux.ReceiveAnyRound(recvCtx, wire.PhaseBundle, -1)
+            if err == nil && len(frame.Payload) > 0 {
+                a.b, err = decodeBundle(frame.Payload)
+                if err == nil && (a.b.index != frame.Round || !a.b.fits(params, last, check)) {
+                    err = fmt.Errorf("%w: the aux sent a bundle that doesn't fit", ErrStockpile)
+                }
+            }
+            a.err = err
+            select {
+            case arrivals <- a:
+            case <- recvCtx.Done():
+                return
+            }
+            if a.err != nil || a.b == nil {
+                return
+            }
+        }
+    }()
+    //requests aren't cut off when ctx is done, so the stop request still goes out after them
+    request := func(n int) error {
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        defer cancel()
+        count := make([]byte, 4)
+        binary.LittleEndian.PutUint32(count, uint32(n))
+        return aux.Send(ctx, wire.PhaseBundleRequest, 0, count)
+    }
+    store := func(a arrival) error {
+        if a.err != nil {
+            return a.err
+        }
+        if a.b == nil {
+            return fmt.Errorf("%w: the aux stopped sending bundles", ErrStockpile)
+        }
+        return s.stockpile.put(a.b)
+    }
+
+    //asked for, but not here yet
+    requested := 0
+    for ctx.Err() == nil {
+        change := s.stockpile.changed()
+        //bundles for other parameters don't count, they're dropped when a round comes to them
+        if want := size - s.stockpile.count(params) - requested; want > 0 {
+            err := request(want)
+            if err != nil {
+                return err
+            }
+            requested += want
+        }
+        select {
+        case a := <- arrivals:
+            err := store(a)
+            if err != nil {
+                return err
+            }
+            requested--
+        case <- change:
+        case <- ctx.Done():
+        }
+    }
+
+    //tell the aux to stop and keep what it sent until then
+    err := request(0)
+    if err != nil {
+        return err
+    }
+    stopTimer := time.NewTimer(timeout)
+    defer stopTimer.Stop()
+    for {
+        select {
+        case a := <- arrivals:
+            if a.err == nil && a.b == nil {
+                return nil
+            }
+            err = store(a)
+            if err != nil {
+                return err
+            }
+        case <- stopTimer.C:
+            return fmt.Errorf("the aux didn't stop sending bundles within %s", timeout)
+        }
+    }
+}
+
+//what the aux did in a RunStockpile
+type StockpileOutput struct {
+    //bundles sent to each server
+    Bundles int
+    //time spent making them, not counting waiting for the servers to ask
+    Preprocessing time.Duration
+}
+
+//make bundles for the servers whenever all of them have asked for more, until all of them stop, see
+//FillStockpile. The servers can't run online rounds meanwhile, the aux doesn't answer them.
+//an error leaves the connections in an unknown state, like for RunRound
+func (a *AuxServer) RunStockpile(ctx context.Context) (StockpileOutput, error) {
+    numServers := len(a.conns)
+    conns := a.conns
+    timeout := a.timeout(config.StepPreprocessing)
+
+    //a session of its own for the stream, so its seeds are new
+    session := make([]byte, SessionLength)
+    _, err := rand.Read(session)
+    if err != nil {
+        return StockpileOutput{}, fmt.Errorf("%w: %v", mycrypto.ErrRandomness, err)
+    }
+
+    type request struct {
+        server int
+        count int
+        err error
+    }
+    requests := make(chan request, numServers)
+    recvCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    for i:=0; i < numServers; i++ {
+        go func(index int) {
+            for {
+                r := request{server: index}
+                frame, err := conns[index].ReceiveAnyRound(recvCtx, wire.PhaseBundleRequest, 4)
+                if err == nil {
+                    r.count = int(binary.LittleEndian.Uint32(frame.Payload))
+                }
+                r.err = err
+                select {
+                case requests <- r:
+                case <- recvCtx.Done():
+                    return
+                }
+                //a request for 0 bundles is the server stopping
+                if r.err != nil || r.count == 0 {
+                    return
+                }
+            }
+        }(i)
+    }
+
+    var out StockpileOutput
+    //bundles every server asked for and hasn't got yet
+    credits := make([]int, numServers)
+    stopped := 0
+    for index := uint64(1); stopped < numServers; {
+        ready := stopped == 0
+        for _, c := range credits {
+            ready = ready && c > 0
+        }
+        if ready {
+            startTime := time.Now()
+            bundles, err := makeBundles(a.keys, a.params, session, index, a.check)
+            if err != nil {
+                return out, err
+            }
+            out.Preprocessing += time.Since(startTime)
+            sendCtx, cancelSend := context.WithTimeout(ctx, timeout)
+            err = RunAll(sendCtx, numServers, func(ctx context.Context, i int) error {
+                return conns[i].Send(ctx, wire.PhaseBundle, index, bundles[i].encode())
+            })
+            cancelSend()
+            if err != nil {
+                return out, err
+            }
+            for i := range credits {
+                credits[i]--
+            }
+            out.Bundles++
+            index++
+            continue
+        }
+
+        var r request
+        select {
+        case r = <- requests:
+        case <- ctx.Done():
+            return out, ctx.Err()
+        }
+        if r.err != nil {
+            return out, r.err
+        }
+        if r.count > 0 {
+            credits[r.server] += r.count
+            continue
+        }
+        //no more bundles for anyone once a server stops, they only work if all servers have them
+        stopped++
+        sendCtx, cancelSend := context.WithTimeout(ctx, timeout)
+        err := conns[r.server].Send(sendCtx, wire.PhaseBundle, 0, nil)
+        cancelSend()
+        if err != nil {
+            return out, err
+        }
+    }
+    return out, nil
+}
+
+//every server's bundle with the given index of the stream or aux file with session, from the keys
+//the aux shares with each server. With check, they have triples for the servers to sacrifice
+func makeBundles(keys []*[32]byte, params Params, session []byte, index uint64, check bool) ([]*bundle, error) {
+    numServers := len(keys)
+
+    seeds := make([]*mycrypto.Seeds, numServers)
+    beaversASeeds := make([][]byte, numServers)
+    beaversBSeeds := make([][]byte, numServers)
+    beaversATwoSeeds := make([][]byte, numServers)
+    beaversBTwoSeeds := make([][]byte, numServers)
+    sacrificeASeeds := make([][]byte, numServers)
+    sacrificeBSeeds := make([][]byte, numServers)
+    for i:=0; i < numServers; i++ {
+        seeds[i] = mycrypto.DeriveSeeds(keys[i], session, index)
+        beaversASeeds[i], beaversBSeeds[i] = seeds[i].BeaversA, seeds[i].BeaversB
+        beaversATwoSeeds[i], beaversBTwoSeeds[i] = seeds[i].BeaversATwo, seeds[i].BeaversBTwo
+        sacrificeASeeds[i], sacrificeBSeeds[i] = seeds[i].SacrificeA, seeds[i].SacrificeB
+    }
+    beavers, err := mycrypto.GenBeavers(params.numBeavers(), beaversASeeds, beaversBSeeds)
+    if err != nil {
+        return nil, err
+    }
+    delta, err := mycrypto.GenShareTrans(params.BatchSize, params.blocksPerRow(), seeds)
+    if err != nil {
+        return nil, err
+    }
+    beaversTwo, err := mycrypto.GenBeavers(params.BatchSize, beaversATwoSeeds, beaversBTwoSeeds)
+    if err != nil {
+        return nil, err
+    }
+    sacrificed := make([][]byte, numServers)
+    var checkDelta []byte
+    if check {
+        sacrificed, err = mycrypto.GenBeavers(params.numBeavers() + params.BatchSize, sacrificeASeeds, sacrificeBSeeds)
+        if err != nil {
+            return nil, err
+        }
+        checkDelta, err = mycrypto.GenShareTrans(params.BatchSize, params.blocksPerRow(), checkTranslationSeeds(seeds))
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    bundles := make([]*bundle, numServers)
+    for i := range bundles {
+        bundles[i] = &bundle{
+            session: session,
+            index: index,
+            params: params,
+            beavers: beavers[i],
+            delta: []byte{},
+            beaversTwo: beaversTwo[i],
+            sacrificed: sacrificed[i],
+        }
+        if check {
+            bundles[i].checkDelta = []byte{}
+        }
+    }
+    bundles[numServers-1].delta = delta
+    if check {
+        bundles[numServers-1].checkDelta = checkDelta
+    }
+    return bundles, nil
+}
@@ -0,0 +1,196 @@
+package protocol
+
+import (
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "testing"
+    "time"
+)
+
+//rounds run from bundles the aux streamed into the servers' stockpiles, and a bundle that's been
+//used is gone from the disk, so it can't come back after a restart
+
+//a stockpile directory for each server
+func stockpileDirs(t *testing.T, numServers int) []string {
+    dirs := make([]string, numServers)
+    root := t.TempDir()
+    for i := range dirs {
+        dirs[i] = filepath.Join(root, fmt.Sprintf("server-%d", i))
+    }
+    return dirs
+}
+
+//wait until every server's stockpile holds size bundles
+func (d *testDeployment) waitFull(t *testing.T, size int) {
+    t.Helper()
+    deadline := time.After(testStepTimeout)
+    for _, stockpile := range d.stockpiles {
+        for {
+            change := stockpile.changed()
+            if stockpile.Len() >= size {
+                break
+            }
+            select {
+            case <- change:
+            case <- deadline:
+                t.Fatalf("stockpile has %d bundles, want %d", stockpile.Len(), size)
+            }
+        }
+    }
+}
+
+//run a round on d and check it put out the batch
+func runHonestRound(t *testing.T, d *testDeployment, round uint64) {
+    t.Helper()
+    inputs, plaintexts := d.batch(t, round)
+    outputs, errs := d.run(t, inputs)
+    for i, err := range errs {
+        if err != nil {
+            t.Fatalf("round %d: server %d: %v", round, i, err)
+        }
+    }
+    messages, err := revealedMessages(d.params, outputs[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !holdsPlaintexts(messages, plaintexts, nil) {
+        t.Errorf("round %d: output isn't a permutation of the inputs", round)
+    }
+}
+
+func TestRoundsFromStockpile(t *testing.T) {
+    const size = 3
+    const rounds = 5
+    for _, numServers := range []int{2, 3} {
+        for _, messagingMode := range []bool{false, true} {
+            params := Params{MsgBlocks: 2, BatchSize: 16, MessagingMode: messagingMode}
+            dirs := stockpileDirs(t, numServers)
+            d := newDeployment(t, numServers, params, deploymentOpts{stockpileDirs: dirs})
+            stop := d.fill(t, size)
+            //more rounds than the stockpile holds, so it has to be refilled on the way
+            for round := uint64(1); round <= rounds; round++ {
+                runHonestRound(t, d, round)
+            }
+            d.waitFull(t, size)
+            out := stop()
+
+            //what's left is on disk, and everything else was used up by the rounds
+            for i, dir := range dirs {
+                reopened, err := OpenStockpile(dir)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if reopened.Len() + rounds != out.Bundles {
+                    t.Errorf("%d servers: server %d has %d bundles left after %d rounds, but the aux made %d", numServers, i, reopened.Len(), rounds, out.Bundles)
+                }
+            }
+        }
+    }
+}
+
+func TestStockpileSurvivesRestart(t *testing.T) {
+    const numServers = 3
+    const size = 3
+    params := Params{MsgBlocks: 1, BatchSize: 16}
+    auxKeys := testAuxKeys(t, numServers)
+    dirs := stockpileDirs(t, numServers)
+
+    before := newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs})
+    stop := before.fill(t, size)
+    before.waitFull(t, size)
+    runHonestRound(t, before, 1)
+    before.waitFull(t, size)
+    stop()
+
+    //the restarted servers go on with the bundles they have left, without the aux
+    after := newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs})
+    for i, stockpile := range after.stockpiles {
+        if stockpile.Len() != size {
+            t.Fatalf("server %d has %d bundles after the restart, want %d", i, stockpile.Len(), size)
+        }
+    }
+    for round := uint64(2); round < 2+size; round++ {
+        runHonestRound(t, after, round)
+    }
+    for i, dir := range dirs {
+        files, err := ioutil.ReadDir(dir)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(files) != 0 {
+            t.Errorf("server %d still has %d files after using up its stockpile", i, len(files))
+        }
+    }
+}
+
+func TestMissingBundleAbortsRound(t *testing.T) {
+    const numServers = 3
+    const size = 2
+    params := Params{MsgBlocks: 1, BatchSize: 16}
+    auxKeys := testAuxKeys(t, numServers)
+    dirs := stockpileDirs(t, numServers)
+
+    d := newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs})
+    stop := d.fill(t, size)
+    d.waitFull(t, size)
+    stop()
+
+    //server 1 loses the bundle the leader will pick
+    files, err := ioutil.ReadDir(dirs[1])
+    if err != nil {
+        t.Fatal(err)
+    }
+    names := make([]string, 0, len(files))
+    for _, f := range files {
+        names = append(names, f.Name())
+    }
+    sort.Strings(names)
+    err = os.Remove(filepath.Join(dirs[1], names[0]))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    d = newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs})
+    inputs, _ := d.batch(t, 1)
+    _, errs := d.run(t, inputs)
+    for i, err := range errs {
+        if !errors.Is(err, ErrStockpile) {
+            t.Errorf("server %d: got %v, want the stockpiles out of step", i, err)
+        }
+    }
+    //the bundle is gone everywhere, and the next one works
+    runHonestRound(t, d, 2)
+}
+
+//the leader tells the others it has no bundle, so they don't wait for its choice
+func TestLeaderWithoutBundleAbortsRound(t *testing.T) {
+    const numServers = 3
+    const size = 2
+    params := Params{MsgBlocks: 1, BatchSize: 16}
+    auxKeys := testAuxKeys(t, numServers)
+    dirs := stockpileDirs(t, numServers)
+
+    d := newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs})
+    stop := d.fill(t, size)
+    d.waitFull(t, size)
+    stop()
+
+    //the leader loses its whole stockpile
+    err := os.RemoveAll(dirs[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    d = newDeployment(t, numServers, params, deploymentOpts{auxKeys: auxKeys, stockpileDirs: dirs})
+    inputs, _ := d.batch(t, 1)
+    _, errs := d.run(t, inputs)
+    for i, err := range errs {
+        if !errors.Is(err, ErrStockpile) {
+            t.Errorf("server %d: got %v, want the stockpiles out of step", i, err)
+        }
+    }
+}
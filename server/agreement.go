@@ -0,0 +1,217 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+
+    "shufflemessage/config"
+    "shufflemessage/wire"
+)
+
+//before running anything together, the servers and the aux check they loaded the same parameters
+//otherwise someone reads the wrong number of bytes and everyone waits forever.
+//at connection setup every pair of parties compares the server list and all the parameter sets
+//they're going to run, and at the start of every evaluation the parameter set of that evaluation.
+//they exchange a hash first, and only if the hashes differ the parameters themselves, to say what's different
+
+var errParamMismatch = errors.New("parameters don't match")
+
+//parameters two parties have to agree on
+type agreedParams struct {
+    Servers []string `json:"servers"`
+    //rounds per parameter set, 0 for rounds forever
+    RoundsPerParam int `json:"roundsPerParam"`
+    //index of the parameter set being evaluated, -1 at connection setup
+    Evaluation int `json:"evaluation"`
+    Params []config.Params `json:"params"`
+    //bundles each server stockpiles, 0 for preprocessing when rounds start
+    Stockpile int `json:"stockpile,omitempty"`
+    //the preprocessing comes from aux files, not a connected aux
+    OfflineAux bool `json:"offlineAux,omitempty"`
+    //the servers make the preprocessing themselves, there's no aux
+    DealerFree bool `json:"dealerFree,omitempty"`
+    //the servers check the aux's preprocessing
+    CheckAux bool `json:"checkAux,omitempty"`
+    //the most messages a round evicts, 0 for the default
+    MaxEvictions int `json:"maxEvictions,omitempty"`
+}
+
+//the parameters checked at connection setup: everything that'll be evaluated
+func setupParams(addrs []string, sched schedule, stockpile int, offlineAux, dealerFree, checkAux bool, maxEvictions int, msgBlocksParams, batchSizeParams []int, messagingModeParams []bool) *agreedParams {
+    p := &agreedParams{
+        Servers: addrs,
+        RoundsPerParam: sched.roundsPerParam,
+        Evaluation: -1,
+        Stockpile: stockpile,
+        OfflineAux: offlineAux,
+        DealerFree: dealerFree,
+        CheckAux: checkAux,
+        MaxEvictions: maxEvictions,
+    }
+    for i := 0; i < sched.paramSets(len(msgBlocksParams)); i++ {
+        p.Params = append(p.Params, paramSet(msgBlocksParams[i], batchSizeParams[i], messagingModeParams[i]))
+    }
+    return p
+}
+
+//the parameters checked at the start of evaluation evalNum
+func evaluationParams(addrs []string, sched schedule, evalNum, msgBlocks, batchSize int, messagingMode bool) *agreedParams {
+    return &agreedParams{
+        Servers: addrs,
+        RoundsPerParam: sched.roundsPerParam,
+        Evaluation: evalNum,
+        Params: []config.Params{paramSet(msgBlocks, batchSize, messagingMode)},
+    }
+}
+
+func paramSet(msgBlocks, batchSize int, messagingMode bool) config.Params {
+    mode := config.ModeStandard
+    if messagingMode {
+        mode = config.ModeMessaging
+    }
+    return config.Params{Mode: mode, MsgBlocks: msgBlocks, BatchSize: batchSize}
+}
+
+func (p *agreedParams) encode() []byte {
+    data, err := json.Marshal(p)
+    if err != nil {
+        panic(err)
+    }
+    return data
+}
+
+func (p *agreedParams) hash() []byte {
+    h := sha256.Sum256(p.encode())
+    return h[:]
+}
+
+//the parameters as a list of names and values, in a fixed order
+func (p *agreedParams) fields() ([]string, map[string]string) {
+    var names []string
+    values := make(map[string]string)
+    add := func(name string, value interface{}) {
+        names = append(names, name)
+        values[name] = fmt.Sprint(value)
+    }
+    add("numServers", len(p.Servers))
+    for i, addr := range p.Servers {
+        add(fmt.Sprintf("servers[%d]", i), addr)
+    }
+    add("roundsPerParam", p.RoundsPerParam)
+    add("stockpile", p.Stockpile)
+    add("offlineAux", p.OfflineAux)
+    add("dealerFree", p.DealerFree)
+    add("checkAux", p.CheckAux)
+    add("maxEvictions", p.MaxEvictions)
+    add("evaluation", p.Evaluation)
+    add("paramSets", len(p.Params))
+    for i, set := range p.Params {
+        add(fmt.Sprintf("params[%d].mode", i), set.Mode)
+        add(fmt.Sprintf("params[%d].msgBlocks", i), set.MsgBlocks)
+        add(fmt.Sprintf("params[%d].batchSize", i), set.BatchSize)
+    }
+    return names, values
+}
+
+//one line for every parameter that differs
+func (p *agreedParams) diff(theirs *agreedParams) string {
+    ourNames, ours := p.fields()
+    theirNames, their := theirs.fields()
+    var lines []string
+    for _, name := range ourNames {
+        theirValue, ok := their[name]
+        if !ok {
+            theirValue = "(none)"
+        }
+        if theirValue != ours[name] {
+            lines = append(lines, fmt.Sprintf("  %s: ours %s, theirs %s", name, ours[name], theirValue))
+        }
+    }
+    for _, name := range theirNames {
+        if _, ok := ours[name]; !ok {
+            lines = append(lines, fmt.Sprintf("  %s: ours (none), theirs %s", name, their[name]))
+        }
+    }
+    return strings.Join(lines, "\n")
+}
+
+//send msg and receive the peer's at the same time, so two peers exchanging can't block each other
+func exchange(ctx context.Context, c *wire.Conn, phase wire.Phase, round uint64, msg []byte, length int) ([]byte, error) {
+    sent := make(chan error, 1)
+    go func() {
+        sent <- c.Send(ctx, phase, round, msg)
+    }()
+    theirs, err := c.Receive(ctx, phase, round, length)
+    sendErr := <- sent
+    if err != nil {
+        return nil, err
+    }
+    if sendErr != nil {
+        return nil, sendErr
+    }
+    return theirs, nil
+}
+
+//check that the peer on c has the same parameters as us
+func checkAgreement(ctx context.Context, c *wire.Conn, mine *agreedParams) error {
+    theirHash, err := exchange(ctx, c, wire.PhaseParams, 0, mine.hash(), sha256.Size)
+    if err != nil {
+        return err
+    }
+    if bytes.Equal(theirHash, mine.hash()) {
+        return nil
+    }
+
+    //they'll have noticed too and send theirs
+    data, err := exchange(ctx, c, wire.PhaseParams, 0, mine.encode(), -1)
+    if err != nil {
+        return err
+    }
+    theirs := &agreedParams{}
+    err = json.Unmarshal(data, theirs)
+    if err != nil {
+        return fmt.Errorf("%s: %w, and theirs can't be read: %v", c.Peer(), errParamMismatch, err)
+    }
+    return fmt.Errorf("%s: %w:\n%s", c.Peer(), errParamMismatch, mine.diff(theirs))
+}
+
+//check the parameters with all the peers at once. conns may have nil entries, which are skipped
+//returns an error listing every peer that disagrees
+func checkAgreementWithAll(ctx context.Context, conns []*wire.Conn, mine *agreedParams) error {
+    errs := make([]error, len(conns))
+    blocker := make(chan int)
+    for i := range conns {
+        go func(index int) {
+            if conns[index] != nil {
+                errs[index] = checkAgreement(ctx, conns[index], mine)
+            }
+            blocker <- 1
+        }(i)
+    }
+    for i := 0; i < len(conns); i++ {
+        <- blocker
+    }
+
+    var failed []error
+    for _, err := range errs {
+        if err != nil {
+            failed = append(failed, err)
+        }
+    }
+    if len(failed) == 1 {
+        return failed[0]
+    }
+    if len(failed) > 1 {
+        msgs := make([]string, len(failed))
+        for i, err := range failed {
+            msgs[i] = err.Error()
+        }
+        return fmt.Errorf("%w with %d parties:\n%s", errParamMismatch, len(failed), strings.Join(msgs, "\n"))
+    }
+    return nil
+}
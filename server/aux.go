@@ -1,173 +1,140 @@
 package main
 
 import (
-    "log"
-    "crypto/tls"
-    "net"
+    "context"
     "time"
     "golang.org/x/crypto/nacl/box"
-    "strconv"
-    "strings"
     "runtime"
     "fmt"
     
-    "shufflemessage/mycrypto" 
+    "shufflemessage/protocol"
+    "shufflemessage/keys"
+    "shufflemessage/wire"
+    "shufflemessage/config"
 )
 
-func aux (numServers int, msgBlocksParams, batchSizeParams []int, addrs []string, messagingModeParams []bool) {
+//run the aux until ctx is cancelled or the schedule is done
+//timeout gives the timeout of each step, see config.Config.Timeout
+//like the shuffle servers, the aux stops if a round fails on the network
+//stockpile is the config's, if it isn't 0 the aux streams bundles of preprocessing instead of running rounds
+//check is the config's Aux.Check, whether the servers check the preprocessing
+//maxEvictions is the config's, which the aux only agrees on with the servers
+//tr connects it to the servers, nil means TLS to addrs
+func aux (ctx context.Context, numServers int, msgBlocksParams, batchSizeParams []int, addrs []string, messagingModeParams []bool, sched schedule, stockpile int, check bool, maxEvictions int, timeout func(step string) time.Duration, directory *keys.Directory, secretKeys *keys.SecretKeys, tr transport) error {
     
-    numParams := len(msgBlocksParams)
+    numParams := sched.paramSets(len(msgBlocksParams))
     
-    log.Println("This is the auxiliary server")
+    infof("This is the auxiliary server\n")
     
-    //using a deterministic source of randomness for testing 
-    //this is just for testing so the different parties share a key
-    //in reality the public keys of the servers/auditors should be known 
-    //ahead of time and those would be used
-    pubKeys := make([]*[32]byte, numServers)
-    sharedKeys := make([][32]byte, numServers)
+    sharedKeys := auxSharedKeys(numServers, directory, secretKeys)
     
-    var err error;
-    
-    _, mySecKey, err := box.GenerateKey(strings.NewReader(strings.Repeat("a", 10000)))
-    if err != nil {
-        log.Println(err)
-        return
-    }
-    
-    for i := 0; i < numServers; i++ {
-    	pubKeys[i], _, err = box.GenerateKey(strings.NewReader(strings.Repeat(strconv.Itoa(i),10000)))
-    	if err != nil {
-        	log.Println(err)
-        	return
-    	}
-    	
-    	box.Precompute(&sharedKeys[i], pubKeys[i], mySecKey)
-    }
- 
-    conf := &tls.Config{
-         InsecureSkipVerify: true,
+    if tr == nil {
+        tlsTr, err := newTLSTransport(addrs, "", directory, secretKeys)
+        if err != nil {
+            return err
+        }
+        tr = tlsTr
     }
+    defer tr.Close()
+    setupTimeout := timeout(config.StepSetup)
     
     //connect to each server 
     //holds connections to the shuffle servers
-    conns := make([]net.Conn, numServers)
+    conns := make([]*wire.Conn, numServers)
     
     for i:=0; i < numServers; i++ {
         //connect to each server
-        conns[i], err = tls.Dial("tcp", addrs[i], conf)
+        conn, err := tr.dial(ctx, i, setupTimeout)
+        if err != nil {
+            return err
+        }
+        conns[i], err = handshake(ctx, conn, fmt.Sprintf("server %d", i), setupTimeout)
         if err != nil {
-            log.Println(err)
-            return
+            return err
         }
         defer conns[i].Close()
-        readFromConn(conns[i], 4)
-        writeToConn(conns[i], intToByte(1))
     }
     
+    //the servers have to have loaded the same servers and parameters as we did
+    setupCtx, cancelSetup := context.WithTimeout(ctx, setupTimeout)
+    err := checkAgreementWithAll(setupCtx, conns, setupParams(addrs, sched, stockpile, false, false, check, maxEvictions, msgBlocksParams, batchSizeParams, messagingModeParams))
+    var session []byte
+    if err == nil {
+        //a new session for the seeds, so they're new even if the round IDs aren't
+        session, err = protocol.StartSession(setupCtx, conns)
+    }
+    cancelSetup()
+    if err != nil {
+        return err
+    }
+    
+    auxServer, err := protocol.NewAuxServer(protocol.AuxConfig{Servers: conns, Keys: sharedKeys, Session: session, Check: check, Timeout: timeout})
+    if err != nil {
+        return err
+    }
     
     for evalNum := 0; evalNum < numParams; evalNum++ {
         messagingMode := messagingModeParams[evalNum]
         msgBlocks := msgBlocksParams[evalNum]
         batchSize := batchSizeParams[evalNum]
         
-        log.Printf("numServers %d\n", numServers)
-        log.Printf("msgBlocks %d\n", msgBlocks)
-        log.Printf("batchSize %d\n", batchSize)
+        infof("numServers %d\n", numServers)
+        infof("msgBlocks %d\n", msgBlocks)
+        infof("batchSize %d\n", batchSize)
         
         if messagingMode {
-            log.Println("in messaging mode; only first block is MACed/verified")
+            infof("in messaging mode; only first block is MACed/verified\n")
         }
         
-     
-        blocksPerRow :=  2*(msgBlocks+1) + 1
-        numBeavers := batchSize * (msgBlocks+1)
-        if messagingMode {
-            blocksPerRow = msgBlocks + 3
-            numBeavers = batchSize
+        //the servers may still be finishing the last evaluation, so this isn't bounded
+        err = checkAgreementWithAll(ctx, conns, evaluationParams(addrs, sched, evalNum, msgBlocks, batchSize, messagingMode))
+        if err != nil {
+            return err
+        }
+        
+        
+        auxServer.SetParams(protocol.Params{MsgBlocks: msgBlocks, BatchSize: batchSize, MessagingMode: messagingMode})
+        
+        //with stockpiles, the servers ask for bundles whenever theirs run low, until they're done with the parameter set
+        if stockpile > 0 {
+            out, err := auxServer.RunStockpile(ctx)
+            if err != nil {
+                return err
+            }
+            fmt.Printf("%d servers, %d msgs per batch, %d byte messages\n", numServers, batchSize, msgBlocks*16)
+            if out.Bundles > 0 {
+                fmt.Printf("%d bundles prepared for the stockpiles, average time %s\n\n", out.Bundles, out.Preprocessing/time.Duration(out.Bundles))
+            }
+            infof("%d bundles prepared for the stockpiles\n\n", out.Bundles)
+            continue
         }
         
         totalBatches := 0
         var totalTime time.Duration
         var beaverTotalTime time.Duration
-        blocker := make(chan int)
-        deltaBlocker := make(chan int)
-        beaverBlocker := make(chan int)
-        seeds := make([][]byte, numServers)
         
-        for testCount:=0; testCount < 5; testCount++{
+        for testCount:=0; sched.moreRounds(testCount); testCount++{
             runtime.GC()
-            log.Println("ready")
-            
-            for i:=0; i < numServers; i++ {
-                go func(index int) {
-                    seeds[index] = readFromConn(conns[index], 128)
-                    blocker <- 1
-                }(i)
-            }
+            debugf("ready\n")
             
-            for i:=0; i < numServers; i++ {
-                <- blocker
+            out, err := auxServer.RunRound(ctx)
+            if err != nil {
+                return err
             }
+            round := out.Round
+            elapsedTime := out.Total
+            beaverElapsedTime := out.Beavers
+            debugf("round %d\n", round)
             
-            log.Println("received requests")
-                
-            startTime := time.Now()
-            
-            //generate the preprocessed information for all the parties
-
-            beavers := mycrypto.GenBeavers(numBeavers, 48, seeds)
-            
-            //send servers their beaver stuff
-            for i:=0; i < numServers; i++ {
-                go func(myBeavers []byte, serverNum int) {
-                    writeToConn(conns[serverNum], myBeavers)
-                    if serverNum == numServers - 1 {
-                        deltaBlocker <- 1
-                    }
-                    blocker <- 1
-                }(beavers[i], i)
-            }
-            
-            beaverElapsedTime := time.Since(startTime)
-                    
-            //get the last delta
-            delta := mycrypto.GenShareTrans(batchSize, blocksPerRow, seeds)
-            
-            //send the last server delta
-            go func(){
-                //consume the delta blocker
-                <- deltaBlocker
-                writeToConn(conns[numServers - 1], delta)
-                beaverBlocker <- 1
-            }()
-            
-            //second round of beaver triples
-            beaversTwo := mycrypto.GenBeavers(batchSize, 96, seeds)
-            
-            //make sure the previous messages are all sent
-            for i:=0; i < numServers; i++ {
-                <- blocker
-            }
-            <- beaverBlocker
-            
-            //send beaver stuff
-            for i:=0; i < numServers; i++ {
-                go func(myBeavers []byte, serverNum int) {
-                    writeToConn(conns[serverNum], myBeavers)
-                    blocker <- 1
-                }(beaversTwo[i], i)
-            }
-            for i:=0; i < numServers; i++ {
-                <- blocker
-            }
-            
-            elapsedTime := time.Since(startTime)
             totalTime += elapsedTime
             beaverTotalTime += beaverElapsedTime
             totalBatches++
             
-            if testCount == 4 {
+            if sched.continuous() {
+                infof("round %d preprocessing prepared in %s\n", round, elapsedTime)
+            }
+            
+            if sched.lastRound(testCount) {
                 fmt.Printf("%d servers, %d msgs per batch, %d byte messages\n", numServers, batchSize, msgBlocks*16)
                 if messagingMode {
                     fmt.Printf("Messaging mode\n")
@@ -176,8 +143,41 @@ func aux (numServers int, msgBlocksParams, batchSizeParams []int, addrs []string
                 fmt.Printf("first beaver generation time only: %s, average: %s\n", beaverElapsedTime, beaverTotalTime/time.Duration(totalBatches))
                 fmt.Printf("%d batches prepared, average time %s\n\n", totalBatches, totalTime/time.Duration(totalBatches))
                 
-                log.Printf("%d batches prepared, average time %s\n\n", totalBatches, totalTime/time.Duration(totalBatches))
+                infof("%d batches prepared, average time %s\n\n", totalBatches, totalTime/time.Duration(totalBatches))
             }
         }
     }
+    return nil
+}
+
+//shared keys with the servers, from the aux's secret key and the servers' public keys
+//the preprocessing seeds are derived from them
+func auxSharedKeys(numServers int, directory *keys.Directory, secretKeys *keys.SecretKeys) []*[32]byte {
+    pubKeys := directory.BoxKeys()
+    mySecKey := secretKeys.BoxKey()
+    sharedKeys := make([]*[32]byte, numServers)
+    for i := 0; i < numServers; i++ {
+        sharedKeys[i] = new([32]byte)
+        box.Precompute(sharedKeys[i], pubKeys[i], mySecKey)
+    }
+    return sharedKeys
+}
+
+//the aux as a batch job, for a config whose aux is offline: write the preprocessing of rounds first
+//to last, all with params, to a file per server in dir. Each server's file goes in its stockpile
+//directory before it starts, see ImportAuxFiles in the protocol package. check is the config's Aux.Check
+func auxFiles(dir string, numServers int, first, last uint64, params protocol.Params, check bool, directory *keys.Directory, secretKeys *keys.SecretKeys) error {
+    infof("This is the auxiliary server, writing the preprocessing of rounds %d to %d\n", first, last)
+    startTime := time.Now()
+    paths, err := protocol.WriteAuxFiles(dir, auxSharedKeys(numServers, directory, secretKeys), first, last, check, func(uint64) (protocol.Params, error) {
+        return params, nil
+    })
+    if err != nil {
+        return err
+    }
+    for i, path := range paths {
+        infof("server %d: %s\n", i, path)
+    }
+    infof("%d rounds prepared in %s\n", last - first + 1, time.Since(startTime))
+    return nil
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "syscall"
+
+    "github.com/pkg/profile"
+
+    "shufflemessage/config"
+    "shufflemessage/keys"
+    "shufflemessage/protocol"
+)
+
+//command line
+//  server keygen            make keys and certificates for everyone in a config
+//  server serve             run a shuffle server
+//  server aux               run the aux (preprocessing) server
+//  server bench             run the evaluation sweep over all parameter sets
+//  server client send|fetch submit a message or fetch a round's output
+//  server convert           turn an old style param file into a JSON config
+//every command but convert takes -config, -log and -profile. The ones that act as a server also take -id
+
+func main() {
+    log.SetFlags(log.Lshortfile)
+
+    if len(os.Args) < 2 {
+        usage()
+        os.Exit(2)
+    }
+
+    var err error
+    switch os.Args[1] {
+    case "keygen":
+        err = keygenCommand(os.Args[2:])
+    case "serve":
+        err = serveCommand(os.Args[2:])
+    case "aux":
+        err = auxCommand(os.Args[2:])
+    case "bench":
+        err = benchCommand(os.Args[2:])
+    case "client":
+        err = clientCommand(os.Args[2:])
+    case "convert":
+        err = convertCommand(os.Args[2:])
+    case "help", "-h", "-help", "--help":
+        usage()
+        return
+    default:
+        fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+        usage()
+        os.Exit(2)
+    }
+    if err != nil {
+        log.Println(err)
+        os.Exit(1)
+    }
+}
+
+func usage() {
+    fmt.Fprintln(os.Stderr, `usage: server <command> [flags]
+
+commands:
+  keygen    make keys and TLS certificates for every server and the aux in the config
+  serve     run shuffle server -id. Runs rounds until it's stopped
+  aux       run the aux server. Start it after all the shuffle servers, or before them with -files if it's offline.
+            Not needed if the config has the servers make the preprocessing themselves
+  bench     run the evaluation sweep over all parameter sets in the config. -id -1 is the aux
+  client    send a message (client send) or fetch a round's output (client fetch)
+  convert   turn an old style param file into a JSON config
+
+run server <command> -h for the flags of a command. Every command but convert takes -config (default config.json),
+-log (debug, info or error) and -profile (cpu, mem, mutex, block or trace, written to -profileDir).
+Shuffle servers are numbered 0, 1, ... in config order and should be started in that order, server 0 is the leader.`)
+}
+
+//a context that's cancelled when the process is told to stop with SIGINT or SIGTERM
+//call the returned function when done with it
+func interruptContext() (context.Context, func()) {
+    ctx, cancel := context.WithCancel(context.Background())
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        select {
+        case sig := <- signals:
+            infof("got %s, stopping\n", sig)
+            cancel()
+        case <- ctx.Done():
+        }
+    }()
+    return ctx, func() {
+        signal.Stop(signals)
+        cancel()
+    }
+}
+
+//flags every command has
+type commonFlags struct {
+    configFile *string
+    logLevel *string
+    profileMode *string
+    profileDir *string
+}
+
+func addCommonFlags(flags *flag.FlagSet) *commonFlags {
+    return &commonFlags{
+        configFile: flags.String("config", "config.json", "config file. Old style param files ending in .txt work too"),
+        logLevel: flags.String("log", "info", "log level: debug, info or error"),
+        profileMode: flags.String("profile", "", "profile the run: cpu, mem, mutex, block or trace. Off if empty"),
+        profileDir: flags.String("profileDir", ".", "directory the profile is written to"),
+    }
+}
+
+//apply the log level and start profiling. call the returned function when the command is done
+func (c *commonFlags) setup() (func(), error) {
+    level, err := parseLogLevel(*c.logLevel)
+    if err != nil {
+        return nil, err
+    }
+    currentLogLevel = level
+
+    var mode func(*profile.Profile)
+    switch *c.profileMode {
+    case "":
+        return func() {}, nil
+    case "cpu":
+        mode = profile.CPUProfile
+    case "mem":
+        mode = profile.MemProfile
+    case "mutex":
+        mode = profile.MutexProfile
+    case "block":
+        mode = profile.BlockProfile
+    case "trace":
+        mode = profile.TraceProfile
+    default:
+        return nil, fmt.Errorf("unknown profile %q, use cpu, mem, mutex, block or trace", *c.profileMode)
+    }
+    p := profile.Start(mode, profile.ProfilePath(*c.profileDir))
+    return p.Stop, nil
+}
+
+func (c *commonFlags) loadConfig() (*config.Config, error) {
+    return config.Load(*c.configFile)
+}
+
+//flags for the keys of a server
+type identityFlags struct {
+    directoryFile *string
+    secretKeyFile *string
+}
+
+func addIdentityFlags(flags *flag.FlagSet) *identityFlags {
+    return &identityFlags{
+        directoryFile: flags.String("directory", "", "public key directory of all servers. Overrides the config"),
+        secretKeyFile: flags.String("key", "", "this server's secret key file. Overrides the config"),
+    }
+}
+
+//load the key directory and server serverNum's secret keys, and check they fit the config
+func (f *identityFlags) load(conf *config.Config, serverNum int) (*keys.Directory, *keys.SecretKeys, error) {
+    if *f.directoryFile != "" {
+        conf.Directory = *f.directoryFile
+    }
+    secretKeyFile := *f.secretKeyFile
+    if secretKeyFile == "" {
+        secretKeyFile = conf.KeyFile(serverNum)
+    }
+
+    directory, err := keys.ReadDirectory(conf.DirectoryFile())
+    if err != nil {
+        return nil, nil, err
+    }
+    if len(directory.Servers) != len(conf.Servers) {
+        return nil, nil, fmt.Errorf("the key directory has keys for %d servers but the config has %d servers", len(directory.Servers), len(conf.Servers))
+    }
+    secretKeys, err := keys.ReadSecretKeys(secretKeyFile, directory)
+    if err != nil {
+        return nil, nil, err
+    }
+    if secretKeys.Index != serverNum {
+        return nil, nil, fmt.Errorf("%s holds the keys of server %d, not server %d", secretKeyFile, secretKeys.Index, serverNum)
+    }
+    return directory, secretKeys, nil
+}
+
+func checkServerNum(conf *config.Config, serverNum int, allowAux bool) error {
+    min := 0
+    if allowAux {
+        min = keys.Aux
+    }
+    if serverNum < min || serverNum >= len(conf.Servers) {
+        return fmt.Errorf("-id must be between %d and %d", min, len(conf.Servers)-1)
+    }
+    return nil
+}
+
+//the parameter sets in the form server and aux take them
+func paramLists(conf *config.Config) ([]int, []int, []bool) {
+    msgBlocksParams := make([]int, 0)
+    batchSizeParams := make([]int, 0)
+    messagingModeParams := make([]bool, 0)
+    for _, params := range conf.Params {
+        msgBlocksParams = append(msgBlocksParams, params.MsgBlocks)
+        batchSizeParams = append(batchSizeParams, params.BatchSize)
+        messagingModeParams = append(messagingModeParams, params.MessagingMode())
+    }
+    return msgBlocksParams, batchSizeParams, messagingModeParams
+}
+
+func keygenCommand(args []string) error {
+    flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+    common := addCommonFlags(flags)
+    numServers := flags.Int("servers", 0, "number of shuffle servers. Defaults to the number in the config")
+    outDir := flags.String("out", "", "directory to write the keys to. Defaults to the directory holding the config's key directory")
+    flags.Parse(args)
+
+    stop, err := common.setup()
+    if err != nil {
+        return err
+    }
+    defer stop()
+
+    if *numServers == 0 || *outDir == "" {
+        conf, err := common.loadConfig()
+        if err != nil {
+            return fmt.Errorf("%v (or give -servers and -out)", err)
+        }
+        if *numServers == 0 {
+            *numServers = len(conf.Servers)
+        }
+        if *outDir == "" {
+            *outDir = filepath.Dir(conf.DirectoryFile())
+        }
+    }
+
+    err = keys.GenerateFiles(*numServers, *outDir)
+    if err != nil {
+        return err
+    }
+    infof("wrote keys for %d servers and the aux to %s. Give each server only its own secret key file, and everyone, clients included, %s\n", *numServers, *outDir, keys.DirectoryFileName)
+    return nil
+}
+
+func serveCommand(args []string) error {
+    flags := flag.NewFlagSet("serve", flag.ExitOnError)
+    common := addCommonFlags(flags)
+    identity := addIdentityFlags(flags)
+    serverNum := flags.Int("id", 0, "which server this is, counting from 0 in config order. 0 is the leader")
+    clientAddr := flags.String("clients", "", "address to accept client connections on (addr:port). Defaults to the port of this server's clientAddr in the config. Without one, the leader simulates its clients")
+    boardAddr := flags.String("board", "", "address to serve the bulletin board of round outputs on over HTTP (addr:port). If empty, no board is run")
+    boardDir := flags.String("boardDir", "board", "directory the bulletin board archives round outputs in")
+    boardKeep := flags.Int("boardKeep", 100, "number of past rounds the bulletin board keeps")
+    rounds := flags.Int("rounds", 0, "rounds to run for each parameter set. 0 runs rounds forever on the first parameter set. The aux needs the same value")
+    interval := flags.Duration("interval", 0, "how long a round takes submissions before empty slots are padded with dummy messages. 0 waits for a full batch")
+    evidenceDir := flags.String("evidence", "evidence", "directory to write evidence against misbehaving servers to")
+    verify := flags.Bool("verify", false, "check the MACs of every round's output, and on the leader that it holds the messages it made up in a new order. A failed check stops the server")
+    stockpileDir := flags.String("stockpile", "stockpile", "directory to keep the bundles of preprocessing in if the config has a stockpile, in a server-<id> directory of its own. An offline aux's file for this server goes there too")
+    flags.Parse(args)
+
+    stop, err := common.setup()
+    if err != nil {
+        return err
+    }
+    defer stop()
+
+    conf, err := common.loadConfig()
+    if err != nil {
+        return err
+    }
+    err = checkServerNum(conf, *serverNum, false)
+    if err != nil {
+        return err
+    }
+    directory, secretKeys, err := identity.load(conf, *serverNum)
+    if err != nil {
+        return err
+    }
+    if *clientAddr == "" {
+        *clientAddr = conf.ClientListenAddr(*serverNum)
+    }
+
+    opts := serverOptions{
+        clientAddr: *clientAddr,
+        boardAddr: *boardAddr,
+        boardDir: *boardDir,
+        boardKeep: *boardKeep,
+        evidenceDir: *evidenceDir,
+        sched: schedule{roundsPerParam: *rounds, interval: *interval},
+        verify: *verify,
+        stockpileDir: serverStockpileDir(*stockpileDir, *serverNum),
+    }
+    if opts.sched.continuous() && len(conf.Params) > 1 {
+        infof("running rounds continuously, only the first parameter set is used\n")
+    }
+    ctx, stopServer := interruptContext()
+    defer stopServer()
+    return server(ctx, conf, *serverNum, directory, secretKeys, opts)
+}
+
+func auxCommand(args []string) error {
+    flags := flag.NewFlagSet("aux", flag.ExitOnError)
+    common := addCommonFlags(flags)
+    identity := addIdentityFlags(flags)
+    rounds := flags.Int("rounds", 0, "rounds to run for each parameter set. 0 runs rounds forever on the first parameter set. Must match the shuffle servers")
+    filesDir := flags.String("files", "", "if the config's aux is offline, directory to write the preprocessing files of rounds -from to -to to, one per server, instead of connecting to the servers")
+    from := flags.Uint64("from", 1, "first round to write preprocessing files for, see -files")
+    to := flags.Uint64("to", 0, "last round to write preprocessing files for, see -files")
+    paramSet := flags.Int("params", 0, "index of the parameter set in the config the rounds of the preprocessing files run with, see -files")
+    flags.Parse(args)
+
+    stop, err := common.setup()
+    if err != nil {
+        return err
+    }
+    defer stop()
+
+    conf, err := common.loadConfig()
+    if err != nil {
+        return err
+    }
+    if *filesDir != "" && !conf.Aux.Offline {
+        return fmt.Errorf("-files is only for an offline aux, and the config's isn't")
+    }
+    if conf.Aux.Offline {
+        if *filesDir == "" {
+            return fmt.Errorf("the config's aux is offline, give -files to write its preprocessing files")
+        }
+        if *to < *from || *from == 0 {
+            return fmt.Errorf("-from and -to must give a range of rounds starting at 1 or later, not %d to %d", *from, *to)
+        }
+        if *paramSet < 0 || *paramSet >= len(conf.Params) {
+            return fmt.Errorf("-params must be between 0 and %d", len(conf.Params)-1)
+        }
+        directory, secretKeys, err := identity.load(conf, keys.Aux)
+        if err != nil {
+            return err
+        }
+        p := conf.Params[*paramSet]
+        params := protocol.Params{MsgBlocks: p.MsgBlocks, BatchSize: p.BatchSize, MessagingMode: p.MessagingMode()}
+        return auxFiles(*filesDir, len(conf.Servers), *from, *to, params, conf.Aux.Check, directory, secretKeys)
+    }
+    return runAux(conf, identity, schedule{roundsPerParam: *rounds})
+}
+
+func runAux(conf *config.Config, identity *identityFlags, sched schedule) error {
+    if conf.DealerFree() {
+        return fmt.Errorf("the config has the servers make the preprocessing themselves, there's no aux to run")
+    }
+    if conf.Aux.Offline {
+        return fmt.Errorf("the config's aux is offline, write its preprocessing files with server aux -files before starting the servers")
+    }
+    directory, secretKeys, err := identity.load(conf, keys.Aux)
+    if err != nil {
+        return err
+    }
+    msgBlocksParams, batchSizeParams, messagingModeParams := paramLists(conf)
+    ctx, stop := interruptContext()
+    defer stop()
+    return aux(ctx, len(conf.Servers), msgBlocksParams, batchSizeParams, conf.Addrs(), messagingModeParams, sched, conf.Stockpile, conf.Aux.Check, conf.MaxEvictions, conf.Timeout, directory, secretKeys, nil)
+}
+
+//the evaluation: every parameter set for a few rounds, with the leader simulating the clients
+func benchCommand(args []string) error {
+    flags := flag.NewFlagSet("bench", flag.ExitOnError)
+    common := addCommonFlags(flags)
+    identity := addIdentityFlags(flags)
+    serverNum := flags.Int("id", 0, "which server this is, counting from 0 in config order. 0 is the leader, -1 the aux")
+    rounds := flags.Int("rounds", 5, "rounds to run for each parameter set. All servers and the aux need the same value")
+    evidenceDir := flags.String("evidence", "evidence", "directory to write evidence against misbehaving servers to")
+    verify := flags.Bool("verify", false, "check every round's output, see serve -h. Ignored by the aux")
+    stockpileDir := flags.String("stockpile", "stockpile", "directory to keep the bundles of preprocessing in, see serve -h. Ignored by the aux")
+    flags.Parse(args)
+
+    stop, err := common.setup()
+    if err != nil {
+        return err
+    }
+    defer stop()
+
+    if *rounds <= 0 {
+        return fmt.Errorf("-rounds must be positive")
+    }
+    conf, err := common.loadConfig()
+    if err != nil {
+        return err
+    }
+    err = checkServerNum(conf, *serverNum, true)
+    if err != nil {
+        return err
+    }
+    sched := schedule{roundsPerParam: *rounds}
+    if *serverNum == keys.Aux {
+        return runAux(conf, identity, sched)
+    }
+    directory, secretKeys, err := identity.load(conf, *serverNum)
+    if err != nil {
+        return err
+    }
+    ctx, stopServer := interruptContext()
+    defer stopServer()
+    return server(ctx, conf, *serverNum, directory, secretKeys, serverOptions{
+        evidenceDir: *evidenceDir,
+        sched: sched,
+        verify: *verify,
+        stockpileDir: serverStockpileDir(*stockpileDir, *serverNum),
+    })
+}
+
+//where server serverNum keeps its stockpile, so servers on the same machine can share the -stockpile flag
+func serverStockpileDir(dir string, serverNum int) string {
+    return filepath.Join(dir, fmt.Sprintf("server-%d", serverNum))
+}
+
+//convert an old style param file to a JSON config
+func convertCommand(args []string) error {
+    flags := flag.NewFlagSet("convert", flag.ExitOnError)
+    out := flags.String("out", "", "file to write the JSON config to. Stdout if empty")
+    flags.Usage = func() {
+        fmt.Fprintln(flags.Output(), "usage: server convert [-out config.json] paramFile.txt")
+        flags.PrintDefaults()
+    }
+    flags.Parse(args)
+    if flags.NArg() != 1 {
+        flags.Usage()
+        os.Exit(2)
+    }
+
+    paramFile := flags.Arg(0)
+    f, err := os.Open(paramFile)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    conf, err := config.ParseLegacy(f)
+    if err != nil {
+        return fmt.Errorf("%s: %w", paramFile, err)
+    }
+    if *out == "" {
+        return conf.Write(os.Stdout)
+    }
+    outFile, err := os.Create(*out)
+    if err != nil {
+        return err
+    }
+    err = conf.Write(outFile)
+    if err != nil {
+        outFile.Close()
+        return err
+    }
+    return outFile.Close()
+}
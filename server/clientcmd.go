@@ -0,0 +1,149 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    "shufflemessage/client"
+    "shufflemessage/config"
+    "shufflemessage/keys"
+)
+
+//client send and client fetch, a command line front end for the client package
+//the server addresses, keys and message size all come from the config, so a client
+//only needs the deployment's config file and key directory
+
+func clientCommand(args []string) error {
+    if len(args) < 1 {
+        fmt.Fprintln(os.Stderr, "usage: server client send [flags] message\n       server client fetch [flags]")
+        os.Exit(2)
+    }
+    switch args[0] {
+    case "send":
+        return clientSendCommand(args[1:])
+    case "fetch":
+        return clientFetchCommand(args[1:])
+    }
+    return fmt.Errorf("unknown client command %q, use send or fetch", args[0])
+}
+
+//flags both client commands have
+type clientFlags struct {
+    common *commonFlags
+    directoryFile *string
+    paramSet *int
+    timeout *time.Duration
+}
+
+func addClientFlags(flags *flag.FlagSet) *clientFlags {
+    return &clientFlags{
+        common: addCommonFlags(flags),
+        directoryFile: flags.String("directory", "", "public key directory of the servers. Overrides the config"),
+        paramSet: flags.Int("params", 0, "which of the config's parameter sets the servers are running"),
+        timeout: flags.Duration("timeout", 30*time.Second, "give up after this long"),
+    }
+}
+
+//build a client from the config. also returns the config
+func (f *clientFlags) newClient() (*client.Client, *config.Config, error) {
+    conf, err := f.common.loadConfig()
+    if err != nil {
+        return nil, nil, err
+    }
+    if *f.paramSet < 0 || *f.paramSet >= len(conf.Params) {
+        return nil, nil, fmt.Errorf("-params must be between 0 and %d", len(conf.Params)-1)
+    }
+    if *f.directoryFile != "" {
+        conf.Directory = *f.directoryFile
+    }
+    directory, err := keys.ReadDirectory(conf.DirectoryFile())
+    if err != nil {
+        return nil, nil, err
+    }
+    if len(directory.Servers) != len(conf.Servers) {
+        return nil, nil, fmt.Errorf("the key directory has keys for %d servers but the config has %d servers", len(directory.Servers), len(conf.Servers))
+    }
+
+    params := conf.Params[*f.paramSet]
+    c, err := client.NewClient(client.Config{
+        LeaderAddr: conf.Servers[0].ClientAddr,
+        ServerAddrs: conf.ClientAddrs(),
+        PubKeys: directory.BoxKeys(),
+        MsgBlocks: params.MsgBlocks,
+        MessagingMode: params.MessagingMode(),
+        TLSConfig: directory.ClientTLSConfig(),
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+    return c, conf, nil
+}
+
+func clientSendCommand(args []string) error {
+    flags := flag.NewFlagSet("client send", flag.ExitOnError)
+    cf := addClientFlags(flags)
+    flags.Parse(args)
+    if flags.NArg() == 0 {
+        return fmt.Errorf("usage: server client send [flags] message")
+    }
+
+    stop, err := cf.common.setup()
+    if err != nil {
+        return err
+    }
+    defer stop()
+
+    c, conf, err := cf.newClient()
+    if err != nil {
+        return err
+    }
+    if conf.Servers[0].ClientAddr == "" {
+        return fmt.Errorf("the config has no clientAddr for the leader")
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), *cf.timeout)
+    defer cancel()
+    err = c.Submit(ctx, []byte(strings.Join(flags.Args(), " ")))
+    if err != nil {
+        return err
+    }
+    infof("message accepted\n")
+    return nil
+}
+
+func clientFetchCommand(args []string) error {
+    flags := flag.NewFlagSet("client fetch", flag.ExitOnError)
+    cf := addClientFlags(flags)
+    round := flags.Uint64("round", 0, "round to fetch. 0 is the latest")
+    flags.Parse(args)
+
+    stop, err := cf.common.setup()
+    if err != nil {
+        return err
+    }
+    defer stop()
+
+    c, conf, err := cf.newClient()
+    if err != nil {
+        return err
+    }
+    if conf.ClientAddrs() == nil {
+        return fmt.Errorf("the config needs a clientAddr for every server to fetch")
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), *cf.timeout)
+    defer cancel()
+    output, err := c.Fetch(ctx, *round)
+    if err != nil {
+        return err
+    }
+    infof("round %d: %d messages, %d rows failed the MAC check\n", output.Round, len(output.Messages), len(output.InvalidRows))
+    for _, msg := range output.Messages {
+        fmt.Printf("%s\n", msg)
+    }
+    return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+    "log"
+    "crypto/tls"
+    "net"
+    "sync"
+    "encoding/binary"
+    
+    "shufflemessage/client"
+)
+
+//client-facing side of the servers
+//clients connect over TLS and send framed requests, see client/client.go for the format
+//the leader takes submissions: the payload is the leader's share (message share, tag share, key seed share)
+//followed by one anonymous box per other server, exactly what clientSim produces
+//every submission is answered with a 4 byte status
+//all servers answer fetch requests for their share of recent rounds' output, see client/fetch.go
+
+//upper bound on the blocks per message a client may announce
+//so a bad header can't make the leader allocate arbitrary amounts of memory
+const maxClientMsgBlocks = 1 << 16
+
+type clientSubmission struct {
+    conn net.Conn
+    msgBlocks int
+    data []byte
+}
+
+//what the listener currently accepts. Changes with every parameter set
+type clientParams struct {
+    mu sync.Mutex
+    numServers int
+    msgBlocks int
+}
+
+func (p *clientParams) set(numServers, msgBlocks int) {
+    p.mu.Lock()
+    p.numServers = numServers
+    p.msgBlocks = msgBlocks
+    p.mu.Unlock()
+}
+
+func (p *clientParams) get() (int, int) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.numServers, p.msgBlocks
+}
+
+//accept client connections and queue their submissions until the receiving phase takes them
+//submissions is nil on servers other than the leader, which only serve outputs
+func listenForClients(addr string, cer tls.Certificate, params *clientParams, submissions chan<- *clientSubmission, outputs *outputStore) error {
+    config := &tls.Config{Certificates: []tls.Certificate{cer}}
+    ln, err := tls.Listen("tcp", addr, config)
+    if err != nil {
+        return err
+    }
+
+    infof("accepting client connections on %s\n", addr)
+
+    go func() {
+        defer ln.Close()
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                log.Println(err)
+                return
+            }
+            go handleClient(conn, params, submissions, outputs)
+        }
+    }()
+
+    return nil
+}
+
+func handleClient(conn net.Conn, params *clientParams, submissions chan<- *clientSubmission, outputs *outputStore) {
+    for {
+        header, err := readFromConnErr(conn, client.HeaderLength)
+        if err != nil {
+            conn.Close()
+            return
+        }
+
+        requestType := byteToInt(header[0:4])
+        msgBlocks := byteToInt(header[4:8])
+        payloadLength := byteToInt(header[8:12])
+
+        if requestType == client.RequestFetch {
+            if payloadLength != 8 || !serveOutput(conn, outputs) {
+                conn.Close()
+                return
+            }
+            continue
+        }
+
+        if requestType != client.RequestSubmit || submissions == nil {
+            infof("client %s sent unknown request type %d\n", conn.RemoteAddr(), requestType)
+            conn.Close()
+            return
+        }
+
+        numServers, currentMsgBlocks := params.get()
+        if msgBlocks <= 0 || msgBlocks > maxClientMsgBlocks ||
+            payloadLength != client.SubmissionLength(numServers, msgBlocks) {
+            infof("client %s sent a malformed submission header\n", conn.RemoteAddr())
+            conn.Close()
+            return
+        }
+
+        data, err := readFromConnErr(conn, payloadLength)
+        if err != nil {
+            conn.Close()
+            return
+        }
+
+        //don't queue messages that can't go in the current batch
+        if msgBlocks != currentMsgBlocks {
+            rejectSubmission(conn)
+            continue
+        }
+
+        submissions <- &clientSubmission{conn: conn, msgBlocks: msgBlocks, data: data}
+    }
+}
+
+//send the client this server's share of the requested round
+func serveOutput(conn net.Conn, outputs *outputStore) bool {
+    roundBytes, err := readFromConnErr(conn, 8)
+    if err != nil {
+        return false
+    }
+    
+    output := outputs.get(binary.LittleEndian.Uint64(roundBytes))
+    if output == nil {
+        _, err = conn.Write(intToByte(client.StatusUnknownRound))
+    } else {
+        _, err = conn.Write(output.encode())
+    }
+    return err == nil
+}
+
+func acceptSubmission(conn net.Conn) {
+    _, err := conn.Write(intToByte(client.StatusAccepted))
+    if err != nil {
+        log.Println(err)
+    }
+}
+
+func rejectSubmission(conn net.Conn) {
+    _, err := conn.Write(intToByte(client.StatusRejected))
+    if err != nil {
+        log.Println(err)
+    }
+}
+
+//tell the operator which submissions were in the rows that failed verification
+//sources maps db rows to the submissions in them, see leaderReceivingPhase. Any server can make a row
+//fail, so the client isn't necessarily to blame
+func reportEvictions(round uint64, rows []int, sources []*clientSubmission) {
+    for _, row := range rows {
+        sub := sources[row]
+        if sub == nil {
+            infof("round %d: evicted row %d, which failed the mac check (client or server fault) and holds a message generated by the leader\n", round, row)
+        } else {
+            infof("round %d: evicted row %d, which failed the mac check (client or server fault) and holds the submission of %s\n", round, row, sub.conn.RemoteAddr())
+        }
+    }
+}
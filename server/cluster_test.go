@@ -0,0 +1,254 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "shufflemessage/client"
+    "shufflemessage/config"
+    "shufflemessage/keys"
+    "shufflemessage/mycrypto"
+    "shufflemessage/protocol"
+)
+
+//a whole deployment in one process for tests: the shuffle servers and the aux, connected by a
+//memNetwork and running the same server and aux functions as the serve and aux commands
+//clients submit straight into the leader's queue and read the outputs from every server's store
+
+//how long a test cluster gets to finish its rounds
+const clusterTimeout = 2*time.Minute
+
+type testCluster struct {
+    conf *config.Config
+    directory *keys.Directory
+    network *memNetwork
+    submissions chan *clientSubmission
+    //every server's shares of the outputs
+    outputs []*outputStore
+    //one result per server and one for the aux
+    done chan error
+    cancel context.CancelFunc
+}
+
+//what a test cluster runs. The zero value of the preprocessing fields has an online aux prepare each
+//round's preprocessing when it starts
+type clusterOpts struct {
+    numServers int
+    //the parameter sets, each run for roundsPerParam rounds
+    params []config.Params
+    roundsPerParam int
+    //the leader makes up all the messages instead of taking them from submit
+    simulateClients bool
+    //bundles each server stockpiles, in directories of the test
+    stockpile int
+    //the aux writes the files of all the rounds first, like server aux -files, and isn't started
+    offlineAux bool
+    //the servers check the aux
+    checkAux bool
+    //there's no aux, the servers make the preprocessing themselves
+    dealerFree bool
+}
+
+//start opts.numServers servers and the aux
+//the leader takes its messages from submit, filling each batch before it starts the round, unless it
+//simulates the clients. All servers check every round's output with verifyOutput
+func startCluster(t *testing.T, opts clusterOpts) *testCluster {
+    t.Helper()
+    numServers := opts.numServers
+    directory, secrets, err := keys.Generate(numServers)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conf := &config.Config{
+        Aux: config.Aux{Offline: opts.offlineAux, Check: opts.checkAux},
+        Params: opts.params,
+        Timeouts: map[string]string{config.StepDefault: "30s"},
+        Stockpile: opts.stockpile,
+    }
+    if opts.dealerFree {
+        conf.Preprocessing = config.PreprocessingSemiHonestServers
+    }
+    for i:=0; i < numServers; i++ {
+        //never dialed, the servers only agree on them
+        conf.Servers = append(conf.Servers, config.Server{Addr: fmt.Sprintf("server%d.test:%d", i, 4330+i)})
+    }
+    err = conf.Validate()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+    c := &testCluster{
+        conf: conf,
+        directory: directory,
+        network: newMemNetwork(),
+        submissions: make(chan *clientSubmission, 1024),
+        outputs: make([]*outputStore, numServers),
+        done: make(chan error, numServers+1),
+        cancel: cancel,
+    }
+    t.Cleanup(cancel)
+
+    sched := schedule{roundsPerParam: opts.roundsPerParam}
+    evidenceDir := t.TempDir()
+    stockpileDir := t.TempDir()
+    if conf.Aux.Offline {
+        writeClusterAuxFiles(t, conf, opts.roundsPerParam, stockpileDir, directory, secrets[numServers])
+    }
+    for i:=0; i < numServers; i++ {
+        c.outputs[i] = &outputStore{}
+        serverOpts := serverOptions{
+            evidenceDir: evidenceDir,
+            sched: sched,
+            verify: true,
+            stockpileDir: serverStockpileDir(stockpileDir, i),
+            transport: c.network.endpoint(i),
+            outputs: c.outputs[i],
+            //short keys keep the rounds without an aux fast
+            paillierKeyBits: 512,
+        }
+        if !opts.simulateClients {
+            serverOpts.submissions = c.submissions
+        }
+        go func(serverNum int) {
+            err := server(ctx, conf, serverNum, directory, secrets[serverNum], serverOpts)
+            if err != nil {
+                err = fmt.Errorf("server %d: %w", serverNum, err)
+            }
+            c.done <- err
+        }(i)
+    }
+    if conf.Aux.Offline || conf.DealerFree() {
+        c.done <- nil
+        return c
+    }
+    msgBlocksParams, batchSizeParams, messagingModeParams := paramLists(conf)
+    go func() {
+        err := aux(ctx, numServers, msgBlocksParams, batchSizeParams, conf.Addrs(), messagingModeParams, sched, conf.Stockpile, conf.Aux.Check, conf.MaxEvictions, conf.Timeout, directory, secrets[numServers], c.network.endpoint(keys.Aux))
+        if err != nil {
+            err = fmt.Errorf("aux: %w", err)
+        }
+        c.done <- err
+    }()
+    return c
+}
+
+//write the aux files of every round of conf's parameter sets and put each server's in its stockpile directory
+func writeClusterAuxFiles(t *testing.T, conf *config.Config, roundsPerParam int, stockpileDir string, directory *keys.Directory, auxSecrets *keys.SecretKeys) {
+    t.Helper()
+    filesDir := t.TempDir()
+    numServers := len(conf.Servers)
+    for i, p := range conf.Params {
+        first := uint64(i*roundsPerParam + 1)
+        last := first + uint64(roundsPerParam) - 1
+        params := protocol.Params{MsgBlocks: p.MsgBlocks, BatchSize: p.BatchSize, MessagingMode: p.MessagingMode()}
+        err := auxFiles(filesDir, numServers, first, last, params, conf.Aux.Check, directory, auxSecrets)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for j:=0; j < numServers; j++ {
+            dir := serverStockpileDir(stockpileDir, j)
+            err = os.MkdirAll(dir, 0700)
+            if err != nil {
+                t.Fatal(err)
+            }
+            name := protocol.AuxFileName(j, first, last)
+            err = os.Rename(filepath.Join(filesDir, name), filepath.Join(dir, name))
+            if err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+}
+
+//seal plaintext for params and queue it at the leader, like a client connection would
+//the leader's answer comes on the returned channel once it has taken the message into a batch, or
+//rejected it. it's -1 if the leader never answers
+func (c *testCluster) submit(t *testing.T, plaintext []byte, params config.Params) <-chan int {
+    t.Helper()
+    padded, err := client.Pad(plaintext, params.MsgBlocks)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ct, err := mycrypto.EncryptCT(padded)
+    if err != nil {
+        t.Fatal(err)
+    }
+    payload, err := client.SealCiphertext(ct, c.directory.BoxKeys(), params.MessagingMode())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    mine, theirs := net.Pipe()
+    status := make(chan int, 1)
+    go func() {
+        defer mine.Close()
+        answer, err := readFromConnErr(mine, 4)
+        if err != nil {
+            status <- -1
+            return
+        }
+        status <- byteToInt(answer)
+    }()
+    c.submissions <- &clientSubmission{conn: theirs, msgBlocks: params.MsgBlocks, data: payload}
+    return status
+}
+
+//wait for every server and the aux to finish their rounds
+func (c *testCluster) wait(t *testing.T) {
+    t.Helper()
+    for i:=0; i < len(c.outputs)+1; i++ {
+        err := <- c.done
+        if err != nil {
+            //the others are stuck without the one that failed
+            c.cancel()
+            t.Fatal(err)
+        }
+    }
+}
+
+//the merged output of round, put together from every server's share like client.Fetch does
+//along with the leader's record of the round
+func (c *testCluster) merged(round uint64) ([]byte, *roundOutput, error) {
+    shares := make([][]byte, len(c.outputs))
+    for i, store := range c.outputs {
+        output := store.get(round)
+        if output == nil {
+            return nil, nil, fmt.Errorf("server %d has no output for round %d", i, round)
+        }
+        shares[i] = output.share
+    }
+    merged, err := mycrypto.Merge(shares)
+    if err != nil {
+        return nil, nil, err
+    }
+    return merged, c.outputs[0].get(round), nil
+}
+
+//the messages revealed in round. dummy rows are left out
+//errors if a share is missing or a row doesn't verify
+func (c *testCluster) revealed(round uint64) ([][]byte, error) {
+    merged, output, err := c.merged(round)
+    if err != nil {
+        return nil, err
+    }
+    rows, badRows := client.CheckMacsAndDecrypt(merged, output.msgBlocks, output.batchSize, output.messagingMode)
+    if len(badRows) > 0 {
+        return nil, fmt.Errorf("rows %v of round %d don't verify", badRows, round)
+    }
+    messages := make([][]byte, 0, len(rows))
+    for _, row := range rows {
+        msg, err := client.Unpad(row)
+        if err != nil {
+            //dummy row
+            continue
+        }
+        messages = append(messages, msg)
+    }
+    return messages, nil
+}
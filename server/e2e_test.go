@@ -0,0 +1,95 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "testing"
+
+    "shufflemessage/client"
+    "shufflemessage/config"
+)
+
+//complete rounds through an in-process cluster, see cluster_test.go
+
+func TestRevealedOutputIsPermutation(t *testing.T) {
+    //two parameter sets run one after the other
+    severalParams := []config.Params{
+        {Mode: config.ModeStandard, MsgBlocks: 1, BatchSize: 16},
+        {Mode: config.ModeMessaging, MsgBlocks: 2, BatchSize: 32},
+    }
+    tests := []struct {
+        name string
+        opts clusterOpts
+    }{
+        {"two servers", clusterOpts{numServers: 2, params: []config.Params{{Mode: config.ModeStandard, MsgBlocks: 2, BatchSize: 16}}, roundsPerParam: 2}},
+        {"three servers", clusterOpts{numServers: 3, params: []config.Params{{Mode: config.ModeStandard, MsgBlocks: 1, BatchSize: 16}}, roundsPerParam: 2}},
+        {"messaging mode", clusterOpts{numServers: 3, params: []config.Params{{Mode: config.ModeMessaging, MsgBlocks: 3, BatchSize: 16}}, roundsPerParam: 1}},
+        {"several parameter sets", clusterOpts{numServers: 2, params: severalParams, roundsPerParam: 2}},
+        {"stockpile", clusterOpts{numServers: 3, params: []config.Params{{Mode: config.ModeStandard, MsgBlocks: 1, BatchSize: 16}}, roundsPerParam: 4, stockpile: 2}},
+        {"stockpile over several parameter sets", clusterOpts{numServers: 2, params: severalParams, roundsPerParam: 2, stockpile: 3}},
+        {"offline aux", clusterOpts{numServers: 3, params: []config.Params{{Mode: config.ModeStandard, MsgBlocks: 1, BatchSize: 16}}, roundsPerParam: 3, offlineAux: true}},
+        {"offline aux over several parameter sets", clusterOpts{numServers: 2, params: severalParams, roundsPerParam: 2, offlineAux: true}},
+        {"no aux", clusterOpts{numServers: 2, params: []config.Params{{Mode: config.ModeStandard, MsgBlocks: 1, BatchSize: 16}}, roundsPerParam: 2, dealerFree: true}},
+        {"checked aux", clusterOpts{numServers: 3, params: []config.Params{{Mode: config.ModeStandard, MsgBlocks: 1, BatchSize: 16}}, roundsPerParam: 2, checkAux: true}},
+        {"checked aux with a stockpile", clusterOpts{numServers: 2, params: []config.Params{{Mode: config.ModeMessaging, MsgBlocks: 2, BatchSize: 16}}, roundsPerParam: 2, stockpile: 2, checkAux: true}},
+        {"checked offline aux", clusterOpts{numServers: 2, params: []config.Params{{Mode: config.ModeStandard, MsgBlocks: 1, BatchSize: 16}}, roundsPerParam: 2, offlineAux: true, checkAux: true}},
+        {"no aux with three servers", clusterOpts{numServers: 3, params: []config.Params{{Mode: config.ModeMessaging, MsgBlocks: 2, BatchSize: 16}}, roundsPerParam: 1, dealerFree: true}},
+    }
+    for _, test := range tests {
+        test := test
+        t.Run(test.name, func(t *testing.T) {
+            c := startCluster(t, test.opts)
+
+            //the leader numbers the rounds from 1 and runs them in order
+            submitted := make(map[uint64][][]byte)
+            var round uint64
+            for _, params := range test.opts.params {
+                for r:=0; r < test.opts.roundsPerParam; r++ {
+                    round++
+                    statuses := make([]<-chan int, params.BatchSize)
+                    for i := range statuses {
+                        msg := []byte(fmt.Sprintf("r%d m%d", round, i))
+                        submitted[round] = append(submitted[round], msg)
+                        statuses[i] = c.submit(t, msg, params)
+                    }
+                    for i, status := range statuses {
+                        if s := <- status; s != client.StatusAccepted {
+                            t.Fatalf("round %d message %d: leader answered %d", round, i, s)
+                        }
+                    }
+                }
+            }
+            c.wait(t)
+
+            for r:=uint64(1); r <= round; r++ {
+                revealed, err := c.revealed(r)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if !samePlaintexts(revealed, submitted[r]) {
+                    t.Errorf("round %d revealed %q, want a permutation of %q", r, revealed, submitted[r])
+                }
+            }
+        })
+    }
+}
+
+//whether a and b hold the same plaintexts, in any order
+func samePlaintexts(a, b [][]byte) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    sorted := func(msgs [][]byte) [][]byte {
+        s := append([][]byte(nil), msgs...)
+        sort.Slice(s, func(i, j int) bool { return bytes.Compare(s[i], s[j]) < 0 })
+        return s
+    }
+    a, b = sorted(a), sorted(b)
+    for i := range a {
+        if !bytes.Equal(a[i], b[i]) {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+
+    "shufflemessage/protocol"
+)
+
+//write evidence records to dir, one file per accused server
+func writeEvidence(dir string, records []*protocol.Evidence) {
+    if len(records) == 0 {
+        return
+    }
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    for _, e := range records {
+        data, err := json.MarshalIndent(e, "", "  ")
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+        path := filepath.Join(dir, fmt.Sprintf("round-%d-%s-server-%d.json", e.Round, phaseFileName(e.Phase), e.Accused))
+        err = ioutil.WriteFile(path, data, 0644)
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+        log.Printf("round %d: server %d's %s opening didn't match its commitment, evidence written to %s\n", e.Round, e.Accused, e.Phase, path)
+    }
+}
+
+func phaseFileName(phase string) string {
+    name := []byte(phase)
+    for i := range name {
+        if name[i] == ' ' {
+            name[i] = '-'
+        }
+    }
+    return string(name)
+}
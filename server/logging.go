@@ -0,0 +1,43 @@
+package main
+
+import (
+    "fmt"
+    "log"
+)
+
+//log levels for -log
+//errors are always logged with the log package directly. infof is for what an operator
+//wants to see (rounds finishing, evictions, listeners), debugf for the step by step progress of a round
+type logLevel int
+
+const (
+    levelDebug logLevel = iota
+    levelInfo
+    levelError
+)
+
+var currentLogLevel = levelInfo
+
+func parseLogLevel(s string) (logLevel, error) {
+    switch s {
+    case "debug":
+        return levelDebug, nil
+    case "info":
+        return levelInfo, nil
+    case "error":
+        return levelError, nil
+    }
+    return levelInfo, fmt.Errorf("unknown log level %q, use debug, info or error", s)
+}
+
+func debugf(format string, v ...interface{}) {
+    if currentLogLevel <= levelDebug {
+        log.Output(2, fmt.Sprintf(format, v...))
+    }
+}
+
+func infof(format string, v ...interface{}) {
+    if currentLogLevel <= levelInfo {
+        log.Output(2, fmt.Sprintf(format, v...))
+    }
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "sync"
+    
+    "shufflemessage/client"
+)
+
+//how many past rounds each server keeps its revealed share of, for clients to fetch
+const outputsKept = 16
+
+//this server's share of a revealed round, plus everyone's commitments
+type roundOutput struct {
+    round uint64
+    numServers int
+    serverNum int
+    msgBlocks int
+    batchSize int
+    messagingMode bool
+    commitments []byte
+    share []byte
+}
+
+type outputStore struct {
+    mu sync.Mutex
+    outputs []*roundOutput
+}
+
+func (s *outputStore) add(output *roundOutput) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.outputs = append(s.outputs, output)
+    if len(s.outputs) > outputsKept {
+        s.outputs = s.outputs[len(s.outputs)-outputsKept:]
+    }
+}
+
+//round 0 means the latest round
+func (s *outputStore) get(round uint64) *roundOutput {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.outputs) == 0 {
+        return nil
+    }
+    if round == 0 {
+        return s.outputs[len(s.outputs)-1]
+    }
+    for _, output := range s.outputs {
+        if output.round == round {
+            return output
+        }
+    }
+    return nil
+}
+
+func (o *roundOutput) encode() []byte {
+    return client.EncodeFetchResponse(o.round, o.numServers, o.serverNum, o.msgBlocks, o.batchSize, o.messagingMode, o.commitments, o.share)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "shufflemessage/keys"
+)
+
+//mutual TLS between the servers and the aux
+//every server presents its own certificate from its secret key file, and only certificates
+//whose fingerprints are in the key directory are accepted. Whoever dials pins the certificate
+//of the server it meant to reach, and the listener tells who connected from their certificate
+//rather than from the order connections happen to arrive in
+
+//how long a peer gets to finish the TLS handshake
+const peerHandshakeTimeout = 30*time.Second
+
+//config for dialing server peer (or the aux)
+func peerDialConfig(directory *keys.Directory, cer tls.Certificate, peer int) (*tls.Config, error) {
+    pub, err := directory.Server(peer)
+    if err != nil {
+        return nil, err
+    }
+    return &tls.Config{
+        Certificates: []tls.Certificate{cer},
+        //the certificates are self-signed, they're checked against the pinned fingerprint instead
+        InsecureSkipVerify: true,
+        VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+            if len(rawCerts) == 0 || !bytes.Equal(keys.Fingerprint(rawCerts[0]), pub.TLS) {
+                return fmt.Errorf("certificate is not the one pinned for server %d", peer)
+            }
+            return nil
+        },
+        MinVersion: tls.VersionTLS12,
+    }, nil
+}
+
+//config for the listener the other servers connect to
+func peerListenConfig(directory *keys.Directory, cer tls.Certificate) *tls.Config {
+    return &tls.Config{
+        Certificates: []tls.Certificate{cer},
+        ClientAuth: tls.RequireAnyClientCert,
+        VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+            if len(rawCerts) == 0 {
+                return errors.New("no client certificate")
+            }
+            if _, ok := directory.Identify(rawCerts[0]); !ok {
+                return errors.New("client certificate is not in the key directory")
+            }
+            return nil
+        },
+        MinVersion: tls.VersionTLS12,
+    }
+}
+
+//dial server peer and check that it's really that server
+//timeout bounds connecting and the TLS handshake
+func dialPeer(ctx context.Context, addr string, directory *keys.Directory, cer tls.Certificate, peer int, timeout time.Duration) (net.Conn, error) {
+    conf, err := peerDialConfig(directory, cer, peer)
+    if err != nil {
+        return nil, err
+    }
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    dialer := &tls.Dialer{Config: conf}
+    return dialer.DialContext(ctx, "tcp", addr)
+}
+
+//accepts connections from the other servers and sorts them by who they're from
+//connections from one peer come out in the order their handshakes finish, which needn't be the order
+//the peer made them in. Nothing depends on that: every peer makes one connection to us per run
+type peerListener struct {
+    ln net.Listener
+    directory *keys.Directory
+
+    mu sync.Mutex
+    queues map[int]chan net.Conn
+
+    closed chan struct{}
+    err error
+}
+
+func listenForPeers(addr string, directory *keys.Directory, cer tls.Certificate) (*peerListener, error) {
+    ln, err := tls.Listen("tcp", addr, peerListenConfig(directory, cer))
+    if err != nil {
+        return nil, err
+    }
+    p := &peerListener{
+        ln: ln,
+        directory: directory,
+        queues: make(map[int]chan net.Conn),
+        closed: make(chan struct{}),
+    }
+    go p.run()
+    return p, nil
+}
+
+func (p *peerListener) run() {
+    for {
+        conn, err := p.ln.Accept()
+        if err != nil {
+            p.err = err
+            close(p.closed)
+            return
+        }
+        //handshake concurrently, so a peer that's slow to finish doesn't hold up the others
+        go p.identify(conn.(*tls.Conn))
+    }
+}
+
+func (p *peerListener) identify(conn *tls.Conn) {
+    conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+    err := conn.Handshake()
+    if err != nil {
+        log.Printf("rejected connection from %s: %v\n", conn.RemoteAddr(), err)
+        conn.Close()
+        return
+    }
+    conn.SetDeadline(time.Time{})
+
+    //the listen config already made sure this is someone in the directory
+    peer, _ := p.directory.Identify(conn.ConnectionState().PeerCertificates[0].Raw)
+    p.queue(peer) <- conn
+}
+
+func (p *peerListener) queue(peer int) chan net.Conn {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    q, ok := p.queues[peer]
+    if !ok {
+        q = make(chan net.Conn, 64)
+        p.queues[peer] = q
+    }
+    return q
+}
+
+//the next connection from server peer (or the aux)
+//waits until the peer connects or ctx is cancelled
+func (p *peerListener) acceptFrom(ctx context.Context, peer int) (net.Conn, error) {
+    select {
+    case conn := <- p.queue(peer):
+        return conn, nil
+    case <- p.closed:
+        return nil, p.err
+    case <- ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+func (p *peerListener) Close() error {
+    return p.ln.Close()
+}
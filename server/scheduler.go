@@ -0,0 +1,93 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    "shufflemessage/client"
+    "shufflemessage/mycrypto"
+)
+
+//rounds are driven by a schedule
+//the benchmark is the schedule that runs a fixed number of rounds for every parameter set
+//a deployment runs rounds forever on the first parameter set. Each round closes when its batch
+//fills up or when the round interval runs out, and the empty slots are padded with dummy messages
+//so the batch size stays fixed
+type schedule struct {
+    //rounds to run for each parameter set. 0 means run rounds forever on the first parameter set
+    roundsPerParam int
+    //how long a round stays open for submissions. 0 means wait for a full batch
+    interval time.Duration
+}
+
+func (s schedule) continuous() bool {
+    return s.roundsPerParam == 0
+}
+
+//how many of the parameter sets get evaluated
+func (s schedule) paramSets(numParams int) int {
+    if s.continuous() {
+        return 1
+    }
+    return numParams
+}
+
+//whether to run another round for the current parameter set, roundCount rounds in
+func (s schedule) moreRounds(roundCount int) bool {
+    return s.continuous() || roundCount < s.roundsPerParam
+}
+
+//whether roundCount is the last round of its parameter set
+func (s schedule) lastRound(roundCount int) bool {
+    return !s.continuous() && roundCount == s.roundsPerParam - 1
+}
+
+//collect the client submissions for one round
+//returns batchSize slots. Slots left nil weren't filled before the round closed
+//if submissions is nil, no slot gets filled and the receiving phase makes up all the messages
+//errors only if ctx is cancelled
+func collectBatch(ctx context.Context, submissions <-chan *clientSubmission, numServers, msgBlocks, batchSize int, interval time.Duration) ([]*clientSubmission, error) {
+    batch := make([]*clientSubmission, batchSize)
+    if submissions == nil {
+        return batch, nil
+    }
+
+    var timeout <-chan time.Time
+    if interval > 0 {
+        timer := time.NewTimer(interval)
+        defer timer.Stop()
+        timeout = timer.C
+    }
+
+    for filled := 0; filled < batchSize; {
+        select {
+        case sub := <- submissions:
+            if sub.msgBlocks != msgBlocks || len(sub.data) != client.SubmissionLength(numServers, msgBlocks) {
+                //queued before the parameters changed
+                rejectSubmission(sub.conn)
+                continue
+            }
+            acceptSubmission(sub.conn)
+            batch[filled] = sub
+            filled++
+        case <- timeout:
+            infof("round closed with %d of %d messages, padding with dummies\n", filled, batchSize)
+            return batch, nil
+        case <- ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+
+    return batch, nil
+}
+
+//a well-formed message that doesn't hold anything
+//it decrypts to all zeros, which client.Unpad doesn't accept as a message
+//msgBlocks counts the key block, like in clientSim
+func dummySubmission(msgBlocks int, pubKeys []*[32]byte, messagingMode bool) ([]byte, error) {
+    ct, err := mycrypto.EncryptCT(make([]byte, 16*(msgBlocks-1)))
+    if err != nil {
+        return nil, err
+    }
+    return client.SealCiphertext(ct, pubKeys, messagingMode)
+}
@@ -1,25 +1,56 @@
 package main
 
 import (
+    "context"
+    "errors"
     "log"
-    "crypto/tls"
-    "net"
-    "os"
     "time"
     //"unsafe"
-    "crypto/rand"
-    "golang.org/x/crypto/nacl/box"
     //"sync/atomic"
-    "strconv"
-    "bufio"
-    "strings"
     "runtime"
     "fmt"
+    "net/http"
+    "golang.org/x/crypto/nacl/box"
         
     "shufflemessage/mycrypto" 
+    "shufflemessage/board"
+    "shufflemessage/keys"
+    "shufflemessage/config"
+    "shufflemessage/wire"
+    "shufflemessage/mux"
+    "shufflemessage/protocol"
 )
 
-func main() {    
+//settings of a shuffle server that don't come from the config, from the serve and bench command lines
+type serverOptions struct {
+    //where clients submit and fetch. empty means the leader simulates the clients
+    clientAddr string
+    //where the bulletin board is served. empty means no board
+    boardAddr string
+    boardDir string
+    boardKeep int
+    evidenceDir string
+    sched schedule
+    //check every round's output against its inputs, see verify.go. a failed check ends the run
+    verify bool
+    //where the bundles of preprocessing are kept if the config has a stockpile or the aux is offline
+    //an offline aux's files go here too
+    stockpileDir string
+    //how to reach the other servers and the aux. nil means TLS to the addresses in the config
+    transport transport
+    //submissions from clients in the same process, for tests. Used by the leader instead of a client listener
+    submissions chan *clientSubmission
+    //where our shares of the outputs are kept for clients to fetch. nil means a store of our own
+    outputs *outputStore
+    //bits of the Paillier key without an aux, for tests. 0 means protocol's default
+    paillierKeyBits int
+}
+
+//run shuffle server serverNum until ctx is cancelled or the schedule is done
+//a round that fails on the network, e.g. because a peer stops answering within the step's timeout,
+//is aborted and ends the run, since the connections may be left in the middle of a message. Rounds
+//that all servers abort together, on a failed verification or a commitment mismatch, are just skipped
+func server(ctx context.Context, conf *config.Config, serverNum int, directory *keys.Directory, secretKeys *keys.SecretKeys, opts serverOptions) error {
     //for i:=0; i < 10; i++ {
     //    log.Println(mycrypto.TestGenShareTrans())
     //}
@@ -28,591 +59,412 @@ func main() {
     //log.Println(mycrypto.TestGenBeavers())
     //return
     
-    numServers := 0
-    msgBlocksParams := make([]int, 0)
-    batchSizeParams := make([]int, 0)    
-    serverNum := 0
-    paramFile := ""
-    numParams := 0
-    messagingModeParams := make([]bool, 0)
+    numServers := len(conf.Servers)
+    numParams := len(conf.Params)
+    addrs := conf.Addrs()
+    msgBlocksParams, batchSizeParams, messagingModeParams := paramLists(conf)
     
+    leader := false
+    sched := opts.sched
     
-    log.SetFlags(log.Lshortfile)
-        
-    if len(os.Args) < 3 {
-        log.Println("usage: server [servernum] [paramFile]")
-        log.Println("servers 0... are the shuffling servers. Start them in order.")
-        log.Println("server -1 is the aux server. Start it last. ")
-        log.Println("paramFile has one parameter per line. First, the number of servers. Then the number of different parameter sets to evaluate. Then all the server addresses(addr:port). Extra addresses beyond the number of servers are ignored. Then there's a line that says 'PARAMS'. Then sets of three lines indicating whether to run in messaging or standard mode, blocks per msg, and batch size. Examples should be included with the code. ")
-        return
+    if serverNum == 0 {
+        infof("This server is the leader\n")
+        leader = true
     } else {
-        serverNum, _ = strconv.Atoi(os.Args[1])
-        paramFile = os.Args[2]
+        infof("This is server %d\n", serverNum)
     }
     
-    file, err := os.Open(paramFile)
-    if err != nil {
-        panic(err)
-    }
+    //clients seal their shares to these keys
+    pubKeys := directory.BoxKeys()
+    mySecKey := secretKeys.BoxKey()
     
-    addrs := make([]string, 0)
-    ports := make([]string, 0)
-    scanner := bufio.NewScanner(file)
-    scanner.Scan()
-    numServers, _ = strconv.Atoi(scanner.Text())
-    scanner.Scan()
-    numParams, _ = strconv.Atoi(scanner.Text())
-    scanner.Scan()
-    for i:= 0; scanner.Text() != "PARAMS"; i++ {
-        addrs = append(addrs, scanner.Text())
-        //get the port number out
-        colonPos := strings.Index(addrs[i], ":")
-        if colonPos == -1 {
-            panic("server addresses must include :port")
-        }
-        ports = append(ports, addrs[i][colonPos:])
-        scanner.Scan()
-    }
+    //shared key with the aux
+    var auxKey [32]byte
+    box.Precompute(&auxKey, directory.AuxBoxKey(), mySecKey)
     
-    for i:= 0; i < numParams; i++ {
-        scanner.Scan()
-        if scanner.Text() == "messaging" {
-            messagingModeParams = append(messagingModeParams, true)
-        } else {
-            messagingModeParams = append(messagingModeParams, false)
+    //bundles of preprocessing left from earlier runs are used first
+    //an offline aux's files are taken into the stockpile when we start
+    var stockpile *protocol.Stockpile
+    if conf.Stockpile > 0 || conf.Aux.Offline {
+        var err error
+        stockpile, err = protocol.OpenStockpile(opts.stockpileDir)
+        if err != nil {
+            return err
         }
-        scanner.Scan()
-        msgBlocksInput, _ := strconv.Atoi(scanner.Text())
-        msgBlocksParams = append(msgBlocksParams, msgBlocksInput)
-        scanner.Scan()
-        batchSizeInput, _ := strconv.Atoi(scanner.Text())
-        batchSizeParams = append(batchSizeParams, batchSizeInput)
-    }
-    
-    err = scanner.Err()
-    if err != nil {
-        panic(err)
-    }
-    file.Close()
-    
-    leader := false
-    myNum := serverNum
-    
-    if serverNum == -1 { //aux server
-        aux(numServers, msgBlocksParams, batchSizeParams, addrs, messagingModeParams)
-        return
-    } else if serverNum == 0 {
-        log.Println("This server is the leader")
-        leader = true
-    } else {
-        log.Printf("This is server %d\n", serverNum)
+        if conf.Aux.Offline {
+            imported, err := stockpile.ImportAuxFiles(&auxKey, serverNum)
+            if err != nil {
+                return fmt.Errorf("importing aux files from %s: %w", opts.stockpileDir, err)
+            }
+            infof("imported %d bundles of preprocessing from aux files\n", imported)
+        }
+        infof("%d bundles of preprocessing in the stockpile\n", stockpile.Len())
     }
     
-    cer, err := tls.LoadX509KeyPair("server.crt", "server.key")
-    if err != nil {
-        log.Println(err)
-        return
-    }
-    config := &tls.Config{Certificates: []tls.Certificate{cer}}
-    ln, err := tls.Listen("tcp", ports[serverNum], config)  
-    if err != nil {
-        log.Println(err)
-        return
+    tr := opts.transport
+    if tr == nil {
+        tlsTr, err := newTLSTransport(addrs, conf.ListenAddr(serverNum), directory, secretKeys)
+        if err != nil {
+            return err
+        }
+        tr = tlsTr
     }
-    defer ln.Close()
+    defer tr.Close()
     
-    conf := &tls.Config{
-         InsecureSkipVerify: true,
-    }
+    //waiting for the others to start isn't bounded, but once they're there the handshakes are
+    setupTimeout := conf.Timeout(config.StepSetup)
     
     //set up connections between all the servers
-    //holds connections to the other shuffle servers
+    //there's one connection to every other shuffle server, carrying a session of streams (see the mux package)
+    //conns holds the control stream of each session, which carries the round announcements and the
+    //small protocol messages of the rounds
     //conns[serverNum] will be empty
-    conns := make([]net.Conn, numServers)
+    //every control stream starts with a handshake that settles the protocol version, see the wire package
+    sessions := make([]*mux.Session, numServers)
+    conns := make([]*wire.Conn, numServers)
     
     //each server connects to the ones with lower indices
     //except at the end aux connects to all of them
     //connect to lower numbered servers
     for i:=0; i < serverNum; i++ {
-        conns[i], err = tls.Dial("tcp", addrs[i], conf)
+        conn, err := tr.dial(ctx, i, setupTimeout)
         if err != nil {
-            log.Println(err)
-            return 
+            return err
+        }
+        sessions[i] = mux.NewSession(conn)
+        defer sessions[i].Close()
+        conns[i], err = handshake(ctx, sessions[i].Stream(streamControl), fmt.Sprintf("server %d", i), setupTimeout)
+        if err != nil {
+            return err
         }
-        defer conns[i].Close()
-        readFromConn(conns[i], 4)
-        writeToConn(conns[i], intToByte(1))
     }
     
-    log.Println("connected to lower numbered servers")
+    debugf("connected to lower numbered servers\n")
     
     //wait for connections from higher numbered servers
     for i:= serverNum+1; i < numServers; i++ {
-        conns[i], err = ln.Accept()
+        conn, err := tr.accept(ctx, i)
+        if err != nil {
+            return err
+        }
+        sessions[i] = mux.NewSession(conn)
+        defer sessions[i].Close()
+        conns[i], err = handshake(ctx, sessions[i].Stream(streamControl), fmt.Sprintf("server %d", i), setupTimeout)
         if err != nil {
-            log.Println(err)
-            return
+            return err
         }
-        conns[i].SetDeadline(time.Time{})
-        writeToConn(conns[i], intToByte(1))
-        readFromConn(conns[i], 4)
     }
     
-    log.Println("connected to higher numbered servers")
+    debugf("connected to higher numbered servers\n")
+    
+    //connection from aux server, unless it's offline and left its preprocessing in files, or there's
+    //no aux and we make the preprocessing with the other servers
+    offlineAux := conf.Aux.Offline
+    dealerFree := conf.DealerFree()
+    auxConnected := !offlineAux && !dealerFree
+    var auxConn *wire.Conn
+    if dealerFree {
+        infof("no aux, the servers make the preprocessing themselves. This is only secure if every server follows the protocol\n")
+    }
+    if conf.Aux.Check {
+        infof("checking the aux's preprocessing before each round uses it\n")
+    }
+    if auxConnected {
+        conn, err := tr.accept(ctx, keys.Aux)
+        if err != nil {
+            return err
+        }
+        auxConn, err = handshake(ctx, conn, "aux", setupTimeout)
+        if err != nil {
+            return err
+        }
+        defer auxConn.Close()
+        
+        debugf("connected to aux server\n")
+    }
     
-    //connection from aux server
-    auxConn, err := ln.Accept()
+    //everyone we run rounds with has to have loaded the same servers and parameters
+    parties := append([]*wire.Conn{auxConn}, conns...)
+    setupCtx, cancelSetup := context.WithTimeout(ctx, setupTimeout)
+    err := checkAgreementWithAll(setupCtx, parties, setupParams(addrs, sched, conf.Stockpile, offlineAux, dealerFree, conf.Aux.Check, conf.MaxEvictions, msgBlocksParams, batchSizeParams, messagingModeParams))
+    var session []byte
+    if err == nil && auxConnected {
+        //the aux picks the session our preprocessing seeds are derived in
+        session, err = protocol.JoinSession(setupCtx, auxConn)
+    }
+    cancelSetup()
     if err != nil {
-        log.Println(err)
-        return
+        return err
+    }
+    
+    //client submissions, if we're taking them from real clients
+    //and our shares of past outputs, for clients to fetch
+    var submissions chan *clientSubmission
+    currentClientParams := &clientParams{}
+    outputs := opts.outputs
+    if outputs == nil {
+        outputs = &outputStore{}
+    }
+    if opts.clientAddr != "" {
+        if leader {
+            submissions = make(chan *clientSubmission, 1024)
+        }
+        cer, err := secretKeys.Certificate()
+        if err != nil {
+            return err
+        }
+        err = listenForClients(opts.clientAddr, cer, currentClientParams, submissions, outputs)
+        if err != nil {
+            return err
+        }
+    } else if opts.submissions != nil && leader {
+        submissions = opts.submissions
     }
-    auxConn.SetDeadline(time.Time{})
-    writeToConn(auxConn, intToByte(1))
-    readFromConn(auxConn, 4)
     
-    log.Println("connected to aux server")
+    //bulletin board for the merged outputs
+    var outputBoard *board.Board
+    if opts.boardAddr != "" {
+        outputBoard, err = board.Open(opts.boardDir, opts.boardKeep)
+        if err != nil {
+            return err
+        }
+        go func() {
+            log.Println(http.ListenAndServe(opts.boardAddr, outputBoard.Handler()))
+        }()
+        infof("bulletin board listening on %s\n", opts.boardAddr)
+    }
     
-    //using a deterministic source of randomness for testing 
-    //this is just for testing so the different parties share a key
-    //in reality the public keys of the servers/auditors should be known 
-    //ahead of time and those would be used
-    pubKeys := make([]*[32]byte, numServers)
-    var mySecKey *[32]byte
+    //rounds are numbered across all parameter sets. The leader picks the number of every round
+    //and the others follow. The number keeps increasing across restarts if the leader has a board
+    var round uint64
+    if leader && outputBoard != nil {
+        round = outputBoard.Latest()
+    }
     
-    for i := 0; i < numServers; i++ {
+    //the shuffle, the verifications and the reveal each get a stream of their own
+    shuffleConns := make([]*wire.Conn, numServers)
+    verificationConns := make([]*wire.Conn, numServers)
+    revealConns := make([]*wire.Conn, numServers)
+    for i := range sessions {
         if i == serverNum {
-            pubKeys[i], mySecKey, err = box.GenerateKey(strings.NewReader(strings.Repeat(strconv.Itoa(i),10000)))
-            if err != nil {
-                log.Println(err)
-                return
-            }
-        } else {
-            pubKeys[i], _, err = box.GenerateKey(strings.NewReader(strings.Repeat(strconv.Itoa(i),10000)))
-            if err != nil {
-                log.Println(err)
-                return
-            }
+            continue
         }
+        shuffleConns[i] = roundStream(sessions[i], conns[i], streamShuffle, "shuffle")
+        verificationConns[i] = roundStream(sessions[i], conns[i], streamVerification, "verification")
+        revealConns[i] = roundStream(sessions[i], conns[i], streamReveal, "reveal")
+    }
+    
+    //the rounds themselves run in the protocol package
+    shuffler, err := protocol.NewShuffleServer(protocol.ServerConfig{
+        ServerNum: serverNum,
+        Peers: conns,
+        ShufflePeers: shuffleConns,
+        VerificationPeers: verificationConns,
+        RevealPeers: revealConns,
+        Aux: auxConn,
+        AuxKey: &auxKey,
+        Session: session,
+        Stockpile: stockpile,
+        OfflineAux: offlineAux,
+        DealerFree: dealerFree,
+        PaillierKeyBits: opts.paillierKeyBits,
+        CheckAux: conf.Aux.Check,
+        MaxEvictions: conf.MaxEvictions,
+        SignKey: secretKeys.SignKey(),
+        Timeout: conf.Timeout,
+    })
+    if err != nil {
+        return err
     }
     
-    for evalNum := 0; evalNum < numParams; evalNum++ {
+    for evalNum := 0; evalNum < sched.paramSets(numParams); evalNum++ {
         messagingMode := messagingModeParams[evalNum]
         msgBlocks := msgBlocksParams[evalNum]
         batchSize := batchSizeParams[evalNum]
         
-        log.Printf("numServers %d\n", numServers)
-        log.Printf("msgBlocks %d\n", msgBlocks)
-        log.Printf("batchSize %d\n", batchSize)
+        infof("numServers %d\n", numServers)
+        infof("msgBlocks %d\n", msgBlocks)
+        infof("batchSize %d\n", batchSize)
         
         if messagingMode {
-            log.Println("in messaging mode; only first block is MACed/verified")
+            infof("in messaging mode; only first block is MACed/verified\n")
         }
         
-        log.Println("\nClient performance test")
-        var totalClientTime time.Duration
-        for i:= 0; i < 10; i++ {
-            _, clientTime:= clientSim(batchSize, msgBlocks, pubKeys, messagingMode)
-            totalClientTime += clientTime
-            
+        //the others may still be finishing the last evaluation, so this isn't bounded
+        err = checkAgreementWithAll(ctx, parties, evaluationParams(addrs, sched, evalNum, msgBlocks, batchSize, messagingMode))
+        if err != nil {
+            return err
         }
-        fmt.Printf("Client average compute time: %s\n\n", totalClientTime/time.Duration(10))
         
-        //some relevant values
-        blocksPerRow :=  2*(msgBlocks+1) + 1 
-        numBeavers := batchSize * (msgBlocks +1)
+        currentClientParams.set(numServers, msgBlocks)
         
-        if messagingMode {
-            blocksPerRow = msgBlocks + 3
-            numBeavers = batchSize
+        if opts.clientAddr == "" && opts.submissions == nil {
+            infof("\nClient performance test\n")
+            var totalClientTime time.Duration
+            for i:= 0; i < 10; i++ {
+                _, clientTime, err := clientSim(batchSize, msgBlocks, pubKeys, messagingMode)
+                if err != nil {
+                    return err
+                }
+                totalClientTime += clientTime
+                
+            }
+            fmt.Printf("Client average compute time: %s\n\n", totalClientTime/time.Duration(10))
         }
         
-        dbSize := blocksPerRow*batchSize*16
+        params := protocol.Params{MsgBlocks: msgBlocks, BatchSize: batchSize, MessagingMode: messagingMode}
+        shuffler.SetParams(params)
+        
+        //with a stockpile the aux streams bundles for this parameter set while the rounds run
+        stopFilling := startFilling(ctx, shuffler, conf.Stockpile)
         
-        //data structure for holding batch of messages
-        //each entry will be of length blocksPerRow*16
-        db := make([][]byte, batchSize)
+        //our shares of the batch's messages, as they come in from the clients or the leader
+        shares := make([][]byte, batchSize)
         for i:= 0; i < batchSize; i++ {
-            db[i] = make([]byte, blocksPerRow*16)
+            shares[i] = make([]byte, params.ShareLength())
         }
-        flatDB := make([]byte, dbSize)
 
         //set up running average for timing
         batchesCompleted := 0
         var totalTime, totalBlindMacTime, totalShuffleTime, totalRevealTime time.Duration
+        //the times of the last round that completed
+        var blindMacElapsedTime, shuffleElapsedTime, revealElapsedTime, elapsedTime time.Duration
         
-        numThreads, chunkSize := mycrypto.PickNumThreads(batchSize)
+        numThreads, _ := mycrypto.PickNumThreads(batchSize)
 
-        log.Printf("using %d threads", numThreads)
+        debugf("using %d threads", numThreads)
         if numThreads != 16 {
-            log.Println("performance could be improved by using a batchSize divisible by 16")
+            infof("performance could be improved by using a batchSize divisible by 16\n")
         }
         
-        setupConns := make([][]net.Conn, numServers)
+        //the leader passes on the submissions over one stream per worker thread
+        setupConns := make([][]*wire.Conn, numServers)
         if leader {
             for i:=1; i < numServers; i++ {          
-                setupConns[i] = make([]net.Conn, numThreads)
-                for j:=0; j < numThreads; j++ {
-                    setupConns[i][j], err = tls.Dial("tcp", addrs[i], conf)
-                    if err != nil {
-                        log.Println(err)
-                        return 
-                    }
-                    readFromConn(setupConns[i][j], 4)
-                    writeToConn(setupConns[i][j], intToByte(1))
-                    defer setupConns[i][j].Close()
-                }
+                setupConns[i] = submissionStreams(sessions[i], conns[i], numThreads)
             }
         } else {
-            setupConns[0] = make([]net.Conn, numThreads)
-            for j:=0; j < numThreads; j++ {
-                setupConns[0][j], err = ln.Accept()
-                if err != nil {
-                    log.Println(err)
-                    return
-                }
-                writeToConn(setupConns[0][j], intToByte(1))
-                readFromConn(setupConns[0][j], 4)
-                setupConns[0][j].SetDeadline(time.Time{})
-            }
+            setupConns[0] = submissionStreams(sessions[0], conns[0], numThreads)
         }
         
-        beaverBlocker := make(chan int, 2)
-        beaverBlockerTwo := make(chan int, 2)
-        beaverCBlocker := make(chan int)
-        beaverCBlockerTwo := make(chan int)
-        blocker := make(chan int, 5)
-        deltaBlocker := make(chan int)
-        expansionBlocker := make(chan int)
-        hashBlocker := make(chan int)
-        unflattenBlocker := make(chan int)
-        
-        for testCount:=0; testCount < 5; testCount++{
+        for testCount:=0; sched.moreRounds(testCount); testCount++{
             runtime.GC()
-            log.Println("server ready")
-            //NOTE: since the purpose of this evaluation is to measure the performance once the servers have already received the messages from the client, I'm just going to have the lead server generate the client queries and pass them on to the others to save time
-            //receiving client connections phase 
-            if leader {
-                leaderReceivingPhase(db, setupConns, msgBlocks+1, batchSize, pubKeys, messagingMode)
-            } else {
-                otherReceivingPhase(db, setupConns, numServers, msgBlocks+1, batchSize, pubKeys[serverNum], mySecKey, serverNum)
-            }
-            //runtime.GC()
-            log.Println("starting processing of message batch")
-            //processing phase
-            //NOTE: in reality, the blind verification and aux server stuff could be done as messages arrive
-            //this would speed up the processing time, esp. if the server were multithreaded
-            //but I'm handling everything for a batch at once so I can report performance for processing a batch        
-                        
-            aInitial := make([]byte, 0) //not important for first server
-            bFinal := make([]byte, 0) //not important for last server
-            aAtPermTime := make([]byte, 0) //not important for last server
-            delta := make([]byte, 0) //only important for last server
-            pi := make([]int, 0)
-            beaversA := make([]byte, 0)
-            beaversB := make([]byte, 0)
-            beaversC := make([]byte, 0)
-            beaversATwo := make([]byte, 0)
-            beaversBTwo := make([]byte, 0)
-            beaversCTwo := make([]byte, 0)
-            
+            debugf("server ready\n")
             
-            startTime := time.Now()
-            
-            //pick seeds for aInitial, bFinal, aAtPermTime, pi, and beaver shares a, b (for both sets of verifications)
-            seeds := make([]byte, 128)
-            _,err := rand.Read(seeds[:])
-            if err != nil {
-                log.Println("couldn't generate seed")
-                panic(err)
-            }
-                    
-            //send the seeds to aux server
-            go func () {
-                writeToConn(auxConn, seeds)
-                blocker <- 1
-            }()
-            //seed expansion
-            go func() {
-                if !messagingMode {
-                    expandDB(db, msgBlocks+1)
-                }
-                expansionBlocker <- 1
-            }()
-            //generate the shares for which seeds were sent to the aux server
-            go func() {
-                    beaversA = mycrypto.AesPRG(16*numBeavers, seeds[48:64])
-                    beaverBlocker <- 1
-            }()
-            go func() {
-                    beaversB = mycrypto.AesPRG(16*numBeavers, seeds[64:80])
-                    beaverBlocker <- 1
-            }()
-            go func() {
-                pi = mycrypto.GenPerm(batchSize, seeds[80:96])
-                blocker <- 1
-            }()
-            go func() {
-                if serverNum > 0 {
-                    aInitial = mycrypto.AesPRG(dbSize, seeds[0:16])
-                }
-                blocker <- 1
-            }()
-            go func() {
-                if serverNum != numServers - 1 {
-                    bFinal = mycrypto.AesPRG(dbSize, seeds[16:32])
-                }
-                blocker <- 1
-            }()
-            go func() {
-                if serverNum != numServers - 1 {
-                    aAtPermTime = mycrypto.AesPRG(dbSize, seeds[32:48])
-                }
-                blocker <- 1
-            }()
-            go func() {
-                    beaversATwo = mycrypto.AesPRG(16*batchSize, seeds[96:112])
-                    beaverBlockerTwo <- 1
-            }()
-            go func() {
-                    beaversBTwo = mycrypto.AesPRG(16*batchSize, seeds[112:128])
-                    beaverBlockerTwo <- 1
-            }()
-
-            go func() {
-                //read beaver triples and share translation stuff
-                beaversC = readFromConn(auxConn, numBeavers*16)
-                beaverCBlocker <- 1
-                if serverNum == numServers - 1 {//read delta
-                    delta = readFromConn(auxConn, dbSize)
-                    deltaBlocker <- 1
-                }
-                
-                if messagingMode {
-                    beaversCTwo = readFromConn(auxConn, numBeavers*16)
-                } else { //fewer beaver triples second time
-                    beaversCTwo = readFromConn(auxConn, batchSize*16)
+            //the leader closes the round and tells everyone its number
+            //waiting for the round to start isn't bounded, every step after that is
+            var batch, sources []*clientSubmission
+            if leader {
+                batch, err = collectBatch(ctx, submissions, numServers, msgBlocks, batchSize, sched.interval)
+                if err != nil {
+                    return err
                 }
-                
-                beaverCBlockerTwo <- 1
-            }()
-            
-            //make sure all the beaver triple a/b parts are here before proceeding
-            for i:=0; i < 2; i++ {
-                <- beaverBlocker
-            }
-            
-            //make sure seed expansion is done
-            <- expansionBlocker
-
-            //if numServers > 2, timing starts here, wait to have all aux stuff. If numServers == 2, timing starts earlier with processing phase
-            if numServers > 2 {
-                for i:=0; i < 5; i++ {
-                    <- blocker
+                round++
+                for i:=1; i < numServers; i++ {
+                    err = conns[i].Send(ctx, wire.PhaseRound, round, nil)
+                    if err != nil {
+                        return err
+                    }
                 }
-                <- beaverCBlocker
-                if serverNum == numServers - 1 {
-                    <- deltaBlocker
+            } else {
+                announcement, err := conns[0].ReceiveAnyRound(ctx, wire.PhaseRound, 0)
+                if err != nil {
+                    return err
                 }
-                for i:=0; i < 2; i++ {
-                    <- beaverBlockerTwo
+                if announcement.Round <= round {
+                    return fmt.Errorf("leader announced round %d after round %d", announcement.Round, round)
                 }
-                <- beaverCBlockerTwo
-                
-                startTime = time.Now()
-
-            }
-
-            blindMacStartTime := time.Now()
-            
-            //blind mac verification
-            
-            //expand the key shares into the individual mac key shares, mask them and the msg shares with part of a beaver triple
-            maskedStuff := mycrypto.GetMaskedStuff(batchSize, msgBlocks+1, myNum, beaversA, beaversB, db, messagingMode, false)
-            
-            //everyone distributes shares and then merges them
-            maskedShares := broadcastAndReceiveFromAll(maskedStuff, conns, serverNum)
-                    
-            mergedMaskedShares := mergeFlattenedDBs(maskedShares, numServers, len(maskedStuff))
-            
-            if numServers == 2 {
-                <- beaverCBlocker
-            }
-            
-            //everyone computes (computed mac - provided tag) shares
-            macDiffShares := mycrypto.BeaverProduct(msgBlocks+1, batchSize, beaversC, mergedMaskedShares, db, leader, messagingMode, false, false)
-            
-            //broadcast shares
-            finalMacDiffShares := broadcastAndReceiveFromAll(macDiffShares, conns, serverNum)
-            
-            //verify the mac differences come out to 0
-            success := mycrypto.CheckSharesAreZero(batchSize, numServers, finalMacDiffShares)
-            if !success {
-                panic("blind mac verification failed")
+                round = announcement.Round
             }
+            debugf("round %d\n", round)
             
-            
-            blindMacElapsedTime := time.Since(blindMacStartTime)
-            
-            //make sure the self-computed share translation stuff is ready if numServers == 2
-            if numServers == 2 {
-                for i:=0; i < 5; i++ {
-                    <- blocker
-                }
+            //NOTE: since the purpose of this evaluation is to measure the performance once the servers have already received the messages from the client, unless -clients is given I'm just going to have the lead server generate the client queries and pass them on to the others to save time
+            //receiving client connections phase 
+            var inputs *roundInputs
+            if leader && opts.verify {
+                inputs = newRoundInputs(batchSize)
             }
-            
-            shuffleStartTime := time.Now()
-                
-            //shuffle
-            flatten(db, flatDB)
-            if serverNum != 0 { //everyone masks their DB share and sends it to server 0
-
-                mycrypto.AddOrSub(flatDB, aInitial, true)//false is for subtraction
-                writeToConn(conns[0], flatDB)
-            } else { //server 0 does the shuffle
-                
-                //receive all the values masked with aInitial
-                for i:=1; i < numServers; i++ {
-                    mycrypto.AddOrSub(flatDB, readFromConn(conns[i], dbSize), true)
-                }
-                
-                //permute and apply delta, mask result and send to server 1
-                flatDB = mycrypto.PermuteDB(flatDB, pi)
-                mycrypto.AddOrSub(flatDB, aAtPermTime, true)
-                writeToConn(conns[1], flatDB)
+            receiveCtx, cancelReceive := context.WithTimeout(ctx, conf.Timeout(config.StepSubmissions))
+            if leader {
+                sources, err = leaderReceivingPhase(receiveCtx, round, shares, setupConns, msgBlocks+1, batchSize, pubKeys, messagingMode, batch, submissions == nil, inputs)
+            } else {
+                err = otherReceivingPhase(receiveCtx, round, shares, setupConns, numServers, msgBlocks+1, batchSize, pubKeys[serverNum], mySecKey, serverNum)
             }
-            //the middle servers take turns shuffling
-            if serverNum != 0 && serverNum != numServers - 1 {
-                //complete the vector to be permuted (read from prev server)             
-                sAtPermTime := readFromConn(conns[serverNum-1], dbSize)
-                
-                //permute and apply delta, mask and send to next server
-                flatDB = mycrypto.PermuteDB(sAtPermTime, pi)
-                mycrypto.AddOrSub(flatDB, aAtPermTime, true)
-                writeToConn(conns[serverNum+1], flatDB)
+            cancelReceive()
+            if err != nil {
+                return &protocol.AbortError{Round: round, Err: err}
             }
-            //the last server shuffles
-            if serverNum == numServers - 1 {
-                //complete the vector to be permuted (read from prev server) 
-                sAtPermTime := readFromConn(conns[serverNum-1], dbSize)
-                
-                //permute and apply delta
-                flatDB = mycrypto.PermuteDB(sAtPermTime, pi)
-                
-                if numServers == 2 {
-                    <- deltaBlocker
-                }
-                
-                mycrypto.AddOrSub(flatDB, delta, true)
+            //runtime.GC()
+            debugf("starting processing of message batch\n")
+            
+            out, err := shuffler.RunRound(ctx, protocol.Inputs{Round: round, Shares: shares})
+            //if a server's opening didn't match its commitment, keep the evidence and go on with the next round
+            var mismatch *protocol.CommitmentError
+            if errors.As(err, &mismatch) {
+                writeEvidence(opts.evidenceDir, mismatch.Evidence)
+                log.Println(mismatch)
+                continue
             }
-            //bFinal is actually the db here for everyone except the final server
-            if serverNum != numServers - 1 {
-                flatDB = bFinal
+            //a failed blind mac verification is seen by every server at the same point, so the others
+            //have stopped too and the connections are still in step
+            //same for a round the servers don't all have the bundle of, or one no aux file had, and for
+            //preprocessing that failed the check of the aux
+            if errors.Is(err, mycrypto.ErrVerification) || errors.Is(err, protocol.ErrStockpile) || errors.Is(err, protocol.ErrAuxCheating) {
+                log.Println(err)
+                continue
             }
-            
-            shuffleElapsedTime := time.Since(shuffleStartTime)
-            
-            
-            //second blind mac verification
-            
-            //unflatten DB
-            for i:=0; i < numThreads; i++ {
-                startI := i*chunkSize
-                endI := (i+1)*chunkSize
-                go func(startIndex, endIndex int) {
-                    for j:=startIndex; j < endIndex; j++ {
-                        db[j] = flatDB[j*blocksPerRow*16:(j+1)*blocksPerRow*16]
-                    }
-                    unflattenBlocker <- 1
-                }(startI, endI)
+            if err != nil {
+                return err
             }
-                
-            
-            //start the hash of the final DB here in the background
-            hash := make([]byte, 0)
-            go func() {
-                //hash the whole db
-                hash = mycrypto.Hash(flatDB)
-                hashBlocker <- 1
-            }()
-            
-
             
-            if numServers == 2 {
-                for i:=0; i < 2; i++ {
-                    <- beaverBlockerTwo
+            if len(out.Evicted) > 0 {
+                infof("round %d: %d rows failed the mac check (client or server fault), evicted them\n", round, len(out.Evicted))
+                if leader {
+                    reportEvictions(round, out.Evicted, sources)
                 }
             }
             
-            for i:=0; i < numThreads; i++ {
-                <-unflattenBlocker
-            }
-            
-            //expand the key shares into the individual mac key shares, mask them and the msg shares with part of a beaver triple
-            maskedStuff = mycrypto.GetMaskedStuff(batchSize, msgBlocks+1, myNum, beaversATwo, beaversBTwo, db, messagingMode, true)
-            
-            //everyone distributes shares and then merges them
-            maskedShares = broadcastAndReceiveFromAll(maskedStuff, conns, serverNum)
-                    
-            mergedMaskedShares = mergeFlattenedDBs(maskedShares, numServers, len(maskedStuff))
-            
-            if numServers == 2 {
-                <- beaverCBlockerTwo
-            }
-            
-            //everyone computes (computed mac - provided tag) shares
-            macDiffShares = mycrypto.BeaverProduct(msgBlocks+1, batchSize, beaversCTwo, mergedMaskedShares, db, leader, messagingMode, true, true)
-                        
-            //hash macDiffShares and distribute as a commitment. 
-            hashedMacDiffShares := mycrypto.Hash(macDiffShares)
-            allHashedMacDiffShares := broadcastAndReceiveFromAll(hashedMacDiffShares, conns, serverNum)
+            //keep our share around for clients to fetch
+            outputs.add(&roundOutput{
+                round: round,
+                numServers: numServers,
+                serverNum: serverNum,
+                msgBlocks: msgBlocks,
+                batchSize: batchSize,
+                messagingMode: messagingMode,
+                commitments: out.Commitments,
+                share: out.Share,
+            })
             
-            //broadcast shares
-            finalMacDiffShares = broadcastAndReceiveFromAll(macDiffShares, conns, serverNum)
-            
-            //check that the broadcasted shares match the commitment
-            if !mycrypto.CheckHashes(allHashedMacDiffShares, finalMacDiffShares, len(macDiffShares), serverNum) {
-                panic("mac hashes did not match")
-            }
-            
-            //verify the macs come out to 0
-            success = mycrypto.CheckSharesAreZero(numThreads, numServers, finalMacDiffShares)
-            if !success {
-                panic("blind mac verification two failed")
+            /*The servers don't actually need to do this last step, the clients can do it 
+            themselves with client.Fetch, both when it's used for broadcast and messaging.
+            With -verify they do it anyway, to catch rounds that reveal garbage*/
+            if opts.verify {
+                err = verifyOutput(round, out.Merged, msgBlocks, batchSize, messagingMode, inputs, out.Evicted)
+                if err != nil {
+                    return err
+                }
             }
             
-            revealTimeStart := time.Now()
-            
-            
-            //commit, reveal, mac verify, decrypt
-            
-            //make sure we're done hashing the DB
-            <- hashBlocker
-            
-            //send out hash (commitments)
-            hashes := broadcastAndReceiveFromAll(hash, conns, serverNum)
-            
-            //send out full DB after getting everyone's commitment
-            flatDBs := broadcastAndReceiveFromAll(flatDB, conns, serverNum)
-
-            //check that the received DBs match the received hashes
-            if !mycrypto.CheckHashes(hashes, flatDBs, dbSize, serverNum) {
-                panic("hashes did not match")
+            blindMacElapsedTime = out.Timings.BlindMac
+            shuffleElapsedTime = out.Timings.Shuffle
+            revealElapsedTime = out.Timings.Reveal
+            elapsedTime = out.Timings.Total
+            
+            //publish the output, outside the timed part
+            if outputBoard != nil {
+                err = outputBoard.Publish(board.RoundInfo{
+                    Round: round,
+                    NumServers: numServers,
+                    MsgBlocks: msgBlocks,
+                    BatchSize: batchSize,
+                    MessagingMode: messagingMode,
+                    RowLength: len(out.Merged)/batchSize,
+                }, out.Merged)
+                if err != nil {
+                    log.Printf("couldn't publish round %d: %v\n", round, err)
+                }
             }
-            //merge DBs
-            mergedDB := mergeFlattenedDBs(flatDBs, numServers, len(flatDB))
-            
-            _ = mergedDB
-            /*The servers don't actually need to do this last step, the clients can do it 
-            themselves, both when it's used for broadcast and messaging*/
-            //check macs in merged DBs and decrypt
-            //outputDB, ok := checkMacsAndDecrypt(mergedDB, numServers, msgBlocks+1, batchSize, messagingMode)
-            //if !ok {
-            //    panic("macs did not verify")
-            //}
-            //_ = outputDB 
-            
-            revealElapsedTime := time.Since(revealTimeStart)
-            elapsedTime := time.Since(startTime)
             
             if leader{
                 batchesCompleted++
@@ -622,25 +474,63 @@ func main() {
                 totalRevealTime += revealElapsedTime
             }
             
-            //only the leader outputs the stats on the last round
-            if leader && testCount == 4{
+            if leader && sched.continuous() {
+                infof("round %d done in %s\n", round, elapsedTime)
+            }
+            
+        }
+        
+        //only the leader outputs the stats, once the parameter set's rounds are done, even if the
+        //last of them was aborted
+        if leader && !sched.continuous() {
 
-                //log.Println(outputDB);
-                
-                fmt.Printf("%d servers, %d msgs per batch, %d byte messages\n", numServers, batchSize, msgBlocks*16)
-                if messagingMode {
-                    fmt.Printf("Messaging mode\n")
-                }
+            //log.Println(outputDB);
+            
+            fmt.Printf("%d servers, %d msgs per batch, %d byte messages\n", numServers, batchSize, msgBlocks*16)
+            if messagingMode {
+                fmt.Printf("Messaging mode\n")
+            }
+            if batchesCompleted == 0 {
+                fmt.Printf("batches completed: 0\n\n\n")
+                infof("no batch completed\n\n\n")
+            } else {
                 fmt.Printf("blind mac time: %s, average: %s", blindMacElapsedTime, totalBlindMacTime/time.Duration(batchesCompleted))
                 fmt.Printf("shuffle time: %s, average: %s", shuffleElapsedTime, totalShuffleTime/time.Duration(batchesCompleted))
                 fmt.Printf("reveal time: %s, average: %s\n", revealElapsedTime, totalRevealTime/time.Duration(batchesCompleted))
                 fmt.Printf("batches completed: %d\n", batchesCompleted)
-                fmt.Printf("Time for this batch: %s\n", elapsedTime)
+                fmt.Printf("Time for the last batch: %s\n", elapsedTime)
                 fmt.Printf("Average time per batch: %s\n\n\n", totalTime/time.Duration(batchesCompleted))
                 
-                log.Printf("Average time per batch: %s\n\n\n", totalTime/time.Duration(batchesCompleted))
+                infof("Average time per batch: %s\n\n\n", totalTime/time.Duration(batchesCompleted))
             }
-            
         }
+        
+        //the aux stops streaming before the next parameter set is agreed on
+        err = stopFilling()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+//keep shuffler's stockpile at size bundles until the returned function is called, which stops
+//filling it and returns how that went. Does nothing without a stockpile (size 0)
+func startFilling(ctx context.Context, shuffler *protocol.ShuffleServer, size int) func() error {
+    if size <= 0 {
+        return func() error { return nil }
+    }
+    fillCtx, cancel := context.WithCancel(ctx)
+    fillDone := make(chan error, 1)
+    go func() {
+        err := shuffler.FillStockpile(fillCtx, size)
+        if err != nil {
+            log.Printf("filling the stockpile: %v\n", err)
+        }
+        fillDone <- err
+    }()
+    return func() error {
+        cancel()
+        return <- fillDone
     }
 }
@@ -1,21 +1,32 @@
 package main
 
 import (
-    "log"
+    "context"
+    "errors"
     "net"
     "golang.org/x/crypto/nacl/box"
     "io"
     "time"
+    "fmt"
     "crypto/rand"
     //"crypto/tls"
     
     "shufflemessage/mycrypto" 
+    "shufflemessage/client"
+    "shufflemessage/wire"
+    "shufflemessage/mux"
+    "shufflemessage/protocol"
 )
 
 
 //some utility functions used by the servers
 
-func leaderReceivingPhase(db [][]byte, setupConns [][]net.Conn, msgBlocks, batchSize int,  pubKeys []*[32]byte, messagingMode bool) {
+//batch holds the client submissions collected for this round
+//empty slots are filled with clientSim messages if simulateClients is set (benchmark load generator)
+//and with dummy messages otherwise
+//returns the submission that ended up in each row of the db (nil for messages the leader made up)
+//if inputs isn't nil, the plaintexts of the messages the leader makes up and the rows they go into are recorded in it
+func leaderReceivingPhase(ctx context.Context, round uint64, db [][]byte, setupConns [][]*wire.Conn, msgBlocks, batchSize int,  pubKeys []*[32]byte, messagingMode bool, batch []*clientSubmission, simulateClients bool, inputs *roundInputs) ([]*clientSubmission, error) {
     //client connection receiving phase
     numServers := len(setupConns)
     
@@ -26,90 +37,90 @@ func leaderReceivingPhase(db [][]byte, setupConns [][]net.Conn, msgBlocks, batch
     seed := make([]byte, 16)
     _,err := rand.Read(seed)
     if err != nil {
-        log.Println("couldn't generate seed")
-        panic(err)
+        return nil, fmt.Errorf("%w: %v", mycrypto.ErrRandomness, err)
     }
-    rand.Read(seed)
-    prelimPerm := mycrypto.GenPerm(batchSize, seed)
+    prelimPerm, err := mycrypto.GenPerm(batchSize, seed)
+    if err != nil {
+        return nil, err
+    }
+    sources := make([]*clientSubmission, batchSize)
     //NOTE: the preliminary permutation is effectively "for free" to evaluate because the server just copies the client messages into their permuted indices directly
     
     
     numThreads, chunkSize := mycrypto.PickNumThreads(batchSize)
     //numThreads = 1
     //chunkSize = batchSize
-    blocker := make(chan int)
     
-    for i:=0; i < numThreads; i++ {
-        startIndex := i*chunkSize
-        endIndex := (i+1)*chunkSize
-        go func(startI, endI, threadNum int) {
-            //for performance measurement we'll only implement the case where all client messages are good
-            //we'll just panic later if a blind mac verification fails
-                        
-            for msgCount := startI; msgCount < endI; msgCount++ {
-                //handle connections from client, pass on boxes
-                
-                clientTransmission, _ := clientSim(msgCount%26, msgBlocks, pubKeys, messagingMode)
-                
-                //handle the message sent for this server
-                copy(db[prelimPerm[msgCount]][0:shareLength], clientTransmission[0:shareLength])
-                
-                //pass on the boxes to the other servers, send the index they should be placed in too
-                for i := 1; i < numServers; i++ {
-                    
-                    //send prelimPerm[msgCount]
-                    writeToConn(setupConns[i][threadNum], intToByte(prelimPerm[msgCount]))
+    err = protocol.RunAll(ctx, numThreads, func(ctx context.Context, threadNum int) error {
+        //for performance measurement we'll only implement the case where all client messages are good
+        //we'll just panic later if a blind mac verification fails
                     
-                    //send client message
-                    start := shareLength + (i-1)*boxedShareLength
-                    end := shareLength + i*boxedShareLength
-                    writeToConn(setupConns[i][threadNum], clientTransmission[start:end])
+        for msgCount := threadNum*chunkSize; msgCount < (threadNum+1)*chunkSize; msgCount++ {
+            //handle connections from client, pass on boxes
+            
+            var clientTransmission, plaintext []byte
+            var err error
+            if batch[msgCount] != nil {
+                clientTransmission = batch[msgCount].data
+            } else if simulateClients {
+                clientTransmission, _, err = clientSim(msgCount%26, msgBlocks, pubKeys, messagingMode)
+                plaintext = mycrypto.MakeMsg(msgBlocks-1, msgCount%26)
+            } else {
+                clientTransmission, err = dummySubmission(msgBlocks, pubKeys, messagingMode)
+                plaintext = make([]byte, 16*(msgBlocks-1))
+            }
+            if err != nil {
+                return err
+            }
+            if inputs != nil {
+                inputs.plaintexts[msgCount] = plaintext
+                inputs.rows[msgCount] = prelimPerm[msgCount]
+            }
+            
+            //handle the message sent for this server
+            copy(db[prelimPerm[msgCount]][0:shareLength], clientTransmission[0:shareLength])
+            sources[prelimPerm[msgCount]] = batch[msgCount]
+            
+            //pass on the boxes to the other servers, along with the index they should be placed in
+            for i := 1; i < numServers; i++ {
+                start := shareLength + (i-1)*boxedShareLength
+                end := shareLength + i*boxedShareLength
+                submission := append(intToByte(prelimPerm[msgCount]), clientTransmission[start:end]...)
+                err := setupConns[i][threadNum].Send(ctx, wire.PhaseSubmissions, round, submission)
+                if err != nil {
+                    return err
                 }
             }
-            blocker <- 1
-        }(startIndex, endIndex, i)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
     }
     
-    for i:=0; i < numThreads; i++ {
-        <- blocker
-    }
+    return sources, nil
 }
 
-func clientSim(msgType, msgBlocks int, pubKeys []*[32]byte, messagingMode bool) ([]byte, time.Duration) {
+func clientSim(msgType, msgBlocks int, pubKeys []*[32]byte, messagingMode bool) ([]byte, time.Duration, error) {
     startTime := time.Now()
     
-    numServers := len(pubKeys)
-        
-    //generate the MACed ciphertext, MAC, and all the keys; secret share
-    //look in vendors/mycrypto/crypto.go for details
-    msg := mycrypto.MakeCT(msgBlocks-1, msgType)
-    mac, keySeeds := mycrypto.WeirdMac(numServers, msg, messagingMode)
-    bodyShares := mycrypto.Share(numServers, append(msg, mac...))
-        
-    //box shares with the appropriate key share seeds prepended
-    //"box" sent to leader is actually just sent to the leader without a box
-    msgToSend := append(bodyShares[0], keySeeds[0]...)
-    
-    //log.Printf("Msg length for one share: %d\n", len(msgToSend))
-    //log.Printf("encryption size overhead: %d\n", box.AnonymousOverhead)
-    
-    for i:= 1; i < numServers; i++ {
-        
-        //SealAnonymous appends its output to msgToSend
-        boxedMessage, err := box.SealAnonymous(nil, append(bodyShares[i], keySeeds[i]...), pubKeys[i], rand.Reader)
-        if err != nil {
-            panic(err)
-        }
-        msgToSend = append(msgToSend, boxedMessage...)
+    //generate the MACed ciphertext, MAC, and all the keys; secret share and box
+    //look in client/client.go for details
+    ct, err := mycrypto.MakeCT(msgBlocks-1, msgType)
+    if err != nil {
+        return nil, 0, err
+    }
+    msgToSend, err := client.SealCiphertext(ct, pubKeys, messagingMode)
+    if err != nil {
+        return nil, 0, err
     }
-    
     
     elapsedTime := time.Since(startTime)
     
-    return msgToSend, elapsedTime
+    return msgToSend, elapsedTime, nil
 }
 
-func otherReceivingPhase(db [][]byte, setupConns [][]net.Conn, numServers, msgBlocks, batchSize int, myPubKey, mySecKey *[32]byte, myNum int) {
+func otherReceivingPhase(ctx context.Context, round uint64, db [][]byte, setupConns [][]*wire.Conn, numServers, msgBlocks, batchSize int, myPubKey, mySecKey *[32]byte, myNum int) error {
 
     //48 is for mac key share, mac, encryption key, 16 bytes each
     shareLength := 32 + 16*msgBlocks
@@ -118,82 +129,85 @@ func otherReceivingPhase(db [][]byte, setupConns [][]net.Conn, numServers, msgBl
     //numThreads = 1
     //chunkSize = batchSize
     
-    blocker:= make(chan int)
-    
-    for i:=0; i < numThreads; i++ {
-        startIndex := i*chunkSize
-        endIndex := (i+1)*chunkSize
-        go func(startI, endI, threadIndex int) {
-            //client connection receiving phase
-            for msgCount := startI; msgCount < endI; msgCount++ {
-                
-                //read permuted index from leader
-                prelimPermIndex := byteToInt(readFromConn(setupConns[0][threadIndex], 4))
-                
-                //read client box from leader, unbox
-                clientBox := readFromConn(setupConns[0][threadIndex], boxedShareLength)
-                
-                clientMessage, ok := box.OpenAnonymous(nil, clientBox, myPubKey, mySecKey)
-                if !ok {
-                    panic("decryption not ok!!")
-                }
-                
-                //store in db
-                copy(db[prelimPermIndex][0:shareLength], clientMessage[:])
+    return protocol.RunAll(ctx, numThreads, func(ctx context.Context, threadIndex int) error {
+        //client connection receiving phase
+        for msgCount := threadIndex*chunkSize; msgCount < (threadIndex+1)*chunkSize; msgCount++ {
+            
+            //read permuted index and client box from leader, unbox
+            submission, err := setupConns[0][threadIndex].Receive(ctx, wire.PhaseSubmissions, round, 4 + boxedShareLength)
+            if err != nil {
+                return err
+            }
+            prelimPermIndex := byteToInt(submission[0:4])
+            if prelimPermIndex < 0 || prelimPermIndex >= batchSize {
+                return fmt.Errorf("leader sent a submission for row %d of %d", prelimPermIndex, batchSize)
             }
+            clientBox := submission[4:]
             
-            blocker <- 1
-        }(startIndex, endIndex, i)
-    }
-    
-    for i:=0; i < numThreads; i++ {
-        <- blocker
-    }
+            clientMessage, ok := box.OpenAnonymous(nil, clientBox, myPubKey, mySecKey)
+            if !ok {
+                return errors.New("leader sent a submission that doesn't decrypt")
+            }
+            
+            //store in db
+            copy(db[prelimPermIndex][0:shareLength], clientMessage[:])
+        }
+        return nil
+    })
 }
 
-func expandDB(db [][]byte, msgBlocks int) {
-    blocker := make(chan int)
-    batchSize := len(db)
-    numThreads, chunkSize := mycrypto.PickNumThreads(batchSize)
-    
-    for i:=0; i < numThreads; i++ {
-        startIndex := i*chunkSize;
-        endIndex := (i+1)*chunkSize
-        go func(startI, endI int) {
-            for j:=startI; j < endI; j++ {
-                copy(db[j][(msgBlocks+1)*16:], 
-                     mycrypto.AesPRG(msgBlocks*16, db[j][(msgBlocks+1)*16:(msgBlocks+2)*16]))
-            }
-            blocker <- 1
-        }(startIndex, endIndex)
-    }
-    
-    for i:=0; i < numThreads; i++ {
-        <- blocker
+//streams of the session between two servers
+const (
+    //the round announcements and the small protocol messages of the rounds
+    streamControl = 0
+    //the bulk of a round, see protocol.ServerConfig.ShufflePeers
+    streamShuffle = 1
+    streamVerification = 2
+    streamReveal = 3
+    //the submissions the leader passes on, one stream per worker thread from here on
+    streamSubmissions = 4
+)
+
+//a stream of session for one part of the rounds, see the stream constants
+//control is the session's control stream, which did the handshake
+func roundStream(session *mux.Session, control *wire.Conn, id uint32, name string) *wire.Conn {
+    return wire.NewConnVersion(session.Stream(id), fmt.Sprintf("%s %s stream", control.Peer(), name), control.Version())
+}
+
+//the streams for passing on submissions to or from the server on the other end of session
+//control is the session's control stream, which did the handshake
+func submissionStreams(session *mux.Session, control *wire.Conn, numThreads int) []*wire.Conn {
+    streams := make([]*wire.Conn, numThreads)
+    for j:=0; j < numThreads; j++ {
+        stream := session.Stream(streamSubmissions + uint32(j))
+        streams[j] = wire.NewConnVersion(stream, fmt.Sprintf("%s submission stream %d", control.Peer(), j), control.Version())
     }
+    return streams
 }
 
-func readFromConn(conn net.Conn, bytes int) []byte {
-    buffer := make([]byte, bytes)
-    for count := 0; count < bytes; {
-        n, err := conn.Read(buffer[count:])
-        //log.Println(count)
-        //log.Println(bytes)
-        count += n
-        if err != nil && err != io.EOF && count != bytes {
-            log.Println(n)
-            panic(err)
-        }
+//handshake on a connection to another server or the aux, giving up on the connection if it fails
+func handshake(ctx context.Context, conn net.Conn, peer string, timeout time.Duration) (*wire.Conn, error) {
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    c := wire.NewConn(conn, peer)
+    err := c.Handshake(ctx)
+    if err != nil {
+        conn.Close()
+        return nil, err
     }
-    return buffer
+    debugf("connected to %s, protocol version %d\n", peer, c.Version())
+    return c, nil
 }
 
-func writeToConn(conn net.Conn, msg []byte) {
-    n, err := conn.Write(msg)
+//read exactly bytes bytes from a client connection
+//hands back errors instead of panicking, since clients shouldn't be able to bring down the server
+func readFromConnErr(conn net.Conn, bytes int) ([]byte, error) {
+    buffer := make([]byte, bytes)
+    _, err := io.ReadFull(conn, buffer)
     if err != nil {
-        log.Println(n)
-        panic(err)
+        return nil, err
     }
+    return buffer, nil
 }
 
 func intToByte(myInt int) (retBytes []byte){
@@ -209,117 +223,3 @@ func byteToInt(myBytes []byte) (x int) {
     x = int(myBytes[3]) << 24 + int(myBytes[2]) << 16 + int(myBytes[1]) << 8 + int(myBytes[0])
     return
 }
-
-//flatten the db
-func flatten(db [][]byte, flatDB []byte){
-    rowLen := len(db[0])
-    for i:= 0; i < len(db); i++ {
-        copy(flatDB[i*rowLen:(i+1)*rowLen], db[i])
-    }
-}
-
-func unflatten(db [][]byte, flatDB []byte) {
-    rowLen := len(db[0])
-    for i:=0; i < len(db); i++ {
-        db[i] = flatDB[i*rowLen:(i+1)*rowLen]
-    }
-}
-
-//merge the concatenation of flattened DBs into one DB
-//by taking the elementwise sum of all the DBs
-func mergeFlattenedDBs(flatDBs []byte, numServers, dbSize int) []byte {
-    if dbSize % 16 != 0 || len(flatDBs) != numServers*dbSize {
-        panic("something is wrong with the MergeFlattenedDBs parameters")
-    }
-    
-    dbs := make([][]byte, numServers)
-    
-    for i := 0; i < numServers; i++ {
-        dbs[i] = flatDBs[i*dbSize:(i+1)*dbSize]
-    }
-    
-    return mycrypto.Merge(dbs)
-}
-
-//check all the macs in a merged db
-//and decrypt the messages
-func checkMacsAndDecrypt(mergedDB []byte, numServers, msgBlocks, batchSize int, messagingMode bool) ([][]byte, bool) {
-    outputDB := make([][]byte, batchSize)
-    rowLen := msgBlocks*32 + 16
-    
-    if messagingMode {
-        rowLen = msgBlocks*16 + 32
-    }
-    
-    success := true
-    
-    numThreads, chunkSize := mycrypto.PickNumThreads(batchSize)
-    blocker := make(chan int)
-    
-    for t:=0; t < numThreads; t++ {
-        startIndex := t*chunkSize
-        endIndex := (t+1)*chunkSize
-        go func(startI, endI int) {
-            for i:=startI; i < endI; i++ {
-                row := mergedDB[rowLen*i:rowLen*(i+1)]
-                msg := row[:msgBlocks*16]
-                tag := row[msgBlocks*16:(msgBlocks+1)*16]
-                keys := row[(msgBlocks+1)*16:]
-
-                if !mycrypto.CheckMac(msg, tag, keys, messagingMode) {
-                    success = false
-                }
-                
-                //decrypt
-                msg = mycrypto.DecryptCT(msg)
-                
-                outputDB[i] = msg
-            }
-            blocker <- 1
-        }(startIndex, endIndex)
-    }
-    
-    for i:=0; i < numThreads; i++ {
-        <- blocker
-    }
-    
-    return outputDB, success
-}
-
-func broadcastAndReceiveFromAll(msg []byte, conns []net.Conn, myNum int) []byte {
-    blocker := make(chan int)
-    numServers := len(conns)
-    contentLenPerServer := len(msg)
-    content := make([]byte, contentLenPerServer*numServers)
-        
-    //for servers with lower number, read then write
-    for i:=0; i < myNum; i++ {
-        go func(data, outputLocation []byte, conn net.Conn) {
-            bytesToRead := len(data)
-            copy(outputLocation, readFromConn(conn, bytesToRead))
-            writeToConn(conn, data)
-            blocker <- 1
-            return
-        }(msg, content[i*contentLenPerServer:(i+1)*contentLenPerServer], conns[i])
-    }
-    
-    //for servers with higher number, write then read
-    for i:= myNum+1; i < numServers; i++ {
-        go func(data, outputLocation []byte, conn net.Conn) {
-            bytesToRead := len(data)
-            writeToConn(conn, data)
-            copy(outputLocation, readFromConn(conn, bytesToRead))
-            blocker <- 1
-            return
-        }(msg, content[i*contentLenPerServer:(i+1)*contentLenPerServer], conns[i])
-    }
-    
-    //"receive" from self
-    copy(content[contentLenPerServer*myNum:contentLenPerServer*(myNum+1)], msg[:])
-    
-    for i := 1; i < numServers; i++ {
-        <- blocker
-    }
-    
-    return content
-}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "net"
+    "sync"
+    "time"
+
+    "shufflemessage/keys"
+)
+
+//how the shuffle servers and the aux reach each other
+//every server dials the ones with lower numbers and accepts the higher ones and the aux, the aux dials
+//every server. Deployments use TLS to the addresses in the config, tests can wire everyone up in
+//one process with a memNetwork instead, and everything above the connections runs the same either way
+
+type transport interface {
+    //connect to server peer, within timeout
+    dial(ctx context.Context, peer int, timeout time.Duration) (net.Conn, error)
+    //the next connection from server peer (or the aux)
+    //waits until the peer connects or ctx is cancelled
+    accept(ctx context.Context, peer int) (net.Conn, error)
+    Close() error
+}
+
+//mutual TLS between the servers and the aux, see peers.go
+type tlsTransport struct {
+    addrs []string
+    directory *keys.Directory
+    cer tls.Certificate
+    //nil for the aux, which only dials
+    ln *peerListener
+}
+
+//listenAddr is where the other servers and the aux connect to us. empty means don't listen, for the aux
+func newTLSTransport(addrs []string, listenAddr string, directory *keys.Directory, secretKeys *keys.SecretKeys) (*tlsTransport, error) {
+    cer, err := secretKeys.Certificate()
+    if err != nil {
+        return nil, err
+    }
+    t := &tlsTransport{addrs: addrs, directory: directory, cer: cer}
+    if listenAddr != "" {
+        t.ln, err = listenForPeers(listenAddr, directory, cer)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return t, nil
+}
+
+func (t *tlsTransport) dial(ctx context.Context, peer int, timeout time.Duration) (net.Conn, error) {
+    return dialPeer(ctx, t.addrs[peer], t.directory, t.cer, peer, timeout)
+}
+
+func (t *tlsTransport) accept(ctx context.Context, peer int) (net.Conn, error) {
+    if t.ln == nil {
+        return nil, fmt.Errorf("not listening for connections from %d", peer)
+    }
+    return t.ln.acceptFrom(ctx, peer)
+}
+
+func (t *tlsTransport) Close() error {
+    if t.ln == nil {
+        return nil
+    }
+    return t.ln.Close()
+}
+
+//servers and the aux in one process, connected by net.Pipe
+//there's no TLS, everyone is who their endpoint says they are
+type memNetwork struct {
+    mu sync.Mutex
+    //connections on their way from one party to another, by [from, to]
+    queues map[[2]int]chan net.Conn
+}
+
+func newMemNetwork() *memNetwork {
+    return &memNetwork{queues: make(map[[2]int]chan net.Conn)}
+}
+
+func (n *memNetwork) queue(from, to int) chan net.Conn {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    q, ok := n.queues[[2]int{from, to}]
+    if !ok {
+        q = make(chan net.Conn, 64)
+        n.queues[[2]int{from, to}] = q
+    }
+    return q
+}
+
+//the transport of server me (or the aux) on the network
+func (n *memNetwork) endpoint(me int) transport {
+    return &memTransport{network: n, me: me}
+}
+
+type memTransport struct {
+    network *memNetwork
+    me int
+}
+
+func (t *memTransport) dial(ctx context.Context, peer int, timeout time.Duration) (net.Conn, error) {
+    mine, theirs := net.Pipe()
+    select {
+    case t.network.queue(t.me, peer) <- theirs:
+        return mine, nil
+    case <- ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+func (t *memTransport) accept(ctx context.Context, peer int) (net.Conn, error) {
+    select {
+    case conn := <- t.network.queue(peer, t.me):
+        return conn, nil
+    case <- ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+func (t *memTransport) Close() error {
+    return nil
+}
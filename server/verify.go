@@ -0,0 +1,116 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+
+    "shufflemessage/client"
+)
+
+//checking the output of rounds against what went into them, with -verify
+//every server checks the MACs of the merged output. The leader also records the plaintexts of the
+//messages it makes up, and checks that the output holds exactly those and isn't in the order it took
+//them in. It can't know what real clients sent, so their messages (and evicted ones) only have to
+//account for the rest of the rows
+
+//a shuffle may leave the messages in the order they came in if that's at least this likely, and then
+//the order isn't checked. e.g. a batch of 2
+const unshuffledChance = 1.0/(1 << 40)
+
+//what the leader put into a round
+type roundInputs struct {
+    //in the order the leader took the messages, nil for ones it doesn't know the plaintext of
+    plaintexts [][]byte
+    //the db row each message went into
+    rows []int
+}
+
+func newRoundInputs(batchSize int) *roundInputs {
+    return &roundInputs{plaintexts: make([][]byte, batchSize), rows: make([]int, batchSize)}
+}
+
+//check a round's merged output. inputs is nil on the servers other than the leader,
+//which only check the MACs. evicted are the db rows that were evicted in the round
+//the error says which output rows or inputs are the problem
+func verifyOutput(round uint64, merged []byte, msgBlocks, batchSize int, messagingMode bool, inputs *roundInputs, evicted []int) error {
+    outputs, badRows := client.CheckMacsAndDecrypt(merged, msgBlocks, batchSize, messagingMode)
+    if len(badRows) > 0 {
+        return fmt.Errorf("round %d output check failed: MACs of output rows %v don't verify", round, badRows)
+    }
+    if inputs == nil {
+        debugf("round %d output MACs checked\n", round)
+        return nil
+    }
+
+    wasEvicted := make(map[int]bool)
+    for _, row := range evicted {
+        wasEvicted[row] = true
+    }
+
+    //the plaintexts that have to come out, and how many rows we can't say anything about
+    expected := make(map[string][]int)
+    unknown := 0
+    for i, plaintext := range inputs.plaintexts {
+        if plaintext == nil || wasEvicted[inputs.rows[i]] {
+            unknown++
+            continue
+        }
+        expected[string(plaintext)] = append(expected[string(plaintext)], i)
+    }
+
+    unmatched := make([]int, 0)
+    for row, output := range outputs {
+        if indices := expected[string(output)]; len(indices) > 0 {
+            expected[string(output)] = indices[1:]
+            continue
+        }
+        unmatched = append(unmatched, row)
+    }
+    missing := make([]int, 0)
+    for _, indices := range expected {
+        missing = append(missing, indices...)
+    }
+    sort.Ints(missing)
+
+    if len(missing) > 0 || len(unmatched) != unknown {
+        problems := make([]string, 0, 2)
+        if len(missing) > 0 {
+            problems = append(problems, fmt.Sprintf("inputs %v are missing from the output", missing))
+        }
+        if len(unmatched) != unknown {
+            problems = append(problems, fmt.Sprintf("output rows %v don't match any input (%d unknown inputs)", unmatched, unknown))
+        }
+        return fmt.Errorf("round %d output check failed: %s", round, strings.Join(problems, ", "))
+    }
+
+    if unknown == 0 && orderMatters(inputs.plaintexts) {
+        inOrder := true
+        for i, plaintext := range inputs.plaintexts {
+            inOrder = inOrder && bytes.Equal(outputs[i], plaintext)
+        }
+        if inOrder {
+            return fmt.Errorf("round %d output check failed: output rows 0 to %d are in the order the messages were submitted", round, batchSize-1)
+        }
+    }
+
+    debugf("round %d output checked\n", round)
+    return nil
+}
+
+//whether a shuffle of plaintexts is unlikely enough to keep their order that it's worth checking
+//the chance is 1 over the number of distinct orders, n!/(k1!*k2!*...) for plaintexts that come up k1, k2, ... times
+func orderMatters(plaintexts [][]byte) bool {
+    counts := make(map[string]int)
+    for _, plaintext := range plaintexts {
+        counts[string(plaintext)]++
+    }
+    logOrders, _ := math.Lgamma(float64(len(plaintexts)+1))
+    for _, k := range counts {
+        logK, _ := math.Lgamma(float64(k+1))
+        logOrders -= logK
+    }
+    return logOrders > -math.Log(unshuffledChance)
+}
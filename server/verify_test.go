@@ -0,0 +1,82 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+
+    "shufflemessage/client"
+    "shufflemessage/config"
+)
+
+//with simulated clients the leader knows every plaintext, so the whole check runs on every round
+func TestVerifySimulatedRounds(t *testing.T) {
+    params := []config.Params{
+        {Mode: config.ModeStandard, MsgBlocks: 2, BatchSize: 32},
+        {Mode: config.ModeMessaging, MsgBlocks: 1, BatchSize: 16},
+    }
+    c := startCluster(t, clusterOpts{numServers: 3, params: params, roundsPerParam: 2, simulateClients: true})
+    c.wait(t)
+}
+
+func TestVerifyOutputReportsRows(t *testing.T) {
+    params := config.Params{Mode: config.ModeStandard, MsgBlocks: 1, BatchSize: 16}
+    c := startCluster(t, clusterOpts{numServers: 2, params: []config.Params{params}, roundsPerParam: 1})
+
+    inputs := newRoundInputs(params.BatchSize)
+    statuses := make([]<-chan int, params.BatchSize)
+    for i := range statuses {
+        msg := []byte(fmt.Sprintf("message %d", i))
+        padded, err := client.Pad(msg, params.MsgBlocks)
+        if err != nil {
+            t.Fatal(err)
+        }
+        inputs.plaintexts[i] = padded
+        inputs.rows[i] = i
+        statuses[i] = c.submit(t, msg, params)
+    }
+    for _, status := range statuses {
+        <- status
+    }
+    c.wait(t)
+    merged, _, err := c.merged(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    check := func(merged []byte, inputs *roundInputs) error {
+        return verifyOutput(1, merged, params.MsgBlocks, params.BatchSize, false, inputs, nil)
+    }
+
+    err = check(merged, inputs)
+    if err != nil {
+        t.Fatalf("good round: %v", err)
+    }
+
+    //an input that didn't come out
+    wrong := newRoundInputs(params.BatchSize)
+    copy(wrong.plaintexts, inputs.plaintexts)
+    copy(wrong.rows, inputs.rows)
+    wrong.plaintexts[3] = make([]byte, len(inputs.plaintexts[3]))
+    err = check(merged, wrong)
+    if err == nil || !strings.Contains(err.Error(), "inputs [3] are missing") {
+        t.Errorf("missing input: got %v", err)
+    }
+
+    //the output in the order it was submitted
+    outputs, _ := client.CheckMacsAndDecrypt(merged, params.MsgBlocks, params.BatchSize, false)
+    unshuffled := newRoundInputs(params.BatchSize)
+    copy(unshuffled.plaintexts, outputs)
+    err = check(merged, unshuffled)
+    if err == nil || !strings.Contains(err.Error(), "in the order") {
+        t.Errorf("unshuffled output: got %v", err)
+    }
+
+    //a row that doesn't verify
+    tampered := append([]byte(nil), merged...)
+    rowLen := client.RowLength(params.MsgBlocks, false)
+    tampered[5*rowLen + 20] ^= 1
+    err = check(tampered, inputs)
+    if err == nil || !strings.Contains(err.Error(), "output rows [5]") {
+        t.Errorf("tampered row: got %v", err)
+    }
+}
@@ -0,0 +1,402 @@
+package wire
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "time"
+)
+
+//framed protocol spoken between the servers and the aux
+//every message is a frame:
+//  [1 type][1 phase][8 round][4 payload length][payload]
+//all integers are little endian. The round and phase tell the receiver which step of which round
+//the sender thinks it's in, so a disagreement shows up as an error naming the step instead of
+//as a hang or silently misread bytes.
+//a connection starts with both sides sending a hello frame with the protocol versions they speak:
+//  [4 magic][2 lowest version][2 highest version]
+//and both go on with the highest version they have in common
+//every operation takes a context. Its deadline becomes the deadline of the connection and cancelling
+//it interrupts the operation, which then fails with the context's error. An interrupted frame may be
+//half sent or half read, so the connection shouldn't be used after that
+
+//version 2: the servers derive their preprocessing seeds from the key they share with the aux
+//instead of sending them with every request, so it doesn't work with version 1
+//version 3: the servers send the shuffle, the verifications and the reveal on streams of their own
+//instead of the control stream, so it doesn't work with version 2
+const (
+    //versions this implementation speaks
+    MinVersion = 3
+    MaxVersion = 3
+)
+
+const headerLength = 14
+
+//"CLRN"
+const helloMagic = 0x4e524c43
+
+//the length prefix is 4 bytes
+const MaxPayloadLength = 1 << 32 - 1
+
+type Type uint8
+
+const (
+    TypeHello Type = 1
+    TypeData Type = 2
+)
+
+//step of the protocol a frame belongs to
+type Phase uint8
+
+const (
+    PhaseHandshake Phase = iota
+    //parties check they're running with the same parameters
+    PhaseParams
+    //the leader announces the round's ID
+    PhaseRound
+    //the leader passes the client submissions on
+    PhaseSubmissions
+    //servers ask the aux for a round's preprocessing. The frame has no payload, just the round
+    PhaseRequest
+    //the aux sends beaver triples, share translation deltas and the second set of beaver triples
+    PhaseBeavers
+    PhaseDelta
+    PhaseBeaversTwo
+    //first blind MAC verification
+    PhaseMaskedShares
+    PhaseMacDiffShares
+    //shares masked with aInitial go to the leader, then the shuffle moves from server to server
+    PhaseShuffleInput
+    PhaseShuffle
+    //second blind MAC verification, with committed shares
+    PhaseMaskedSharesTwo
+    PhaseMacDiffCommitment
+    PhaseMacDiffSharesTwo
+    PhaseMacStatus
+    //reveal
+    PhaseDBCommitment
+    PhaseDB
+    PhaseRevealStatus
+    //the aux picks the session the servers derive their seeds in, see mycrypto.DeriveSeeds
+    PhaseSession
+    //offline preprocessing: servers ask the aux for more bundles, the aux streams them, and at the start
+    //of a round the leader says which bundle it uses and everyone says whether they have it
+    PhaseBundleRequest
+    PhaseBundle
+    PhaseBundleChoice
+    PhaseBundleStatus
+    //dealer-free preprocessing, without an aux: the servers exchange Paillier keys, multiply their shares
+    //of the beaver triples under them, then take turns permuting everyone's encrypted shares of the
+    //share translation, and the result goes to the last server
+    PhasePaillierKey
+    PhaseBeaverShares
+    PhaseBeaverProducts
+    PhaseTranslationShares
+    PhaseTranslationPermuted
+    PhaseTranslationResult
+    //checking the aux: it sends extra triples to sacrifice after the second ones, then the servers toss
+    //coins, exchange masks that add up to zero, open the sacrificed triples and say their results
+    PhaseSacrificedBeavers
+    PhaseCheckCommitment
+    PhaseCheckCoins
+    PhaseCheckCoinStatus
+    PhaseCheckMasks
+    PhaseSacrificeOpenings
+    PhaseCheckResult
+    //the servers compare what they opened in the first blind mac verification before evicting rows
+    PhaseMacDiffDigest
+    //checking the aux's share translation: it sends the last server a second delta, and the servers
+    //shuffle with it like in the round
+    PhaseCheckDelta
+    PhaseCheckShuffleInput
+    PhaseCheckShuffle
+)
+
+var phaseNames = []string{
+    "handshake",
+    "parameter agreement",
+    "round announcement",
+    "submissions",
+    "preprocessing request",
+    "beaver triples",
+    "share translation",
+    "second beaver triples",
+    "masked shares",
+    "mac difference shares",
+    "shuffle input",
+    "shuffle",
+    "second masked shares",
+    "mac difference commitment",
+    "second mac difference shares",
+    "mac check status",
+    "db commitment",
+    "db",
+    "reveal status",
+    "session",
+    "bundle request",
+    "bundle",
+    "bundle choice",
+    "bundle status",
+    "paillier key",
+    "encrypted beaver shares",
+    "beaver products",
+    "encrypted translation shares",
+    "permuted translation shares",
+    "translation result",
+    "sacrificed beaver triples",
+    "check coin commitment",
+    "check coins",
+    "check coin status",
+    "check masks",
+    "sacrifice openings",
+    "check result",
+    "mac difference digest",
+    "check share translation",
+    "check shuffle input",
+    "check shuffle",
+}
+
+func (p Phase) String() string {
+    if int(p) < len(phaseNames) {
+        return phaseNames[p]
+    }
+    return fmt.Sprintf("phase %d", uint8(p))
+}
+
+var (
+    //the peer doesn't speak the protocol or no version we do
+    ErrVersion = errors.New("wire: no common protocol version")
+    //the frame isn't for the step we're in: wrong type, phase or round
+    ErrUnexpected = errors.New("wire: unexpected frame")
+    //the frame's payload doesn't have the length the step calls for
+    ErrLength = errors.New("wire: wrong payload length")
+)
+
+//an error on a connection, with the peer and the step it happened in
+type Error struct {
+    Peer string
+    Phase Phase
+    Err error
+}
+
+func (e *Error) Error() string {
+    return fmt.Sprintf("%s: %s: %v", e.Peer, e.Phase, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+    return e.Err
+}
+
+type Frame struct {
+    Type Type
+    Phase Phase
+    Round uint64
+    Payload []byte
+}
+
+//a connection that sends and receives frames
+//Send and the receiving methods may be used from different goroutines, but there
+//should only be one sender and one receiver at a time
+type Conn struct {
+    conn net.Conn
+    //who's on the other end, for error messages
+    peer string
+    version int
+}
+
+func NewConn(conn net.Conn, peer string) *Conn {
+    return &Conn{conn: conn, peer: peer}
+}
+
+//a connection to a peer we already did the handshake with over another connection,
+//e.g. another stream of the same session. It speaks the version negotiated there
+func NewConnVersion(conn net.Conn, peer string, version int) *Conn {
+    return &Conn{conn: conn, peer: peer, version: version}
+}
+
+func (c *Conn) Peer() string {
+    return c.peer
+}
+
+//the negotiated protocol version, 0 before the handshake
+func (c *Conn) Version() int {
+    return c.version
+}
+
+func (c *Conn) NetConn() net.Conn {
+    return c.conn
+}
+
+func (c *Conn) Close() error {
+    return c.conn.Close()
+}
+
+func (c *Conn) fail(phase Phase, err error) error {
+    return &Error{Peer: c.peer, Phase: phase, Err: err}
+}
+
+//apply ctx to one operation using setDeadline to set the connection's deadline
+//call the returned function when the operation is over, with its error. It hands back
+//the context's error instead if the context is why the operation failed
+func bind(ctx context.Context, setDeadline func(time.Time) error) func(error) error {
+    deadline, hasDeadline := ctx.Deadline()
+    setDeadline(deadline)
+    stop := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        select {
+        case <- ctx.Done():
+            //a deadline in the past makes the blocked call return
+            setDeadline(time.Unix(1, 0))
+        case <- stop:
+        }
+    }()
+    return func(err error) error {
+        close(stop)
+        <- stopped
+        if err == nil {
+            return nil
+        }
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        if hasDeadline && !time.Now().Before(deadline) {
+            return context.DeadlineExceeded
+        }
+        return err
+    }
+}
+
+//exchange hellos and pick the protocol version
+func (c *Conn) Handshake(ctx context.Context) (err error) {
+    done := bind(ctx, c.conn.SetDeadline)
+    defer func() {
+        if e, ok := err.(*Error); ok {
+            e.Err = done(e.Err)
+        } else {
+            done(nil)
+        }
+    }()
+
+    hello := make([]byte, 8)
+    binary.LittleEndian.PutUint32(hello[0:4], helloMagic)
+    binary.LittleEndian.PutUint16(hello[4:6], MinVersion)
+    binary.LittleEndian.PutUint16(hello[6:8], MaxVersion)
+
+    //send in the background so two peers saying hello at once can't block each other
+    sent := make(chan error, 1)
+    go func() {
+        sent <- c.send(TypeHello, PhaseHandshake, 0, hello)
+    }()
+
+    frame, err := c.read(TypeHello, PhaseHandshake, 8)
+    if err == nil && binary.LittleEndian.Uint32(frame.Payload[0:4]) != helloMagic {
+        err = c.fail(PhaseHandshake, fmt.Errorf("%w: not a hello", ErrVersion))
+    }
+    sendErr := <- sent
+    if err != nil {
+        return err
+    }
+    if sendErr != nil {
+        return c.fail(PhaseHandshake, sendErr)
+    }
+
+    peerMin := int(binary.LittleEndian.Uint16(frame.Payload[4:6]))
+    peerMax := int(binary.LittleEndian.Uint16(frame.Payload[6:8]))
+    version := MaxVersion
+    if peerMax < version {
+        version = peerMax
+    }
+    if version < MinVersion || version < peerMin {
+        return c.fail(PhaseHandshake, fmt.Errorf("%w: we speak %d-%d, peer speaks %d-%d", ErrVersion, MinVersion, MaxVersion, peerMin, peerMax))
+    }
+    c.version = version
+    return nil
+}
+
+//send a data frame
+func (c *Conn) Send(ctx context.Context, phase Phase, round uint64, payload []byte) error {
+    done := bind(ctx, c.conn.SetWriteDeadline)
+    err := done(c.send(TypeData, phase, round, payload))
+    if err != nil {
+        return c.fail(phase, err)
+    }
+    return nil
+}
+
+func (c *Conn) send(t Type, phase Phase, round uint64, payload []byte) error {
+    if uint64(len(payload)) > MaxPayloadLength {
+        return ErrLength
+    }
+    header := make([]byte, headerLength)
+    header[0] = byte(t)
+    header[1] = byte(phase)
+    binary.LittleEndian.PutUint64(header[2:10], round)
+    binary.LittleEndian.PutUint32(header[10:14], uint32(len(payload)))
+    buffers := net.Buffers{header}
+    //an empty write isn't free on every conn: on a net.Pipe it waits for a read that never comes
+    if len(payload) > 0 {
+        buffers = append(buffers, payload)
+    }
+    _, err := buffers.WriteTo(c.conn)
+    return err
+}
+
+//read the next frame and check that it's a frame of type t for phase
+//if length isn't -1, a frame with a different payload length is refused before its payload is read
+func (c *Conn) read(t Type, phase Phase, length int) (*Frame, error) {
+    header := make([]byte, headerLength)
+    _, err := io.ReadFull(c.conn, header)
+    if err != nil {
+        return nil, c.fail(phase, err)
+    }
+    frame := &Frame{
+        Type: Type(header[0]),
+        Phase: Phase(header[1]),
+        Round: binary.LittleEndian.Uint64(header[2:10]),
+    }
+    if frame.Type != t || frame.Phase != phase {
+        return nil, c.fail(phase, fmt.Errorf("%w: got a %s frame", ErrUnexpected, frame.Phase))
+    }
+    payloadLength := binary.LittleEndian.Uint32(header[10:14])
+    if length >= 0 && uint64(payloadLength) != uint64(length) {
+        return nil, c.fail(phase, fmt.Errorf("%w: got %d bytes, expected %d", ErrLength, payloadLength, length))
+    }
+    frame.Payload = make([]byte, payloadLength)
+    _, err = io.ReadFull(c.conn, frame.Payload)
+    if err != nil {
+        return nil, c.fail(phase, err)
+    }
+    return frame, nil
+}
+
+//read the next frame, which has to be a data frame for phase with the given payload length
+//length -1 accepts any length
+func (c *Conn) ReceiveAnyRound(ctx context.Context, phase Phase, length int) (*Frame, error) {
+    done := bind(ctx, c.conn.SetReadDeadline)
+    frame, err := c.read(TypeData, phase, length)
+    if err != nil {
+        e := err.(*Error)
+        e.Err = done(e.Err)
+        return nil, e
+    }
+    done(nil)
+    return frame, nil
+}
+
+//read the payload of the next frame, which has to be a data frame for phase and round
+//with the given payload length. length -1 accepts any length
+func (c *Conn) Receive(ctx context.Context, phase Phase, round uint64, length int) ([]byte, error) {
+    frame, err := c.ReceiveAnyRound(ctx, phase, length)
+    if err != nil {
+        return nil, err
+    }
+    if frame.Round != round {
+        return nil, c.fail(phase, fmt.Errorf("%w: frame is for round %d, we're in round %d", ErrUnexpected, frame.Round, round))
+    }
+    return frame.Payload, nil
+}
@@ -0,0 +1,150 @@
+package wire
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net"
+    "testing"
+    "time"
+)
+
+//the two ends of a connection, past the handshake. each is named after the other end
+func connPair(t *testing.T) (*Conn, *Conn) {
+    a, b := net.Pipe()
+    t.Cleanup(func() {
+        a.Close()
+        b.Close()
+    })
+    ca, cb := NewConnVersion(a, "b", MaxVersion), NewConnVersion(b, "a", MaxVersion)
+    return ca, cb
+}
+
+func testContext(t *testing.T) context.Context {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    t.Cleanup(cancel)
+    return ctx
+}
+
+//a hello frame from a peer speaking versions min to max
+func hello(magic uint32, min, max int) []byte {
+    frame := make([]byte, headerLength+8)
+    frame[0] = byte(TypeHello)
+    frame[1] = byte(PhaseHandshake)
+    binary.LittleEndian.PutUint32(frame[10:14], 8)
+    binary.LittleEndian.PutUint32(frame[headerLength:], magic)
+    binary.LittleEndian.PutUint16(frame[headerLength+4:], uint16(min))
+    binary.LittleEndian.PutUint16(frame[headerLength+6:], uint16(max))
+    return frame
+}
+
+func TestPhaseNames(t *testing.T) {
+    if len(phaseNames) != int(PhaseCheckShuffle)+1 {
+        t.Fatalf("%d phase names for %d phases", len(phaseNames), int(PhaseCheckShuffle)+1)
+    }
+    names := make(map[string]bool)
+    for _, name := range phaseNames {
+        if names[name] {
+            t.Errorf("two phases are called %q", name)
+        }
+        names[name] = true
+    }
+}
+
+func TestHandshake(t *testing.T) {
+    a, b := net.Pipe()
+    defer a.Close()
+    defer b.Close()
+    ca, cb := NewConn(a, "b"), NewConn(b, "a")
+    errs := make(chan error, 1)
+    go func() {
+        errs <- cb.Handshake(testContext(t))
+    }()
+    err := ca.Handshake(testContext(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := <- errs; err != nil {
+        t.Fatal(err)
+    }
+    if ca.Version() != MaxVersion || cb.Version() != MaxVersion {
+        t.Errorf("settled on versions %d and %d, want %d", ca.Version(), cb.Version(), MaxVersion)
+    }
+}
+
+func TestHandshakeRefusesPeers(t *testing.T) {
+    peers := []struct {
+        name string
+        hello []byte
+    }{
+        {"older versions only", hello(helloMagic, 1, MinVersion-1)},
+        {"newer versions only", hello(helloMagic, MaxVersion+1, MaxVersion+2)},
+        {"not a hello", hello(0, MinVersion, MaxVersion)},
+    }
+    for _, peer := range peers {
+        a, b := net.Pipe()
+        go io.Copy(ioutil.Discard, b)
+        go b.Write(peer.hello)
+        c := NewConn(a, "peer")
+        err := c.Handshake(testContext(t))
+        var e *Error
+        if !errors.Is(err, ErrVersion) || !errors.As(err, &e) || e.Phase != PhaseHandshake {
+            t.Errorf("%s: got %v, want no common version", peer.name, err)
+        }
+        a.Close()
+        b.Close()
+    }
+}
+
+func TestReceive(t *testing.T) {
+    ca, cb := connPair(t)
+    ctx := testContext(t)
+    payload := []byte("payload")
+    go ca.Send(ctx, PhaseDB, 7, payload)
+    got, err := cb.Receive(ctx, PhaseDB, 7, len(payload))
+    if err != nil || !bytes.Equal(got, payload) {
+        t.Fatalf("got %q, %v", got, err)
+    }
+
+    bad := []struct {
+        name string
+        phase Phase
+        round uint64
+        length int
+        want error
+    }{
+        {"another phase", PhaseDBCommitment, 7, len(payload), ErrUnexpected},
+        {"another round", PhaseDB, 8, len(payload), ErrUnexpected},
+        {"another length", PhaseDB, 7, len(payload)+1, ErrLength},
+    }
+    for _, c := range bad {
+        //each refusal leaves the connection mid-frame, so it gets a fresh one
+        ca, cb := connPair(t)
+        go ca.Send(ctx, PhaseDB, 7, payload)
+        _, err := cb.Receive(ctx, c.phase, c.round, c.length)
+        var e *Error
+        if !errors.Is(err, c.want) || !errors.As(err, &e) || e.Phase != c.phase || e.Peer != "a" {
+            t.Errorf("%s: got %v, want %v in the %s", c.name, err, c.want, c.phase)
+        }
+    }
+}
+
+func TestReceiveIsInterrupted(t *testing.T) {
+    _, cb := connPair(t)
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(10*time.Millisecond, cancel)
+    _, err := cb.Receive(ctx, PhaseDB, 1, -1)
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("got %v, want the receive cancelled", err)
+    }
+
+    ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    _, err = cb.Receive(ctx, PhaseDB, 1, -1)
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("got %v, want the receive timed out", err)
+    }
+}